@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/base64"
 	"log"
+	"time"
 	
 	"github.com/gin-gonic/gin"
 	
@@ -10,6 +12,13 @@ import (
 	"server/internal/controller/middleware"
 	"server/pkg/auth"
 	"server/pkg/database"
+	"server/pkg/encryption"
+	"server/pkg/keycache"
+	"server/pkg/local_disk"
+	"server/pkg/ratelimit"
+	"server/pkg/s3"
+	"server/pkg/storage"
+	"server/pkg/webdav"
 	"server/pkg/yandex_disk"
 	"server/internal/repository/postgres"
 	"server/internal/usecase"
@@ -39,19 +48,72 @@ func main() {
 		cfg.YandexDisk.RedirectURI,
 	)
 	
+	// Хранилища файлов: провайдер выбирается пользователем при подключении
+	storageProviders := storage.NewRegistry(yandex_disk.ProviderName)
+	storageProviders.Register(yandex_disk.ProviderName, yandexDiskClient)
+	// Адреса S3 и WebDAV задает пользователь: во внутреннюю сеть - только из списка
+	endpointPolicy, err := storage.NewEndpointPolicy(cfg.RemoteStorage.AllowedEndpoints)
+	if err != nil {
+		log.Fatal("Failed to parse STORAGE_ALLOWED_ENDPOINTS:", err)
+	}
+	storageProviders.Register(s3.ProviderName, s3.NewClient(endpointPolicy))
+	storageProviders.Register(webdav.ProviderName, webdav.NewClient(endpointPolicy))
+	if cfg.LocalStorage.Root != "" {
+		localDiskClient, err := local_disk.NewClient(cfg.LocalStorage.Root)
+		if err != nil {
+			log.Fatal("Failed to initialize local storage:", err)
+		}
+		storageProviders.Register(local_disk.ProviderName, localDiskClient)
+	}
+	
+	cipherSuite, err := encryption.ParseCipherSuite(cfg.Encryption.Cipher)
+	if err != nil {
+		log.Fatal("Invalid encryption settings:", err)
+	}
+	
+	var escrowKey []byte
+	if cfg.Encryption.EscrowKey != "" {
+		if escrowKey, err = base64.StdEncoding.DecodeString(cfg.Encryption.EscrowKey); err != nil {
+			log.Fatal("Invalid escrow public key:", err)
+		}
+	}
+	
+	encryptionService, err := encryption.NewEncryptionService(encryption.Config{
+		Argon2: encryption.Argon2Params{
+			Time:    uint32(cfg.Encryption.Argon2Time),
+			Memory:  uint32(cfg.Encryption.Argon2Memory),
+			Threads: uint8(cfg.Encryption.Argon2Threads),
+		},
+		Suite:           cipherSuite,
+		EscrowPublicKey: escrowKey,
+	})
+	if err != nil {
+		log.Fatal("Invalid encryption settings:", err)
+	}
+	
 	// Репозитории
 	userRepo := postgres.NewUserRepository(db)
 	fileRepo := postgres.NewFileRepository(db)
+	directoryRepo := postgres.NewDirectoryRepository(db)
+	keySlotRepo := postgres.NewKeySlotRepository(db)
+	keyRotationRepo := postgres.NewKeyRotationRepository(db)
+	fileShareRepo := postgres.NewFileShareRepository(db)
+	chunkRepo := postgres.NewChunkRepository(db)
+	replicaRepo := postgres.NewReplicaRepository(db)
 	
 	// Use cases
 	authUC := usecase.NewAuthUseCase(userRepo, jwtManager)
-	storageUC := usecase.NewStorageUseCase(fileRepo, userRepo, yandexDiskClient)
+	keyRotationUC := usecase.NewKeyRotationUseCase(fileRepo, userRepo, directoryRepo, keySlotRepo, keyRotationRepo, replicaRepo, storageProviders, encryptionService)
+	storageUC := usecase.NewStorageUseCase(fileRepo, userRepo, directoryRepo, keySlotRepo, chunkRepo, replicaRepo, yandexDiskClient, storageProviders, encryptionService, keyRotationUC)
 	userUC := usecase.NewUserUseCase(userRepo)
+	keySlotUC := usecase.NewKeySlotUseCase(fileRepo, userRepo, keySlotRepo, replicaRepo, storageProviders, encryptionService)
+	shareUC := usecase.NewShareUseCase(fileRepo, userRepo, keySlotRepo, fileShareRepo, replicaRepo, storageProviders, encryptionService)
+	sessionUC := usecase.NewSessionUseCase(userRepo, keySlotRepo, encryptionService, keycache.New(time.Duration(cfg.Encryption.SessionIdleMinutes)*time.Minute))
 	
 	// Handlers
 	authHandler := http.NewAuthHandler(authUC)
-	storageHandler := http.NewStorageHandler(storageUC)
-	userHandler := http.NewUserHandler(userUC)
+	storageHandler := http.NewStorageHandler(storageUC, shareUC, sessionUC)
+	userHandler := http.NewUserHandler(userUC, keyRotationUC, keySlotUC)
 	
 	// Настройка роутера
 	router := gin.Default()
@@ -60,7 +122,7 @@ func main() {
 	router.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Session-Key")
 		
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -75,6 +137,7 @@ func main() {
 	{
 		public.POST("/auth/register", authHandler.Register)
 		public.POST("/auth/login", authHandler.Login)
+		public.POST("/auth/recover", middleware.RateLimit(ratelimit.New(10, time.Hour)), userHandler.RecoverPassword)
 	}
 	
 	// Protected routes
@@ -87,18 +150,48 @@ func main() {
 			storageGroup.GET("/yandex/auth-url", storageHandler.GetYandexAuthURL)
 			storageGroup.POST("/yandex/callback", storageHandler.HandleYandexCallback)
 			storageGroup.GET("/yandex/token", storageHandler.GetYandexToken) 
+			storageGroup.GET("/quota", storageHandler.GetQuota)
+			storageGroup.POST("/connect", storageHandler.ConnectStorage)
+			storageGroup.GET("/replication", storageHandler.GetReplication)
+			storageGroup.PUT("/replication", storageHandler.SetReplicationPolicy)
+			storageGroup.POST("/backends", storageHandler.AttachStorage)
+			storageGroup.DELETE("/backends/:id", storageHandler.DetachStorage)
 			storageGroup.GET("/files", storageHandler.GetFiles)
 			storageGroup.GET("/files/:id", storageHandler.GetFileInfo)
 			storageGroup.POST("/files/:id/decrypt-name", storageHandler.GetDecryptedFilename)
 			storageGroup.POST("/upload", storageHandler.UploadFile)
 			storageGroup.POST("/files/:id/download", storageHandler.DownloadFile)
+			storageGroup.POST("/verify-password", storageHandler.VerifyMasterPassword)
+			storageGroup.POST("/unlock", storageHandler.Unlock)
+			storageGroup.POST("/lock", storageHandler.Lock)
 			storageGroup.DELETE("/files/:id", storageHandler.DeleteFile)
+			storageGroup.POST("/files/:id/shares", storageHandler.ShareFile)
+			storageGroup.GET("/shares", storageHandler.GetShares)
+			storageGroup.POST("/shares/:id/accept", storageHandler.AcceptShare)
+			storageGroup.POST("/shares/:id/revoke", storageHandler.RevokeShare)
+			storageGroup.POST("/shares/:id/download", storageHandler.DownloadSharedFile)
+
+			// Client-side encryption routes
+			storageGroup.GET("/client/keyring", storageHandler.GetKeyring)
+			storageGroup.POST("/client/keyring", storageHandler.SetupKeyring)
+			storageGroup.POST("/client/directories", storageHandler.CreateEncryptedDirectory)
+			storageGroup.POST("/client/upload", storageHandler.UploadEncryptedFile)
+			storageGroup.GET("/client/files/:id", storageHandler.DownloadEncryptedFile)
 		}
 		
 		// User routes
 		userGroup := protected.Group("/user")
 		{
 			userGroup.GET("/profile", userHandler.GetProfile)
+			userGroup.PUT("/encryption", userHandler.UpdateEncryptionSettings)
+			userGroup.POST("/password", userHandler.ChangePassword)
+			userGroup.POST("/login-password", userHandler.ChangeLoginPassword)
+			userGroup.GET("/password/rotation", userHandler.GetKeyRotation)
+			userGroup.POST("/password/rotation/resume", userHandler.ResumeKeyRotation)
+			userGroup.GET("/keyslots", userHandler.GetKeySlots)
+			userGroup.POST("/keyslots/recovery", userHandler.AddRecoveryKey)
+			userGroup.POST("/keyslots/escrow", userHandler.AddEscrowKey)
+			userGroup.DELETE("/keyslots/:id", userHandler.RemoveKeySlot)
 		}
 	}
 	
@@ -0,0 +1,429 @@
+// Команда decrypt расшифровывает файлы, скачанные из облака, без сервера и БД.
+//
+// Расшифровать один файл (имя берется из зашифрованного имени файла):
+//
+//	decrypt -in 'aGVsbG8....encrypted' -out ./restored
+//
+// Расшифровать выгрузку Яндекс.Диска целиком:
+//
+//	decrypt -in ./yandex-export -out ./restored
+//
+// Расшифровать только имя файла:
+//
+//	decrypt -name 'aGVsbG8....encrypted' -keyring ./keyring.json -user-id 42 -file-id 6f1c...
+//
+// Мастер-пароль читается из SECURE_CLOUD_PASSWORD или со стандартного ввода.
+// Файлы, ключ которых обернут ключом из слотов, требуют копию слотов
+// (.secure-cloud-keyring.json из корня облака); открыть ее можно паролем,
+// ключом восстановления (-recovery-key-file, "-" - со стандартного ввода) или
+// ключом администратора (-escrow-key). Секреты не передаются аргументами
+// командной строки: их видно в списке процессов и истории оболочки.
+// Имена файлов шифруются ключом пользователя из слотов. Имена старых
+// форматов шифровались паролем: без пароля такие файлы сохраняются под
+// зашифрованными именами.
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"server/pkg/encryption"
+)
+
+const encryptedSuffix = ".encrypted"
+
+type decryptor struct {
+	enc       *encryption.EncryptionService
+	password  string
+	masterKey []byte // Ключ пользователя из слотов (nil - слоты не открыты)
+	names     *encryption.NameKeys
+	userID    uint64 // Владелец файлов для имен каталогов (0 - неизвестен)
+	fileID    string // Идентификатор файла для файлов до версии 7
+	failed    int
+}
+
+func main() {
+	in := flag.String("in", "", "encrypted file or downloaded directory tree")
+	out := flag.String("out", ".", "output directory")
+	name := flag.String("name", "", "decrypt only this encrypted file name and print it")
+	base := flag.String("base", "/", "cloud directory of -in (names are bound to their directory)")
+	keyringPath := flag.String("keyring", "", "key slots file (default: "+encryption.KeyringFileName+" in -in directory)")
+	recoveryKeyPath := flag.String("recovery-key-file", "", "unlock key slots with the recovery key from this file (\"-\" reads standard input)")
+	escrowKeyPath := flag.String("escrow-key", "", "unlock key slots with the admin escrow private key (base64 file)")
+	userID := flag.Uint64("user-id", 0, "file owner ID (files and names written before format 7)")
+	fileID := flag.String("file-id", "", "file ID (a single file written before format 7)")
+	flag.Parse()
+
+	if *in == "" && *name == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Файлы расшифровываются офлайн из облака самого пользователя: ключ
+	// выводится с любыми допустимыми параметрами из заголовка
+	enc, err := encryption.NewEncryptionService(encryption.Config{Argon2: encryption.DefaultArgon2Params, Argon2Limit: encryption.MaxArgon2Params})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	d := &decryptor{enc: enc, userID: *userID, fileID: *fileID}
+	var recoveryKey string
+	switch {
+	case *recoveryKeyPath != "":
+		if recoveryKey, err = readRecoveryKey(*recoveryKeyPath); err != nil {
+			log.Fatal("Failed to read recovery key:", err)
+		}
+		if recoveryKey == "" {
+			log.Fatal("Recovery key is empty")
+		}
+	case *escrowKeyPath == "":
+		if d.password, err = readPassword(); err != nil {
+			log.Fatal("Failed to read password:", err)
+		}
+	}
+
+	if *name != "" {
+		var fc *encryption.FileContext
+		if d.userID != 0 || d.fileID != "" {
+			fc = &encryption.FileContext{UserID: d.userID, FileID: d.fileID, Dir: dirPrefix(*base)}
+		}
+		if *keyringPath != "" {
+			if err := d.unlockKeyring(*keyringPath, recoveryKey, *escrowKeyPath); err != nil {
+				log.Fatal("Failed to unlock key slots:", err)
+			}
+		}
+		plain, err := enc.DecryptFilename(*name, d.nameKeys(), fc)
+		if err != nil {
+			log.Fatal("Failed to decrypt name:", err)
+		}
+		fmt.Println(plain)
+		return
+	}
+
+	info, err := os.Stat(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *keyringPath == "" {
+		dir := *in
+		if !info.IsDir() {
+			dir = filepath.Dir(*in)
+		}
+		if _, err := os.Stat(filepath.Join(dir, encryption.KeyringFileName)); err == nil {
+			*keyringPath = filepath.Join(dir, encryption.KeyringFileName)
+		}
+	}
+	if *keyringPath != "" {
+		if err := d.unlockKeyring(*keyringPath, recoveryKey, *escrowKeyPath); err != nil {
+			log.Fatal("Failed to unlock key slots:", err)
+		}
+	} else if d.password == "" {
+		log.Fatal("Key slots file is required to decrypt without the password")
+	}
+
+	if err := os.MkdirAll(*out, 0o700); err != nil {
+		log.Fatal(err)
+	}
+
+	if info.IsDir() {
+		if d.userID == 0 {
+			d.userID = detectUserID(*in)
+		}
+		d.decryptTree(*in, *out, *base)
+	} else if err := d.decryptFile(*in, *out, *base); err != nil {
+		log.Fatal(err)
+	}
+
+	if d.failed > 0 {
+		log.Fatalf("%d item(s) could not be decrypted", d.failed)
+	}
+}
+
+// readPassword читает мастер-пароль из окружения или первой строки ввода
+func readPassword() (string, error) {
+	if password, ok := os.LookupEnv("SECURE_CLOUD_PASSWORD"); ok {
+		return password, nil
+	}
+
+	fmt.Fprint(os.Stderr, "Master password: ")
+	return readLine(os.Stdin)
+}
+
+// readRecoveryKey читает ключ восстановления из файла path или со
+// стандартного ввода, если path - "-"
+func readRecoveryKey(path string) (string, error) {
+	if path == "-" {
+		fmt.Fprint(os.Stderr, "Recovery key: ")
+		return readLine(os.Stdin)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return readLine(f)
+}
+
+// readLine читает первую строку r без перевода строки
+func readLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// unlockKeyring открывает ключ пользователя из копии слотов
+func (d *decryptor) unlockKeyring(path, recoveryKey, escrowKeyPath string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	keyring, err := encryption.ParseKeyring(data)
+	if err != nil {
+		return err
+	}
+	if d.userID == 0 {
+		d.userID = keyring.UserID
+	}
+
+	switch {
+	case escrowKeyPath != "":
+		encoded, err := os.ReadFile(escrowKeyPath)
+		if err != nil {
+			return err
+		}
+		privateKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil {
+			return fmt.Errorf("invalid escrow key: %w", err)
+		}
+		d.masterKey, err = d.enc.Unlock(keyring, encryption.SlotEscrow, privateKey)
+		return err
+	case recoveryKey != "":
+		d.masterKey, err = d.enc.Unlock(keyring, encryption.SlotRecovery, []byte(recoveryKey))
+		return err
+	default:
+		d.masterKey, err = d.enc.Unlock(keyring, encryption.SlotPassword, []byte(d.password))
+		return err
+	}
+}
+
+// detectUserID берет владельца из заголовка первого файла с контекстом
+func detectUserID(root string) uint64 {
+	var userID uint64
+	filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(entry.Name(), encryptedSuffix) {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+
+		if fc, _, err := encryption.ReadFileContext(f); err == nil && fc != nil {
+			userID = fc.UserID
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return userID
+}
+
+// decryptTree расшифровывает каталог src в dst. plainDir - открытый путь
+// src в облаке: к нему привязаны зашифрованные имена каталогов.
+func (d *decryptor) decryptTree(src, dst, plainDir string) {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		d.fail(src, err)
+		return
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(src, entry.Name())
+
+		if entry.IsDir() {
+			name := d.directoryName(entry.Name(), plainDir)
+			target := filepath.Join(dst, name)
+			if err := os.MkdirAll(target, 0o700); err != nil {
+				d.fail(path, err)
+				continue
+			}
+			d.decryptTree(path, target, strings.TrimSuffix(plainDir, "/")+"/"+name)
+			continue
+		}
+
+		if entry.Name() == encryption.KeyringFileName {
+			continue
+		}
+		if err := d.decryptFile(path, dst, plainDir); err != nil {
+			d.fail(path, err)
+		}
+	}
+}
+
+// directoryName расшифровывает имя каталога. Каталоги, созданные до
+// шифрования путей, хранятся под открытыми именами.
+func (d *decryptor) directoryName(name, plainDir string) string {
+	if !strings.HasSuffix(name, encryptedSuffix) || (d.masterKey == nil && d.password == "") {
+		return name
+	}
+
+	plain, err := d.enc.DecryptFilename(name, d.nameKeys(), &encryption.FileContext{
+		UserID: d.userID,
+		Dir:    dirPrefix(plainDir),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: keeping encrypted directory name %s: %v\n", name, err)
+		return name
+	}
+	return safeName(plain, name)
+}
+
+// nameKeys возвращает ключи имен файлов: ключ из слотов для новых имен и
+// пароль для имен старых форматов
+func (d *decryptor) nameKeys() *encryption.NameKeys {
+	if d.names == nil {
+		d.names = &encryption.NameKeys{KEK: d.masterKey, Password: d.password}
+	}
+	return d.names
+}
+
+// decryptFile расшифровывает файл src в каталог dst
+func (d *decryptor) decryptFile(src, dst, plainDir string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	name := filepath.Base(src)
+	if !strings.HasSuffix(name, encryptedSuffix) {
+		// Файлы, загруженные без шифрования, копируем как есть
+		return writeFile(uniquePath(filepath.Join(dst, name)), f)
+	}
+
+	fc, r, err := encryption.ReadFileContext(f)
+	if err != nil {
+		return err
+	}
+	fc = d.context(fc)
+
+	plainName := strings.TrimSuffix(name, encryptedSuffix)
+	if d.masterKey != nil || d.password != "" {
+		nameContext := fc
+		if fc != nil {
+			nameContext = &encryption.FileContext{UserID: fc.UserID, FileID: fc.FileID, Dir: dirPrefix(plainDir)}
+		}
+		if decrypted, err := d.enc.DecryptFilename(name, d.nameKeys(), nameContext); err == nil {
+			plainName = safeName(decrypted, plainName)
+		} else {
+			fmt.Fprintf(os.Stderr, "warning: keeping encrypted file name %s: %v\n", name, err)
+		}
+	}
+
+	decrypted, err := d.decryptStream(f, r, fc)
+	if err != nil {
+		return err
+	}
+	return writeFile(uniquePath(filepath.Join(dst, plainName)), decrypted)
+}
+
+// decryptStream расшифровывает файл паролем или ключом пользователя из слотов
+func (d *decryptor) decryptStream(f *os.File, r io.Reader, fc *encryption.FileContext) (io.Reader, error) {
+	if d.password != "" {
+		decrypted, err := d.enc.NewDecryptReader(r, d.password, fc)
+		if err == nil || d.masterKey == nil {
+			return decrypted, err
+		}
+
+		// Ключ файла обернут ключом из слотов - читаем файл заново
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		r = f
+	}
+
+	if d.masterKey == nil {
+		return nil, encryption.ErrMasterKeyRequired
+	}
+	return d.enc.NewDecryptReaderWithMasterKey(r, d.masterKey, fc)
+}
+
+// context возвращает контекст файла: из заголовка или из флагов
+func (d *decryptor) context(fc *encryption.FileContext) *encryption.FileContext {
+	if fc != nil || d.fileID == "" {
+		return fc
+	}
+	return &encryption.FileContext{UserID: d.userID, FileID: d.fileID}
+}
+
+func (d *decryptor) fail(path string, err error) {
+	d.failed++
+	fmt.Fprintf(os.Stderr, "error: %s: %v\n", path, err)
+}
+
+// writeFile пишет r в новый файл dst. Частично записанный файл при ошибке удаляется.
+func writeFile(dst string, r io.Reader) error {
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	fmt.Println(dst)
+	return nil
+}
+
+// safeName не дает расшифрованному имени выйти за пределы каталога
+func safeName(name, fallback string) string {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return fallback
+	}
+	return name
+}
+
+// uniquePath добавляет номер к имени, если файл уже существует
+func uniquePath(path string) string {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return path
+	}
+
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		if _, err := os.Stat(candidate); errors.Is(err, os.ErrNotExist) {
+			return candidate
+		}
+	}
+}
+
+// dirPrefix возвращает каталог с завершающим слешем (как на сервере)
+func dirPrefix(dir string) string {
+	if dir == "" || dir == "." || dir == "/" {
+		return "/"
+	}
+	return strings.TrimSuffix(dir, "/") + "/"
+}
@@ -0,0 +1,45 @@
+// Команда escrowkey генерирует пару ключей X25519 администратора для
+// депонирования ключей пользователей:
+//
+//	escrowkey -out ./escrow.key
+//
+// Закрытый ключ в base64 записывается в файл -out (права 0600) и должен
+// храниться вне сервера; им открываются слоты депонирования командой
+// decrypt -escrow-key. Открытый ключ печатается строкой ESCROW_PUBLIC_KEY
+// для конфигурации сервера.
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"server/pkg/encryption"
+)
+
+func main() {
+	out := flag.String("out", "escrow.key", "file for the escrow private key (must not exist)")
+	flag.Parse()
+
+	publicKey, privateKey, err := encryption.GenerateEscrowKeyPair()
+	if err != nil {
+		log.Fatal("Failed to generate escrow key:", err)
+	}
+
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		log.Fatal("Failed to create private key file:", err)
+	}
+	if _, err := fmt.Fprintln(f, base64.StdEncoding.EncodeToString(privateKey)); err != nil {
+		f.Close()
+		log.Fatal("Failed to write private key:", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal("Failed to write private key:", err)
+	}
+
+	fmt.Printf("ESCROW_PUBLIC_KEY=%s\n", base64.StdEncoding.EncodeToString(publicKey))
+	fmt.Fprintf(os.Stderr, "private key written to %s, keep it offline\n", *out)
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	
 	"github.com/joho/godotenv"
 )
@@ -16,6 +18,9 @@ type Config struct {
 	DBName     string
 	JWTSecret  string
 	YandexDisk YandexDiskConfig
+	LocalStorage LocalStorageConfig
+	RemoteStorage RemoteStorageConfig
+	Encryption EncryptionConfig
 }
 
 type YandexDiskConfig struct {
@@ -24,6 +29,33 @@ type YandexDiskConfig struct {
 	RedirectURI  string
 }
 
+// LocalStorageConfig - хранилище в каталоге на сервере
+// (пустой Root - хранилище отключено)
+type LocalStorageConfig struct {
+	Root string
+}
+
+// RemoteStorageConfig - хранилища, адрес которых задает пользователь (S3, WebDAV).
+// AllowedEndpoints - хосты, IP-адреса и сети CIDR во внутренней сети, к которым
+// можно обращаться (в том числе по http), например локальный MinIO.
+type RemoteStorageConfig struct {
+	AllowedEndpoints []string
+}
+
+// EncryptionConfig задает параметры Argon2id для вывода ключей из мастер-пароля
+// и набор шифров новых файлов
+type EncryptionConfig struct {
+	Cipher        string
+	EscrowKey     string // Открытый ключ X25519 администратора в base64 (пусто - без депонирования)
+	Argon2Time    int
+	Argon2Memory  int // КиБ
+	Argon2Threads int
+	
+	// Время простоя в минутах, после которого ключи разблокированной
+	// сессии стираются из памяти
+	SessionIdleMinutes int
+}
+
 func Load() *Config {
 	// Загружаем .env файл
 	err := godotenv.Load()
@@ -44,6 +76,21 @@ func Load() *Config {
 			ClientSecret: getEnv("YANDEX_DISK_CLIENT_SECRET", ""),
 			RedirectURI:  getEnv("YANDEX_DISK_REDIRECT_URI", "http://localhost:8080/api/v1/storage/yandex/callback"),
 		},
+		LocalStorage: LocalStorageConfig{
+			Root: getEnv("LOCAL_STORAGE_ROOT", ""),
+		},
+		RemoteStorage: RemoteStorageConfig{
+			AllowedEndpoints: getEnvList("STORAGE_ALLOWED_ENDPOINTS"),
+		},
+		Encryption: EncryptionConfig{
+			Cipher:        getEnv("ENCRYPTION_CIPHER", "aes-256-gcm"),
+			EscrowKey:     getEnv("ESCROW_PUBLIC_KEY", ""),
+			Argon2Time:    getEnvInt("ARGON2_TIME", 3),
+			Argon2Memory:  getEnvInt("ARGON2_MEMORY_KIB", 64*1024),
+			Argon2Threads: getEnvInt("ARGON2_THREADS", 4),
+			
+			SessionIdleMinutes: getEnvInt("SESSION_IDLE_MINUTES", 15),
+		},
 	}
 }
 
@@ -52,4 +99,29 @@ func getEnv(key, defaultValue string) string {
 		return value
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Warning: invalid value for %s, using default %d", key, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// getEnvList разбирает список через запятую
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,189 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"server/internal/usecase"
+	"server/pkg/encryption"
+)
+
+// Шифрование на клиенте: сервер принимает и отдает только шифротексты в
+// формате pkg/encryption (см. pkg/client)
+
+type SetupKeyringRequest struct {
+	MasterKeyID []byte                  `json:"master_key_id" binding:"required"`
+	Slot        *encryption.KeyringSlot `json:"slot" binding:"required"`
+}
+
+type CreateDirectoryRequest struct {
+	Path          string `json:"path" binding:"required"`
+	EncryptedName string `json:"encrypted_name" binding:"required"`
+}
+
+// GetKeyring отдает слоты ключа пользователя для открытия на клиенте
+func (h *StorageHandler) GetKeyring(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	keyring, err := h.storageUC.GetKeyring(c.Request.Context(), userID)
+	if status, ok := passphraseErrorStatus(err); ok {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keyring": keyring})
+}
+
+// SetupKeyring сохраняет ключ пользователя, созданный и обернутый на клиенте
+func (h *StorageHandler) SetupKeyring(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var req SetupKeyringRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	keyring, err := h.storageUC.SetupClientKeyring(c.Request.Context(), userID, req.MasterKeyID, req.Slot)
+	if errors.Is(err, usecase.ErrPassphraseAlreadySet) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"keyring": keyring})
+}
+
+// CreateEncryptedDirectory создает каталог под именем, зашифрованным на клиенте
+func (h *StorageHandler) CreateEncryptedDirectory(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var req CreateDirectoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	dir, err := h.storageUC.CreateEncryptedDirectory(c.Request.Context(), userID, req.Path, req.EncryptedName)
+	if status, ok := passphraseErrorStatus(err); ok {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"directory": dir})
+}
+
+// UploadEncryptedFile принимает файл, зашифрованный на клиенте. Поля формы
+// file_id и encrypted_name должны идти раньше файла: файл пересылается в
+// облако по мере получения.
+func (h *StorageHandler) UploadEncryptedFile(c *gin.Context) {
+	userID := c.GetUint("userID")
+	path := c.DefaultQuery("path", "/")
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "multipart form is required"})
+		return
+	}
+
+	var fileID, encryptedName string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid multipart form"})
+			return
+		}
+
+		switch part.FormName() {
+		case "file_id", "encrypted_name", "path":
+			value, err := io.ReadAll(io.LimitReader(part, 4096))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid multipart form"})
+				return
+			}
+			switch part.FormName() {
+			case "file_id":
+				fileID = string(value)
+			case "encrypted_name":
+				encryptedName = string(value)
+			default:
+				path = string(value)
+			}
+
+		case "file":
+			if fileID == "" || encryptedName == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "file_id and encrypted_name are required before file"})
+				return
+			}
+
+			metadata, err := h.storageUC.UploadEncryptedFile(c.Request.Context(), userID, path, fileID, encryptedName, part)
+			if status, ok := passphraseErrorStatus(err); ok {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+			if errors.Is(err, usecase.ErrInvalidEncryptedFile) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if errors.Is(err, usecase.ErrDuplicateFileID) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, UploadFileResponse{
+				FileID:        metadata.ID,
+				Message:       "Encrypted file uploaded successfully",
+				EncryptedName: metadata.EncryptedName,
+			})
+			return
+		}
+	}
+}
+
+// DownloadEncryptedFile отдает шифротекст файла без расшифровки
+func (h *StorageHandler) DownloadEncryptedFile(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var id uint
+	if _, err := fmt.Sscanf(c.Param("id"), "%d", &id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file ID"})
+		return
+	}
+
+	content, file, err := h.storageUC.DownloadEncryptedFile(c.Request.Context(), userID, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	defer content.Close()
+
+	// Зашифрованное имя - base64url, его можно передать в заголовке как есть
+	c.DataFromReader(http.StatusOK, -1, "application/octet-stream", content, map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=\"%s\"", file.EncryptedName),
+		"X-File-UUID":         file.UUID,
+		"Cache-Control":       "no-store",
+	})
+}
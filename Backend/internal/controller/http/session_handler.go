@@ -0,0 +1,112 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"server/internal/usecase"
+)
+
+// sessionKeyHeader - секрет разблокированной сессии (см. Unlock)
+const sessionKeyHeader = "X-Session-Key"
+
+type UnlockRequest struct {
+	MasterPassword string `json:"master_password" binding:"required"`
+}
+
+// Unlock открывает ключи мастер-паролем на время сессии: дальше запросы
+// могут передавать заголовок X-Session-Key вместо master_password
+func (h *StorageHandler) Unlock(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var req UnlockRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sessionKey, idleTimeout, err := h.sessionUC.Unlock(c.Request.Context(), userID, c.GetString("sessionID"), req.MasterPassword)
+	if status, ok := passphraseErrorStatus(err); ok {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session_key":  sessionKey,
+		"idle_timeout": int(idleTimeout.Seconds()),
+	})
+}
+
+// Lock стирает ключи сессии с сервера
+func (h *StorageHandler) Lock(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	err := h.sessionUC.Lock(c.Request.Context(), userID, c.GetString("sessionID"))
+	if status, ok := passphraseErrorStatus(err); ok {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session locked"})
+}
+
+// masterPassword возвращает мастер-пароль из запроса, а без него - пустой
+// пароль и контекст разблокированной сессии, в котором ключи пользователя
+// уже открыты. При ошибке отвечает клиенту сам.
+func (h *StorageHandler) masterPassword(c *gin.Context, masterPassword string) (context.Context, string, bool) {
+	ctx := c.Request.Context()
+	if masterPassword != "" {
+		return ctx, masterPassword, true
+	}
+
+	sessionKey := c.GetHeader(sessionKeyHeader)
+	if sessionKey == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "master_password or an unlocked session is required"})
+		return nil, "", false
+	}
+
+	ctx, err := h.sessionUC.Resume(ctx, c.GetUint("userID"), c.GetString("sessionID"), sessionKey)
+	if status, ok := passphraseErrorStatus(err); ok {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return nil, "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, "", false
+	}
+	return ctx, "", true
+}
+
+// bindOptionalJSON разбирает тело запроса, которое может отсутствовать
+func bindOptionalJSON(c *gin.Context, req interface{}) bool {
+	if err := c.ShouldBindJSON(req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// sessionErrorStatus возвращает HTTP-статус ошибок сессии
+func sessionErrorStatus(err error) (int, bool) {
+	switch {
+	case errors.Is(err, usecase.ErrSessionLocked):
+		return http.StatusLocked, true
+	case errors.Is(err, usecase.ErrNoSession):
+		return http.StatusUnauthorized, true
+	case errors.Is(err, usecase.ErrMasterPasswordRequired):
+		return http.StatusPreconditionRequired, true
+	}
+	return 0, false
+}
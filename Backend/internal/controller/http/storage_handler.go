@@ -1,34 +1,54 @@
 package http
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 
 	"server/internal/usecase"
+	"server/pkg/encryption"
+	"server/pkg/storage"
 )
 
 type StorageHandler struct {
 	storageUC usecase.StorageUseCase
+	shareUC   usecase.ShareUseCase
+	sessionUC usecase.SessionUseCase
 }
 
-func NewStorageHandler(storageUC usecase.StorageUseCase) *StorageHandler {
-	return &StorageHandler{storageUC: storageUC}
+func NewStorageHandler(storageUC usecase.StorageUseCase, shareUC usecase.ShareUseCase, sessionUC usecase.SessionUseCase) *StorageHandler {
+	return &StorageHandler{storageUC: storageUC, shareUC: shareUC, sessionUC: sessionUC}
 }
 
 type ConnectYandexRequest struct {
 	Code string `json:"code" binding:"required"`
 }
 
+// DownloadFileRequest - без master_password используется разблокированная сессия
 type DownloadFileRequest struct {
-	MasterPassword string `json:"master_password" binding:"required"`
+	MasterPassword string `json:"master_password"`
 }
 
+// GetFilenameRequest - без master_password используется разблокированная сессия
 type GetFilenameRequest struct {
+	MasterPassword string `json:"master_password"`
+}
+
+type VerifyPasswordRequest struct {
 	MasterPassword string `json:"master_password" binding:"required"`
 }
 
+// ConnectStorageRequest - учетные данные зависят от провайдера: строка или
+// JSON-объект (для локального диска не нужны)
+type ConnectStorageRequest struct {
+	Provider    string          `json:"provider" binding:"required"`
+	Credentials json.RawMessage `json:"credentials"`
+}
+
 type UploadFileResponse struct {
 	FileID    uint   `json:"file_id"`
 	Message   string `json:"message"`
@@ -101,12 +121,15 @@ func (h *StorageHandler) GetDecryptedFilename(c *gin.Context) {
 	}
 	
 	var req GetFilenameRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !bindOptionalJSON(c, &req) {
+		return
+	}
+	ctx, masterPassword, ok := h.masterPassword(c, req.MasterPassword)
+	if !ok {
 		return
 	}
 	
-	filename, err := h.storageUC.GetDecryptedFilename(c.Request.Context(), userID, id, req.MasterPassword)
+	filename, err := h.storageUC.GetDecryptedFilename(ctx, userID, id, masterPassword)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -118,38 +141,97 @@ func (h *StorageHandler) GetDecryptedFilename(c *gin.Context) {
 func (h *StorageHandler) UploadFile(c *gin.Context) {
 	userID := c.GetUint("userID")
 	path := c.DefaultQuery("path", "/")
-	masterPassword := c.PostForm("master_password")
-	
-	if masterPassword == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "master password is required"})
-		return
-	}
+	// Сжатие: gzip, none или пусто - выбор по MIME-типу файла
+	compression := c.Query("compression")
+	// Хранение фрагментами с дедупликацией
+	chunked := c.Query("chunked") == "true"
 	
-	file, err := c.FormFile("file")
+	// Читаем multipart потоком: файл шифруется и отправляется в облако по мере
+	// получения, поэтому master_password должен идти в форме раньше файла
+	reader, err := c.Request.MultipartReader()
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "multipart form is required"})
 		return
 	}
 	
-	// Проверяем размер файла (макс 100MB)
-	if file.Size > 100*1024*1024 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "file size exceeds 100MB limit"})
-		return
+	var masterPassword string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid multipart form"})
+			return
+		}
+		
+		switch part.FormName() {
+		case "master_password":
+			value, err := io.ReadAll(io.LimitReader(part, 4096))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid multipart form"})
+				return
+			}
+			masterPassword = string(value)
+			
+		case "compression":
+			value, err := io.ReadAll(io.LimitReader(part, 64))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid multipart form"})
+				return
+			}
+			compression = string(value)
+			
+		case "chunked":
+			value, err := io.ReadAll(io.LimitReader(part, 16))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid multipart form"})
+				return
+			}
+			chunked = string(value) == "true"
+			
+		case "file":
+			// Без мастер-пароля в форме используется разблокированная сессия
+			ctx, masterPassword, ok := h.masterPassword(c, masterPassword)
+			if !ok {
+				return
+			}
+			
+			metadata, err := h.storageUC.UploadFile(
+				ctx,
+				userID,
+				part.FileName(),
+				part.Header.Get("Content-Type"),
+				part,
+				masterPassword,
+				path,
+				compression,
+				chunked,
+			)
+			if status, ok := passphraseErrorStatus(err); ok {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+			if errors.Is(err, usecase.ErrChunkedRequiresKeySlots) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			
+			response := UploadFileResponse{
+				FileID:    metadata.ID,
+				Message:   "File uploaded and encrypted successfully",
+				EncryptedName: metadata.EncryptedName,
+			}
+			
+			c.JSON(http.StatusOK, response)
+			return
+		}
 	}
-	
-	metadata, err := h.storageUC.UploadFile(c.Request.Context(), userID, file, masterPassword, path)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	
-	response := UploadFileResponse{
-		FileID:    metadata.ID,
-		Message:   "File uploaded and encrypted successfully",
-		EncryptedName: metadata.EncryptedName,
-	}
-	
-	c.JSON(http.StatusOK, response)
 }
 
 func (h *StorageHandler) DownloadFile(c *gin.Context) {
@@ -163,28 +245,67 @@ func (h *StorageHandler) DownloadFile(c *gin.Context) {
 	}
 	
 	var req DownloadFileRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !bindOptionalJSON(c, &req) {
+		return
+	}
+	ctx, masterPassword, ok := h.masterPassword(c, req.MasterPassword)
+	if !ok {
 		return
 	}
 	
-	content, filename, err := h.storageUC.DownloadFile(c.Request.Context(), userID, id, req.MasterPassword)
+	content, filename, err := h.storageUC.DownloadFile(ctx, userID, id, masterPassword)
+	if status, ok := passphraseErrorStatus(err); ok {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, usecase.ErrFileRotationPending) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, encryption.ErrTampered) {
+		// Файл в облаке подменен или изменен - это не ошибка сервера
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	defer content.Close()
 	
-	// Устанавливаем заголовки для скачивания с правильным именем файла
-	c.Header("Content-Description", "File Transfer")
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
-	c.Header("Content-Type", "application/octet-stream")
-	c.Header("Content-Length", fmt.Sprintf("%d", len(content)))
-	c.Header("Content-Transfer-Encoding", "binary")
-	c.Header("Expires", "0")
-	c.Header("Cache-Control", "must-revalidate")
-	c.Header("Pragma", "public")
-	
-	c.Data(http.StatusOK, "application/octet-stream", content)
+	// Устанавливаем заголовки для скачивания с правильным именем файла.
+	// Размер заранее неизвестен: файл расшифровывается по мере отдачи
+	c.DataFromReader(http.StatusOK, -1, "application/octet-stream", content, map[string]string{
+		"Content-Description":       "File Transfer",
+		"Content-Disposition":       fmt.Sprintf("attachment; filename=\"%s\"", filename),
+		"Content-Transfer-Encoding": "binary",
+		"Expires":                   "0",
+		"Cache-Control":             "must-revalidate",
+		"Pragma":                    "public",
+	})
+}
+
+// VerifyMasterPassword проверяет мастер-пароль до загрузки или скачивания файлов
+func (h *StorageHandler) VerifyMasterPassword(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var req VerifyPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.storageUC.VerifyMasterPassword(c.Request.Context(), userID, req.MasterPassword)
+	if status, ok := passphraseErrorStatus(err); ok {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Master password is valid"})
 }
 
 func (h *StorageHandler) DeleteFile(c *gin.Context) {
@@ -216,4 +337,331 @@ func (h *StorageHandler) GetYandexToken(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{"access_token": token})
-}
\ No newline at end of file
+}
+
+// GetQuota возвращает занятое место в хранилище пользователя
+func (h *StorageHandler) GetQuota(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	provider, quota, err := h.storageUC.GetQuota(c.Request.Context(), userID)
+	if errors.Is(err, storage.ErrNotConnected) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"provider": provider, "quota": quota})
+}
+
+// ConnectStorage подключает хранилище без OAuth
+func (h *StorageHandler) ConnectStorage(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var req ConnectStorageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var credentials string
+	if len(req.Credentials) > 0 && json.Unmarshal(req.Credentials, &credentials) != nil {
+		credentials = string(req.Credentials)
+	}
+
+	err := h.storageUC.ConnectStorage(c.Request.Context(), userID, req.Provider, credentials)
+	if errors.Is(err, usecase.ErrStorageInUse) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Storage connected successfully", "provider": req.Provider})
+}
+
+// ReplicationPolicyRequest - для политики quorum min_replicas обязателен
+type ReplicationPolicyRequest struct {
+	Policy      string `json:"policy" binding:"required"`
+	MinReplicas int    `json:"min_replicas"`
+}
+
+// GetReplication возвращает хранилища пользователя и политику репликации
+func (h *StorageHandler) GetReplication(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	settings, err := h.storageUC.GetReplication(c.Request.Context(), userID)
+	if errors.Is(err, storage.ErrNotConnected) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// SetReplicationPolicy задает политику записи копий
+func (h *StorageHandler) SetReplicationPolicy(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var req ReplicationPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.storageUC.SetReplicationPolicy(c.Request.Context(), userID, req.Policy, req.MinReplicas)
+	if errors.Is(err, usecase.ErrInvalidReplicationPolicy) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Replication policy updated"})
+}
+
+// AttachStorage подключает дополнительное хранилище для копий файлов
+func (h *StorageHandler) AttachStorage(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var req ConnectStorageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var credentials string
+	if len(req.Credentials) > 0 && json.Unmarshal(req.Credentials, &credentials) != nil {
+		credentials = string(req.Credentials)
+	}
+
+	backend, err := h.storageUC.AttachStorage(c.Request.Context(), userID, req.Provider, credentials)
+	if errors.Is(err, storage.ErrNotConnected) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, usecase.ErrBackendExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, backend)
+}
+
+// DetachStorage отключает дополнительное хранилище
+func (h *StorageHandler) DetachStorage(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var id uint
+	if _, err := fmt.Sscanf(c.Param("id"), "%d", &id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storage ID"})
+		return
+	}
+
+	err := h.storageUC.DetachStorage(c.Request.Context(), userID, id)
+	if errors.Is(err, usecase.ErrBackendNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Storage detached successfully"})
+}
+
+type ShareFileRequest struct {
+	Email          string `json:"email" binding:"required,email"`
+	MasterPassword string `json:"master_password"`
+}
+
+// ShareRequest - без master_password используется разблокированная сессия
+type ShareRequest struct {
+	MasterPassword string `json:"master_password"`
+}
+
+// ShareFile открывает доступ к файлу другому пользователю
+func (h *StorageHandler) ShareFile(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var id uint
+	if _, err := fmt.Sscanf(c.Param("id"), "%d", &id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file ID"})
+		return
+	}
+
+	var req ShareFileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx, masterPassword, ok := h.masterPassword(c, req.MasterPassword)
+	if !ok {
+		return
+	}
+
+	share, err := h.shareUC.ShareFile(ctx, userID, id, req.Email, masterPassword)
+	if status, ok := shareErrorStatus(err); ok {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"share": share})
+}
+
+// GetShares возвращает отправленные и полученные доступы к файлам
+func (h *StorageHandler) GetShares(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	shares, err := h.shareUC.GetShares(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"shares": shares})
+}
+
+// AcceptShare принимает файл, которым поделился другой пользователь
+func (h *StorageHandler) AcceptShare(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var id uint
+	if _, err := fmt.Sscanf(c.Param("id"), "%d", &id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid share ID"})
+		return
+	}
+
+	var req ShareRequest
+	if !bindOptionalJSON(c, &req) {
+		return
+	}
+	ctx, masterPassword, ok := h.masterPassword(c, req.MasterPassword)
+	if !ok {
+		return
+	}
+
+	share, err := h.shareUC.AcceptShare(ctx, userID, id, masterPassword)
+	if status, ok := shareErrorStatus(err); ok {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"share": share})
+}
+
+// RevokeShare отзывает доступ к файлу (владелец) или отказывается от него (получатель)
+func (h *StorageHandler) RevokeShare(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var id uint
+	if _, err := fmt.Sscanf(c.Param("id"), "%d", &id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid share ID"})
+		return
+	}
+
+	err := h.shareUC.RevokeShare(c.Request.Context(), userID, id)
+	if status, ok := shareErrorStatus(err); ok {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Share revoked successfully"})
+}
+
+// DownloadSharedFile расшифровывает принятый файл мастер-паролем получателя
+func (h *StorageHandler) DownloadSharedFile(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var id uint
+	if _, err := fmt.Sscanf(c.Param("id"), "%d", &id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid share ID"})
+		return
+	}
+
+	var req ShareRequest
+	if !bindOptionalJSON(c, &req) {
+		return
+	}
+	ctx, masterPassword, ok := h.masterPassword(c, req.MasterPassword)
+	if !ok {
+		return
+	}
+
+	content, filename, err := h.shareUC.DownloadSharedFile(ctx, userID, id, masterPassword)
+	if status, ok := shareErrorStatus(err); ok {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, encryption.ErrTampered) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer content.Close()
+
+	c.DataFromReader(http.StatusOK, -1, "application/octet-stream", content, map[string]string{
+		"Content-Description":       "File Transfer",
+		"Content-Disposition":       fmt.Sprintf("attachment; filename=\"%s\"", filename),
+		"Content-Transfer-Encoding": "binary",
+		"Expires":                   "0",
+		"Cache-Control":             "must-revalidate",
+		"Pragma":                    "public",
+	})
+}
+
+// shareErrorStatus возвращает HTTP-статус ошибок обмена файлами
+func shareErrorStatus(err error) (int, bool) {
+	switch {
+	case errors.Is(err, usecase.ErrShareNotFound):
+		return http.StatusNotFound, true
+	case errors.Is(err, usecase.ErrShareAlreadyGranted):
+		return http.StatusConflict, true
+	case errors.Is(err, usecase.ErrRecipientHasNoKey), errors.Is(err, usecase.ErrFileNotShareable), errors.Is(err, usecase.ErrClientFileShare):
+		return http.StatusUnprocessableEntity, true
+	}
+	return passphraseErrorStatus(err)
+}
+
+// passphraseErrorStatus возвращает HTTP-статус ошибок мастер-пароля
+func passphraseErrorStatus(err error) (int, bool) {
+	switch {
+	case errors.Is(err, usecase.ErrInvalidMasterPassword):
+		return http.StatusForbidden, true
+	case errors.Is(err, usecase.ErrPassphraseNotSet):
+		return http.StatusPreconditionRequired, true
+	case errors.Is(err, usecase.ErrPassphraseSameAsLogin):
+		return http.StatusBadRequest, true
+	}
+	return sessionErrorStatus(err)
+}
@@ -1,26 +1,39 @@
 package http
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 
 	"server/internal/usecase"
+	"server/pkg/encryption"
 )
 
 type UserHandler struct {
-	userUC usecase.UserUseCase
+	userUC        usecase.UserUseCase
+	keyRotationUC usecase.KeyRotationUseCase
+	keySlotUC     usecase.KeySlotUseCase
 }
 
-func NewUserHandler(userUC usecase.UserUseCase) *UserHandler {
+func NewUserHandler(userUC usecase.UserUseCase, keyRotationUC usecase.KeyRotationUseCase, keySlotUC usecase.KeySlotUseCase) *UserHandler {
 	return &UserHandler{
-		userUC: userUC,
+		userUC:        userUC,
+		keyRotationUC: keyRotationUC,
+		keySlotUC:     keySlotUC,
 	}
 }
 
 type UserProfileResponse struct {
-	ID    uint   `json:"id"`
-	Email string `json:"email"`
+	ID          uint   `json:"id"`
+	Email       string `json:"email"`
+	CipherSuite        string `json:"cipher_suite,omitempty"`
+	DeterministicNames bool   `json:"deterministic_names"`
+	Padding            string `json:"padding"`
+	PassphraseSet      bool   `json:"passphrase_set"` // false - мастер-пароль задается первой загрузкой
+	SharingEnabled     bool   `json:"sharing_enabled"` // Есть ключ для получения файлов от других пользователей
+	StorageProvider    string `json:"storage_provider,omitempty"` // Пусто - хранилище не подключено
 }
 
 func (h *UserHandler) GetProfile(c *gin.Context) {
@@ -33,8 +46,18 @@ func (h *UserHandler) GetProfile(c *gin.Context) {
 	}
 
 	response := UserProfileResponse{
-		ID:    user.ID,
-		Email: user.Email,
+		ID:                 user.ID,
+		Email:              user.Email,
+		DeterministicNames: user.DeterministicNames,
+		Padding:            encryption.PaddingScheme(user.Padding).String(),
+		PassphraseSet:      user.HasPassphrase(),
+		SharingEnabled:     len(user.SharePublicKey) > 0,
+	}
+	if user.StorageCredentials != "" {
+		response.StorageProvider = user.StorageProvider
+	}
+	if user.CipherSuite != 0 {
+		response.CipherSuite = encryption.CipherSuite(user.CipherSuite).String()
 	}
 
 	c.JSON(http.StatusOK, response)
@@ -68,4 +91,220 @@ func (h *UserHandler) UpdateProfile(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Profile updated successfully"})
-}
\ No newline at end of file
+}
+
+type EncryptionSettingsRequest struct {
+	CipherSuite        *string `json:"cipher_suite"` // Пустая строка - набор по умолчанию
+	DeterministicNames *bool   `json:"deterministic_names"`
+	Padding            *string `json:"padding"` // none, padme или pow2
+}
+
+// UpdateEncryptionSettings меняет настройки шифрования новых файлов пользователя
+func (h *UserHandler) UpdateEncryptionSettings(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var req EncryptionSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.userUC.UpdateEncryptionSettings(c.Request.Context(), userID, usecase.EncryptionSettings{
+		CipherSuite:        req.CipherSuite,
+		DeterministicNames: req.DeterministicNames,
+		Padding:            req.Padding,
+	}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Encryption settings updated successfully"})
+}
+
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=8"`
+}
+
+// ChangePassword меняет мастер-пароль и запускает фоновую смену ключей файлов
+func (h *UserHandler) ChangePassword(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rotation, err := h.keyRotationUC.ChangeMasterPassword(c.Request.Context(), userID, req.OldPassword, req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":  "Password changed, re-keying files in background",
+		"rotation": rotation,
+	})
+}
+
+// ChangeLoginPassword меняет пароль входа, мастер-пароль остается прежним
+func (h *UserHandler) ChangeLoginPassword(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.keyRotationUC.ChangeLoginPassword(c.Request.Context(), userID, req.OldPassword, req.NewPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Login password changed"})
+}
+
+func (h *UserHandler) GetKeyRotation(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	rotation, err := h.keyRotationUC.GetKeyRotation(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rotation": rotation})
+}
+
+// ResumeKeyRotation продолжает прерванную или завершившуюся с ошибками смену ключей
+func (h *UserHandler) ResumeKeyRotation(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rotation, err := h.keyRotationUC.ResumeKeyRotation(c.Request.Context(), userID, req.OldPassword, req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"rotation": rotation})
+}
+
+type RecoverPasswordRequest struct {
+	Email       string `json:"email" binding:"required,email"`
+	RecoveryKey string `json:"recovery_key" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=8"`
+}
+
+// RecoverPassword задает новый мастер-пароль по ключу восстановления
+func (h *UserHandler) RecoverPassword(c *gin.Context) {
+	var req RecoverPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rotation, err := h.keyRotationUC.RecoverMasterPassword(c.Request.Context(), req.Email, req.RecoveryKey, req.NewPassword)
+	if errors.Is(err, usecase.ErrTooManyAttempts) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":  "Password recovered, re-encrypting file names in background",
+		"rotation": rotation,
+	})
+}
+
+func (h *UserHandler) GetKeySlots(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	slots, err := h.keySlotUC.GetKeySlots(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"slots": slots})
+}
+
+type KeySlotRequest struct {
+	MasterPassword string `json:"master_password" binding:"required"`
+	Label          string `json:"label"`
+}
+
+// AddRecoveryKey создает ключ восстановления. Ключ показывается только
+// в этом ответе - сервер хранит лишь обернутый им ключ пользователя.
+func (h *UserHandler) AddRecoveryKey(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var req KeySlotRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	recoveryKey, slot, err := h.keySlotUC.AddRecoveryKey(c.Request.Context(), userID, req.MasterPassword, req.Label)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"recovery_key": recoveryKey,
+		"slot":         slot,
+	})
+}
+
+// AddEscrowKey оборачивает ключ пользователя ключом администратора
+func (h *UserHandler) AddEscrowKey(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var req KeySlotRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	slot, err := h.keySlotUC.AddEscrowKey(c.Request.Context(), userID, req.MasterPassword)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"slot": slot})
+}
+
+func (h *UserHandler) RemoveKeySlot(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var id uint
+	if _, err := fmt.Sscanf(c.Param("id"), "%d", &id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid key slot ID"})
+		return
+	}
+
+	var req KeySlotRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.keySlotUC.RemoveKeySlot(c.Request.Context(), userID, id, req.MasterPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Key slot removed successfully"})
+}
@@ -27,7 +27,7 @@ func AuthMiddleware(authUC usecase.AuthUseCase) gin.HandlerFunc {
 		}
 		
 		token := parts[1]
-		userID, err := authUC.ValidateToken(c.Request.Context(), token)
+		userID, sessionID, err := authUC.ValidateToken(c.Request.Context(), token)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
@@ -35,6 +35,7 @@ func AuthMiddleware(authUC usecase.AuthUseCase) gin.HandlerFunc {
 		}
 		
 		c.Set("userID", userID)
+		c.Set("sessionID", sessionID)
 		c.Next()
 	}
 }
\ No newline at end of file
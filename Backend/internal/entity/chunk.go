@@ -0,0 +1,34 @@
+package entity
+
+import (
+	"time"
+)
+
+// Chunk - зашифрованный фрагмент в облаке пользователя (см.
+// encryption.NewChunkRef). Фрагмент хранится один раз и удаляется, когда
+// на него не ссылается ни один файл.
+type Chunk struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_chunks_user_chunk" json:"user_id"`
+	ChunkID   string    `gorm:"not null;uniqueIndex:idx_chunks_user_chunk" json:"chunk_id"` // Идентификатор фрагмента (hex), имя файла в облаке
+	Size      int64     `gorm:"not null" json:"size"`                                       // Размер зашифрованного фрагмента
+	RefCount  int       `gorm:"not null" json:"ref_count"`                                  // Число ссылок из файлов
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (Chunk) TableName() string {
+	return "chunks"
+}
+
+// FileChunk - ссылка файла на фрагмент. Ключи фрагментов хранятся только
+// в зашифрованном манифесте файла, здесь - лишь идентификаторы для учета ссылок.
+type FileChunk struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	FileID   uint   `gorm:"not null;index" json:"file_id"`
+	Position int    `gorm:"not null" json:"position"`
+	ChunkID  string `gorm:"not null" json:"chunk_id"`
+}
+
+func (FileChunk) TableName() string {
+	return "file_chunks"
+}
@@ -0,0 +1,22 @@
+package entity
+
+import (
+	"time"
+)
+
+// Directory - соответствие открытого пути каталога зашифрованному пути в облаке.
+// В облаке видны только зашифрованные имена каталогов, открытые имена
+// хранятся только здесь.
+type Directory struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	UserID        uint      `gorm:"not null;uniqueIndex:idx_directories_user_path;index:idx_directories_user_encrypted_path" json:"user_id"`
+	Path          string    `gorm:"not null;uniqueIndex:idx_directories_user_path" json:"path"`               // Открытый путь, например /taxes/2025
+	Name          string    `gorm:"not null" json:"name"`                                                     // Открытое имя каталога
+	EncryptedPath string    `gorm:"not null;index:idx_directories_user_encrypted_path" json:"encrypted_path"` // Путь в облачном хранилище
+	EncryptedName string    `gorm:"not null" json:"encrypted_name"`                                           // Зашифрованное имя в облаке
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func (Directory) TableName() string {
+	return "directories"
+}
@@ -8,18 +8,28 @@ import (
 
 type FileMetadata struct {
     ID           uint   `gorm:"primaryKey" json:"id"`
+    UUID         string `gorm:"index" json:"uuid,omitempty"` // Постоянный идентификатор, к которому привязан шифротекст
     UserID       uint   `gorm:"not null;index" json:"user_id"`
     Filename     string `gorm:"not null" json:"filename"`     // Исходное имя файла
     EncryptedName string `gorm:"not null" json:"encrypted_name"`    // Зашифрованное имя в облаке
     Path         string `gorm:"not null" json:"path"`     // Путь в облачном хранилище
+    Dir          string `json:"dir,omitempty"`            // Открытый каталог файла (пути в облаке зашифрованы)
     Size         int64  `gorm:"not null" json:"size"`     // Размер файла в байтах
     MimeType     string `json:"mime_type"`                // MIME-тип
     IsEncrypted  bool   `gorm:"default:true" json:"is_encrypted"` // Флаг шифрования
     Type         string `gorm:"default:'file'" json:"type"` // 'file' или 'dir'
+    WrappedKey   []byte `json:"-"`                       // Ключ файла, обернутый ключом пользователя
+    KDF          uint8  `json:"-"`                       // Функция вывода ключа в заголовке файла (0 - старый формат)
+    ClientEncrypted bool `json:"client_encrypted"`      // Зашифрован клиентом: открытое имя серверу неизвестно
+    Chunked      bool   `json:"chunked"`                 // В облаке манифест, содержимое - в общих фрагментах (см. Chunk)
     CreatedAt    time.Time `json:"created_at"`
     UpdatedAt    time.Time `json:"updated_at"`
     DeletedAt    gorm.DeletedAt `gorm:"index" json:"deleted_at"`
     
+    // Хранилища, в которых лежат копии файла (таблица file_replicas).
+    // Пусто - файл загружен до репликации и лежит в основном хранилище.
+    Replicas []*FileReplica `gorm:"-" json:"replicas,omitempty"`
+    
     User User `gorm:"foreignKey:UserID" json:"-"`
 }
 
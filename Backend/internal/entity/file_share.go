@@ -0,0 +1,40 @@
+package entity
+
+import (
+	"time"
+)
+
+// Статусы обмена файлом
+const (
+	FileSharePending  = "pending"  // Получатель еще не принял файл
+	FileShareAccepted = "accepted" // Получатель принял файл и может его скачивать
+	FileShareRevoked  = "revoked"  // Владелец отозвал доступ или получатель отказался
+)
+
+// FileShare - доступ получателя к файлу владельца. Ключ файла обернут для
+// открытого ключа X25519 получателя (см. encryption.SealShare): открыть его
+// может только получатель своим мастер-паролем.
+type FileShare struct {
+	ID          uint   `gorm:"primaryKey" json:"id"`
+	FileID      uint   `gorm:"not null;index" json:"file_id"`
+	OwnerID     uint   `gorm:"not null;index" json:"owner_id"`
+	RecipientID uint   `gorm:"not null;index" json:"recipient_id"`
+	Status      string `gorm:"not null" json:"status"`
+
+	// Открытые данные для списка доступа: получатель не может расшифровать
+	// имя файла паролем владельца
+	Filename       string `json:"filename"`
+	OwnerEmail     string `json:"owner_email"`
+	RecipientEmail string `json:"recipient_email"`
+
+	EphemeralKey []byte `json:"-"` // Эфемерный открытый ключ X25519
+	WrappedKey   []byte `json:"-"` // Ключ файла, обернутый для получателя
+
+	CreatedAt  time.Time  `json:"created_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (FileShare) TableName() string {
+	return "file_shares"
+}
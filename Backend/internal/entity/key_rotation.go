@@ -0,0 +1,58 @@
+package entity
+
+import (
+	"time"
+)
+
+// Статусы смены ключей
+const (
+	KeyRotationRunning   = "running"
+	KeyRotationCompleted = "completed"
+	KeyRotationFailed    = "failed"
+	KeyRotationAborted   = "aborted" // Пароль не был изменен, задание не запускалось
+
+	KeyRotationItemPending = "pending"
+	KeyRotationItemDone    = "done"
+	KeyRotationItemFailed  = "failed"
+)
+
+// KeyRotation - фоновая перешифровка файлов пользователя после смены мастер-пароля
+type KeyRotation struct {
+	ID     uint   `gorm:"primaryKey" json:"id"`
+	UserID uint   `gorm:"not null;index" json:"user_id"`
+	Status string `gorm:"not null" json:"status"`
+	Total  int    `json:"total"`
+	Done   int    `json:"done"`
+	Failed int    `json:"failed"`
+
+	// Параметры и контрольное значение ключа старого пароля нужны, чтобы
+	// продолжить прерванную смену ключей. Стираются после завершения.
+	OldKeyCheck     []byte `json:"-"`
+	OldKeyKDF       uint8  `json:"-"`
+	OldKeyKDFParams []byte `json:"-"`
+	OldKeySalt      []byte `json:"-"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+func (KeyRotation) TableName() string {
+	return "key_rotations"
+}
+
+// KeyRotationItem - прогресс смены ключа отдельного файла
+type KeyRotationItem struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	RotationID uint      `gorm:"not null;index" json:"rotation_id"`
+	FileID     uint      `gorm:"not null" json:"file_id"`
+	Status     string    `gorm:"not null" json:"status"`
+	OldPath    string    `json:"old_path"`
+	NewPath    string    `json:"new_path"` // Запоминается до записи в облако
+	Error      string    `json:"error,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func (KeyRotationItem) TableName() string {
+	return "key_rotation_items"
+}
@@ -0,0 +1,36 @@
+package entity
+
+import (
+	"time"
+)
+
+// Типы слотов ключей
+const (
+	KeySlotPassword = "password" // Ключ слота выводится из мастер-пароля
+	KeySlotRecovery = "recovery" // Ключ слота выводится из ключа восстановления
+	KeySlotEscrow   = "escrow"   // Ключ слота согласуется с ключом администратора
+)
+
+// KeySlot - ключ пользователя (KEK), обернутый одним из секретов пользователя.
+// Любой слот открывает один и тот же ключ пользователя.
+type KeySlot struct {
+	ID     uint   `gorm:"primaryKey" json:"id"`
+	UserID uint   `gorm:"not null;index" json:"user_id"`
+	Type   string `gorm:"not null" json:"type"`
+	Label  string `json:"label,omitempty"`
+
+	// Параметры вывода ключа слота (для слотов пароля и восстановления)
+	KDF       uint8  `json:"-"`
+	KDFParams []byte `json:"-"`
+	Salt      []byte `json:"-"`
+
+	// Эфемерный открытый ключ X25519 (для слота депонирования)
+	EphemeralKey []byte `json:"-"`
+
+	WrappedKey []byte    `gorm:"not null" json:"-"` // Ключ пользователя, обернутый ключом слота
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (KeySlot) TableName() string {
+	return "key_slots"
+}
@@ -0,0 +1,62 @@
+package entity
+
+import (
+	"time"
+)
+
+// Политики записи реплик (User.ReplicationPolicy)
+const (
+	ReplicationAll    = "all"    // Запись должна пройти во все хранилища
+	ReplicationQuorum = "quorum" // Достаточно User.ReplicationMin хранилищ
+)
+
+// Состояние реплики файла
+const (
+	ReplicaHealthy = "healthy"
+	ReplicaFailed  = "failed" // Запись или чтение завершились ошибкой
+)
+
+// StorageBackend - дополнительное хранилище пользователя, в которое пишутся
+// реплики файлов. Основное хранилище задано в User (StorageProvider и
+// StorageCredentials) и в репликах обозначается BackendID = 0.
+type StorageBackend struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	UserID      uint      `gorm:"not null;index" json:"user_id"`
+	Provider    string    `gorm:"not null" json:"provider"`
+	Credentials string    `gorm:"not null" json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (StorageBackend) TableName() string {
+	return "storage_backends"
+}
+
+// FileReplica - копия файла в одном из хранилищ пользователя. Путь у всех
+// копий один - FileMetadata.Path.
+type FileReplica struct {
+	ID        uint      `gorm:"primaryKey" json:"-"`
+	FileID    uint      `gorm:"not null;uniqueIndex:idx_file_replicas_file_backend" json:"-"`
+	BackendID uint      `gorm:"not null;uniqueIndex:idx_file_replicas_file_backend" json:"backend_id"` // 0 - основное хранилище
+	Provider  string    `gorm:"not null" json:"provider"`
+	Status    string    `gorm:"not null" json:"status"`
+	LastError string    `json:"last_error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (FileReplica) TableName() string {
+	return "file_replicas"
+}
+
+// ChunkReplica - копия фрагмента (Chunk) в одном из хранилищ пользователя.
+// Фрагмент загружается один раз и переиспользуется другими файлами, поэтому
+// его копии учитываются отдельно от копий файлов.
+type ChunkReplica struct {
+	ID        uint      `gorm:"primaryKey" json:"-"`
+	ChunkID   uint      `gorm:"not null;uniqueIndex:idx_chunk_replicas_chunk_backend" json:"-"` // Chunk.ID
+	BackendID uint      `gorm:"not null;uniqueIndex:idx_chunk_replicas_chunk_backend;index" json:"backend_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (ChunkReplica) TableName() string {
+	return "chunk_replicas"
+}
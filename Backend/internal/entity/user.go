@@ -9,16 +9,66 @@ import (
 type User struct {
 	ID        uint   `gorm:"primaryKey"`
 	Email     string `gorm:"uniqueIndex;not null"`
-	Password  string `gorm:"not null"` // Хэш мастер-пароля
+	Password  string `gorm:"not null"` // Хэш пароля входа
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 	
-	// OAuth токены для Яндекс.Диска
-	YandexDiskToken  string
-	YandexDiskExpiry *time.Time
+	// Хранилище файлов пользователя: имя провайдера в реестре хранилищ
+	// и учетные данные для него (OAuth-токен Яндекс.Диска). Колонка
+	// учетных данных осталась от токена Яндекс.Диска.
+	StorageProvider    string `gorm:"default:yandex_disk"`
+	StorageCredentials string `gorm:"column:yandex_disk_token"`
+	YandexDiskExpiry   *time.Time
+	
+	// Запись копий файлов в дополнительные хранилища (см. StorageBackend):
+	// политика ReplicationAll или ReplicationQuorum (пусто - ReplicationAll)
+	// и число хранилищ, которых достаточно для ReplicationQuorum
+	ReplicationPolicy string
+	ReplicationMin    int
+	
+	// Параметры вывода ключа пользователя (KEK) из мастер-пароля.
+	// После перехода на слоты ключей (см. KeySlot) не меняются и нужны
+	// только для расшифровки файлов, записанных до перехода.
+	KeyKDF       uint8
+	KeyKDFParams []byte
+	KeySalt      []byte
+	
+	// Проверочное значение ключа, выведенного из мастер-пароля по параметрам
+	// выше (см. encryption.NewKeyCheck). Со слотами ключей его роль играет
+	// MasterKeyID. Пусто - пароль еще не был подтвержден.
+	KeyCheck []byte
+	
+	// Идентификатор ключа пользователя из слотов (пусто - слотов еще нет)
+	MasterKeyID []byte
+	
+	// Набор шифров новых файлов (0 - набор по умолчанию для сервера)
+	CipherSuite uint8
+	
+	// Детерминированные имена (AES-SIV): одинаковые имена в одном каталоге
+	// совпадают, что позволяет перезаписывать файлы вместо дубликатов
+	DeterministicNames bool
+	
+	// Схема выравнивания размера новых файлов (0 - без выравнивания)
+	Padding uint8
+	
+	// Парольная фраза шифрования (мастер-пароль) отличается от пароля входа
+	// и проверяется только слотом пароля или KeyCheck. У аккаунтов, созданных
+	// до разделения паролей, мастер-паролем служит пароль входа, пока
+	// пользователь не сменит один из них.
+	SeparatePassphrase bool
+	
+	// Пара ключей X25519 для обмена файлами (см. FileShare). Закрытый ключ
+	// обернут ключом пользователя из слотов. Пусто - пара еще не создана.
+	SharePublicKey  []byte
+	SharePrivateKey []byte
 }
 
 func (User) TableName() string {
 	return "users"
+}
+
+// HasPassphrase проверяет, задана ли парольная фраза шифрования
+func (u *User) HasPassphrase() bool {
+	return !u.SeparatePassphrase || len(u.MasterKeyID) > 0 || len(u.KeySalt) > 0
 }
\ No newline at end of file
@@ -23,4 +23,77 @@ type FileMetadataRepository interface {
 	UpdateFileMetadata(ctx context.Context, file *entity.FileMetadata) error
 	DeleteFileMetadata(ctx context.Context, id uint) error
 	GetFileByPath(ctx context.Context, userID uint, path string) (*entity.FileMetadata, error)
-}
\ No newline at end of file
+	GetFileByUUID(ctx context.Context, userID uint, uuid string) (*entity.FileMetadata, error)
+}
+
+// DirectoryRepository определяет контракт для работы с соответствием
+// открытых и зашифрованных путей каталогов
+type DirectoryRepository interface {
+	CreateDirectory(ctx context.Context, dir *entity.Directory) error
+	GetDirectoryByPath(ctx context.Context, userID uint, path string) (*entity.Directory, error)
+	GetDirectoryByEncryptedPath(ctx context.Context, userID uint, encryptedPath string) (*entity.Directory, error)
+	// GetUserDirectories возвращает каталоги пользователя, родительские раньше вложенных
+	GetUserDirectories(ctx context.Context, userID uint) ([]*entity.Directory, error)
+	// RenameDirectory сохраняет новый путь каталога в облаке и заменяет
+	// старый путь oldEncryptedPath в путях вложенных каталогов и файлов
+	RenameDirectory(ctx context.Context, dir *entity.Directory, oldEncryptedPath string) error
+}
+
+// KeySlotRepository определяет контракт для работы со слотами ключей
+type KeySlotRepository interface {
+	CreateKeySlot(ctx context.Context, slot *entity.KeySlot) error
+	GetKeySlots(ctx context.Context, userID uint) ([]*entity.KeySlot, error)
+	GetKeySlotByID(ctx context.Context, id uint) (*entity.KeySlot, error)
+	UpdateKeySlot(ctx context.Context, slot *entity.KeySlot) error
+	DeleteKeySlot(ctx context.Context, id uint) error
+}
+
+// KeyRotationRepository определяет контракт для работы с заданиями смены ключей
+type KeyRotationRepository interface {
+	CreateRotation(ctx context.Context, rotation *entity.KeyRotation, items []*entity.KeyRotationItem) error
+	GetLatestRotation(ctx context.Context, userID uint) (*entity.KeyRotation, error)
+	UpdateRotation(ctx context.Context, rotation *entity.KeyRotation) error
+	GetUnfinishedItems(ctx context.Context, rotationID uint) ([]*entity.KeyRotationItem, error)
+	UpdateItem(ctx context.Context, item *entity.KeyRotationItem) error
+	CountItems(ctx context.Context, rotationID uint, status string) (int, error)
+}
+// FileShareRepository определяет контракт для работы с доступом к файлам других пользователей
+type FileShareRepository interface {
+	CreateShare(ctx context.Context, share *entity.FileShare) error
+	GetShareByID(ctx context.Context, id uint) (*entity.FileShare, error)
+	// GetUserShares возвращает файлы, которыми пользователь поделился или которые получил
+	GetUserShares(ctx context.Context, userID uint) ([]*entity.FileShare, error)
+	UpdateShare(ctx context.Context, share *entity.FileShare) error
+}
+
+// ChunkRepository определяет контракт для учета фрагментов файлов
+type ChunkRepository interface {
+	CreateChunk(ctx context.Context, chunk *entity.Chunk) error
+	// AddChunkRefs меняет число ссылок на фрагмент; false - фрагмента нет
+	AddChunkRefs(ctx context.Context, userID uint, chunkID string, delta int) (bool, error)
+	GetChunk(ctx context.Context, userID uint, chunkID string) (*entity.Chunk, error)
+	// DeleteUnusedChunk удаляет фрагмент вместе с записями о его копиях,
+	// только если на него не осталось ссылок
+	DeleteUnusedChunk(ctx context.Context, id uint) (bool, error)
+	// SetFileChunks заменяет ссылки файла на фрагменты
+	SetFileChunks(ctx context.Context, fileID uint, chunkIDs []string) error
+	GetFileChunks(ctx context.Context, fileID uint) ([]*entity.FileChunk, error)
+}
+
+// ReplicaRepository определяет контракт для работы с дополнительными
+// хранилищами пользователя и репликами файлов
+type ReplicaRepository interface {
+	CreateBackend(ctx context.Context, backend *entity.StorageBackend) error
+	GetBackends(ctx context.Context, userID uint) ([]*entity.StorageBackend, error)
+	GetBackendByID(ctx context.Context, id uint) (*entity.StorageBackend, error)
+	// DeleteBackend удаляет хранилище вместе с записями о репликах файлов
+	// и фрагментов в нем
+	DeleteBackend(ctx context.Context, id uint) error
+	// SetFileReplicas заменяет записи о репликах файла
+	SetFileReplicas(ctx context.Context, fileID uint, replicas []*entity.FileReplica) error
+	GetFileReplicas(ctx context.Context, fileID uint) ([]*entity.FileReplica, error)
+	UpdateReplica(ctx context.Context, replica *entity.FileReplica) error
+	GetChunkReplicas(ctx context.Context, chunkID uint) ([]*entity.ChunkReplica, error)
+	// AddChunkReplicas запоминает копии фрагмента; уже известные пропускаются
+	AddChunkReplicas(ctx context.Context, chunkID uint, backendIDs []uint) error
+}
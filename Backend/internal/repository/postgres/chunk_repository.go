@@ -0,0 +1,81 @@
+package postgres
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+
+	"server/internal/entity"
+	"server/internal/repository"
+)
+
+type chunkRepository struct {
+	db *gorm.DB
+}
+
+func NewChunkRepository(db *gorm.DB) repository.ChunkRepository {
+	return &chunkRepository{db: db}
+}
+
+func (r *chunkRepository) CreateChunk(ctx context.Context, chunk *entity.Chunk) error {
+	return r.db.WithContext(ctx).Create(chunk).Error
+}
+
+func (r *chunkRepository) AddChunkRefs(ctx context.Context, userID uint, chunkID string, delta int) (bool, error) {
+	result := r.db.WithContext(ctx).
+		Model(&entity.Chunk{}).
+		Where("user_id = ? AND chunk_id = ?", userID, chunkID).
+		UpdateColumn("ref_count", gorm.Expr("ref_count + ?", delta))
+	return result.RowsAffected > 0, result.Error
+}
+
+func (r *chunkRepository) GetChunk(ctx context.Context, userID uint, chunkID string) (*entity.Chunk, error) {
+	var chunk entity.Chunk
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND chunk_id = ?", userID, chunkID).
+		First(&chunk).Error
+	if err != nil {
+		return nil, err
+	}
+	return &chunk, nil
+}
+
+func (r *chunkRepository) DeleteUnusedChunk(ctx context.Context, id uint) (bool, error) {
+	deleted := false
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("ref_count <= 0").Delete(&entity.Chunk{}, id)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		deleted = true
+		return tx.Where("chunk_id = ?", id).Delete(&entity.ChunkReplica{}).Error
+	})
+	return deleted && err == nil, err
+}
+
+func (r *chunkRepository) SetFileChunks(ctx context.Context, fileID uint, chunkIDs []string) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("file_id = ?", fileID).Delete(&entity.FileChunk{}).Error; err != nil {
+			return err
+		}
+		if len(chunkIDs) == 0 {
+			return nil
+		}
+
+		refs := make([]*entity.FileChunk, len(chunkIDs))
+		for i, chunkID := range chunkIDs {
+			refs[i] = &entity.FileChunk{FileID: fileID, Position: i, ChunkID: chunkID}
+		}
+		return tx.CreateInBatches(refs, 500).Error
+	})
+}
+
+func (r *chunkRepository) GetFileChunks(ctx context.Context, fileID uint) ([]*entity.FileChunk, error) {
+	var refs []*entity.FileChunk
+	err := r.db.WithContext(ctx).
+		Where("file_id = ?", fileID).
+		Order("position").
+		Find(&refs).Error
+	return refs, err
+}
@@ -0,0 +1,80 @@
+package postgres
+
+import (
+	"context"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+
+	"server/internal/entity"
+	"server/internal/repository"
+)
+
+type directoryRepository struct {
+	db *gorm.DB
+}
+
+func NewDirectoryRepository(db *gorm.DB) repository.DirectoryRepository {
+	return &directoryRepository{db: db}
+}
+
+func (r *directoryRepository) CreateDirectory(ctx context.Context, dir *entity.Directory) error {
+	return r.db.WithContext(ctx).Create(dir).Error
+}
+
+func (r *directoryRepository) GetDirectoryByPath(ctx context.Context, userID uint, path string) (*entity.Directory, error) {
+	var dir entity.Directory
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND path = ?", userID, path).
+		First(&dir).Error
+	if err != nil {
+		return nil, err
+	}
+	return &dir, nil
+}
+
+func (r *directoryRepository) GetDirectoryByEncryptedPath(ctx context.Context, userID uint, encryptedPath string) (*entity.Directory, error) {
+	var dir entity.Directory
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND encrypted_path = ?", userID, encryptedPath).
+		First(&dir).Error
+	if err != nil {
+		return nil, err
+	}
+	return &dir, nil
+}
+
+func (r *directoryRepository) GetUserDirectories(ctx context.Context, userID uint) ([]*entity.Directory, error) {
+	var dirs []*entity.Directory
+	// Путь родителя - префикс пути вложенного каталога и при сортировке идет раньше
+	err := r.db.WithContext(ctx).
+		Where("user_id = ?", userID).
+		Order("path").
+		Find(&dirs).Error
+	return dirs, err
+}
+
+func (r *directoryRepository) RenameDirectory(ctx context.Context, dir *entity.Directory, oldEncryptedPath string) error {
+	// Префикс сравниваем через left(): в LIKE символ "_" из base64url был бы шаблоном
+	prefix := oldEncryptedPath + "/"
+	n := utf8.RuneCountInString(prefix)
+	newPath := gorm.Expr("? || substr(encrypted_path, ?)", dir.EncryptedPath+"/", n+1)
+	newFilePath := gorm.Expr("? || substr(path, ?)", dir.EncryptedPath+"/", n+1)
+
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(dir).Error; err != nil {
+			return err
+		}
+
+		err := tx.Model(&entity.Directory{}).
+			Where("user_id = ? AND left(encrypted_path, ?) = ?", dir.UserID, n, prefix).
+			Update("encrypted_path", newPath).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&entity.FileMetadata{}).
+			Where("user_id = ? AND left(path, ?) = ?", dir.UserID, n, prefix).
+			Update("path", newFilePath).Error
+	})
+}
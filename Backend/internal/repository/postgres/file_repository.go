@@ -65,4 +65,15 @@ func (r *fileRepository) GetFileByPath(ctx context.Context, userID uint, path st
 	fmt.Printf("DEBUG: Found existing metadata for path %s: %s (ID: %d)\n", 
 		path, file.Filename, file.ID)
 	return &file, nil
-}
\ No newline at end of file
+}
+
+func (r *fileRepository) GetFileByUUID(ctx context.Context, userID uint, uuid string) (*entity.FileMetadata, error) {
+	var file entity.FileMetadata
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND uuid = ?", userID, uuid).
+		First(&file).Error
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
@@ -0,0 +1,44 @@
+package postgres
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+
+	"server/internal/entity"
+	"server/internal/repository"
+)
+
+type fileShareRepository struct {
+	db *gorm.DB
+}
+
+func NewFileShareRepository(db *gorm.DB) repository.FileShareRepository {
+	return &fileShareRepository{db: db}
+}
+
+func (r *fileShareRepository) CreateShare(ctx context.Context, share *entity.FileShare) error {
+	return r.db.WithContext(ctx).Create(share).Error
+}
+
+func (r *fileShareRepository) GetShareByID(ctx context.Context, id uint) (*entity.FileShare, error) {
+	var share entity.FileShare
+	err := r.db.WithContext(ctx).First(&share, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &share, nil
+}
+
+func (r *fileShareRepository) GetUserShares(ctx context.Context, userID uint) ([]*entity.FileShare, error) {
+	var shares []*entity.FileShare
+	err := r.db.WithContext(ctx).
+		Where("owner_id = ? OR recipient_id = ?", userID, userID).
+		Order("id").
+		Find(&shares).Error
+	return shares, err
+}
+
+func (r *fileShareRepository) UpdateShare(ctx context.Context, share *entity.FileShare) error {
+	return r.db.WithContext(ctx).Save(share).Error
+}
@@ -0,0 +1,76 @@
+package postgres
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+
+	"server/internal/entity"
+	"server/internal/repository"
+)
+
+type keyRotationRepository struct {
+	db *gorm.DB
+}
+
+func NewKeyRotationRepository(db *gorm.DB) repository.KeyRotationRepository {
+	return &keyRotationRepository{db: db}
+}
+
+func (r *keyRotationRepository) CreateRotation(ctx context.Context, rotation *entity.KeyRotation, items []*entity.KeyRotationItem) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(rotation).Error; err != nil {
+			return err
+		}
+
+		if len(items) == 0 {
+			return nil
+		}
+
+		for _, item := range items {
+			item.RotationID = rotation.ID
+		}
+		return tx.Create(&items).Error
+	})
+}
+
+func (r *keyRotationRepository) GetLatestRotation(ctx context.Context, userID uint) (*entity.KeyRotation, error) {
+	var rotation entity.KeyRotation
+	err := r.db.WithContext(ctx).
+		Where("user_id = ?", userID).
+		Order("id DESC").
+		First(&rotation).Error
+	if err != nil {
+		return nil, err
+	}
+	return &rotation, nil
+}
+
+func (r *keyRotationRepository) UpdateRotation(ctx context.Context, rotation *entity.KeyRotation) error {
+	return r.db.WithContext(ctx).Save(rotation).Error
+}
+
+func (r *keyRotationRepository) GetUnfinishedItems(ctx context.Context, rotationID uint) ([]*entity.KeyRotationItem, error) {
+	var items []*entity.KeyRotationItem
+	err := r.db.WithContext(ctx).
+		Where("rotation_id = ? AND status <> ?", rotationID, entity.KeyRotationItemDone).
+		Order("id").
+		Find(&items).Error
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (r *keyRotationRepository) UpdateItem(ctx context.Context, item *entity.KeyRotationItem) error {
+	return r.db.WithContext(ctx).Save(item).Error
+}
+
+func (r *keyRotationRepository) CountItems(ctx context.Context, rotationID uint, status string) (int, error) {
+	var count int64
+	err := r.db.WithContext(ctx).
+		Model(&entity.KeyRotationItem{}).
+		Where("rotation_id = ? AND status = ?", rotationID, status).
+		Count(&count).Error
+	return int(count), err
+}
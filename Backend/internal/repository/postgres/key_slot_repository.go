@@ -0,0 +1,48 @@
+package postgres
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+
+	"server/internal/entity"
+	"server/internal/repository"
+)
+
+type keySlotRepository struct {
+	db *gorm.DB
+}
+
+func NewKeySlotRepository(db *gorm.DB) repository.KeySlotRepository {
+	return &keySlotRepository{db: db}
+}
+
+func (r *keySlotRepository) CreateKeySlot(ctx context.Context, slot *entity.KeySlot) error {
+	return r.db.WithContext(ctx).Create(slot).Error
+}
+
+func (r *keySlotRepository) GetKeySlots(ctx context.Context, userID uint) ([]*entity.KeySlot, error) {
+	var slots []*entity.KeySlot
+	err := r.db.WithContext(ctx).
+		Where("user_id = ?", userID).
+		Order("id").
+		Find(&slots).Error
+	return slots, err
+}
+
+func (r *keySlotRepository) GetKeySlotByID(ctx context.Context, id uint) (*entity.KeySlot, error) {
+	var slot entity.KeySlot
+	err := r.db.WithContext(ctx).First(&slot, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &slot, nil
+}
+
+func (r *keySlotRepository) UpdateKeySlot(ctx context.Context, slot *entity.KeySlot) error {
+	return r.db.WithContext(ctx).Save(slot).Error
+}
+
+func (r *keySlotRepository) DeleteKeySlot(ctx context.Context, id uint) error {
+	return r.db.WithContext(ctx).Delete(&entity.KeySlot{}, id).Error
+}
@@ -0,0 +1,106 @@
+package postgres
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"server/internal/entity"
+	"server/internal/repository"
+)
+
+type replicaRepository struct {
+	db *gorm.DB
+}
+
+func NewReplicaRepository(db *gorm.DB) repository.ReplicaRepository {
+	return &replicaRepository{db: db}
+}
+
+func (r *replicaRepository) CreateBackend(ctx context.Context, backend *entity.StorageBackend) error {
+	return r.db.WithContext(ctx).Create(backend).Error
+}
+
+func (r *replicaRepository) GetBackends(ctx context.Context, userID uint) ([]*entity.StorageBackend, error) {
+	var backends []*entity.StorageBackend
+	err := r.db.WithContext(ctx).
+		Where("user_id = ?", userID).
+		Order("id").
+		Find(&backends).Error
+	return backends, err
+}
+
+func (r *replicaRepository) GetBackendByID(ctx context.Context, id uint) (*entity.StorageBackend, error) {
+	var backend entity.StorageBackend
+	err := r.db.WithContext(ctx).First(&backend, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &backend, nil
+}
+
+func (r *replicaRepository) DeleteBackend(ctx context.Context, id uint) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("backend_id = ?", id).Delete(&entity.FileReplica{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("backend_id = ?", id).Delete(&entity.ChunkReplica{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&entity.StorageBackend{}, id).Error
+	})
+}
+
+func (r *replicaRepository) SetFileReplicas(ctx context.Context, fileID uint, replicas []*entity.FileReplica) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("file_id = ?", fileID).Delete(&entity.FileReplica{}).Error; err != nil {
+			return err
+		}
+		if len(replicas) == 0 {
+			return nil
+		}
+
+		for _, replica := range replicas {
+			replica.ID = 0
+			replica.FileID = fileID
+		}
+		return tx.Create(replicas).Error
+	})
+}
+
+func (r *replicaRepository) GetFileReplicas(ctx context.Context, fileID uint) ([]*entity.FileReplica, error) {
+	var replicas []*entity.FileReplica
+	err := r.db.WithContext(ctx).
+		Where("file_id = ?", fileID).
+		Order("backend_id").
+		Find(&replicas).Error
+	return replicas, err
+}
+
+func (r *replicaRepository) UpdateReplica(ctx context.Context, replica *entity.FileReplica) error {
+	return r.db.WithContext(ctx).Save(replica).Error
+}
+
+func (r *replicaRepository) GetChunkReplicas(ctx context.Context, chunkID uint) ([]*entity.ChunkReplica, error) {
+	var replicas []*entity.ChunkReplica
+	err := r.db.WithContext(ctx).
+		Where("chunk_id = ?", chunkID).
+		Order("backend_id").
+		Find(&replicas).Error
+	return replicas, err
+}
+
+func (r *replicaRepository) AddChunkReplicas(ctx context.Context, chunkID uint, backendIDs []uint) error {
+	if len(backendIDs) == 0 {
+		return nil
+	}
+
+	replicas := make([]*entity.ChunkReplica, len(backendIDs))
+	for i, backendID := range backendIDs {
+		replicas[i] = &entity.ChunkReplica{ChunkID: chunkID, BackendID: backendID}
+	}
+	return r.db.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(replicas).Error
+}
@@ -36,9 +36,11 @@ func (uc *authUseCase) Register(ctx context.Context, email, password string) err
 		return err
 	}
 	
+	// Парольная фраза шифрования задается отдельно при первой загрузке
 	user := &entity.User{
-		Email:    email,
-		Password: string(hashedPassword),
+		Email:              email,
+		Password:           string(hashedPassword),
+		SeparatePassphrase: true,
 	}
 	
 	return uc.userRepo.CreateUser(ctx, user)
@@ -65,17 +67,17 @@ func (uc *authUseCase) Login(ctx context.Context, email, password string) (strin
 	return token, nil
 }
 
-func (uc *authUseCase) ValidateToken(ctx context.Context, token string) (uint, error) {
+func (uc *authUseCase) ValidateToken(ctx context.Context, token string) (uint, string, error) {
 	claims, err := uc.jwtManager.ValidateToken(token)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 	
 	// Проверяем, существует ли пользователь
 	_, err = uc.userRepo.GetUserByID(ctx, claims.UserID)
 	if err != nil {
-		return 0, errors.New("user not found")
+		return 0, "", errors.New("user not found")
 	}
 	
-	return claims.UserID, nil
+	return claims.UserID, claims.ID, nil
 }
\ No newline at end of file
@@ -0,0 +1,421 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+
+	"server/internal/entity"
+	"server/pkg/chunker"
+	"server/pkg/encryption"
+	"server/pkg/storage"
+)
+
+// Хранение фрагментами (см. encryption/dedup.go).
+//
+// Фрагменты лежат в облаке в каталоге chunkDir под своими идентификаторами,
+// число ссылок на каждый учитывается в БД (Chunk, FileChunk). На месте
+// файла в облаке хранится зашифрованный манифест - обычный файл текущего
+// формата, поэтому смена пароля, обмен файлами и привязка к файлу работают
+// для него без изменений.
+
+const (
+	chunkDir = "/.secure-cloud-chunks"
+
+	// Манифест фрагментов DefaultParams занимает около 52 байт на МиБ файла
+	maxManifestSize = 64 << 20
+)
+
+var ErrChunkedRequiresKeySlots = errors.New("chunked storage requires key slots, verify the master password first")
+
+// chunkRefMu упорядочивает учет ссылок на фрагменты: удаление фрагмента без
+// ссылок не должно пересечься с новой ссылкой на него
+var chunkRefMu sync.Mutex
+
+// uploadChunked делит content на фрагменты и загружает в облако только
+// фрагменты, которых там еще нет. Возвращает манифест и идентификаторы
+// фрагментов по порядку; на каждый фрагмент взята ссылка.
+func (uc *storageUseCase) uploadChunked(ctx context.Context, user *entity.User, content io.Reader, kek []byte, suite encryption.CipherSuite) (*encryption.Manifest, []string, error) {
+	if uc.chunkRepo == nil {
+		return nil, nil, errors.New("chunked storage is not available")
+	}
+
+	suite, err := uc.encryption.ResolveSuite(suite)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	disk, err := uc.userStorage(ctx, user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chunks, err := chunker.New(content, chunker.DefaultParams)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dedupKey := encryption.DedupKey(kek)
+	manifest := &encryption.Manifest{}
+	var chunkIDs []string
+	var stored, reused int
+	folderReady := false
+	for {
+		data, err := chunks.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			uc.releaseChunks(ctx, user, chunkIDs)
+			return nil, nil, fmt.Errorf("failed to read file: %w", err)
+		}
+
+		ref := encryption.NewChunkRef(dedupKey, data)
+		chunkID := hex.EncodeToString(ref.ID)
+
+		isNew, err := uc.storeChunk(ctx, user, disk, chunkID, ref, data, suite, &folderReady)
+		if err != nil {
+			uc.releaseChunks(ctx, user, chunkIDs)
+			return nil, nil, err
+		}
+		if isNew {
+			stored++
+		} else {
+			reused++
+		}
+
+		chunkIDs = append(chunkIDs, chunkID)
+		manifest.Chunks = append(manifest.Chunks, ref)
+	}
+
+	slog.Debug("chunked upload", "user", user.ID, "new_chunks", stored, "reused_chunks", reused)
+	return manifest, chunkIDs, nil
+}
+
+// storeChunk берет ссылку на фрагмент, загружая его в облако, если его там
+// еще нет. Возвращает true для нового фрагмента.
+func (uc *storageUseCase) storeChunk(ctx context.Context, user *entity.User, disk *replicaSet, chunkID string, ref encryption.ChunkRef, data []byte, suite encryption.CipherSuite, folderReady *bool) (bool, error) {
+	chunkRefMu.Lock()
+	found, err := uc.chunkRepo.AddChunkRefs(ctx, user.ID, chunkID, 1)
+	chunkRefMu.Unlock()
+	if err != nil {
+		return false, fmt.Errorf("failed to update chunk: %w", err)
+	}
+	if found {
+		if err := uc.replicateChunk(ctx, user, disk, chunkID, ref, data, suite); err != nil {
+			uc.releaseChunks(ctx, user, []string{chunkID})
+			return false, err
+		}
+		return false, nil
+	}
+
+	if !*folderReady {
+		if err := disk.Mkdir(ctx, chunkDir); err != nil {
+			return false, fmt.Errorf("failed to create chunk directory: %w", err)
+		}
+		*folderReady = true
+	}
+
+	blob, err := encryption.SealChunk(suite, ref, data)
+	if err != nil {
+		return false, fmt.Errorf("failed to encrypt chunk: %w", err)
+	}
+
+	// Запись в БД появляется только после загрузки: фрагмент из БД всегда есть в облаке
+	results, err := disk.UploadReplicas(ctx, chunkPath(chunkID), bytes.NewReader(blob))
+	if err != nil {
+		return false, fmt.Errorf("failed to upload chunk to storage: %w", err)
+	}
+
+	chunkRefMu.Lock()
+	defer chunkRefMu.Unlock()
+
+	chunk := &entity.Chunk{UserID: user.ID, ChunkID: chunkID, Size: int64(len(blob)), RefCount: 1}
+	if err := uc.chunkRepo.CreateChunk(ctx, chunk); err != nil {
+		// Тот же фрагмент параллельно загрузил другой запрос
+		found, addErr := uc.chunkRepo.AddChunkRefs(ctx, user.ID, chunkID, 1)
+		if addErr != nil || !found {
+			return false, fmt.Errorf("failed to save chunk: %w", err)
+		}
+		// Недостающие копии допишет следующая загрузка фрагмента
+		if chunk, err = uc.chunkRepo.GetChunk(ctx, user.ID, chunkID); err != nil {
+			return true, nil
+		}
+	}
+
+	var backendIDs []uint
+	for _, r := range results {
+		if r.err == nil {
+			backendIDs = append(backendIDs, r.backendID)
+		}
+	}
+	uc.saveChunkReplicas(ctx, chunk, backendIDs)
+	return true, nil
+}
+
+// replicateChunk дописывает уже загруженный фрагмент в хранилища, где его
+// нет: подключенные после загрузки фрагмента или не принявшие его при
+// кворуме. Ошибка, если фрагмент лежит в меньшем числе хранилищ, чем
+// требует политика.
+func (uc *storageUseCase) replicateChunk(ctx context.Context, user *entity.User, disk *replicaSet, chunkID string, ref encryption.ChunkRef, data []byte, suite encryption.CipherSuite) error {
+	if uc.replicaRepo == nil {
+		return nil
+	}
+
+	chunk, err := uc.chunkRepo.GetChunk(ctx, user.ID, chunkID)
+	if err != nil {
+		return fmt.Errorf("failed to get chunk: %w", err)
+	}
+	records, err := uc.replicaRepo.GetChunkReplicas(ctx, chunk.ID)
+	if err != nil {
+		return fmt.Errorf("failed to list chunk replicas: %w", err)
+	}
+
+	recorded := make(map[uint]bool, len(records))
+	for _, record := range records {
+		recorded[record.BackendID] = true
+	}
+	stored := 0
+	missing := &replicaSet{Provider: disk.Provider}
+	for _, r := range disk.replicas {
+		if recorded[r.backendID] {
+			stored++
+		} else {
+			missing.replicas = append(missing.replicas, r)
+		}
+	}
+	if len(missing.replicas) == 0 {
+		return nil
+	}
+
+	// Фрагменты, загруженные до учета копий, уже лежат в хранилищах
+	var found []uint
+	var firstErr error
+	upload := &replicaSet{Provider: disk.Provider}
+	for _, r := range missing.each(func(disk *storage.Storage) error {
+		_, err := disk.Stat(ctx, chunkPath(chunkID))
+		return err
+	}) {
+		switch {
+		case r.err == nil:
+			found = append(found, r.backendID)
+		case errors.Is(r.err, storage.ErrNotFound):
+			upload.replicas = append(upload.replicas, r.replica)
+		default:
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			slog.Warn("chunk replica check failed", "chunk", chunkID, "backend", r.backendID, "provider", r.provider, "error", r.err)
+		}
+	}
+
+	if len(upload.replicas) > 0 {
+		blob, err := encryption.SealChunk(suite, ref, data)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt chunk: %w", err)
+		}
+		for _, r := range upload.each(func(disk *storage.Storage) error {
+			if err := disk.Mkdir(ctx, chunkDir); err != nil {
+				return err
+			}
+			return disk.Upload(ctx, chunkPath(chunkID), bytes.NewReader(blob))
+		}) {
+			if r.err != nil {
+				if firstErr == nil {
+					firstErr = r.err
+				}
+				slog.Warn("chunk replica upload failed", "chunk", chunkID, "backend", r.backendID, "provider", r.provider, "error", r.err)
+				continue
+			}
+			found = append(found, r.backendID)
+		}
+	}
+
+	uc.saveChunkReplicas(ctx, chunk, found)
+	if ok := stored + len(found); ok < disk.required {
+		return fmt.Errorf("chunk %s is stored in %d of %d storages, %d required: %w", chunkID, ok, len(disk.replicas), disk.required, firstErr)
+	}
+	return nil
+}
+
+// saveChunkReplicas запоминает, в каких хранилищах лежит фрагмент
+func (uc *storageUseCase) saveChunkReplicas(ctx context.Context, chunk *entity.Chunk, backendIDs []uint) {
+	if uc.replicaRepo == nil {
+		return
+	}
+	if err := uc.replicaRepo.AddChunkReplicas(ctx, chunk.ID, backendIDs); err != nil {
+		slog.Warn("failed to save chunk replicas", "chunk", chunk.ChunkID, "error", err)
+	}
+}
+
+// releaseChunks снимает ссылки на фрагменты и удаляет фрагменты без ссылок
+func (uc *storageUseCase) releaseChunks(ctx context.Context, user *entity.User, chunkIDs []string) {
+	if len(chunkIDs) == 0 {
+		return
+	}
+
+	// Без хранилища ссылки все равно снимаются, фрагменты остаются в облаке
+	disk, err := uc.userStorage(ctx, user)
+	if err != nil {
+		slog.Warn("storage is not available, chunks are kept", "user", user.ID, "error", err)
+	}
+
+	chunkRefMu.Lock()
+	defer chunkRefMu.Unlock()
+
+	for _, chunkID := range chunkIDs {
+		if _, err := uc.chunkRepo.AddChunkRefs(ctx, user.ID, chunkID, -1); err != nil {
+			slog.Warn("failed to release chunk", "chunk", chunkID, "user", user.ID, "error", err)
+			continue
+		}
+
+		chunk, err := uc.chunkRepo.GetChunk(ctx, user.ID, chunkID)
+		if err != nil || chunk.RefCount > 0 {
+			continue
+		}
+
+		deleted, err := uc.chunkRepo.DeleteUnusedChunk(ctx, chunk.ID)
+		if err != nil || !deleted || disk == nil {
+			continue
+		}
+		if err := disk.Delete(ctx, chunkPath(chunkID)); err != nil {
+			slog.Warn("failed to delete chunk", "chunk", chunkID, "user", user.ID, "error", err)
+		}
+	}
+}
+
+// releaseFileChunks снимает ссылки файла на фрагменты
+func (uc *storageUseCase) releaseFileChunks(ctx context.Context, user *entity.User, fileID uint) error {
+	refs, err := uc.chunkRepo.GetFileChunks(ctx, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to list file chunks: %w", err)
+	}
+
+	chunkIDs := make([]string, len(refs))
+	for i, ref := range refs {
+		chunkIDs[i] = ref.ChunkID
+	}
+	uc.releaseChunks(ctx, user, chunkIDs)
+
+	return uc.chunkRepo.SetFileChunks(ctx, fileID, nil)
+}
+
+// replaceFileChunks записывает ссылки файла на фрагменты и снимает
+// ссылки прежней версии файла. Новые ссылки взяты раньше, поэтому
+// фрагменты, общие для обеих версий, не удаляются.
+func (uc *storageUseCase) replaceFileChunks(ctx context.Context, user *entity.User, fileID uint, chunkIDs []string, hadChunks bool) error {
+	if uc.chunkRepo == nil || (len(chunkIDs) == 0 && !hadChunks) {
+		return nil
+	}
+
+	var old []*entity.FileChunk
+	if hadChunks {
+		var err error
+		if old, err = uc.chunkRepo.GetFileChunks(ctx, fileID); err != nil {
+			return fmt.Errorf("failed to list file chunks: %w", err)
+		}
+	}
+
+	if err := uc.chunkRepo.SetFileChunks(ctx, fileID, chunkIDs); err != nil {
+		uc.releaseChunks(ctx, user, chunkIDs)
+		return fmt.Errorf("failed to save file chunks: %w", err)
+	}
+
+	oldIDs := make([]string, len(old))
+	for i, ref := range old {
+		oldIDs[i] = ref.ChunkID
+	}
+	uc.releaseChunks(ctx, user, oldIDs)
+	return nil
+}
+
+// openChunked читает расшифрованный манифест и возвращает содержимое файла,
+// собранное из фрагментов хранилища disk
+func (uc *storageUseCase) openChunked(ctx context.Context, disk *replicaSet, manifestReader io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(io.LimitReader(manifestReader, maxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxManifestSize {
+		return nil, encryption.ErrInvalidManifest
+	}
+
+	manifest, err := encryption.ParseManifest(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &chunkedReader{ctx: ctx, disk: disk, chunks: manifest.Chunks}, nil
+}
+
+// chunkedReader скачивает и расшифровывает фрагменты по мере чтения
+type chunkedReader struct {
+	ctx     context.Context
+	disk    *replicaSet
+	chunks  []encryption.ChunkRef
+	current []byte
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+
+		data, err := r.fetch(r.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		r.current, r.chunks = data, r.chunks[1:]
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// fetch скачивает фрагмент из первого хранилища, где он доступен и цел
+func (r *chunkedReader) fetch(ref encryption.ChunkRef) ([]byte, error) {
+	chunkID := hex.EncodeToString(ref.ID)
+
+	var firstErr error
+	for _, replica := range r.disk.replicas {
+		if replica.err != nil {
+			continue
+		}
+
+		data, err := fetchChunk(r.ctx, replica.disk, chunkID, ref)
+		if err == nil {
+			return data, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+func fetchChunk(ctx context.Context, disk *storage.Storage, chunkID string, ref encryption.ChunkRef) ([]byte, error) {
+	blob, err := disk.Download(ctx, chunkPath(chunkID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download chunk %s: %w", chunkID, err)
+	}
+	defer blob.Close()
+
+	// Зашифрованный фрагмент длиннее открытого только на заголовок и тег
+	data, err := io.ReadAll(io.LimitReader(blob, int64(ref.Size)+1024))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download chunk %s: %w", chunkID, err)
+	}
+	return encryption.OpenChunk(ref, data)
+}
+
+// chunkPath возвращает путь фрагмента в облаке
+func chunkPath(chunkID string) string {
+	return chunkDir + "/" + chunkID
+}
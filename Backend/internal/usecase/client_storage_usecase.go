@@ -0,0 +1,333 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"server/internal/entity"
+	"server/pkg/encryption"
+	"server/pkg/storage"
+)
+
+// Шифрование на клиенте.
+//
+// Клиент (см. pkg/client) сам открывает ключ пользователя слотом пароля из
+// копии слотов, шифрует содержимое и имена файлов в формате pkg/encryption и
+// передает серверу готовые шифротексты. Сервер не получает ни мастер-пароля,
+// ни открытых данных: он проверяет заголовок файла, пересылает шифротекст в
+// облако и сохраняет метаданные. Открытыми остаются только пути каталогов,
+// как и при шифровании на сервере. Файлы обоих режимов совместимы: файл,
+// зашифрованный клиентом, расшифровывается сервером по мастер-паролю и
+// наоборот (если он в формате ключа пользователя из слотов).
+
+var (
+	ErrPassphraseAlreadySet = errors.New("encryption passphrase is already set up")
+	ErrInvalidEncryptedFile = errors.New("encrypted file does not match the expected format")
+	ErrDuplicateFileID      = errors.New("file id is already used by another file")
+)
+
+// GetKeyring возвращает слоты ключа пользователя. Секретов в них нет: ключ
+// пользователя открывается на клиенте паролем.
+func (uc *storageUseCase) GetKeyring(ctx context.Context, userID uint) (*encryption.Keyring, error) {
+	user, err := uc.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	// Ключи в слотах появляются после первой загрузки или проверки пароля
+	if len(user.MasterKeyID) == 0 {
+		return nil, ErrPassphraseNotSet
+	}
+
+	keyring, err := uc.userKeyring(ctx, user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list key slots: %w", err)
+	}
+	return keyring, nil
+}
+
+// SetupClientKeyring сохраняет ключ пользователя, созданный на клиенте, в
+// слоте пароля, который клиент обернул сам. Доступно только пользователям,
+// которые еще не задали парольную фразу шифрования.
+func (uc *storageUseCase) SetupClientKeyring(ctx context.Context, userID uint, masterKeyID []byte, slot *encryption.KeyringSlot) (*encryption.Keyring, error) {
+	if err := uc.encryption.ValidatePasswordSlot(masterKeyID, slot); err != nil {
+		return nil, err
+	}
+
+	keySlotSetupMu.Lock()
+	defer keySlotSetupMu.Unlock()
+
+	user, err := uc.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+	if user.HasPassphrase() {
+		return nil, ErrPassphraseAlreadySet
+	}
+
+	if err := uc.slotRepo.CreateKeySlot(ctx, &entity.KeySlot{
+		UserID:     user.ID,
+		Type:       entity.KeySlotPassword,
+		KDF:        slot.KDF,
+		KDFParams:  slot.KDFParams,
+		Salt:       slot.Salt,
+		WrappedKey: slot.WrappedKey,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to save key slot: %w", err)
+	}
+
+	user.MasterKeyID = masterKeyID
+	if err := uc.userRepo.UpdateUser(ctx, user); err != nil {
+		return nil, fmt.Errorf("failed to save key slots: %w", err)
+	}
+
+	uc.syncKeyring(ctx, user)
+	return uc.userKeyring(ctx, user)
+}
+
+// CreateEncryptedDirectory создает каталог path под именем, зашифрованным
+// клиентом. Родительский каталог должен существовать. Повторный вызов для
+// существующего каталога возвращает его.
+func (uc *storageUseCase) CreateEncryptedDirectory(ctx context.Context, userID uint, path, encryptedName string) (*entity.Directory, error) {
+	user, err := uc.clientUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	path = normalizeDir(path)
+	if path == "/" || strings.Contains(path, "/../") || strings.HasSuffix(path, "/..") {
+		return nil, errors.New("invalid path")
+	}
+	if err := checkEncryptedName(encryptedName); err != nil {
+		return nil, err
+	}
+
+	if dir, err := uc.dirRepo.GetDirectoryByPath(ctx, userID, path); err == nil {
+		return dir, nil
+	}
+
+	parent := path[:strings.LastIndex(path, "/")]
+	providerParent, err := uc.clientDirectory(ctx, userID, normalizeDir(parent))
+	if err != nil {
+		return nil, err
+	}
+
+	return uc.createDirectory(ctx, user, path, providerParent, func() (string, error) {
+		return encryptedName, nil
+	})
+}
+
+// UploadEncryptedFile пересылает в облако файл, зашифрованный клиентом.
+// Файл должен быть в текущем формате, зашифрован ключом пользователя из
+// слотов и привязан к пользователю и идентификатору fileID: иначе его не
+// расшифрует ни сервер, ни другой клиент.
+func (uc *storageUseCase) UploadEncryptedFile(ctx context.Context, userID uint, path, fileID, encryptedName string, content io.Reader) (*entity.FileMetadata, error) {
+	user, err := uc.clientUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !validFileUUID(fileID) {
+		return nil, errors.New("invalid file id")
+	}
+	if err := checkEncryptedName(encryptedName); err != nil {
+		return nil, err
+	}
+
+	dir := normalizeDir(path)
+	providerDir, err := uc.clientDirectory(ctx, userID, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Заголовок проверяем до обращения к облаку
+	header, headerBytes, err := encryption.ReadHeader(content)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEncryptedFile, err)
+	}
+	if err := checkClientHeader(header, user, fileID); err != nil {
+		return nil, err
+	}
+
+	fullPath := dirPrefix(providerDir) + encryptedName
+
+	// Идентификатор выбирает клиент, поэтому он должен быть уникален среди
+	// файлов пользователя: повторно его можно передать только при перезаписи
+	// того же файла
+	existing, err := uc.fileRepo.GetFileByUUID(ctx, userID, fileID)
+	if err == nil && existing.Path != fullPath {
+		return nil, ErrDuplicateFileID
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to check file id: %w", err)
+	}
+
+	counter := &countingWriter{w: io.Discard}
+	blob := io.TeeReader(io.MultiReader(bytes.NewReader(headerBytes), content), counter)
+	disk, err := uc.userStorage(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	replicas, err := disk.UploadReplicas(ctx, fullPath, blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload file to storage: %w", err)
+	}
+
+	// Детерминированное имя совпадает с именем уже загруженного файла -
+	// файл в облаке перезаписан, обновляем его запись
+	fileMetadata, err := uc.fileRepo.GetFileByPath(ctx, userID, fullPath)
+	if err != nil || fileMetadata.Type == "dir" {
+		fileMetadata = &entity.FileMetadata{UserID: userID, Path: fullPath, Type: "file"}
+	}
+
+	// Файл из фрагментов перезаписан файлом клиента: ссылки на фрагменты снимаются
+	hadChunks := fileMetadata.Chunked
+	fileMetadata.Chunked = false
+	fileMetadata.UUID = fileID
+	fileMetadata.Filename = "encrypted_file"
+	fileMetadata.EncryptedName = encryptedName
+	fileMetadata.Dir = dirPrefix(dir)
+	fileMetadata.Size = counter.n
+	fileMetadata.MimeType = "application/octet-stream"
+	fileMetadata.IsEncrypted = true
+	fileMetadata.ClientEncrypted = true
+	fileMetadata.WrappedKey = header.WrappedKey
+	fileMetadata.KDF = header.KDF
+
+	if fileMetadata.ID != 0 {
+		err = uc.fileRepo.UpdateFileMetadata(ctx, fileMetadata)
+	} else {
+		err = uc.fileRepo.CreateFileMetadata(ctx, fileMetadata)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save file metadata: %w", err)
+	}
+	uc.saveReplicas(ctx, fileMetadata.ID, replicas)
+	if err := uc.replaceFileChunks(ctx, user, fileMetadata.ID, nil, hadChunks); err != nil {
+		return nil, err
+	}
+
+	return fileMetadata, nil
+}
+
+// DownloadEncryptedFile возвращает шифротекст файла из облака без
+// расшифровки и метаданные, нужные клиенту для проверки привязки
+func (uc *storageUseCase) DownloadEncryptedFile(ctx context.Context, userID uint, fileID uint) (io.ReadCloser, *entity.FileMetadata, error) {
+	fileMetadata, err := uc.fileRepo.GetFileMetadataByID(ctx, fileID)
+	if err != nil {
+		return nil, nil, errors.New("file not found")
+	}
+
+	if fileMetadata.UserID != userID {
+		return nil, nil, errors.New("access denied")
+	}
+	if fileMetadata.Type == "dir" {
+		return nil, nil, errors.New("not a file")
+	}
+
+	user, err := uc.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, nil, errors.New("user not found")
+	}
+
+	disk, err := uc.userStorage(ctx, user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Шифротекст сервер не проверяет - отдаем первую доступную копию
+	reader, _, err := uc.openFile(ctx, disk, fileMetadata, func(body io.Reader) (io.Reader, error) {
+		return body, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return reader, fileMetadata, nil
+}
+
+// clientUser возвращает пользователя, которому доступно шифрование на
+// клиенте: облако подключено и ключ пользователя хранится в слотах
+func (uc *storageUseCase) clientUser(ctx context.Context, userID uint) (*entity.User, error) {
+	user, err := uc.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	if user.StorageCredentials == "" {
+		return nil, storage.ErrNotConnected
+	}
+	if len(user.MasterKeyID) == 0 {
+		return nil, ErrPassphraseNotSet
+	}
+
+	return user, nil
+}
+
+// clientDirectory возвращает путь в облаке существующего каталога. Каталоги
+// клиент создает сам (CreateEncryptedDirectory): имя для нового каталога
+// сервер зашифровать не может.
+func (uc *storageUseCase) clientDirectory(ctx context.Context, userID uint, dir string) (string, error) {
+	if dir == "/" {
+		return dir, nil
+	}
+
+	directory, err := uc.dirRepo.GetDirectoryByPath(ctx, userID, dir)
+	if err != nil {
+		return "", fmt.Errorf("directory %s does not exist", dir)
+	}
+	return directory.EncryptedPath, nil
+}
+
+// checkClientHeader проверяет, что файл зашифрован ключом пользователя из
+// слотов и привязан к пользователю и файлу fileID
+func checkClientHeader(h *encryption.Header, user *entity.User, fileID string) error {
+	switch {
+	case h.Version < encryption.FormatVersion7:
+		return fmt.Errorf("%w: format version %d is not supported", ErrInvalidEncryptedFile, h.Version)
+	case h.KDF != encryption.KDFMasterKey || !bytes.Equal(h.KDFParams, user.MasterKeyID):
+		return fmt.Errorf("%w: file key is not wrapped by the user key", ErrInvalidEncryptedFile)
+	case h.Flags&encryption.FlagBound == 0 || h.Context == nil:
+		return fmt.Errorf("%w: file is not bound to its id", ErrInvalidEncryptedFile)
+	case h.Context.UserID != uint64(user.ID) || h.Context.FileID != fileID:
+		return fmt.Errorf("%w: file is bound to another user or file id", ErrInvalidEncryptedFile)
+	}
+	return nil
+}
+
+// checkEncryptedName проверяет, что имя похоже на результат EncryptFilename
+// и не выходит за пределы каталога
+func checkEncryptedName(name string) error {
+	data := strings.TrimSuffix(name, ".encrypted")
+	if data == name || data == "" || len(name) > 255 || strings.ContainsAny(data, "/\\.") {
+		return errors.New("invalid encrypted name")
+	}
+	return nil
+}
+
+// validFileUUID проверяет запись UUID вида xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx
+// в нижнем регистре (как у newFileUUID)
+func validFileUUID(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i, c := range id {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"gorm.io/gorm"
+
+	"server/internal/entity"
+	"server/internal/repository"
+	"server/pkg/encryption"
+	"server/pkg/storage"
+)
+
+type testUserRepository struct {
+	repository.UserRepository
+	user *entity.User
+}
+
+func (r *testUserRepository) GetUserByID(ctx context.Context, id uint) (*entity.User, error) {
+	if r.user == nil || r.user.ID != id {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return r.user, nil
+}
+
+// testFileRepository хранит метаданные файлов в памяти
+type testFileRepository struct {
+	repository.FileMetadataRepository
+	files []*entity.FileMetadata
+}
+
+func (r *testFileRepository) CreateFileMetadata(ctx context.Context, file *entity.FileMetadata) error {
+	file.ID = uint(len(r.files) + 1)
+	r.files = append(r.files, file)
+	return nil
+}
+
+func (r *testFileRepository) UpdateFileMetadata(ctx context.Context, file *entity.FileMetadata) error {
+	for i, f := range r.files {
+		if f.ID == file.ID {
+			r.files[i] = file
+			return nil
+		}
+	}
+	return gorm.ErrRecordNotFound
+}
+
+func (r *testFileRepository) GetFileMetadataByID(ctx context.Context, id uint) (*entity.FileMetadata, error) {
+	for _, f := range r.files {
+		if f.ID == id {
+			return f, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *testFileRepository) GetFileByPath(ctx context.Context, userID uint, path string) (*entity.FileMetadata, error) {
+	for _, f := range r.files {
+		if f.UserID == userID && f.Path == path {
+			return f, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *testFileRepository) GetFileByUUID(ctx context.Context, userID uint, uuid string) (*entity.FileMetadata, error) {
+	for _, f := range r.files {
+		if f.UserID == userID && f.UUID == uuid {
+			return f, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func TestUploadEncryptedFileReplacesChunkedFile(t *testing.T) {
+	ctx := context.Background()
+	enc, err := encryption.NewEncryptionService(encryption.Config{Argon2: encryption.DefaultArgon2Params})
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterKey, err := encryption.NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disk := newMemoryStorage()
+	providers := storage.NewRegistry("memory")
+	providers.Register("memory", disk)
+
+	const fileID = "0f8fad5b-d9cb-469f-a165-70867728950e"
+	const encryptedName = "bmFtZQ.encrypted"
+	user := &entity.User{ID: 1, StorageProvider: "memory", StorageCredentials: "user-1", MasterKeyID: encryption.MasterKeyID(masterKey)}
+
+	// Файл из фрагментов по тому же пути, что и у файла клиента
+	chunkID := "00ff"
+	disk.files[chunkPath(chunkID)] = []byte("chunk")
+	files := &testFileRepository{}
+	chunked := &entity.FileMetadata{UserID: user.ID, UUID: fileID, Path: "/" + encryptedName, Type: "file", Chunked: true}
+	files.CreateFileMetadata(ctx, chunked)
+	chunks := &testChunkRepository{
+		chunk:      &entity.Chunk{ID: 3, UserID: user.ID, ChunkID: chunkID, RefCount: 1},
+		fileChunks: map[uint][]string{chunked.ID: {chunkID}},
+	}
+
+	uc := &storageUseCase{
+		fileRepo:   files,
+		userRepo:   &testUserRepository{user: user},
+		chunkRepo:  chunks,
+		providers:  providers,
+		encryption: enc,
+	}
+
+	var blob bytes.Buffer
+	w, _, err := enc.NewEnvelopeWriter(&blob, masterKey, encryption.MasterKeyDerivation(masterKey), encryption.WriteOptions{
+		Context: &encryption.FileContext{UserID: uint64(user.ID), FileID: fileID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("client data"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := uc.UploadEncryptedFile(ctx, user.ID, "/", fileID, encryptedName, bytes.NewReader(blob.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.ID != chunked.ID || file.Chunked || !file.ClientEncrypted {
+		t.Errorf("got id %d, chunked %v, client encrypted %v", file.ID, file.Chunked, file.ClientEncrypted)
+	}
+	if refs := chunks.fileChunks[file.ID]; len(refs) != 0 {
+		t.Errorf("file still references chunks %v", refs)
+	}
+	if chunks.chunk != nil {
+		t.Error("unused chunk is kept in the database")
+	}
+	if disk.has(chunkPath(chunkID)) {
+		t.Error("unused chunk is kept in the storage")
+	}
+	if !bytes.Equal(disk.files[file.Path], blob.Bytes()) {
+		t.Error("client blob is not stored")
+	}
+}
@@ -2,22 +2,27 @@ package usecase
 
 import (
 	"context"
-	"mime/multipart"
+	"io"
+	"time"
 	
 	"server/internal/entity"
+	"server/pkg/encryption"
+	"server/pkg/storage"
 )
 
 // AuthUseCase определяет контракт для аутентификации
 type AuthUseCase interface {
 	Register(ctx context.Context, email, password string) error
 	Login(ctx context.Context, email, password string) (string, error)
-	ValidateToken(ctx context.Context, token string) (uint, error)
+	// ValidateToken возвращает пользователя и идентификатор сессии токена
+	ValidateToken(ctx context.Context, token string) (uint, string, error)
 }
 
 // UserUseCase определяет контракт для работы с пользователями
 type UserUseCase interface {
 	GetUser(ctx context.Context, id uint) (*entity.User, error)
 	UpdateUser(ctx context.Context, user *entity.User) error
+	UpdateEncryptionSettings(ctx context.Context, userID uint, settings EncryptionSettings) error
 }
 
 // StorageUseCase определяет контракт для работы с облачным хранилищем
@@ -27,8 +32,71 @@ type StorageUseCase interface {
 	GetFiles(ctx context.Context, userID uint, path string) ([]*entity.FileMetadata, error)
 	GetFileInfo(ctx context.Context, userID uint, fileID uint) (*entity.FileMetadata, error)
 	GetDecryptedFilename(ctx context.Context, userID uint, fileID uint, masterPassword string) (string, error)
-	UploadFile(ctx context.Context, userID uint, fileHeader *multipart.FileHeader, masterPassword, path string) (*entity.FileMetadata, error)
-	DownloadFile(ctx context.Context, userID uint, fileID uint, masterPassword string) ([]byte, string, error)
+	UploadFile(ctx context.Context, userID uint, filename, contentType string, content io.Reader, masterPassword, path, compression string, chunked bool) (*entity.FileMetadata, error)
+	DownloadFile(ctx context.Context, userID uint, fileID uint, masterPassword string) (io.ReadCloser, string, error)
+	// VerifyMasterPassword проверяет мастер-пароль без обращения к облаку
+	VerifyMasterPassword(ctx context.Context, userID uint, masterPassword string) error
 	DeleteFile(ctx context.Context, userID uint, fileID uint) error
 	GetYandexToken(ctx context.Context, userID uint) (string, error)
-}
\ No newline at end of file
+	// GetQuota возвращает имя провайдера хранилища и занятое место
+	GetQuota(ctx context.Context, userID uint) (string, *storage.Quota, error)
+	// ConnectStorage подключает хранилище без OAuth по учетным данным
+	ConnectStorage(ctx context.Context, userID uint, provider, credentials string) error
+
+	// Репликация: дополнительные хранилища и политика записи копий
+	GetReplication(ctx context.Context, userID uint) (*ReplicationSettings, error)
+	AttachStorage(ctx context.Context, userID uint, provider, credentials string) (*entity.StorageBackend, error)
+	DetachStorage(ctx context.Context, userID uint, backendID uint) error
+	SetReplicationPolicy(ctx context.Context, userID uint, policy string, minReplicas int) error
+
+	// Шифрование на клиенте: сервер принимает и отдает только шифротексты
+	GetKeyring(ctx context.Context, userID uint) (*encryption.Keyring, error)
+	SetupClientKeyring(ctx context.Context, userID uint, masterKeyID []byte, slot *encryption.KeyringSlot) (*encryption.Keyring, error)
+	CreateEncryptedDirectory(ctx context.Context, userID uint, path, encryptedName string) (*entity.Directory, error)
+	UploadEncryptedFile(ctx context.Context, userID uint, path, fileID, encryptedName string, content io.Reader) (*entity.FileMetadata, error)
+	DownloadEncryptedFile(ctx context.Context, userID uint, fileID uint) (io.ReadCloser, *entity.FileMetadata, error)
+}
+
+// KeyRotationUseCase определяет контракт для смены паролей и ключей файлов
+type KeyRotationUseCase interface {
+	ChangeMasterPassword(ctx context.Context, userID uint, oldPassword, newPassword string) (*entity.KeyRotation, error)
+	// ChangeLoginPassword меняет пароль входа, не затрагивая мастер-пароль
+	ChangeLoginPassword(ctx context.Context, userID uint, oldPassword, newPassword string) error
+	GetKeyRotation(ctx context.Context, userID uint) (*entity.KeyRotation, error)
+	ResumeKeyRotation(ctx context.Context, userID uint, oldPassword, newPassword string) (*entity.KeyRotation, error)
+	// RecoverMasterPassword задает новый мастер-пароль по ключу восстановления
+	RecoverMasterPassword(ctx context.Context, email, recoveryKey, newPassword string) (*entity.KeyRotation, error)
+	// UpgradeKeys перешифровывает в фоне ключи, выведенные устаревшей функцией
+	// вывода ключа: все ключи пользователя или только указанный файл
+	UpgradeKeys(ctx context.Context, userID uint, masterPassword string, fileID uint) error
+}
+
+// KeySlotUseCase определяет контракт для работы со слотами ключей пользователя
+type KeySlotUseCase interface {
+	GetKeySlots(ctx context.Context, userID uint) ([]*entity.KeySlot, error)
+	// AddRecoveryKey создает ключ восстановления; он возвращается один раз и не хранится
+	AddRecoveryKey(ctx context.Context, userID uint, masterPassword, label string) (string, *entity.KeySlot, error)
+	AddEscrowKey(ctx context.Context, userID uint, masterPassword string) (*entity.KeySlot, error)
+	RemoveKeySlot(ctx context.Context, userID uint, slotID uint, masterPassword string) error
+}
+
+// ShareUseCase определяет контракт для обмена файлами между пользователями
+type ShareUseCase interface {
+	// ShareFile открывает получателю доступ к файлу; мастер-пароль - владельца
+	ShareFile(ctx context.Context, ownerID uint, fileID uint, recipientEmail, masterPassword string) (*entity.FileShare, error)
+	GetShares(ctx context.Context, userID uint) ([]*entity.FileShare, error)
+	// AcceptShare и DownloadSharedFile принимают мастер-пароль получателя
+	AcceptShare(ctx context.Context, userID uint, shareID uint, masterPassword string) (*entity.FileShare, error)
+	RevokeShare(ctx context.Context, userID uint, shareID uint) error
+	DownloadSharedFile(ctx context.Context, userID uint, shareID uint, masterPassword string) (io.ReadCloser, string, error)
+}
+
+// SessionUseCase определяет контракт для разблокировки ключей на время сессии
+type SessionUseCase interface {
+	// Unlock открывает ключи мастер-паролем и возвращает секрет сессии
+	// для заголовка X-Session-Key и время простоя до блокировки
+	Unlock(ctx context.Context, userID uint, sessionID, masterPassword string) (string, time.Duration, error)
+	Lock(ctx context.Context, userID uint, sessionID string) error
+	// Resume возвращает контекст с ключами сессии
+	Resume(ctx context.Context, userID uint, sessionID, sessionKey string) (context.Context, error)
+}
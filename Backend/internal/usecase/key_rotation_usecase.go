@@ -0,0 +1,859 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"server/internal/entity"
+	"server/internal/repository"
+	"server/pkg/encryption"
+	"server/pkg/ratelimit"
+	"server/pkg/storage"
+)
+
+// ErrFileRotationPending - файл еще не переведен на новый ключ
+var ErrFileRotationPending = errors.New("file is not re-encrypted with the new master password yet, try again later")
+
+type keyRotationUseCase struct {
+	storage      *storageUseCase
+	rotationRepo repository.KeyRotationRepository
+
+	// Попытки восстановления по аккаунту: каждая стоит вывода ключа Argon2id
+	recoverLimiter *ratelimit.Limiter
+
+	mu      sync.Mutex
+	running map[uint]bool // Пользователи, для которых задание уже выполняется
+}
+
+const (
+	recoverAttempts = 5
+	recoverWindow   = time.Hour
+)
+
+func NewKeyRotationUseCase(
+	fileRepo repository.FileMetadataRepository,
+	userRepo repository.UserRepository,
+	dirRepo repository.DirectoryRepository,
+	slotRepo repository.KeySlotRepository,
+	rotationRepo repository.KeyRotationRepository,
+	replicaRepo repository.ReplicaRepository,
+	providers *storage.Registry,
+	encryptionService *encryption.EncryptionService,
+) KeyRotationUseCase {
+	return &keyRotationUseCase{
+		storage: &storageUseCase{
+			fileRepo:    fileRepo,
+			userRepo:    userRepo,
+			dirRepo:     dirRepo,
+			slotRepo:    slotRepo,
+			replicaRepo: replicaRepo,
+			providers:   providers,
+			encryption:  encryptionService,
+		},
+		rotationRepo:   rotationRepo,
+		recoverLimiter: ratelimit.New(recoverAttempts, recoverWindow),
+		running:        make(map[uint]bool),
+	}
+}
+
+func (uc *keyRotationUseCase) ChangeMasterPassword(ctx context.Context, userID uint, oldPassword, newPassword string) (*entity.KeyRotation, error) {
+	user, err := uc.storage.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	if oldPassword == newPassword {
+		return nil, errors.New("new password must differ from the old one")
+	}
+
+	kek, _, err := uc.storage.userKEK(ctx, user, oldPassword)
+	if errors.Is(err, ErrInvalidMasterPassword) {
+		return nil, errors.New("invalid old password")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Мастер-пароль меняется отдельно от пароля входа: после смены у
+	// аккаунта с общим паролем пароли становятся разными
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(newPassword)) == nil {
+		return nil, ErrPassphraseSameAsLogin
+	}
+
+	latest, err := uc.rotationRepo.GetLatestRotation(ctx, userID)
+	if err == nil && (latest.Status == entity.KeyRotationRunning || latest.Status == entity.KeyRotationFailed) {
+		return nil, errors.New("previous key rotation is not finished, resume it first")
+	}
+
+	files, err := uc.storage.fileRepo.GetUserFiles(ctx, userID, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list user files: %w", err)
+	}
+
+	items := rotationItems(files)
+
+	// Со слотами ключей ключ пользователя не меняется: достаточно обернуть
+	// его новым паролем, а задание перешифрует только имена и файлы старых
+	// форматов, ключи которых выводятся из пароля
+	user.SeparatePassphrase = true
+	if len(user.MasterKeyID) > 0 {
+		rotation := &entity.KeyRotation{
+			UserID: userID,
+			Status: entity.KeyRotationRunning,
+			Total:  len(items),
+		}
+		return uc.startWithPasswordSlot(ctx, user, rotation, items, kek, oldPassword, newPassword, "")
+	}
+
+	keyDerivation, err := uc.storage.encryption.NewKeyDerivation()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key parameters: %w", err)
+	}
+
+	newKEK, err := uc.storage.encryption.DeriveKEK(newPassword, keyDerivation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	// Контрольное значение старого ключа нужно только, чтобы проверить
+	// старый пароль при продолжении прерванного задания
+	rotation := &entity.KeyRotation{
+		UserID:          userID,
+		Status:          entity.KeyRotationRunning,
+		Total:           len(items),
+		OldKeyCheck:     user.KeyCheck,
+		OldKeyKDF:       user.KeyKDF,
+		OldKeyKDFParams: user.KeyKDFParams,
+		OldKeySalt:      user.KeySalt,
+	}
+
+	if err := uc.rotationRepo.CreateRotation(ctx, rotation, items); err != nil {
+		return nil, fmt.Errorf("failed to create key rotation: %w", err)
+	}
+
+	user.KeyKDF = keyDerivation.KDF
+	user.KeyKDFParams = keyDerivation.Params
+	user.KeySalt = keyDerivation.Salt
+	user.KeyCheck = encryption.NewKeyCheck(newKEK)
+
+	if err := uc.storage.userRepo.UpdateUser(ctx, user); err != nil {
+		rotation.Status = entity.KeyRotationAborted
+		uc.rotationRepo.UpdateRotation(ctx, rotation)
+		return nil, fmt.Errorf("failed to update password: %w", err)
+	}
+
+	// Задание изменяет rotation в фоне, наружу отдаем копию
+	snapshot := *rotation
+	uc.start(rotation, oldPassword, newPassword)
+	return &snapshot, nil
+}
+
+// ChangeLoginPassword меняет пароль входа. У аккаунта с общим паролем
+// старый пароль остается мастер-паролем: до смены хэша ключ пользователя
+// переводится на слоты, чтобы мастер-пароль проверялся без хэша входа.
+func (uc *keyRotationUseCase) ChangeLoginPassword(ctx context.Context, userID uint, oldPassword, newPassword string) error {
+	user, err := uc.storage.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return errors.New("user not found")
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(oldPassword)); err != nil {
+		return errors.New("invalid old password")
+	}
+
+	if oldPassword == newPassword {
+		return errors.New("new password must differ from the old one")
+	}
+
+	if user.SeparatePassphrase {
+		if _, _, err := uc.storage.userKEK(ctx, user, newPassword); err == nil {
+			return ErrPassphraseSameAsLogin
+		}
+	} else if _, _, err := uc.storage.userKEK(ctx, user, oldPassword); err != nil {
+		return fmt.Errorf("failed to keep encryption passphrase: %w", err)
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	user.Password = string(hashedPassword)
+	user.SeparatePassphrase = true
+	if err := uc.storage.userRepo.UpdateUser(ctx, user); err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	return nil
+}
+
+// RecoverMasterPassword открывает ключ пользователя ключом восстановления и
+// оборачивает его новым мастер-паролем. Старый пароль неизвестен, поэтому
+// имена старых форматов перешифровываются из открытых имен в БД, а файлы
+// старых форматов без ключа файла восстановить нельзя - они отмечаются ошибкой.
+func (uc *keyRotationUseCase) RecoverMasterPassword(ctx context.Context, email, recoveryKey, newPassword string) (*entity.KeyRotation, error) {
+	user, err := uc.storage.userRepo.GetUserByEmail(ctx, email)
+	if err != nil || len(user.MasterKeyID) == 0 {
+		return nil, ErrInvalidRecoveryKey
+	}
+
+	// Дешевые проверки идут до вывода ключа: формат ключа, наличие слота
+	// восстановления и лимит попыток по аккаунту
+	normalized, err := encryption.NormalizeRecoveryKey(recoveryKey)
+	if err != nil {
+		return nil, ErrInvalidRecoveryKey
+	}
+
+	slots, err := uc.storage.slotRepo.GetKeySlots(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list key slots: %w", err)
+	}
+	if countSlots(slots, entity.KeySlotRecovery) == 0 {
+		return nil, ErrInvalidRecoveryKey
+	}
+
+	if !uc.recoverLimiter.Allow(fmt.Sprint(user.ID)) {
+		return nil, ErrTooManyAttempts
+	}
+
+	// Незавершенное задание без старого пароля не продолжить - начинаем
+	// новое по всем файлам
+	latest, latestErr := uc.rotationRepo.GetLatestRotation(ctx, user.ID)
+	if latestErr == nil && latest.Status == entity.KeyRotationRunning && uc.isRunning(user.ID) {
+		return nil, errors.New("key rotation is already running")
+	}
+
+	kek, err := uc.storage.unlockKeySlot(ctx, user, entity.KeySlotRecovery, normalized)
+	if err != nil {
+		return nil, err
+	}
+
+	if latestErr == nil && (latest.Status == entity.KeyRotationRunning || latest.Status == entity.KeyRotationFailed) {
+		latest.Status = entity.KeyRotationAborted
+		if err := uc.rotationRepo.UpdateRotation(ctx, latest); err != nil {
+			return nil, fmt.Errorf("failed to abort key rotation: %w", err)
+		}
+	}
+
+	files, err := uc.storage.fileRepo.GetUserFiles(ctx, user.ID, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list user files: %w", err)
+	}
+	items := rotationItems(files)
+
+	// У аккаунта с общим паролем вместе с мастер-паролем восстанавливается
+	// и пароль входа
+	var hashedPassword []byte
+	if !user.SeparatePassphrase {
+		if hashedPassword, err = bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost); err != nil {
+			return nil, err
+		}
+	} else if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(newPassword)) == nil {
+		return nil, ErrPassphraseSameAsLogin
+	}
+
+	rotation := &entity.KeyRotation{
+		UserID: user.ID,
+		Status: entity.KeyRotationRunning,
+		Total:  len(items),
+	}
+	return uc.startWithPasswordSlot(ctx, user, rotation, items, kek, "", newPassword, string(hashedPassword))
+}
+
+// startWithPasswordSlot оборачивает ключ пользователя kek новым паролем
+// и запускает задание, перешифровывающее файлы и имена старых форматов. Непустой
+// hashedPassword заменяет хэш пароля входа.
+func (uc *keyRotationUseCase) startWithPasswordSlot(ctx context.Context, user *entity.User, rotation *entity.KeyRotation, items []*entity.KeyRotationItem, kek []byte, oldPassword, newPassword, hashedPassword string) (*entity.KeyRotation, error) {
+	if err := uc.rotationRepo.CreateRotation(ctx, rotation, items); err != nil {
+		return nil, fmt.Errorf("failed to create key rotation: %w", err)
+	}
+
+	if err := uc.storage.setPasswordSlot(ctx, user, newPassword, kek); err != nil {
+		rotation.Status = entity.KeyRotationAborted
+		uc.rotationRepo.UpdateRotation(ctx, rotation)
+		return nil, err
+	}
+
+	if hashedPassword != "" {
+		user.Password = hashedPassword
+	}
+	if err := uc.storage.userRepo.UpdateUser(ctx, user); err != nil {
+		rotation.Status = entity.KeyRotationAborted
+		uc.rotationRepo.UpdateRotation(ctx, rotation)
+		return nil, fmt.Errorf("failed to update password: %w", err)
+	}
+
+	snapshot := *rotation
+	uc.start(rotation, oldPassword, newPassword)
+	return &snapshot, nil
+}
+
+func (uc *keyRotationUseCase) UpgradeKeys(ctx context.Context, userID uint, masterPassword string, fileID uint) error {
+	user, err := uc.storage.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return errors.New("user not found")
+	}
+
+	// Файл мог быть зашифрован другим паролем - перевыпускать ключи
+	// пользователя можно только по его мастер-паролю
+	if _, _, err := uc.storage.userKEK(ctx, user, masterPassword); err != nil {
+		return errors.New("password does not match master password")
+	}
+
+	latest, err := uc.rotationRepo.GetLatestRotation(ctx, userID)
+	if err == nil && (latest.Status == entity.KeyRotationRunning || latest.Status == entity.KeyRotationFailed) {
+		return nil
+	}
+
+	keyDerivation := &encryption.KeyDerivation{
+		KDF:    user.KeyKDF,
+		Params: user.KeyKDFParams,
+		Salt:   user.KeySalt,
+	}
+
+	// Слот пароля обновляется при открытии (см. unlockKeySlot), поэтому
+	// со слотами перешифровываются только файлы старых форматов
+	keySlots := len(user.MasterKeyID) > 0
+
+	var items []*entity.KeyRotationItem
+	var newKEK []byte
+	userKeyOutdated := !keySlots && !uc.storage.encryption.IsCurrentKDF(keyDerivation)
+	if userKeyOutdated {
+		// Новый ключ пользователя требует переобернуть ключи всех файлов
+		files, err := uc.storage.fileRepo.GetUserFiles(ctx, userID, "")
+		if err != nil {
+			return fmt.Errorf("failed to list user files: %w", err)
+		}
+		items = rotationItems(files)
+
+		if keyDerivation, err = uc.storage.encryption.NewKeyDerivation(); err != nil {
+			return fmt.Errorf("failed to generate key parameters: %w", err)
+		}
+		if newKEK, err = uc.storage.encryption.DeriveKEK(masterPassword, keyDerivation); err != nil {
+			return fmt.Errorf("failed to derive key: %w", err)
+		}
+	} else {
+		file, err := uc.storage.fileRepo.GetFileMetadataByID(ctx, fileID)
+		if err != nil || file.UserID != userID {
+			return errors.New("file not found")
+		}
+		if file.KDF == user.KeyKDF || (keySlots && len(file.WrappedKey) > 0) {
+			return nil
+		}
+		items = rotationItems([]*entity.FileMetadata{file})
+	}
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	// Контрольное значение старого ключа нужно только, чтобы проверить
+	// старый пароль при продолжении прерванного задания
+	rotation := &entity.KeyRotation{
+		UserID:          userID,
+		Status:          entity.KeyRotationRunning,
+		Total:           len(items),
+		OldKeyCheck:     user.KeyCheck,
+		OldKeyKDF:       user.KeyKDF,
+		OldKeyKDFParams: user.KeyKDFParams,
+		OldKeySalt:      user.KeySalt,
+	}
+
+	if err := uc.rotationRepo.CreateRotation(ctx, rotation, items); err != nil {
+		return fmt.Errorf("failed to create key rotation: %w", err)
+	}
+
+	if userKeyOutdated {
+		user.KeyKDF = keyDerivation.KDF
+		user.KeyKDFParams = keyDerivation.Params
+		user.KeySalt = keyDerivation.Salt
+		user.KeyCheck = encryption.NewKeyCheck(newKEK)
+
+		if err := uc.storage.userRepo.UpdateUser(ctx, user); err != nil {
+			rotation.Status = entity.KeyRotationAborted
+			uc.rotationRepo.UpdateRotation(ctx, rotation)
+			return fmt.Errorf("failed to update key parameters: %w", err)
+		}
+	}
+
+	uc.start(rotation, masterPassword, masterPassword)
+	return nil
+}
+
+// rotationItems создает записи прогресса для зашифрованных файлов
+func rotationItems(files []*entity.FileMetadata) []*entity.KeyRotationItem {
+	var items []*entity.KeyRotationItem
+	for _, file := range files {
+		if file.Type != "file" || !file.IsEncrypted {
+			continue
+		}
+		items = append(items, &entity.KeyRotationItem{
+			FileID:  file.ID,
+			Status:  entity.KeyRotationItemPending,
+			OldPath: file.Path,
+		})
+	}
+	return items
+}
+
+func (uc *keyRotationUseCase) GetKeyRotation(ctx context.Context, userID uint) (*entity.KeyRotation, error) {
+	rotation, err := uc.rotationRepo.GetLatestRotation(ctx, userID)
+	if err != nil {
+		return nil, errors.New("key rotation not found")
+	}
+	return rotation, nil
+}
+
+func (uc *keyRotationUseCase) ResumeKeyRotation(ctx context.Context, userID uint, oldPassword, newPassword string) (*entity.KeyRotation, error) {
+	user, err := uc.storage.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	rotation, err := uc.rotationRepo.GetLatestRotation(ctx, userID)
+	if err != nil {
+		return nil, errors.New("key rotation not found")
+	}
+
+	if rotation.Status != entity.KeyRotationRunning && rotation.Status != entity.KeyRotationFailed {
+		return nil, fmt.Errorf("key rotation is %s", rotation.Status)
+	}
+
+	// Продолжить можно только зная оба пароля: старый нужен для
+	// расшифровки еще не обработанных файлов. Со слотами старый ключ
+	// проверить нечем - с неверным паролем файлы старых форматов снова
+	// завершатся ошибкой.
+	if _, _, err := uc.storage.userKEK(ctx, user, newPassword); err != nil {
+		return nil, errors.New("invalid new password")
+	}
+	if len(rotation.OldKeyCheck) > 0 {
+		oldKEK, err := uc.storage.encryption.DeriveKEK(oldPassword, &encryption.KeyDerivation{
+			KDF:    rotation.OldKeyKDF,
+			Params: rotation.OldKeyKDFParams,
+			Salt:   rotation.OldKeySalt,
+		})
+		if err != nil || !encryption.VerifyKeyCheck(oldKEK, rotation.OldKeyCheck) {
+			return nil, errors.New("invalid old password")
+		}
+	}
+
+	rotation.Status = entity.KeyRotationRunning
+	snapshot := *rotation
+	if !uc.start(rotation, oldPassword, newPassword) {
+		return nil, errors.New("key rotation is already running")
+	}
+
+	return &snapshot, nil
+}
+
+// isRunning проверяет, выполняется ли задание пользователя в этом процессе
+func (uc *keyRotationUseCase) isRunning(userID uint) bool {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return uc.running[userID]
+}
+
+// start запускает задание в фоне, если для пользователя оно еще не выполняется
+func (uc *keyRotationUseCase) start(rotation *entity.KeyRotation, oldPassword, newPassword string) bool {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	if uc.running[rotation.UserID] {
+		return false
+	}
+	uc.running[rotation.UserID] = true
+
+	go func() {
+		defer func() {
+			uc.mu.Lock()
+			delete(uc.running, rotation.UserID)
+			uc.mu.Unlock()
+		}()
+
+		if err := uc.run(context.Background(), rotation, oldPassword, newPassword); err != nil {
+			slog.Warn("key rotation failed", "rotation", rotation.ID, "user", rotation.UserID, "error", err)
+		}
+	}()
+
+	return true
+}
+
+// run обрабатывает все незавершенные файлы задания
+func (uc *keyRotationUseCase) run(ctx context.Context, rotation *entity.KeyRotation, oldPassword, newPassword string) error {
+	user, err := uc.storage.userRepo.GetUserByID(ctx, rotation.UserID)
+	if err != nil {
+		return uc.finish(ctx, rotation, err)
+	}
+
+	newKEK, newKeyDerivation, err := uc.storage.userKEK(ctx, user, newPassword)
+	if err != nil {
+		return uc.finish(ctx, rotation, err)
+	}
+
+	// Со слотами ключ пользователя при смене пароля не меняется
+	var oldKEK []byte
+	if newKeyDerivation.KDF == encryption.KDFMasterKey && len(rotation.OldKeySalt) == 0 {
+		oldKEK = newKEK
+	} else if len(rotation.OldKeySalt) > 0 {
+		oldKEK, err = uc.storage.encryption.DeriveKEK(oldPassword, &encryption.KeyDerivation{
+			KDF:    rotation.OldKeyKDF,
+			Params: rotation.OldKeyKDFParams,
+			Salt:   rotation.OldKeySalt,
+		})
+		if err != nil {
+			return uc.finish(ctx, rotation, err)
+		}
+	}
+
+	items, err := uc.rotationRepo.GetUnfinishedItems(ctx, rotation.ID)
+	if err != nil {
+		return uc.finish(ctx, rotation, err)
+	}
+
+	keys := &rotationKeys{
+		oldPassword:      oldPassword,
+		oldKEK:           oldKEK,
+		newKEK:           newKEK,
+		newKeyDerivation: newKeyDerivation,
+		opts:             userWriteOptions(user),
+	}
+
+	for _, item := range items {
+		if err := uc.rotateFile(ctx, user, item, keys); err != nil {
+			item.Status = entity.KeyRotationItemFailed
+			item.Error = err.Error()
+		} else {
+			item.Status = entity.KeyRotationItemDone
+			item.Error = ""
+		}
+
+		if err := uc.rotationRepo.UpdateItem(ctx, item); err != nil {
+			return uc.finish(ctx, rotation, err)
+		}
+		if err := uc.updateProgress(ctx, rotation); err != nil {
+			return uc.finish(ctx, rotation, err)
+		}
+	}
+
+	// Каталоги переименовываем, когда переведены все файлы: пути файлов в
+	// задании записаны с прежними путями каталогов
+	if err := uc.updateProgress(ctx, rotation); err != nil {
+		return uc.finish(ctx, rotation, err)
+	}
+	if rotation.Failed == 0 {
+		if err := uc.rotateDirectories(ctx, user, keys); err != nil {
+			return uc.finish(ctx, rotation, err)
+		}
+	}
+
+	return uc.finish(ctx, rotation, nil)
+}
+
+// rotationKeys - ключи старого и нового пароля, используемые заданием
+type rotationKeys struct {
+	oldPassword      string
+	oldKEK           []byte
+	newKEK           []byte
+	newKeyDerivation *encryption.KeyDerivation
+	opts             encryption.WriteOptions
+}
+
+// rotateFile переводит один файл на новый ключ. Операция идемпотентна:
+// новый путь запоминается до обращения к облаку, поэтому повторный
+// запуск после сбоя продолжает с того же места.
+func (uc *keyRotationUseCase) rotateFile(ctx context.Context, user *entity.User, item *entity.KeyRotationItem, keys *rotationKeys) error {
+	file, err := uc.storage.fileRepo.GetFileMetadataByID(ctx, item.FileID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Файл удален после начала смены ключей
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load file metadata: %w", err)
+	}
+
+	// Метаданные уже указывают на новый файл - осталось убрать старый.
+	// Совпадение с исходным путем значит, что файл менять не пришлось
+	if item.NewPath != "" && file.Path == item.NewPath {
+		if item.NewPath == item.OldPath {
+			return nil
+		}
+		return uc.removeOldBlob(ctx, user, item)
+	}
+
+	// Идентификатор файла не меняется, поэтому привязка сохраняется.
+	// Файлам без идентификатора детерминированное имя не назначаем:
+	// его не к чему привязать при расшифровке
+	opts := keys.opts
+	opts.Context = fileContext(file)
+	if opts.Context == nil {
+		opts.DeterministicName = false
+	}
+
+	// Ключ файла в заголовке обернут ключом пользователя из слотов, который
+	// при смене пароля не меняется, - старый пароль его не откроет, и
+	// содержимое можно не перешифровывать
+	keySlots := keys.newKeyDerivation.KDF == encryption.KDFMasterKey
+	keepContent := len(file.WrappedKey) > 0 && keySlots && file.KDF == encryption.KDFMasterKey && bytes.Equal(keys.oldKEK, keys.newKEK)
+
+	if item.NewPath == "" {
+		newPath, err := uc.rotatedPath(file, keys, opts, keepContent)
+		if err != nil {
+			return err
+		}
+
+		item.NewPath = newPath
+		if err := uc.rotationRepo.UpdateItem(ctx, item); err != nil {
+			return err
+		}
+	}
+
+	// Имя уже зашифровано ключом пользователя, содержимое не меняется
+	if item.NewPath == file.Path {
+		return nil
+	}
+
+	newName := item.NewPath[strings.LastIndex(item.NewPath, "/")+1:]
+
+	disk, err := uc.storage.userStorage(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	// Итог перемещения или перезаписи файла в каждом хранилище
+	var moved, uploaded []replicaResult
+
+	if keepContent {
+		// Файл мог быть перемещен в прошлой попытке
+		moved, err = disk.Move(ctx, file.Path, item.NewPath)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("failed to rename file: %w", err)
+		}
+	} else {
+		// В остальных случаях заголовок файла открывается старым паролем:
+		// в конвертном формате в нем ключ файла, обернутый старым ключом
+		// пользователя, в старых форматах ключ выводится из самого пароля.
+		// Заголовок входит в проверяемые данные каждого фрагмента, поэтому
+		// перешифровываем содержимое новым ключом под новый путь.
+		reader, err := disk.Download(ctx, file.Path)
+		if err != nil {
+			return fmt.Errorf("failed to download file: %w", err)
+		}
+		defer reader.Close()
+
+		var decrypted io.Reader
+		if len(file.WrappedKey) > 0 {
+			if keys.oldKEK == nil {
+				return errors.New("old key parameters are missing")
+			}
+
+			fileKey, err := encryption.UnwrapKey(keys.oldKEK, file.WrappedKey)
+			if err != nil {
+				return fmt.Errorf("failed to unwrap file key: %w", err)
+			}
+			decrypted, err = uc.storage.encryption.NewDecryptReaderWithKey(reader, fileKey, opts.Context)
+			if err != nil {
+				return fmt.Errorf("decryption failed: %w", err)
+			}
+		} else {
+			decrypted, err = uc.storage.encryption.NewDecryptReader(reader, keys.oldPassword, opts.Context)
+			if err != nil {
+				return fmt.Errorf("decryption failed: %w", err)
+			}
+		}
+
+		// Сжатие при перешифровке выбираем по MIME-типу файла. Манифест
+		// разбитого на фрагменты файла не сжимается
+		opts.Compression, _ = encryption.ChooseCompression("", file.MimeType)
+		if file.Chunked {
+			opts.Compression = encryption.CompressionNone
+		}
+
+		wrappedKey, size, replicas, err := uc.storage.uploadEncrypted(ctx, disk, item.NewPath, decrypted, keys.newKEK, keys.newKeyDerivation, opts)
+		if err != nil {
+			return err
+		}
+		uploaded = replicas
+
+		file.WrappedKey = wrappedKey
+		file.KDF = keys.newKeyDerivation.KDF
+		if !file.Chunked {
+			file.Size = size
+		}
+	}
+
+	file.Path = item.NewPath
+	file.EncryptedName = newName
+	if err := uc.storage.fileRepo.UpdateFileMetadata(ctx, file); err != nil {
+		return fmt.Errorf("failed to update file metadata: %w", err)
+	}
+	if uploaded != nil {
+		uc.storage.saveReplicas(ctx, file.ID, uploaded)
+	} else {
+		uc.storage.markReplicas(ctx, uc.storage.fileReplicas(ctx, file.ID), moved, true)
+	}
+
+	return uc.removeOldBlob(ctx, user, item)
+}
+
+// rotatedPath возвращает путь файла после смены ключей. Имя, уже
+// зашифрованное новым ключом пользователя, не меняется. Перешифрованное
+// содержимое записывается под новым путем, чтобы сбой до обновления
+// метаданных не испортил исходный файл: если детерминированное имя
+// совпадает со старым, имя шифруется со случайным nonce.
+func (uc *keyRotationUseCase) rotatedPath(file *entity.FileMetadata, keys *rotationKeys, opts encryption.WriteOptions, keepContent bool) (string, error) {
+	enc := uc.storage.encryption
+
+	_, err := enc.DecryptFilename(file.EncryptedName, &encryption.NameKeys{KEK: keys.newKEK}, opts.Context)
+	if err == nil && keepContent {
+		return file.Path, nil
+	}
+
+	filename, err := enc.DecryptFilename(file.EncryptedName, &encryption.NameKeys{KEK: keys.oldKEK, Password: keys.oldPassword}, opts.Context)
+	if err != nil {
+		filename = file.Filename
+	}
+
+	encryptedFilename, err := enc.EncryptFilename(filename, keys.newKEK, opts)
+	if err == nil && encryptedFilename == file.EncryptedName {
+		opts.DeterministicName = false
+		encryptedFilename, err = enc.EncryptFilename(filename, keys.newKEK, opts)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt filename: %w", err)
+	}
+
+	return file.Path[:strings.LastIndex(file.Path, "/")+1] + encryptedFilename, nil
+}
+
+// rotateDirectories перешифровывает имена каталогов новым ключом
+// пользователя. Вложенные каталоги обрабатываются раньше родительских:
+// переименование каталога меняет пути всего, что в нем лежит.
+// Переименованный каталог при повторном запуске пропускается.
+func (uc *keyRotationUseCase) rotateDirectories(ctx context.Context, user *entity.User, keys *rotationKeys) error {
+	dirs, err := uc.storage.dirRepo.GetUserDirectories(ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to list directories: %w", err)
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := uc.rotateDirectory(ctx, user, dirs[i], keys); err != nil {
+			return fmt.Errorf("directory %s: %w", dirs[i].Path, err)
+		}
+	}
+	return nil
+}
+
+// rotateDirectory переименовывает каталог в облаке под именем,
+// зашифрованным новым ключом. Открытое имя берется из БД, поэтому старый
+// пароль не нужен. Каталоги под открытыми именами не меняются.
+func (uc *keyRotationUseCase) rotateDirectory(ctx context.Context, user *entity.User, dir *entity.Directory, keys *rotationKeys) error {
+	enc := uc.storage.encryption
+	parent := dir.Path[:strings.LastIndex(dir.Path, "/")]
+	fc := &encryption.FileContext{UserID: uint64(user.ID), Dir: dirPrefix(normalizeDir(parent))}
+
+	if _, err := enc.DecryptFilename(dir.EncryptedName, &encryption.NameKeys{KEK: keys.newKEK}, fc); err == nil {
+		return nil
+	}
+
+	encryptedName, err := enc.EncryptFilename(dir.Name, keys.newKEK, encryption.WriteOptions{
+		Context:           fc,
+		DeterministicName: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encrypt directory name: %w", err)
+	}
+
+	disk, err := uc.storage.userStorage(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	// В каталоге лежат копии многих файлов, поэтому каталог должен
+	// переехать во всех хранилищах. Каталог мог быть перемещен в прошлой
+	// попытке - тогда его нет по старому пути.
+	oldPath := dir.EncryptedPath
+	newPath := oldPath[:strings.LastIndex(oldPath, "/")+1] + encryptedName
+	results, err := disk.Move(ctx, oldPath, newPath)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("failed to rename directory: %w", err)
+	}
+	for _, r := range results {
+		if r.err != nil && !errors.Is(r.err, storage.ErrNotFound) {
+			return fmt.Errorf("failed to rename directory in storage %s: %w", r.provider, r.err)
+		}
+	}
+
+	dir.EncryptedPath = newPath
+	dir.EncryptedName = encryptedName
+	if err := uc.storage.dirRepo.RenameDirectory(ctx, dir, oldPath); err != nil {
+		return fmt.Errorf("failed to update directory paths: %w", err)
+	}
+	return nil
+}
+
+// removeOldBlob удаляет исходный файл, если он остался после перешифровки
+func (uc *keyRotationUseCase) removeOldBlob(ctx context.Context, user *entity.User, item *entity.KeyRotationItem) error {
+	disk, err := uc.storage.userStorage(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	err = disk.Delete(ctx, item.OldPath)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("failed to delete old file: %w", err)
+	}
+	return nil
+}
+
+// updateProgress пересчитывает счетчики задания
+func (uc *keyRotationUseCase) updateProgress(ctx context.Context, rotation *entity.KeyRotation) error {
+	done, err := uc.rotationRepo.CountItems(ctx, rotation.ID, entity.KeyRotationItemDone)
+	if err != nil {
+		return err
+	}
+
+	failed, err := uc.rotationRepo.CountItems(ctx, rotation.ID, entity.KeyRotationItemFailed)
+	if err != nil {
+		return err
+	}
+
+	rotation.Done = done
+	rotation.Failed = failed
+	return uc.rotationRepo.UpdateRotation(ctx, rotation)
+}
+
+// finish фиксирует итоговый статус задания
+func (uc *keyRotationUseCase) finish(ctx context.Context, rotation *entity.KeyRotation, runErr error) error {
+	if err := uc.updateProgress(ctx, rotation); err != nil && runErr == nil {
+		runErr = err
+	}
+
+	if runErr != nil || rotation.Failed > 0 {
+		rotation.Status = entity.KeyRotationFailed
+	} else {
+		now := time.Now()
+		rotation.Status = entity.KeyRotationCompleted
+		rotation.CompletedAt = &now
+
+		// Старый ключ больше не нужен
+		rotation.OldKeyCheck = nil
+		rotation.OldKeyKDF = 0
+		rotation.OldKeyKDFParams = nil
+		rotation.OldKeySalt = nil
+	}
+
+	if err := uc.rotationRepo.UpdateRotation(ctx, rotation); err != nil && runErr == nil {
+		runErr = err
+	}
+
+	return runErr
+}
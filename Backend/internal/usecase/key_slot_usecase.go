@@ -0,0 +1,475 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"server/internal/entity"
+	"server/internal/repository"
+	"server/pkg/encryption"
+	"server/pkg/storage"
+)
+
+var (
+	ErrInvalidMasterPassword = errors.New("invalid master password")
+	ErrInvalidRecoveryKey    = errors.New("invalid recovery key")
+	ErrPassphraseNotSet      = errors.New("encryption passphrase is not set up, upload a file with a new master_password to set it")
+	ErrPassphraseSameAsLogin = errors.New("encryption passphrase must differ from the login password")
+	ErrTooManyAttempts       = errors.New("too many recovery attempts, try again later")
+)
+
+// maxRecoveryKeys ограничивает число слотов восстановления: при восстановлении
+// ключ выводится Argon2id для каждого из них
+const maxRecoveryKeys = 5
+
+// keySlotSetupMu не дает параллельным запросам создать пользователю
+// два разных ключа при переходе на слоты
+var keySlotSetupMu sync.Mutex
+
+type keySlotUseCase struct {
+	storage *storageUseCase
+}
+
+func NewKeySlotUseCase(
+	fileRepo repository.FileMetadataRepository,
+	userRepo repository.UserRepository,
+	slotRepo repository.KeySlotRepository,
+	replicaRepo repository.ReplicaRepository,
+	providers *storage.Registry,
+	encryptionService *encryption.EncryptionService,
+) KeySlotUseCase {
+	return &keySlotUseCase{
+		storage: &storageUseCase{
+			fileRepo:    fileRepo,
+			userRepo:    userRepo,
+			slotRepo:    slotRepo,
+			replicaRepo: replicaRepo,
+			providers:   providers,
+			encryption:  encryptionService,
+		},
+	}
+}
+
+func (uc *keySlotUseCase) GetKeySlots(ctx context.Context, userID uint) ([]*entity.KeySlot, error) {
+	slots, err := uc.storage.slotRepo.GetKeySlots(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list key slots: %w", err)
+	}
+	return slots, nil
+}
+
+func (uc *keySlotUseCase) AddRecoveryKey(ctx context.Context, userID uint, masterPassword, label string) (string, *entity.KeySlot, error) {
+	user, kek, err := uc.unlock(ctx, userID, masterPassword)
+	if err != nil {
+		return "", nil, err
+	}
+
+	slots, err := uc.storage.slotRepo.GetKeySlots(ctx, user.ID)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to list key slots: %w", err)
+	}
+	if countSlots(slots, entity.KeySlotRecovery) >= maxRecoveryKeys {
+		return "", nil, fmt.Errorf("at most %d recovery keys are allowed, remove an old one first", maxRecoveryKeys)
+	}
+
+	recoveryKey, err := encryption.GenerateRecoveryKey()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate recovery key: %w", err)
+	}
+
+	// Ключ слота выводится из нормализованного ключа, чтобы при вводе
+	// не имели значения регистр и дефисы
+	normalized, err := encryption.NormalizeRecoveryKey(recoveryKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	slot, err := uc.storage.newSecretSlot(user, entity.KeySlotRecovery, normalized, kek)
+	if err != nil {
+		return "", nil, err
+	}
+	slot.Label = label
+
+	if err := uc.storage.slotRepo.CreateKeySlot(ctx, slot); err != nil {
+		return "", nil, fmt.Errorf("failed to save key slot: %w", err)
+	}
+
+	uc.storage.syncKeyring(ctx, user)
+	return recoveryKey, slot, nil
+}
+
+func (uc *keySlotUseCase) AddEscrowKey(ctx context.Context, userID uint, masterPassword string) (*entity.KeySlot, error) {
+	escrowKey := uc.storage.encryption.EscrowPublicKey()
+	if escrowKey == nil {
+		return nil, errors.New("key escrow is not configured")
+	}
+
+	user, kek, err := uc.unlock(ctx, userID, masterPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	slots, err := uc.storage.slotRepo.GetKeySlots(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list key slots: %w", err)
+	}
+	for _, slot := range slots {
+		if slot.Type == entity.KeySlotEscrow {
+			return nil, errors.New("escrow key slot already exists")
+		}
+	}
+
+	ephemeralKey, wrappedKey, err := encryption.SealEscrow(escrowKey, kek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap key for escrow: %w", err)
+	}
+
+	slot := &entity.KeySlot{
+		UserID:       user.ID,
+		Type:         entity.KeySlotEscrow,
+		Label:        "admin",
+		EphemeralKey: ephemeralKey,
+		WrappedKey:   wrappedKey,
+	}
+	if err := uc.storage.slotRepo.CreateKeySlot(ctx, slot); err != nil {
+		return nil, fmt.Errorf("failed to save key slot: %w", err)
+	}
+
+	uc.storage.syncKeyring(ctx, user)
+	return slot, nil
+}
+
+func (uc *keySlotUseCase) RemoveKeySlot(ctx context.Context, userID uint, slotID uint, masterPassword string) error {
+	user, _, err := uc.unlock(ctx, userID, masterPassword)
+	if err != nil {
+		return err
+	}
+
+	slot, err := uc.storage.slotRepo.GetKeySlotByID(ctx, slotID)
+	if err != nil || slot.UserID != userID {
+		return errors.New("key slot not found")
+	}
+
+	// Слот пароля меняется только вместе с паролем
+	if slot.Type == entity.KeySlotPassword {
+		return errors.New("password key slot cannot be removed")
+	}
+
+	if err := uc.storage.slotRepo.DeleteKeySlot(ctx, slot.ID); err != nil {
+		return fmt.Errorf("failed to delete key slot: %w", err)
+	}
+
+	uc.storage.syncKeyring(ctx, user)
+	return nil
+}
+
+// unlock открывает ключ пользователя мастер-паролем. Управлять слотами
+// можно только после перехода на слоты.
+func (uc *keySlotUseCase) unlock(ctx context.Context, userID uint, masterPassword string) (*entity.User, []byte, error) {
+	user, err := uc.storage.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, nil, errors.New("user not found")
+	}
+
+	kek, _, err := uc.storage.userKEK(ctx, user, masterPassword)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(user.MasterKeyID) == 0 {
+		return nil, nil, ErrInvalidMasterPassword
+	}
+
+	return user, kek, nil
+}
+
+// unlockKeySlot открывает ключ пользователя секретом secret одного из
+// слотов типа slotType. Слот пароля с устаревшими параметрами вывода
+// ключа сразу перевыпускается.
+func (uc *storageUseCase) unlockKeySlot(ctx context.Context, user *entity.User, slotType, secret string) ([]byte, error) {
+	slots, err := uc.slotRepo.GetKeySlots(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list key slots: %w", err)
+	}
+
+	for _, slot := range slots {
+		if slot.Type != slotType {
+			continue
+		}
+
+		kek, err := uc.encryption.OpenKeySlot(keyringSlot(slot), secret)
+		if err != nil || !bytes.Equal(encryption.MasterKeyID(kek), user.MasterKeyID) {
+			continue
+		}
+
+		keyDerivation := &encryption.KeyDerivation{KDF: slot.KDF, Params: slot.KDFParams, Salt: slot.Salt}
+		if slotType == entity.KeySlotPassword && !uc.encryption.IsCurrentKDF(keyDerivation) {
+			if err := uc.rewrapKeySlot(ctx, user, slot, secret, kek); err != nil {
+				slog.Warn("key slot upgrade failed", "slot", slot.ID, "error", err)
+			}
+		}
+		return kek, nil
+	}
+
+	if slotType == entity.KeySlotRecovery {
+		return nil, ErrInvalidRecoveryKey
+	}
+	return nil, ErrInvalidMasterPassword
+}
+
+// countSlots возвращает число слотов типа slotType
+func countSlots(slots []*entity.KeySlot, slotType string) int {
+	n := 0
+	for _, slot := range slots {
+		if slot.Type == slotType {
+			n++
+		}
+	}
+	return n
+}
+
+// newSecretSlot оборачивает ключ пользователя ключом, выведенным из secret
+func (uc *storageUseCase) newSecretSlot(user *entity.User, slotType, secret string, kek []byte) (*entity.KeySlot, error) {
+	keyDerivation, err := uc.encryption.NewKeyDerivation()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key parameters: %w", err)
+	}
+
+	slotKEK, err := uc.encryption.DeriveKEK(secret, keyDerivation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	suite, err := uc.encryption.ResolveSuite(0)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := encryption.WrapKey(suite, slotKEK, kek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap key: %w", err)
+	}
+
+	return &entity.KeySlot{
+		UserID:     user.ID,
+		Type:       slotType,
+		KDF:        keyDerivation.KDF,
+		KDFParams:  keyDerivation.Params,
+		Salt:       keyDerivation.Salt,
+		WrappedKey: wrappedKey,
+	}, nil
+}
+
+// rewrapKeySlot оборачивает ключ пользователя в слоте заново с новой солью
+// и текущими параметрами вывода ключа
+func (uc *storageUseCase) rewrapKeySlot(ctx context.Context, user *entity.User, slot *entity.KeySlot, secret string, kek []byte) error {
+	updated, err := uc.newSecretSlot(user, slot.Type, secret, kek)
+	if err != nil {
+		return err
+	}
+
+	slot.KDF = updated.KDF
+	slot.KDFParams = updated.KDFParams
+	slot.Salt = updated.Salt
+	slot.WrappedKey = updated.WrappedKey
+	if err := uc.slotRepo.UpdateKeySlot(ctx, slot); err != nil {
+		return err
+	}
+
+	uc.syncKeyring(ctx, user)
+	return nil
+}
+
+// setPasswordSlot заменяет слоты пароля пользователя слотом нового пароля
+func (uc *storageUseCase) setPasswordSlot(ctx context.Context, user *entity.User, password string, kek []byte) error {
+	slot, err := uc.newSecretSlot(user, entity.KeySlotPassword, password, kek)
+	if err != nil {
+		return err
+	}
+
+	slots, err := uc.slotRepo.GetKeySlots(ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to list key slots: %w", err)
+	}
+
+	if err := uc.slotRepo.CreateKeySlot(ctx, slot); err != nil {
+		return fmt.Errorf("failed to save key slot: %w", err)
+	}
+
+	for _, old := range slots {
+		if old.Type != entity.KeySlotPassword {
+			continue
+		}
+		if err := uc.slotRepo.DeleteKeySlot(ctx, old.ID); err != nil {
+			return fmt.Errorf("failed to delete key slot: %w", err)
+		}
+	}
+
+	uc.syncKeyring(ctx, user)
+	return nil
+}
+
+// setupKeySlots переводит пользователя на слоты ключей. Ключ, выведенный
+// из мастер-пароля до появления слотов, становится ключом в слотах: ключи
+// уже загруженных файлов остаются действительными. Возвращает nil, если
+// пароль не подтвержден - тогда ключ выводится из пароля по-старому.
+func (uc *storageUseCase) setupKeySlots(ctx context.Context, user *entity.User, masterPassword string) ([]byte, error) {
+	keySlotSetupMu.Lock()
+	defer keySlotSetupMu.Unlock()
+
+	current, err := uc.userRepo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+	if len(current.MasterKeyID) > 0 {
+		// Параллельный запрос уже создал слоты
+		*user = *current
+		return uc.unlockKeySlot(ctx, user, entity.KeySlotPassword, masterPassword)
+	}
+
+	var kek []byte
+	if len(user.KeySalt) > 0 {
+		kek, err = uc.encryption.DeriveKEK(masterPassword, &encryption.KeyDerivation{
+			KDF:    user.KeyKDF,
+			Params: user.KeyKDFParams,
+			Salt:   user.KeySalt,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive key: %w", err)
+		}
+
+		// Неверный пароль записал бы в слот чужой ключ
+		if !passphraseConfirmed(user, kek, masterPassword) {
+			return nil, nil
+		}
+
+		// Во время смены ключей часть файлов обернута еще старым ключом
+		files, err := uc.fileRepo.GetUserFiles(ctx, user.ID, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list user files: %w", err)
+		}
+		for _, file := range files {
+			if len(file.WrappedKey) == 0 {
+				continue
+			}
+			if _, err := encryption.UnwrapKey(kek, file.WrappedKey); err != nil {
+				return nil, nil
+			}
+		}
+	} else {
+		// Новый ключ создается для любого пароля, но у аккаунта с общим
+		// паролем мастер-паролем может быть только пароль входа
+		if !user.SeparatePassphrase && !passphraseConfirmed(user, nil, masterPassword) {
+			return nil, nil
+		}
+		if kek, err = encryption.NewMasterKey(); err != nil {
+			return nil, fmt.Errorf("failed to generate key: %w", err)
+		}
+	}
+
+	if err := uc.setPasswordSlot(ctx, user, masterPassword, kek); err != nil {
+		return nil, err
+	}
+
+	user.MasterKeyID = encryption.MasterKeyID(kek)
+	if err := uc.userRepo.UpdateUser(ctx, user); err != nil {
+		return nil, fmt.Errorf("failed to save key slots: %w", err)
+	}
+
+	uc.syncKeyring(ctx, user)
+	return kek, nil
+}
+
+// setupPassphrase задает парольную фразу шифрования пользователю, у
+// которого ее еще нет, и возвращает новый ключ пользователя
+func (uc *storageUseCase) setupPassphrase(ctx context.Context, user *entity.User, passphrase string) ([]byte, *encryption.KeyDerivation, error) {
+	if uc.slotRepo == nil {
+		return nil, nil, ErrPassphraseNotSet
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(passphrase)) == nil {
+		return nil, nil, ErrPassphraseSameAsLogin
+	}
+
+	kek, err := uc.setupKeySlots(ctx, user, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	if kek == nil {
+		return nil, nil, ErrInvalidMasterPassword
+	}
+
+	return kek, encryption.MasterKeyDerivation(kek), nil
+}
+
+// passphraseConfirmed проверяет мастер-пароль по проверочному значению
+// ключа kek, а у аккаунтов с общим паролем - по хэшу пароля входа
+func passphraseConfirmed(user *entity.User, kek []byte, masterPassword string) bool {
+	if len(user.KeyCheck) > 0 && kek != nil {
+		return encryption.VerifyKeyCheck(kek, user.KeyCheck)
+	}
+	if user.SeparatePassphrase {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(masterPassword)) == nil
+}
+
+// syncKeyring записывает копию слотов в облако рядом с файлами, чтобы файлы
+// можно было расшифровать без БД (см. cmd/decrypt). Ошибка не прерывает
+// операцию: копия обновится при следующем изменении слотов.
+func (uc *storageUseCase) syncKeyring(ctx context.Context, user *entity.User) {
+	if uc.slotRepo == nil || user.StorageCredentials == "" || len(user.MasterKeyID) == 0 {
+		return
+	}
+
+	keyring, err := uc.userKeyring(ctx, user)
+	if err != nil {
+		slog.Warn("failed to list key slots for keyring copy", "user", user.ID, "error", err)
+		return
+	}
+
+	data, err := encryption.MarshalKeyring(keyring)
+	if err != nil {
+		slog.Warn("failed to encode keyring copy", "user", user.ID, "error", err)
+		return
+	}
+
+	disk, err := uc.userStorage(ctx, user)
+	if err != nil {
+		return
+	}
+	if err := disk.Upload(ctx, "/"+encryption.KeyringFileName, bytes.NewReader(data)); err != nil {
+		slog.Warn("failed to upload keyring copy", "user", user.ID, "error", err)
+	}
+}
+
+// userKeyring собирает слоты пользователя из БД в формат копии слотов
+func (uc *storageUseCase) userKeyring(ctx context.Context, user *entity.User) (*encryption.Keyring, error) {
+	slots, err := uc.slotRepo.GetKeySlots(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring := &encryption.Keyring{UserID: uint64(user.ID), MasterKeyID: user.MasterKeyID}
+	for _, slot := range slots {
+		keyring.Slots = append(keyring.Slots, *keyringSlot(slot))
+	}
+	return keyring, nil
+}
+
+// keyringSlot переводит слот из БД в формат копии слотов
+func keyringSlot(slot *entity.KeySlot) *encryption.KeyringSlot {
+	return &encryption.KeyringSlot{
+		Type:         slot.Type,
+		KDF:          slot.KDF,
+		KDFParams:    slot.KDFParams,
+		Salt:         slot.Salt,
+		EphemeralKey: slot.EphemeralKey,
+		WrappedKey:   slot.WrappedKey,
+	}
+}
@@ -0,0 +1,637 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+
+	"server/internal/entity"
+	"server/pkg/encryption"
+	"server/pkg/storage"
+)
+
+// Репликация.
+//
+// К основному хранилищу пользователь может подключить дополнительные
+// (StorageBackend). Каталоги, файлы и фрагменты пишутся во все хранилища
+// сразу; запись удалась, если ее приняли все хранилища (ReplicationAll) или
+// не меньше ReplicationMin из них (ReplicationQuorum). Для каждого файла
+// запоминается, в каких хранилищах лежат его копии и исправны ли они
+// (FileReplica). Файл читается из первой исправной копии: если хранилище
+// недоступно или копия повреждена, чтение переходит к следующей.
+//
+// Файлы, загруженные до подключения хранилища, в него не копируются.
+// Копии фрагментов учитываются отдельно (ChunkReplica): фрагмент, которого
+// нет в хранилище, дописывается в него при следующей загрузке с этим
+// фрагментом.
+
+var (
+	ErrBackendExists            = errors.New("storage is already attached")
+	ErrBackendNotFound          = errors.New("storage not found")
+	ErrInvalidReplicationPolicy = errors.New("invalid replication policy")
+)
+
+// replica - хранилище пользователя: основное (backendID 0) или дополнительное
+type replica struct {
+	backendID uint
+	provider  string
+	disk      *storage.Storage
+	err       error // Хранилище не открылось (например, провайдер отключен на сервере)
+}
+
+// replicaResult - итог операции в одном хранилище
+type replicaResult struct {
+	replica
+	err error
+}
+
+// replicaSet - хранилища пользователя, основное - первое. Методы повторяют
+// storage.Storage: запись идет во все хранилища, чтение - из первого, где
+// удалось.
+type replicaSet struct {
+	Provider string // Провайдер основного хранилища
+	replicas []replica
+	required int // Сколько хранилищ должны принять запись
+}
+
+// userStorage возвращает хранилища, подключенные пользователем
+func (uc *storageUseCase) userStorage(ctx context.Context, user *entity.User) (*replicaSet, error) {
+	if user.StorageCredentials == "" {
+		return nil, storage.ErrNotConnected
+	}
+
+	primary, err := uc.providers.Open(user.StorageProvider, user.StorageCredentials)
+	if err != nil {
+		return nil, err
+	}
+	set := &replicaSet{
+		Provider: primary.Provider,
+		replicas: []replica{{provider: primary.Provider, disk: primary}},
+	}
+
+	if uc.replicaRepo != nil {
+		backends, err := uc.replicaRepo.GetBackends(ctx, user.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list storages: %w", err)
+		}
+		for _, backend := range backends {
+			disk, err := uc.providers.Open(backend.Provider, backend.Credentials)
+			set.replicas = append(set.replicas, replica{backendID: backend.ID, provider: backend.Provider, disk: disk, err: err})
+		}
+	}
+
+	set.required = len(set.replicas)
+	if user.ReplicationPolicy == entity.ReplicationQuorum && user.ReplicationMin > 0 && user.ReplicationMin < set.required {
+		set.required = user.ReplicationMin
+	}
+	return set, nil
+}
+
+// each выполняет op во всех хранилищах параллельно
+func (s *replicaSet) each(op func(*storage.Storage) error) []replicaResult {
+	results := make([]replicaResult, len(s.replicas))
+	var wg sync.WaitGroup
+	for i, r := range s.replicas {
+		results[i].replica = r
+		if r.err != nil {
+			results[i].err = r.err
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].err = op(r.disk)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// check сводит результаты записи: ошибка, если запись приняли меньше
+// хранилищ, чем требует политика. done считает результат успешным.
+func (s *replicaSet) check(operation string, results []replicaResult, done func(error) bool) error {
+	if len(results) == 1 {
+		return results[0].err
+	}
+
+	var ok int
+	var firstErr error
+	for _, r := range results {
+		if done(r.err) {
+			ok++
+			continue
+		}
+		if firstErr == nil {
+			firstErr = r.err
+		}
+		slog.Warn("replica operation failed", "operation", operation, "backend", r.backendID, "provider", r.provider, "error", r.err)
+	}
+
+	if ok >= s.required {
+		return nil
+	}
+	return fmt.Errorf("%s succeeded in %d of %d storages, %d required: %w", operation, ok, len(results), s.required, firstErr)
+}
+
+func succeeded(err error) bool {
+	return err == nil
+}
+
+// Upload записывает файл во все хранилища
+func (s *replicaSet) Upload(ctx context.Context, path string, content io.Reader) error {
+	_, err := s.UploadReplicas(ctx, path, content)
+	return err
+}
+
+// UploadReplicas записывает файл во все хранилища, читая content один раз,
+// и возвращает итог записи в каждое. Если политика не выполнена, принятые
+// копии удаляются.
+func (s *replicaSet) UploadReplicas(ctx context.Context, path string, content io.Reader) ([]replicaResult, error) {
+	writers := make([]*io.PipeWriter, len(s.replicas))
+	readers := make([]*io.PipeReader, len(s.replicas))
+	for i := range s.replicas {
+		readers[i], writers[i] = io.Pipe()
+	}
+
+	results := make([]replicaResult, len(s.replicas))
+	var wg sync.WaitGroup
+	for i, r := range s.replicas {
+		results[i] = replicaResult{replica: r, err: r.err}
+		if r.err != nil {
+			readers[i].CloseWithError(results[i].err)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].err = results[i].disk.Upload(ctx, path, readers[i])
+			// Хранилище, прервавшее загрузку, больше не читает - запись в него
+			// должна завершиться ошибкой, а не заблокироваться
+			readers[i].Close()
+		}()
+	}
+
+	_, copyErr := io.Copy(&fanOutWriter{writers: writers}, content)
+	for _, w := range writers {
+		w.CloseWithError(copyErr)
+	}
+	wg.Wait()
+
+	if copyErr != nil && !errors.Is(copyErr, errAllWritersFailed) {
+		for i := range results {
+			if results[i].err == nil {
+				results[i].err = copyErr
+			}
+		}
+	}
+
+	err := s.check("upload", results, succeeded)
+	if err != nil && len(results) > 1 {
+		for _, r := range results {
+			if r.err == nil {
+				r.disk.Delete(context.WithoutCancel(ctx), path)
+			}
+		}
+	}
+	return results, err
+}
+
+func (s *replicaSet) Mkdir(ctx context.Context, path string) error {
+	return s.check("mkdir", s.each(func(disk *storage.Storage) error {
+		return disk.Mkdir(ctx, path)
+	}), succeeded)
+}
+
+// Move перемещает файл во всех хранилищах. Отсутствие файла в хранилище
+// (перемещен прошлой попыткой) ошибкой не считается; если файла нет нигде -
+// storage.ErrNotFound.
+func (s *replicaSet) Move(ctx context.Context, from, to string) ([]replicaResult, error) {
+	results := s.each(func(disk *storage.Storage) error {
+		return disk.Move(ctx, from, to)
+	})
+
+	if allNotFound(results) {
+		return results, storage.ErrNotFound
+	}
+	return results, s.check("move", results, func(err error) bool {
+		return err == nil || errors.Is(err, storage.ErrNotFound)
+	})
+}
+
+// Delete удаляет файл во всех хранилищах. Хранилища, где удалить не
+// удалось, не мешают удалению: копия в них остается лишней.
+func (s *replicaSet) Delete(ctx context.Context, path string) error {
+	results := s.each(func(disk *storage.Storage) error {
+		return disk.Delete(ctx, path)
+	})
+
+	if len(results) == 1 || allNotFound(results) {
+		return results[0].err
+	}
+
+	var firstErr error
+	deleted := false
+	for _, r := range results {
+		switch {
+		case r.err == nil:
+			deleted = true
+		case errors.Is(r.err, storage.ErrNotFound):
+		default:
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			slog.Warn("replica delete failed", "path", path, "backend", r.backendID, "provider", r.provider, "error", r.err)
+		}
+	}
+	if deleted {
+		return nil
+	}
+	return firstErr
+}
+
+// Download скачивает файл из первого хранилища, где он доступен
+func (s *replicaSet) Download(ctx context.Context, path string) (io.ReadCloser, error) {
+	var firstErr error
+	for _, r := range s.replicas {
+		err := r.err
+		if err == nil {
+			var reader io.ReadCloser
+			if reader, err = r.disk.Download(ctx, path); err == nil {
+				return reader, nil
+			}
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+func (s *replicaSet) Stat(ctx context.Context, path string) (*storage.Resource, error) {
+	var firstErr error
+	for _, r := range s.replicas {
+		err := r.err
+		if err == nil {
+			var resource *storage.Resource
+			if resource, err = r.disk.Stat(ctx, path); err == nil {
+				return resource, nil
+			}
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+func (s *replicaSet) List(ctx context.Context, path string) ([]storage.Resource, error) {
+	var firstErr error
+	for _, r := range s.replicas {
+		err := r.err
+		if err == nil {
+			var items []storage.Resource
+			if items, err = r.disk.List(ctx, path); err == nil {
+				return items, nil
+			}
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// Quota возвращает место в основном хранилище
+func (s *replicaSet) Quota(ctx context.Context) (*storage.Quota, error) {
+	return s.replicas[0].disk.Quota(ctx)
+}
+
+// forFile возвращает хранилища с копиями файла: сначала исправные, затем
+// отмеченные неисправными. Для файла без записей о копиях - все хранилища.
+func (s *replicaSet) forFile(records []*entity.FileReplica) *replicaSet {
+	if len(records) == 0 {
+		return s
+	}
+
+	status := make(map[uint]string, len(records))
+	for _, record := range records {
+		status[record.BackendID] = record.Status
+	}
+
+	ordered := &replicaSet{Provider: s.Provider, required: s.required}
+	for _, healthy := range []bool{true, false} {
+		for _, r := range s.replicas {
+			if st, ok := status[r.backendID]; ok && (st == entity.ReplicaHealthy) == healthy {
+				ordered.replicas = append(ordered.replicas, r)
+			}
+		}
+	}
+	if len(ordered.replicas) == 0 {
+		return s
+	}
+	return ordered
+}
+
+func allNotFound(results []replicaResult) bool {
+	for _, r := range results {
+		if !errors.Is(r.err, storage.ErrNotFound) {
+			return false
+		}
+	}
+	return true
+}
+
+var errAllWritersFailed = errors.New("all storages failed")
+
+// fanOutWriter пишет во все pipe; pipe, запись в который не удалась,
+// пропускается дальше
+type fanOutWriter struct {
+	writers []*io.PipeWriter
+	failed  []bool
+}
+
+func (w *fanOutWriter) Write(p []byte) (int, error) {
+	if w.failed == nil {
+		w.failed = make([]bool, len(w.writers))
+	}
+
+	alive := 0
+	for i, pw := range w.writers {
+		if w.failed[i] {
+			continue
+		}
+		if _, err := pw.Write(p); err != nil {
+			w.failed[i] = true
+			continue
+		}
+		alive++
+	}
+	if alive == 0 {
+		return 0, errAllWritersFailed
+	}
+	return len(p), nil
+}
+
+// replicaRecords описывает итог записи файла для таблицы реплик
+func replicaRecords(results []replicaResult) []*entity.FileReplica {
+	records := make([]*entity.FileReplica, len(results))
+	for i, r := range results {
+		records[i] = &entity.FileReplica{BackendID: r.backendID, Provider: r.provider, Status: entity.ReplicaHealthy}
+		if r.err != nil {
+			records[i].Status = entity.ReplicaFailed
+			records[i].LastError = r.err.Error()
+		}
+	}
+	return records
+}
+
+// saveReplicas запоминает, в каких хранилищах записан файл
+func (uc *storageUseCase) saveReplicas(ctx context.Context, fileID uint, results []replicaResult) {
+	if uc.replicaRepo == nil {
+		return
+	}
+	if err := uc.replicaRepo.SetFileReplicas(ctx, fileID, replicaRecords(results)); err != nil {
+		slog.Warn("failed to save file replicas", "file", fileID, "error", err)
+	}
+}
+
+// markReplicas отмечает копии файла исправными или неисправными по итогам
+// операции. Отсутствие файла не меняет состояния, если skipNotFound.
+func (uc *storageUseCase) markReplicas(ctx context.Context, records []*entity.FileReplica, results []replicaResult, skipNotFound bool) {
+	if uc.replicaRepo == nil {
+		return
+	}
+
+	for _, r := range results {
+		if skipNotFound && errors.Is(r.err, storage.ErrNotFound) {
+			continue
+		}
+		for _, record := range records {
+			if record.BackendID != r.backendID {
+				continue
+			}
+
+			status, lastError := entity.ReplicaHealthy, ""
+			if r.err != nil {
+				status, lastError = entity.ReplicaFailed, r.err.Error()
+			}
+			if record.Status == status && record.LastError == lastError {
+				continue
+			}
+
+			record.Status, record.LastError = status, lastError
+			if err := uc.replicaRepo.UpdateReplica(ctx, record); err != nil {
+				slog.Warn("failed to update file replica", "file", record.FileID, "backend", record.BackendID, "error", err)
+			}
+		}
+	}
+}
+
+// fileReplicas возвращает записи о копиях файла
+func (uc *storageUseCase) fileReplicas(ctx context.Context, fileID uint) []*entity.FileReplica {
+	if uc.replicaRepo == nil {
+		return nil
+	}
+	records, err := uc.replicaRepo.GetFileReplicas(ctx, fileID)
+	if err != nil {
+		slog.Warn("failed to list file replicas", "file", fileID, "error", err)
+		return nil
+	}
+	return records
+}
+
+// openFile скачивает файл из первой копии, которую удалось открыть функцией
+// open (для расшифровки), и возвращает тело ответа и результат open.
+// Недоступные и поврежденные копии отмечаются неисправными. Другие ошибки
+// open (например, неверный ключ) возвращаются сразу: копии тут ни при чем.
+func (uc *storageUseCase) openFile(ctx context.Context, disk *replicaSet, file *entity.FileMetadata, open func(io.Reader) (io.Reader, error)) (io.ReadCloser, io.Reader, error) {
+	records := uc.fileReplicas(ctx, file.ID)
+
+	var failed []replicaResult
+	var firstErr error
+	for _, r := range disk.forFile(records).replicas {
+		err := r.err
+		var body io.ReadCloser
+		if err == nil {
+			body, err = r.disk.Download(ctx, file.Path)
+		}
+		if err != nil {
+			failed = append(failed, replicaResult{replica: r, err: err})
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to download file: %w", err)
+			}
+			continue
+		}
+
+		decrypted, err := open(body)
+		if err != nil {
+			body.Close()
+			if !errors.Is(err, encryption.ErrTampered) && !errors.Is(err, encryption.ErrContextRequired) {
+				return nil, nil, fmt.Errorf("decryption failed: %w", err)
+			}
+			failed = append(failed, replicaResult{replica: r, err: err})
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		// Копия открылась: остальные ошибки - дело хранилищ, а не ключа
+		uc.markReplicas(ctx, records, append(failed, replicaResult{replica: r}), false)
+		return body, decrypted, nil
+	}
+
+	// Ни одна копия не открылась: поврежденными отмечаем только недоступные,
+	// ошибку расшифровки во всех копиях мог дать и неверный ключ
+	var unavailable []replicaResult
+	for _, r := range failed {
+		if !errors.Is(r.err, encryption.ErrTampered) && !errors.Is(r.err, encryption.ErrContextRequired) {
+			unavailable = append(unavailable, r)
+		}
+	}
+	uc.markReplicas(ctx, records, unavailable, false)
+	return nil, nil, firstErr
+}
+
+// StorageBackendInfo - дополнительное хранилище пользователя для ответа API
+type StorageBackendInfo struct {
+	ID       uint   `json:"id"` // 0 - основное хранилище
+	Provider string `json:"provider"`
+	Primary  bool   `json:"primary"`
+}
+
+// ReplicationSettings - хранилища пользователя и политика записи копий
+type ReplicationSettings struct {
+	Policy      string               `json:"policy"`
+	MinReplicas int                  `json:"min_replicas,omitempty"`
+	Storages    []StorageBackendInfo `json:"storages"`
+}
+
+// GetReplication возвращает хранилища пользователя и политику репликации
+func (uc *storageUseCase) GetReplication(ctx context.Context, userID uint) (*ReplicationSettings, error) {
+	user, err := uc.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+	if user.StorageCredentials == "" {
+		return nil, storage.ErrNotConnected
+	}
+
+	backends, err := uc.replicaRepo.GetBackends(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storages: %w", err)
+	}
+
+	settings := &ReplicationSettings{
+		Policy:   entity.ReplicationAll,
+		Storages: []StorageBackendInfo{{Provider: user.StorageProvider, Primary: true}},
+	}
+	if user.ReplicationPolicy == entity.ReplicationQuorum {
+		settings.Policy, settings.MinReplicas = user.ReplicationPolicy, user.ReplicationMin
+	}
+	for _, backend := range backends {
+		settings.Storages = append(settings.Storages, StorageBackendInfo{ID: backend.ID, Provider: backend.Provider})
+	}
+	return settings, nil
+}
+
+// AttachStorage подключает дополнительное хранилище без OAuth и создает в
+// нем каталоги пользователя. Уже загруженные файлы в него не копируются.
+func (uc *storageUseCase) AttachStorage(ctx context.Context, userID uint, providerName, credentials string) (*entity.StorageBackend, error) {
+	user, err := uc.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+	if user.StorageCredentials == "" {
+		return nil, storage.ErrNotConnected
+	}
+
+	provider, err := uc.providers.Get(providerName)
+	if err != nil {
+		return nil, err
+	}
+	connector, ok := provider.(storage.Connector)
+	if !ok {
+		return nil, fmt.Errorf("storage provider %s must be connected via OAuth", providerName)
+	}
+
+	credentials, err = connector.Connect(ctx, userID, credentials)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect storage: %w", err)
+	}
+
+	// Одно и то же хранилище дважды - не реплика
+	backends, err := uc.replicaRepo.GetBackends(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storages: %w", err)
+	}
+	if providerName == user.StorageProvider && credentials == user.StorageCredentials {
+		return nil, ErrBackendExists
+	}
+	for _, backend := range backends {
+		if backend.Provider == providerName && backend.Credentials == credentials {
+			return nil, ErrBackendExists
+		}
+	}
+
+	// Файлы пишутся в каталоги под теми же путями, что и в основном хранилище
+	disk := storage.Bind(providerName, provider, credentials)
+	dirs, err := uc.dirRepo.GetUserDirectories(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list directories: %w", err)
+	}
+	for _, dir := range dirs {
+		if err := disk.Mkdir(ctx, dir.EncryptedPath); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+
+	backend := &entity.StorageBackend{UserID: userID, Provider: providerName, Credentials: credentials}
+	if err := uc.replicaRepo.CreateBackend(ctx, backend); err != nil {
+		return nil, fmt.Errorf("failed to save storage: %w", err)
+	}
+
+	uc.syncKeyring(ctx, user)
+	return backend, nil
+}
+
+// DetachStorage отключает дополнительное хранилище и удаляет записи о
+// копиях файлов и фрагментов в нем. Сами файлы в хранилище остаются, но
+// больше не читаются и не пишутся.
+func (uc *storageUseCase) DetachStorage(ctx context.Context, userID uint, backendID uint) error {
+	backend, err := uc.replicaRepo.GetBackendByID(ctx, backendID)
+	if err != nil || backend.UserID != userID {
+		return ErrBackendNotFound
+	}
+
+	if err := uc.replicaRepo.DeleteBackend(ctx, backendID); err != nil {
+		return fmt.Errorf("failed to delete storage: %w", err)
+	}
+	return nil
+}
+
+// SetReplicationPolicy задает политику записи копий: entity.ReplicationAll
+// или entity.ReplicationQuorum с числом хранилищ minReplicas
+func (uc *storageUseCase) SetReplicationPolicy(ctx context.Context, userID uint, policy string, minReplicas int) error {
+	switch {
+	case policy == entity.ReplicationAll:
+		minReplicas = 0
+	case policy == entity.ReplicationQuorum && minReplicas >= 1:
+	default:
+		return ErrInvalidReplicationPolicy
+	}
+
+	user, err := uc.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return errors.New("user not found")
+	}
+
+	user.ReplicationPolicy = policy
+	user.ReplicationMin = minReplicas
+	return uc.userRepo.UpdateUser(ctx, user)
+}
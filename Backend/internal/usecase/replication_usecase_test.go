@@ -0,0 +1,393 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"server/internal/entity"
+	"server/internal/repository"
+	"server/pkg/encryption"
+	"server/pkg/storage"
+)
+
+var errUnavailable = errors.New("storage is unavailable")
+
+// memoryStorage - хранилище в памяти; fail задает ошибку операции
+type memoryStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	fail  map[string]error
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{files: make(map[string][]byte), fail: make(map[string]error)}
+}
+
+func (m *memoryStorage) failure(op string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fail[op]
+}
+
+func (m *memoryStorage) has(path string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.files[path]
+	return ok
+}
+
+func (m *memoryStorage) List(ctx context.Context, credentials, path string) ([]storage.Resource, error) {
+	return nil, nil
+}
+
+func (m *memoryStorage) Upload(ctx context.Context, credentials, path string, content io.Reader) error {
+	if err := m.failure("upload"); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[path] = data
+	return nil
+}
+
+func (m *memoryStorage) Download(ctx context.Context, credentials, path string) (io.ReadCloser, error) {
+	if err := m.failure("download"); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[path]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memoryStorage) Delete(ctx context.Context, credentials, path string) error {
+	if err := m.failure("delete"); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[path]; !ok {
+		return storage.ErrNotFound
+	}
+	delete(m.files, path)
+	return nil
+}
+
+func (m *memoryStorage) Mkdir(ctx context.Context, credentials, path string) error {
+	return m.failure("mkdir")
+}
+
+func (m *memoryStorage) Move(ctx context.Context, credentials, from, to string) error {
+	if err := m.failure("move"); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[from]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	delete(m.files, from)
+	m.files[to] = data
+	return nil
+}
+
+func (m *memoryStorage) Copy(ctx context.Context, credentials, from, to string) error {
+	return errors.New("not implemented")
+}
+
+func (m *memoryStorage) Stat(ctx context.Context, credentials, path string) (*storage.Resource, error) {
+	if err := m.failure("stat"); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[path]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return &storage.Resource{Path: path, Type: "file", Size: int64(len(data))}, nil
+}
+
+func (m *memoryStorage) Quota(ctx context.Context, credentials string) (*storage.Quota, error) {
+	return &storage.Quota{}, nil
+}
+
+// newTestReplicaSet создает основное хранилище и n-1 дополнительных
+func newTestReplicaSet(n, required int) (*replicaSet, []*memoryStorage) {
+	set := &replicaSet{Provider: "memory", required: required}
+	disks := make([]*memoryStorage, n)
+	for i := range disks {
+		disks[i] = newMemoryStorage()
+		set.replicas = append(set.replicas, replica{
+			backendID: uint(i),
+			provider:  "memory",
+			disk:      storage.Bind("memory", disks[i], ""),
+		})
+	}
+	return set, disks
+}
+
+func TestReplicaSetCheck(t *testing.T) {
+	results := []replicaResult{{}, {err: errUnavailable}, {}}
+
+	tests := []struct {
+		name     string
+		required int
+		wantErr  bool
+	}{
+		{"all", 3, true},
+		{"quorum met", 2, false},
+		{"quorum of one", 1, false},
+	}
+	for _, tt := range tests {
+		set := &replicaSet{required: tt.required}
+		err := set.check("upload", results, succeeded)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+		if err != nil && !errors.Is(err, errUnavailable) {
+			t.Errorf("%s: error does not wrap the storage error: %v", tt.name, err)
+		}
+	}
+
+	// Единственное хранилище возвращает свою ошибку как есть
+	single := &replicaSet{required: 1}
+	if err := single.check("upload", []replicaResult{{err: errUnavailable}}, succeeded); err != errUnavailable {
+		t.Errorf("single storage: got %v", err)
+	}
+}
+
+func TestReplicaSetUploadQuorum(t *testing.T) {
+	set, disks := newTestReplicaSet(3, 2)
+	disks[2].fail["upload"] = errUnavailable
+
+	results, err := set.UploadReplicas(context.Background(), "/a", strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !disks[0].has("/a") || !disks[1].has("/a") {
+		t.Error("accepted copies are missing")
+	}
+	if !errors.Is(results[2].err, errUnavailable) || results[0].err != nil || results[1].err != nil {
+		t.Errorf("got results %+v", results)
+	}
+
+	records := replicaRecords(results)
+	if records[2].Status != entity.ReplicaFailed || records[0].Status != entity.ReplicaHealthy {
+		t.Errorf("got records %+v", records)
+	}
+}
+
+func TestReplicaSetUploadRemovesCopiesBelowQuorum(t *testing.T) {
+	set, disks := newTestReplicaSet(3, 3)
+	disks[1].fail["upload"] = errUnavailable
+	// Хранилище, которое не открылось, тоже не принимает запись
+	set.replicas[2].err = storage.ErrNotConnected
+
+	_, err := set.UploadReplicas(context.Background(), "/a", strings.NewReader("data"))
+	if err == nil {
+		t.Fatal("upload succeeded in 1 of 3 storages")
+	}
+	if disks[0].has("/a") {
+		t.Error("copy is kept although the policy failed")
+	}
+}
+
+func TestReplicaSetUploadAllFail(t *testing.T) {
+	set, disks := newTestReplicaSet(2, 1)
+	for _, disk := range disks {
+		disk.fail["upload"] = errUnavailable
+	}
+
+	if _, err := set.UploadReplicas(context.Background(), "/a", strings.NewReader(strings.Repeat("x", 1<<20))); !errors.Is(err, errUnavailable) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestReplicaSetMove(t *testing.T) {
+	set, disks := newTestReplicaSet(2, 2)
+	disks[0].files["/a"] = []byte("data")
+
+	// Во втором хранилище файл уже перемещен прошлой попыткой
+	if _, err := set.Move(context.Background(), "/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if !disks[0].has("/b") {
+		t.Error("file is not moved")
+	}
+
+	if _, err := set.Move(context.Background(), "/a", "/b"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("missing everywhere: got %v, want ErrNotFound", err)
+	}
+
+	disks[0].files["/c"] = []byte("data")
+	disks[1].fail["move"] = errUnavailable
+	if _, err := set.Move(context.Background(), "/c", "/d"); !errors.Is(err, errUnavailable) {
+		t.Errorf("move below quorum: got %v", err)
+	}
+}
+
+func TestReplicaSetDelete(t *testing.T) {
+	set, disks := newTestReplicaSet(3, 3)
+	for _, disk := range disks[:2] {
+		disk.files["/a"] = []byte("data")
+	}
+	disks[1].fail["delete"] = errUnavailable
+
+	// Копия, которую не удалось удалить, остается лишней
+	if err := set.Delete(context.Background(), "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if disks[0].has("/a") {
+		t.Error("file is not deleted")
+	}
+
+	disks[0].fail["delete"] = errUnavailable
+	disks[2].fail["delete"] = errUnavailable
+	if err := set.Delete(context.Background(), "/a"); !errors.Is(err, errUnavailable) {
+		t.Errorf("delete failed everywhere: got %v", err)
+	}
+}
+
+func TestReplicaSetForFile(t *testing.T) {
+	set, _ := newTestReplicaSet(3, 3)
+	records := []*entity.FileReplica{
+		{BackendID: 0, Status: entity.ReplicaFailed},
+		{BackendID: 2, Status: entity.ReplicaHealthy},
+	}
+
+	ordered := set.forFile(records)
+	if len(ordered.replicas) != 2 || ordered.replicas[0].backendID != 2 || ordered.replicas[1].backendID != 0 {
+		t.Errorf("got %+v", ordered.replicas)
+	}
+	if set.forFile(nil) != set {
+		t.Error("file without records must be read from all storages")
+	}
+}
+
+// testChunkRepository хранит один фрагмент и ссылки файлов на него
+type testChunkRepository struct {
+	repository.ChunkRepository
+	chunk      *entity.Chunk
+	fileChunks map[uint][]string
+}
+
+func (r *testChunkRepository) AddChunkRefs(ctx context.Context, userID uint, chunkID string, delta int) (bool, error) {
+	if r.chunk == nil || r.chunk.ChunkID != chunkID {
+		return false, nil
+	}
+	r.chunk.RefCount += delta
+	return true, nil
+}
+
+func (r *testChunkRepository) GetChunk(ctx context.Context, userID uint, chunkID string) (*entity.Chunk, error) {
+	if r.chunk == nil || r.chunk.ChunkID != chunkID {
+		return nil, errors.New("record not found")
+	}
+	return r.chunk, nil
+}
+
+func (r *testChunkRepository) DeleteUnusedChunk(ctx context.Context, id uint) (bool, error) {
+	if r.chunk == nil || r.chunk.ID != id || r.chunk.RefCount > 0 {
+		return false, nil
+	}
+	r.chunk = nil
+	return true, nil
+}
+
+func (r *testChunkRepository) SetFileChunks(ctx context.Context, fileID uint, chunkIDs []string) error {
+	if r.fileChunks == nil {
+		r.fileChunks = make(map[uint][]string)
+	}
+	r.fileChunks[fileID] = chunkIDs
+	return nil
+}
+
+func (r *testChunkRepository) GetFileChunks(ctx context.Context, fileID uint) ([]*entity.FileChunk, error) {
+	var refs []*entity.FileChunk
+	for i, chunkID := range r.fileChunks[fileID] {
+		refs = append(refs, &entity.FileChunk{FileID: fileID, Position: i, ChunkID: chunkID})
+	}
+	return refs, nil
+}
+
+type testReplicaRepository struct {
+	repository.ReplicaRepository
+	chunkReplicas map[uint]bool
+}
+
+func (r *testReplicaRepository) GetChunkReplicas(ctx context.Context, chunkID uint) ([]*entity.ChunkReplica, error) {
+	var replicas []*entity.ChunkReplica
+	for backendID := range r.chunkReplicas {
+		replicas = append(replicas, &entity.ChunkReplica{ChunkID: chunkID, BackendID: backendID})
+	}
+	return replicas, nil
+}
+
+func (r *testReplicaRepository) AddChunkReplicas(ctx context.Context, chunkID uint, backendIDs []uint) error {
+	for _, backendID := range backendIDs {
+		r.chunkReplicas[backendID] = true
+	}
+	return nil
+}
+
+func TestStoreChunkReplicatesExistingChunk(t *testing.T) {
+	data := []byte("chunk data")
+	ref := encryption.NewChunkRef(encryption.DedupKey(make([]byte, 32)), data)
+	chunkID := hex.EncodeToString(ref.ID)
+
+	set, disks := newTestReplicaSet(3, 3)
+	// Фрагмент загружен до подключения хранилищ 1 и 2; в хранилище 1 он
+	// уже лежит, но не учтен
+	disks[0].files[chunkPath(chunkID)] = []byte("sealed")
+	disks[1].files[chunkPath(chunkID)] = []byte("sealed")
+
+	chunks := &testChunkRepository{chunk: &entity.Chunk{ID: 5, ChunkID: chunkID, RefCount: 1}}
+	replicas := &testReplicaRepository{chunkReplicas: map[uint]bool{0: true}}
+	uc := &storageUseCase{chunkRepo: chunks, replicaRepo: replicas}
+	user := &entity.User{ID: 1}
+
+	folderReady := true
+	isNew, err := uc.storeChunk(context.Background(), user, set, chunkID, ref, data, encryption.SuiteAES256GCM, &folderReady)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isNew || chunks.chunk.RefCount != 2 {
+		t.Errorf("new: %v, refs: %d", isNew, chunks.chunk.RefCount)
+	}
+	if len(replicas.chunkReplicas) != 3 {
+		t.Errorf("recorded replicas: %v", replicas.chunkReplicas)
+	}
+	if string(disks[1].files[chunkPath(chunkID)]) != "sealed" {
+		t.Error("existing copy is overwritten")
+	}
+
+	blob := disks[2].files[chunkPath(chunkID)]
+	if opened, err := encryption.OpenChunk(ref, blob); err != nil || !bytes.Equal(opened, data) {
+		t.Fatalf("uploaded copy: %q, %v", opened, err)
+	}
+
+	// Хранилище недоступно: фрагмент лежит в 3 хранилищах из 4, политика не выполнена
+	set, _ = newTestReplicaSet(4, 4)
+	set.replicas[3].err = errUnavailable
+	if _, err := uc.storeChunk(context.Background(), user, set, chunkID, ref, data, encryption.SuiteAES256GCM, &folderReady); !errors.Is(err, errUnavailable) {
+		t.Fatalf("got %v", err)
+	}
+	if chunks.chunk.RefCount != 2 {
+		t.Errorf("reference is kept after a failed upload: %d refs", chunks.chunk.RefCount)
+	}
+}
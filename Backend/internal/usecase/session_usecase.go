@@ -0,0 +1,196 @@
+package usecase
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"server/internal/entity"
+	"server/internal/repository"
+	"server/pkg/encryption"
+	"server/pkg/keycache"
+)
+
+var (
+	ErrSessionLocked = errors.New("session is locked, unlock it with the master password")
+	ErrNoSession     = errors.New("token is not bound to a session, log in again")
+	// Файлы старых форматов без ключа файла открываются только паролем,
+	// который в сессии не хранится
+	ErrMasterPasswordRequired = errors.New("file is in an old format, master_password is required to open it")
+)
+
+type sessionUseCase struct {
+	storage *storageUseCase
+	cache   *keycache.Cache
+}
+
+func NewSessionUseCase(
+	userRepo repository.UserRepository,
+	slotRepo repository.KeySlotRepository,
+	encryptionService *encryption.EncryptionService,
+	cache *keycache.Cache,
+) SessionUseCase {
+	return &sessionUseCase{
+		storage: &storageUseCase{
+			userRepo:   userRepo,
+			slotRepo:   slotRepo,
+			encryption: encryptionService,
+		},
+		cache: cache,
+	}
+}
+
+// unlockedKey - ключи, открытые мастер-паролем при разблокировке сессии.
+// Сам пароль не хранится: имена старых форматов открываются выведенным из
+// него ключом NameKey.
+type unlockedKey struct {
+	UserID      uint   `json:"user_id"`
+	KEK         []byte `json:"kek"`
+	NameKey     []byte `json:"name_key"`
+	KDF         uint8  `json:"kdf"`
+	KDFParams   []byte `json:"kdf_params"`
+	Salt        []byte `json:"salt"`
+	Fingerprint []byte `json:"fingerprint"`
+}
+
+type unlockedKeyContextKey struct{}
+
+// Unlock проверяет мастер-пароль и сохраняет открытые им ключи в памяти
+// сервера, зашифровав их секретом сессии. Секрет возвращается клиенту.
+func (uc *sessionUseCase) Unlock(ctx context.Context, userID uint, sessionID, masterPassword string) (string, time.Duration, error) {
+	if sessionID == "" {
+		return "", 0, ErrNoSession
+	}
+
+	user, err := uc.storage.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return "", 0, errors.New("user not found")
+	}
+
+	kek, keyDerivation, err := uc.storage.userKEK(ctx, user, masterPassword)
+	if err != nil {
+		return "", 0, err
+	}
+
+	fingerprint, err := uc.keyFingerprint(ctx, user)
+	if err != nil {
+		return "", 0, err
+	}
+
+	data, err := json.Marshal(&unlockedKey{
+		UserID:      user.ID,
+		KEK:         kek,
+		NameKey:     uc.storage.encryption.LegacyNameKey(masterPassword),
+		KDF:         keyDerivation.KDF,
+		KDFParams:   keyDerivation.Params,
+		Salt:        keyDerivation.Salt,
+		Fingerprint: fingerprint,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	defer keycache.Wipe(data)
+
+	secret, err := uc.cache.Put(sessionID, user.ID, data)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to unlock session: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(secret), uc.cache.IdleTimeout(), nil
+}
+
+// Lock стирает ключи сессии из памяти сервера
+func (uc *sessionUseCase) Lock(ctx context.Context, userID uint, sessionID string) error {
+	if sessionID == "" {
+		return ErrNoSession
+	}
+	uc.cache.Delete(sessionID)
+	return nil
+}
+
+// Resume открывает ключи разблокированной сессии секретом клиента.
+// Возвращает контекст, с которым ключ пользователя не выводится заново.
+func (uc *sessionUseCase) Resume(ctx context.Context, userID uint, sessionID, sessionKey string) (context.Context, error) {
+	if sessionID == "" {
+		return ctx, ErrNoSession
+	}
+
+	secret, err := base64.RawURLEncoding.DecodeString(sessionKey)
+	if err != nil {
+		return ctx, ErrSessionLocked
+	}
+
+	data, err := uc.cache.Get(sessionID, userID, secret)
+	if err != nil {
+		return ctx, ErrSessionLocked
+	}
+	defer keycache.Wipe(data)
+
+	var key unlockedKey
+	if err := json.Unmarshal(data, &key); err != nil || key.UserID != userID {
+		return ctx, ErrSessionLocked
+	}
+
+	// После смены мастер-пароля или ключей сессию нужно разблокировать заново
+	user, err := uc.storage.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return ctx, errors.New("user not found")
+	}
+	fingerprint, err := uc.keyFingerprint(ctx, user)
+	if err != nil {
+		return ctx, err
+	}
+	if subtle.ConstantTimeCompare(fingerprint, key.Fingerprint) != 1 {
+		uc.cache.Delete(sessionID)
+		return ctx, ErrSessionLocked
+	}
+
+	return context.WithValue(ctx, unlockedKeyContextKey{}, &key), nil
+}
+
+// keyFingerprint - отпечаток параметров, которыми мастер-пароль открывает
+// ключ пользователя. Меняется при смене мастер-пароля.
+func (uc *sessionUseCase) keyFingerprint(ctx context.Context, user *entity.User) ([]byte, error) {
+	h := sha256.New()
+	h.Write(user.MasterKeyID)
+	h.Write(user.KeySalt)
+	h.Write(user.KeyCheck)
+
+	if len(user.MasterKeyID) > 0 {
+		slots, err := uc.storage.slotRepo.GetKeySlots(ctx, user.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list key slots: %w", err)
+		}
+		for _, slot := range slots {
+			if slot.Type == entity.KeySlotPassword {
+				h.Write(slot.Salt)
+				h.Write(slot.WrappedKey)
+			}
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// sessionKEK возвращает ключ пользователя из разблокированной сессии,
+// если запрос пришел с ней
+func sessionKEK(ctx context.Context, user *entity.User) ([]byte, *encryption.KeyDerivation, bool) {
+	key, ok := ctx.Value(unlockedKeyContextKey{}).(*unlockedKey)
+	if !ok || key.UserID != user.ID {
+		return nil, nil, false
+	}
+	return key.KEK, &encryption.KeyDerivation{KDF: key.KDF, Params: key.KDFParams, Salt: key.Salt}, true
+}
+
+// sessionNameKey возвращает ключ имен старых форматов из разблокированной сессии
+func sessionNameKey(ctx context.Context, user *entity.User) []byte {
+	key, ok := ctx.Value(unlockedKeyContextKey{}).(*unlockedKey)
+	if !ok || key.UserID != user.ID {
+		return nil
+	}
+	return key.NameKey
+}
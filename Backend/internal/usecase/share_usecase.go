@@ -0,0 +1,319 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"server/internal/entity"
+	"server/internal/repository"
+	"server/pkg/encryption"
+	"server/pkg/storage"
+)
+
+var (
+	ErrShareNotFound       = errors.New("share not found")
+	ErrRecipientHasNoKey   = errors.New("recipient has not set up encryption keys yet")
+	ErrFileNotShareable    = errors.New("file format does not support sharing, upload the file again")
+	ErrClientFileShare     = errors.New("files encrypted on the client cannot be shared yet")
+	ErrShareAlreadyGranted = errors.New("file is already shared with this user")
+)
+
+type shareUseCase struct {
+	storage   *storageUseCase
+	shareRepo repository.FileShareRepository
+}
+
+func NewShareUseCase(
+	fileRepo repository.FileMetadataRepository,
+	userRepo repository.UserRepository,
+	slotRepo repository.KeySlotRepository,
+	shareRepo repository.FileShareRepository,
+	replicaRepo repository.ReplicaRepository,
+	providers *storage.Registry,
+	encryptionService *encryption.EncryptionService,
+) ShareUseCase {
+	return &shareUseCase{
+		storage: &storageUseCase{
+			fileRepo:    fileRepo,
+			userRepo:    userRepo,
+			slotRepo:    slotRepo,
+			replicaRepo: replicaRepo,
+			providers:   providers,
+			encryption:  encryptionService,
+		},
+		shareRepo: shareRepo,
+	}
+}
+
+// ShareFile оборачивает ключ файла для открытого ключа получателя.
+// Мастер-пароль владельца нужен, чтобы развернуть ключ файла.
+func (uc *shareUseCase) ShareFile(ctx context.Context, ownerID uint, fileID uint, recipientEmail, masterPassword string) (*entity.FileShare, error) {
+	file, err := uc.storage.fileRepo.GetFileMetadataByID(ctx, fileID)
+	if err != nil {
+		return nil, errors.New("file not found")
+	}
+	if file.UserID != ownerID {
+		return nil, errors.New("access denied")
+	}
+	// Делиться можно только файлами со случайным ключом файла: ключ,
+	// выведенный из пароля, раскрыл бы получателю ключ владельца
+	if file.Type == "dir" || len(file.WrappedKey) == 0 {
+		return nil, ErrFileNotShareable
+	}
+	// Открытого имени файла клиента сервер не знает, а получатель не может
+	// расшифровать зашифрованное имя: оно привязано к ключу имен владельца
+	if file.ClientEncrypted {
+		return nil, ErrClientFileShare
+	}
+
+	owner, err := uc.storage.userRepo.GetUserByID(ctx, ownerID)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	recipient, err := uc.storage.userRepo.GetUserByEmail(ctx, strings.TrimSpace(recipientEmail))
+	if err != nil {
+		return nil, errors.New("recipient not found")
+	}
+	if recipient.ID == owner.ID {
+		return nil, errors.New("cannot share a file with yourself")
+	}
+	if len(recipient.SharePublicKey) == 0 {
+		return nil, ErrRecipientHasNoKey
+	}
+
+	shares, err := uc.shareRepo.GetUserShares(ctx, ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shares: %w", err)
+	}
+	for _, share := range shares {
+		if share.FileID == file.ID && share.RecipientID == recipient.ID && share.Status != entity.FileShareRevoked {
+			return nil, ErrShareAlreadyGranted
+		}
+	}
+
+	kek, _, err := uc.storage.userKEK(ctx, owner, masterPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	fileKey, err := encryption.UnwrapKey(kek, file.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap file key: %w", err)
+	}
+
+	ephemeralKey, wrappedKey, err := encryption.SealShare(recipient.SharePublicKey, fileKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap file key for recipient: %w", err)
+	}
+
+	share := &entity.FileShare{
+		FileID:         file.ID,
+		OwnerID:        owner.ID,
+		RecipientID:    recipient.ID,
+		Status:         entity.FileSharePending,
+		Filename:       file.Filename,
+		OwnerEmail:     owner.Email,
+		RecipientEmail: recipient.Email,
+		EphemeralKey:   ephemeralKey,
+		WrappedKey:     wrappedKey,
+	}
+	if err := uc.shareRepo.CreateShare(ctx, share); err != nil {
+		return nil, fmt.Errorf("failed to save share: %w", err)
+	}
+
+	return share, nil
+}
+
+func (uc *shareUseCase) GetShares(ctx context.Context, userID uint) ([]*entity.FileShare, error) {
+	shares, err := uc.shareRepo.GetUserShares(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shares: %w", err)
+	}
+	return shares, nil
+}
+
+// AcceptShare принимает файл. Ключ файла проверяется сразу, чтобы
+// получатель узнал о неверном мастер-пароле до скачивания.
+func (uc *shareUseCase) AcceptShare(ctx context.Context, userID uint, shareID uint, masterPassword string) (*entity.FileShare, error) {
+	share, err := uc.recipientShare(ctx, userID, shareID)
+	if err != nil {
+		return nil, err
+	}
+	if share.Status != entity.FileSharePending {
+		return nil, fmt.Errorf("share is already %s", share.Status)
+	}
+
+	if _, err := uc.openShare(ctx, userID, share, masterPassword); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	share.Status = entity.FileShareAccepted
+	share.AcceptedAt = &now
+	if err := uc.shareRepo.UpdateShare(ctx, share); err != nil {
+		return nil, fmt.Errorf("failed to save share: %w", err)
+	}
+
+	return share, nil
+}
+
+// RevokeShare отзывает доступ (владелец) или отказывается от файла
+// (получатель). Обернутый ключ файла удаляется. Скачанную копию и ключ
+// файла, который получатель уже видел, отозвать нельзя.
+func (uc *shareUseCase) RevokeShare(ctx context.Context, userID uint, shareID uint) error {
+	share, err := uc.shareRepo.GetShareByID(ctx, shareID)
+	if err != nil || (share.OwnerID != userID && share.RecipientID != userID) {
+		return ErrShareNotFound
+	}
+	if share.Status == entity.FileShareRevoked {
+		return nil
+	}
+
+	now := time.Now()
+	share.Status = entity.FileShareRevoked
+	share.RevokedAt = &now
+	share.EphemeralKey = nil
+	share.WrappedKey = nil
+	if err := uc.shareRepo.UpdateShare(ctx, share); err != nil {
+		return fmt.Errorf("failed to save share: %w", err)
+	}
+	return nil
+}
+
+// DownloadSharedFile расшифровывает принятый файл ключом, открытым
+// мастер-паролем получателя
+func (uc *shareUseCase) DownloadSharedFile(ctx context.Context, userID uint, shareID uint, masterPassword string) (io.ReadCloser, string, error) {
+	share, err := uc.recipientShare(ctx, userID, shareID)
+	if err != nil {
+		return nil, "", err
+	}
+	if share.Status != entity.FileShareAccepted {
+		return nil, "", errors.New("share is not accepted")
+	}
+
+	fileKey, err := uc.openShare(ctx, userID, share, masterPassword)
+	if err != nil {
+		return nil, "", err
+	}
+
+	file, err := uc.storage.fileRepo.GetFileMetadataByID(ctx, share.FileID)
+	if err != nil || file.UserID != share.OwnerID {
+		return nil, "", errors.New("file not found")
+	}
+
+	// Файл лежит в облаке владельца
+	owner, err := uc.storage.userRepo.GetUserByID(ctx, share.OwnerID)
+	if err != nil {
+		return nil, "", errors.New("file owner not found")
+	}
+
+	disk, err := uc.storage.userStorage(ctx, owner)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Файл, перезаписанный владельцем, зашифрован новым ключом файла
+	// и с ключом из доступа не расшифруется
+	reader, decrypted, err := uc.storage.openFile(ctx, disk, file, func(body io.Reader) (io.Reader, error) {
+		return uc.storage.encryption.NewDecryptReaderWithKey(body, fileKey, fileContext(file))
+	})
+	if err != nil {
+		if errors.Is(err, encryption.ErrTampered) || errors.Is(err, encryption.ErrContextRequired) {
+			return nil, "", encryption.ErrTampered
+		}
+		return nil, "", err
+	}
+
+	// Фрагменты файла лежат там же, в облаке владельца
+	if file.Chunked {
+		decrypted, err = uc.storage.openChunked(ctx, disk, decrypted)
+		if err != nil {
+			reader.Close()
+			if errors.Is(err, encryption.ErrTampered) {
+				return nil, "", encryption.ErrTampered
+			}
+			return nil, "", fmt.Errorf("failed to read chunk manifest: %w", err)
+		}
+	}
+
+	filename := file.Filename
+	if file.ClientEncrypted {
+		filename = share.Filename
+	}
+	return &readCloser{Reader: decrypted, Closer: reader}, filename, nil
+}
+
+// recipientShare возвращает доступ, полученный пользователем
+func (uc *shareUseCase) recipientShare(ctx context.Context, userID uint, shareID uint) (*entity.FileShare, error) {
+	share, err := uc.shareRepo.GetShareByID(ctx, shareID)
+	if err != nil || share.RecipientID != userID {
+		return nil, ErrShareNotFound
+	}
+	return share, nil
+}
+
+// openShare открывает ключ файла закрытым ключом получателя, который
+// разворачивается ключом пользователя из мастер-пароля
+func (uc *shareUseCase) openShare(ctx context.Context, userID uint, share *entity.FileShare, masterPassword string) ([]byte, error) {
+	user, err := uc.storage.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	kek, _, err := uc.storage.userKEK(ctx, user, masterPassword)
+	if err != nil {
+		return nil, err
+	}
+	if len(user.SharePrivateKey) == 0 {
+		return nil, ErrRecipientHasNoKey
+	}
+
+	privateKey, err := encryption.UnwrapKey(kek, user.SharePrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap share key: %w", err)
+	}
+
+	fileKey, err := encryption.OpenShare(privateKey, share.EphemeralKey, share.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open shared file key: %w", err)
+	}
+	return fileKey, nil
+}
+
+// ensureShareKeys создает пользователю пару ключей для обмена файлами.
+// Закрытый ключ оборачивается ключом из слотов: он не меняется при смене
+// мастер-пароля, поэтому пару не нужно перевыпускать.
+func (uc *storageUseCase) ensureShareKeys(ctx context.Context, user *entity.User, kek []byte) {
+	if len(user.SharePublicKey) > 0 || len(user.MasterKeyID) == 0 {
+		return
+	}
+
+	publicKey, privateKey, err := encryption.GenerateShareKeyPair()
+	if err != nil {
+		slog.Warn("failed to generate share keys", "user", user.ID, "error", err)
+		return
+	}
+
+	suite, err := uc.encryption.ResolveSuite(0)
+	if err != nil {
+		return
+	}
+
+	wrappedKey, err := encryption.WrapKey(suite, kek, privateKey)
+	if err != nil {
+		slog.Warn("failed to wrap share key", "user", user.ID, "error", err)
+		return
+	}
+
+	user.SharePublicKey = publicKey
+	user.SharePrivateKey = wrappedKey
+	if err := uc.userRepo.UpdateUser(ctx, user); err != nil {
+		slog.Warn("failed to save share keys", "user", user.ID, "error", err)
+	}
+}
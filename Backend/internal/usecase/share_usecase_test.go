@@ -0,0 +1,20 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"server/internal/entity"
+)
+
+func TestShareFileRejectsClientEncryptedFile(t *testing.T) {
+	files := &testFileRepository{}
+	file := &entity.FileMetadata{UserID: 1, Type: "file", Filename: "encrypted_file", WrappedKey: []byte("key"), ClientEncrypted: true}
+	files.CreateFileMetadata(context.Background(), file)
+	uc := &shareUseCase{storage: &storageUseCase{fileRepo: files}}
+
+	if _, err := uc.ShareFile(context.Background(), 1, file.ID, "bob@example.com", "password"); !errors.Is(err, ErrClientFileShare) {
+		t.Fatalf("got %v, want ErrClientFileShare", err)
+	}
+}
@@ -3,36 +3,60 @@ package usecase
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
+	"log/slog"
 	"strings"
 	"time"
 
 	"server/internal/entity"
 	"server/internal/repository"
 	"server/pkg/encryption"
+	"server/pkg/storage"
 	"server/pkg/yandex_disk"
 )
 
+// ErrStorageInUse - в подключенном хранилище уже есть файлы
+var ErrStorageInUse = errors.New("storage cannot be changed while it contains files")
+
 type storageUseCase struct {
 	fileRepo     repository.FileMetadataRepository
 	userRepo     repository.UserRepository
-	yandexDisk   *yandex_disk.Client
+	dirRepo      repository.DirectoryRepository
+	slotRepo     repository.KeySlotRepository
+	chunkRepo    repository.ChunkRepository
+	replicaRepo  repository.ReplicaRepository
+	yandexDisk   *yandex_disk.Client // OAuth Яндекс.Диска
+	providers    *storage.Registry
 	encryption   *encryption.EncryptionService
+	keyRotation  KeyRotationUseCase
 }
 
 func NewStorageUseCase(
 	fileRepo repository.FileMetadataRepository,
 	userRepo repository.UserRepository,
+	dirRepo repository.DirectoryRepository,
+	slotRepo repository.KeySlotRepository,
+	chunkRepo repository.ChunkRepository,
+	replicaRepo repository.ReplicaRepository,
 	yandexDisk *yandex_disk.Client,
+	providers *storage.Registry,
+	encryptionService *encryption.EncryptionService,
+	keyRotation KeyRotationUseCase,
 ) StorageUseCase {
 	return &storageUseCase{
 		fileRepo:     fileRepo,
 		userRepo:     userRepo,
+		dirRepo:      dirRepo,
+		slotRepo:     slotRepo,
+		chunkRepo:    chunkRepo,
+		replicaRepo:  replicaRepo,
 		yandexDisk:   yandexDisk,
-		encryption:   encryption.NewEncryptionService(),
+		providers:    providers,
+		encryption:   encryptionService,
+		keyRotation:  keyRotation,
 	}
 }
 
@@ -52,7 +76,8 @@ func (uc *storageUseCase) HandleCallback(ctx context.Context, code string, userI
 	}
 
 	expiry := time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
-	user.YandexDiskToken = tokenResp.AccessToken
+	user.StorageProvider = yandex_disk.ProviderName
+	user.StorageCredentials = tokenResp.AccessToken
 	user.YandexDiskExpiry = &expiry
 
 	return uc.userRepo.UpdateUser(ctx, user)
@@ -64,46 +89,111 @@ func (uc *storageUseCase) GetYandexToken(ctx context.Context, userID uint) (stri
 		return "", errors.New("user not found")
 	}
 
-	if user.YandexDiskToken == "" {
+	if user.StorageCredentials == "" || (user.StorageProvider != "" && user.StorageProvider != yandex_disk.ProviderName) {
 		return "", errors.New("yandex disk not connected")
 	}
 
-	return user.YandexDiskToken, nil
+	return user.StorageCredentials, nil
+}
+
+// GetQuota возвращает провайдер хранилища пользователя и занятое в нем место
+func (uc *storageUseCase) GetQuota(ctx context.Context, userID uint) (string, *storage.Quota, error) {
+	user, err := uc.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return "", nil, errors.New("user not found")
+	}
+
+	disk, err := uc.userStorage(ctx, user)
+	if err != nil {
+		return "", nil, err
+	}
+
+	quota, err := disk.Quota(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get storage quota: %w", err)
+	}
+	return disk.Provider, quota, nil
+}
+
+// ConnectStorage подключает хранилище, которому не нужен OAuth (локальный
+// диск и т.п.). Сменить хранилище можно, только пока в нем нет файлов:
+// файлы между хранилищами не переносятся.
+func (uc *storageUseCase) ConnectStorage(ctx context.Context, userID uint, providerName, credentials string) error {
+	user, err := uc.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return errors.New("user not found")
+	}
+
+	provider, err := uc.providers.Get(providerName)
+	if err != nil {
+		return err
+	}
+	connector, ok := provider.(storage.Connector)
+	if !ok {
+		return fmt.Errorf("storage provider %s must be connected via OAuth", providerName)
+	}
+
+	if user.StorageCredentials != "" && user.StorageProvider != providerName {
+		files, err := uc.fileRepo.GetUserFiles(ctx, userID, "")
+		if err != nil {
+			return fmt.Errorf("failed to check user files: %w", err)
+		}
+		if len(files) > 0 {
+			return ErrStorageInUse
+		}
+	}
+
+	credentials, err = connector.Connect(ctx, userID, credentials)
+	if err != nil {
+		return fmt.Errorf("failed to connect storage: %w", err)
+	}
+
+	user.StorageProvider = providerName
+	user.StorageCredentials = credentials
+	return uc.userRepo.UpdateUser(ctx, user)
 }
 
 func (uc *storageUseCase) GetFiles(ctx context.Context, userID uint, path string) ([]*entity.FileMetadata, error) {
 	user, err := uc.userRepo.GetUserByID(ctx, userID)
 	if err != nil {
-		fmt.Printf("DEBUG: User %d not found: %v\n", userID, err)
 		return nil, errors.New("user not found")
 	}
 
-	if user.YandexDiskToken == "" {
-		fmt.Printf("DEBUG: Yandex.Disk not connected for user %d\n", userID)
-		return nil, errors.New("yandex disk not connected")
+	disk, err := uc.userStorage(ctx, user)
+	if err != nil {
+		return nil, err
 	}
 
-	// Нормализуем путь
-	if path == "" {
-		path = "/"
-	}
+	// Нормализуем путь: клиент работает с открытыми путями,
+	// в облаке каталоги лежат под зашифрованными именами
+	path = normalizeDir(path)
+	providerPath := uc.resolveDirectory(ctx, userID, path)
 	
-	fmt.Printf("DEBUG: Getting files from Yandex.Disk for user %d, path: '%s'\n", userID, path)
+	slog.Debug("listing files", "provider", disk.Provider, "user", userID, "path", path)
 
-	// Получаем файлы из Яндекс.Диска
-	diskResp, err := uc.yandexDisk.GetFilesList(ctx, user.YandexDiskToken, path)
+	// Получаем файлы из хранилища
+	items, err := disk.List(ctx, providerPath)
 	if err != nil {
-		fmt.Printf("DEBUG: Failed to get files from Yandex.Disk: %v\n", err)
-		return nil, fmt.Errorf("failed to get files from yandex disk: %w", err)
+		return nil, fmt.Errorf("failed to get files from storage: %w", err)
 	}
 
-	fmt.Printf("DEBUG: Got %d items from Yandex.Disk path '%s'\n", len(diskResp.Embedded.Items), path)
+	slog.Debug("listed files", "user", userID, "path", path, "items", len(items))
 
 	// Для каждого элемента создаем метаданные
 	var filesMetadata []*entity.FileMetadata
-	for _, item := range diskResp.Embedded.Items {
-		fmt.Printf("DEBUG: Processing item: %s (type: %s, path: %s, size: %d)\n", 
-			item.Name, item.Type, item.Path, item.Size)
+	for _, item := range items {
+		slog.Debug("processing item", "name", item.Name, "type", item.Type, "path", item.Path, "size", item.Size)
+		
+		// Копия слотов ключей и каталог фрагментов - служебные
+		if path == "/" && (item.Name == encryption.KeyringFileName || "/"+item.Name == chunkDir) {
+			continue
+		}
+
+		// Каталоги отдаем с открытыми именем и путем из сохраненного соответствия
+		if item.Type == "dir" {
+			filesMetadata = append(filesMetadata, uc.directoryMetadata(ctx, userID, path, item))
+			continue
+		}
 		
 		// Определяем, является ли файл зашифрованным
 		isEncrypted := strings.HasSuffix(item.Name, ".encrypted")
@@ -121,16 +211,11 @@ func (uc *storageUseCase) GetFiles(ctx context.Context, userID uint, path string
 		
 		// Определяем тип (dir или file)
 		itemType := "file"
-		if item.Type == "dir" {
-			itemType = "dir"
-		}
 		
 		// Определяем MIME тип
 		mimeType := item.MimeType
 		if mimeType == "" {
-			if itemType == "dir" {
-				mimeType = "directory"
-			} else if strings.HasSuffix(strings.ToLower(item.Name), ".jpg") || 
+			if strings.HasSuffix(strings.ToLower(item.Name), ".jpg") || 
 			   strings.HasSuffix(strings.ToLower(item.Name), ".jpeg") {
 				mimeType = "image/jpeg"
 			} else if strings.HasSuffix(strings.ToLower(item.Name), ".png") {
@@ -144,8 +229,13 @@ func (uc *storageUseCase) GetFiles(ctx context.Context, userID uint, path string
 			}
 		}
 		
-		// Проверяем, есть ли уже метаданные в БД
-		fileMetadata, err := uc.fileRepo.GetFileByPath(ctx, userID, item.Path)
+		// Проверяем, есть ли уже метаданные в БД. Загруженные через сервис
+		// файлы хранят путь без префикса "disk:"
+		itemPath := strings.TrimPrefix(item.Path, "disk:")
+		fileMetadata, err := uc.fileRepo.GetFileByPath(ctx, userID, itemPath)
+		if err != nil {
+			fileMetadata, err = uc.fileRepo.GetFileByPath(ctx, userID, item.Path)
+		}
 		if err != nil {
 			// Создаем новую запись
 			fileMetadata = &entity.FileMetadata{
@@ -153,119 +243,536 @@ func (uc *storageUseCase) GetFiles(ctx context.Context, userID uint, path string
 				Filename:      originalName,
 				EncryptedName: item.Name,
 				Path:          item.Path,
+				Dir:           dirPrefix(path),
 				Size:          item.Size,
 				MimeType:      mimeType,
 				IsEncrypted:   isEncrypted,
 				Type:          itemType,
 			}
 			
-			// Сохраняем в БД только файлы (не папки)
-			if itemType == "file" {
-				err = uc.fileRepo.CreateFileMetadata(ctx, fileMetadata)
-				if err != nil {
-					fmt.Printf("DEBUG: Could not save metadata for %s: %v\n", item.Name, err)
-					// Продолжаем даже если не удалось сохранить
-				}
+			// Сохраняем в БД
+			err = uc.fileRepo.CreateFileMetadata(ctx, fileMetadata)
+			if err != nil {
+				slog.Warn("could not save file metadata", "name", item.Name, "user", userID, "error", err)
+				// Продолжаем даже если не удалось сохранить
 			}
 			
-			fmt.Printf("DEBUG: Created metadata for %s: %s (encrypted: %v, type: %s, size: %d)\n", 
-				item.Type, originalName, isEncrypted, itemType, item.Size)
+			slog.Debug("created file metadata", "name", originalName, "encrypted", isEncrypted, "type", itemType, "size", item.Size)
 		} else {
-			// Обновляем существующую запись
-			fileMetadata.Filename = originalName
+			// Обновляем существующую запись. Открытое имя зашифрованного
+			// файла известно только из БД - его не перезаписываем
+			if !fileMetadata.IsEncrypted || !isEncrypted {
+				fileMetadata.Filename = originalName
+			}
 			fileMetadata.EncryptedName = item.Name
-			fileMetadata.Size = item.Size
+			// В облаке у файла из фрагментов лежит только манифест
+			if !fileMetadata.Chunked {
+				fileMetadata.Size = item.Size
+			}
 			fileMetadata.MimeType = mimeType
 			fileMetadata.IsEncrypted = isEncrypted
 			fileMetadata.Type = itemType
 			
 			// Обновляем в БД
 			if err := uc.fileRepo.UpdateFileMetadata(ctx, fileMetadata); err != nil {
-				fmt.Printf("DEBUG: Could not update metadata for %s: %v\n", item.Name, err)
+				slog.Warn("could not update file metadata", "name", item.Name, "user", userID, "error", err)
 			}
 			
-			fmt.Printf("DEBUG: Updated metadata for %s: %s (ID: %d, type: %s, size: %d)\n", 
-				item.Type, fileMetadata.Filename, fileMetadata.ID, itemType, item.Size)
+			slog.Debug("updated file metadata", "file", fileMetadata.ID, "type", itemType, "size", item.Size)
 		}
 		
 		// Добавляем в результат
 		filesMetadata = append(filesMetadata, fileMetadata)
 	}
 
-	fmt.Printf("DEBUG: Returning %d items (files + folders)\n", len(filesMetadata))
+	slog.Debug("returning files", "user", userID, "items", len(filesMetadata))
 	return filesMetadata, nil
 }
 
-func (uc *storageUseCase) UploadFile(ctx context.Context, userID uint, fileHeader *multipart.FileHeader, masterPassword, path string) (*entity.FileMetadata, error) {
+func (uc *storageUseCase) UploadFile(ctx context.Context, userID uint, filename, contentType string, content io.Reader, masterPassword, path, compression string, chunked bool) (*entity.FileMetadata, error) {
 	user, err := uc.userRepo.GetUserByID(ctx, userID)
 	if err != nil {
 		return nil, errors.New("user not found")
 	}
 
-	if user.YandexDiskToken == "" {
-		return nil, errors.New("yandex disk not connected")
+	disk, err := uc.userStorage(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	// Постоянный идентификатор файла: к нему и к пользователю привязываются
+	// шифротексты имени и содержимого
+	fileUUID, err := newFileUUID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate file id: %w", err)
 	}
 
-	// Открываем файл
-	file, err := fileHeader.Open()
+	// Уже сжатые форматы не сжимаем даже по запросу
+	codec, err := encryption.ChooseCompression(compression, contentType)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
+		return nil, err
 	}
-	defer file.Close()
 
-	// Читаем содержимое файла
-	fileContent, err := io.ReadAll(file)
+	// Ключ пользователя, которым оборачивается случайный ключ файла.
+	// Открываем его первым: неверный пароль не должен создавать каталоги.
+	// Первая загрузка задает парольную фразу шифрования.
+	kek, keyDerivation, err := uc.userKEK(ctx, user, masterPassword)
+	if errors.Is(err, ErrPassphraseNotSet) {
+		kek, keyDerivation, err = uc.setupPassphrase(ctx, user, masterPassword)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
+		return nil, err
+	}
+
+	// Ключ дедупликации выводится из ключа в слотах, который не меняется
+	// при смене пароля
+	if chunked && keyDerivation.KDF != encryption.KDFMasterKey {
+		return nil, ErrChunkedRequiresKeySlots
 	}
 
-	// Шифруем файл
-	encryptedContent, err := uc.encryption.EncryptFile(fileContent, masterPassword)
+	// Каталоги создаются в облаке под зашифрованными именами
+	dir := normalizeDir(path)
+	providerDir, err := uc.ensureDirectory(ctx, user, dir, kek)
 	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt file: %w", err)
+		return nil, err
 	}
 
 	// Шифруем имя файла
-	encryptedFilename, err := uc.encryption.EncryptFilename(fileHeader.Filename, masterPassword)
+	opts := userWriteOptions(user)
+	opts.Context = &encryption.FileContext{UserID: uint64(userID), FileID: fileUUID, Dir: dirPrefix(dir)}
+	opts.Compression = codec
+	encryptedFilename, err := uc.encryption.EncryptFilename(filename, kek, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to encrypt filename: %w", err)
 	}
 
 	// Формируем полный путь
-	fullPath := path
-	if path != "/" && !strings.HasSuffix(path, "/") {
-		fullPath += "/"
+	fullPath := dirPrefix(providerDir) + encryptedFilename
+
+	// Детерминированное имя совпадает с именем уже загруженного файла с тем
+	// же именем в том же каталоге - тогда перезаписываем его, а не плодим копии
+	var existing *entity.FileMetadata
+	if opts.DeterministicName {
+		if file, err := uc.fileRepo.GetFileByPath(ctx, userID, fullPath); err == nil && file.Type != "dir" {
+			existing = file
+			if existing.UUID != "" {
+				opts.Context.FileID = existing.UUID
+			}
+		}
 	}
-	fullPath += encryptedFilename
 
-	// Загружаем зашифрованный файл в Яндекс.Диск
-	reader := bytes.NewReader(encryptedContent)
-	err = uc.yandexDisk.UploadFile(ctx, user.YandexDiskToken, fullPath, reader)
+	// Содержимое уходит в облако новыми фрагментами, на место файла -
+	// зашифрованный манифест
+	var chunkIDs []string
+	var plainSize int64
+	if chunked {
+		manifest, ids, err := uc.uploadChunked(ctx, user, content, kek, opts.Suite)
+		if err != nil {
+			return nil, err
+		}
+		chunkIDs, plainSize = ids, manifest.Size()
+		content = bytes.NewReader(manifest.Marshal())
+		opts.Compression = encryption.CompressionNone
+	}
+
+	wrappedKey, size, replicas, err := uc.uploadEncrypted(ctx, disk, fullPath, content, kek, keyDerivation, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to upload file to yandex disk: %w", err)
+		if chunked {
+			uc.releaseChunks(ctx, user, chunkIDs)
+		}
+		return nil, err
+	}
+	if chunked {
+		size = plainSize
+	}
+
+	if existing != nil {
+		hadChunks := existing.Chunked
+		existing.UUID = opts.Context.FileID
+		existing.Filename = filename
+		existing.EncryptedName = encryptedFilename
+		existing.Size = size
+		existing.MimeType = contentType
+		existing.IsEncrypted = true
+		existing.WrappedKey = wrappedKey
+		existing.KDF = keyDerivation.KDF
+		existing.Chunked = chunked
+
+		if err := uc.fileRepo.UpdateFileMetadata(ctx, existing); err != nil {
+			return nil, fmt.Errorf("failed to save file metadata: %w", err)
+		}
+		uc.saveReplicas(ctx, existing.ID, replicas)
+		if err := uc.replaceFileChunks(ctx, user, existing.ID, chunkIDs, hadChunks); err != nil {
+			return nil, err
+		}
+		return existing, nil
 	}
 
 	// Сохраняем метаданные в БД
 	fileMetadata := &entity.FileMetadata{
+		UUID:          fileUUID,
 		UserID:        userID,
-		Filename:      fileHeader.Filename,
+		Filename:      filename,
 		EncryptedName: encryptedFilename,
 		Path:          fullPath,
-		Size:          int64(len(encryptedContent)),
-		MimeType:      fileHeader.Header.Get("Content-Type"),
+		Dir:           dirPrefix(dir),
+		Size:          size,
+		MimeType:      contentType,
 		IsEncrypted:   true,
 		Type:          "file",
+		WrappedKey:    wrappedKey,
+		KDF:           keyDerivation.KDF,
+		Chunked:       chunked,
 	}
 
 	err = uc.fileRepo.CreateFileMetadata(ctx, fileMetadata)
 	if err != nil {
+		if chunked {
+			uc.releaseChunks(ctx, user, chunkIDs)
+		}
 		return nil, fmt.Errorf("failed to save file metadata: %w", err)
 	}
+	uc.saveReplicas(ctx, fileMetadata.ID, replicas)
+	if err := uc.replaceFileChunks(ctx, user, fileMetadata.ID, chunkIDs, false); err != nil {
+		return nil, err
+	}
 
 	return fileMetadata, nil
 }
 
-func (uc *storageUseCase) DownloadFile(ctx context.Context, userID uint, fileID uint, masterPassword string) ([]byte, string, error) {
+// uploadEncrypted шифрует content потоком и загружает результат в хранилище:
+// данные идут через шифрование прямо в облако, не накапливаясь в памяти.
+// Возвращает обернутый ключ файла, размер зашифрованного файла и итог
+// записи в каждое хранилище.
+func (uc *storageUseCase) uploadEncrypted(ctx context.Context, disk *replicaSet, fullPath string, content io.Reader, kek []byte, keyDerivation *encryption.KeyDerivation, opts encryption.WriteOptions) ([]byte, int64, []replicaResult, error) {
+	pr, pw := io.Pipe()
+	counter := &countingWriter{w: pw}
+	encryptDone := make(chan error, 1)
+
+	var wrappedKey []byte
+	go func() {
+		var err error
+		wrappedKey, err = uc.encryptStream(counter, content, kek, keyDerivation, opts)
+		pw.CloseWithError(err)
+		encryptDone <- err
+	}()
+
+	replicas, err := disk.UploadReplicas(ctx, fullPath, pr)
+	// Если загрузка прервалась, закрытие pipe разблокирует шифрование
+	pr.Close()
+
+	encryptErr := <-encryptDone
+	if encryptErr != nil && !errors.Is(encryptErr, io.ErrClosedPipe) {
+		return nil, 0, nil, fmt.Errorf("failed to encrypt file: %w", encryptErr)
+	}
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to upload file to storage: %w", err)
+	}
+
+	return wrappedKey, counter.n, replicas, nil
+}
+
+// encryptStream шифрует content случайным ключом файла и пишет результат в w.
+// Возвращает ключ файла, обернутый ключом пользователя.
+func (uc *storageUseCase) encryptStream(w io.Writer, content io.Reader, kek []byte, keyDerivation *encryption.KeyDerivation, opts encryption.WriteOptions) ([]byte, error) {
+	encWriter, wrappedKey, err := uc.encryption.NewEnvelopeWriter(w, kek, keyDerivation, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(encWriter, content); err != nil {
+		return nil, err
+	}
+
+	if err := encWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	return wrappedKey, nil
+}
+
+// userWriteOptions возвращает параметры шифрования новых файлов пользователя
+func userWriteOptions(user *entity.User) encryption.WriteOptions {
+	return encryption.WriteOptions{
+		Suite:             encryption.CipherSuite(user.CipherSuite),
+		DeterministicName: user.DeterministicNames,
+		Padding:           encryption.PaddingScheme(user.Padding),
+	}
+}
+
+// fileContext возвращает контекст, к которому привязан шифротекст файла.
+// Файлы, загруженные до появления привязки, идентификатора не имеют.
+func fileContext(file *entity.FileMetadata) *encryption.FileContext {
+	if file.UUID == "" {
+		return nil
+	}
+	dir := file.Dir
+	if dir == "" {
+		dir = file.Path[:strings.LastIndex(file.Path, "/")+1]
+	}
+	return &encryption.FileContext{UserID: uint64(file.UserID), FileID: file.UUID, Dir: dir}
+}
+
+// normalizeDir приводит открытый путь каталога к виду /a/b (корень - /)
+func normalizeDir(path string) string {
+	path = strings.TrimPrefix(path, "disk:")
+	var parts []string
+	for _, part := range strings.Split(path, "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// dirPrefix возвращает путь каталога с завершающим слэшем
+func dirPrefix(dir string) string {
+	if strings.HasSuffix(dir, "/") {
+		return dir
+	}
+	return dir + "/"
+}
+
+// resolveDirectory возвращает путь в облаке для открытого пути каталога.
+// Каталоги без сохраненного соответствия считаются незашифрованными.
+func (uc *storageUseCase) resolveDirectory(ctx context.Context, userID uint, path string) string {
+	plain, provider := "/", "/"
+	for _, name := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		plain = dirPrefix(plain) + name
+		if dir, err := uc.dirRepo.GetDirectoryByPath(ctx, userID, plain); err == nil {
+			provider = dir.EncryptedPath
+		} else {
+			provider = dirPrefix(provider) + name
+		}
+	}
+	return provider
+}
+
+// ensureDirectory возвращает путь в облаке для открытого пути каталога,
+// создавая недостающие каталоги под зашифрованными именами. Имена каталогов
+// шифруются детерминированно с привязкой к родительскому каталогу, поэтому
+// повторное создание того же каталога дает то же имя.
+func (uc *storageUseCase) ensureDirectory(ctx context.Context, user *entity.User, path string, kek []byte) (string, error) {
+	plain, provider := "/", "/"
+	for _, name := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if name == ".." {
+			return "", errors.New("invalid path")
+		}
+
+		parent := plain
+		plain = dirPrefix(plain) + name
+		if dir, err := uc.dirRepo.GetDirectoryByPath(ctx, user.ID, plain); err == nil {
+			provider = dir.EncryptedPath
+			continue
+		}
+
+		dir, err := uc.createDirectory(ctx, user, plain, provider, func() (string, error) {
+			return uc.encryption.EncryptFilename(name, kek, encryption.WriteOptions{
+				Context:           &encryption.FileContext{UserID: uint64(user.ID), Dir: dirPrefix(parent)},
+				DeterministicName: true,
+			})
+		})
+		if err != nil {
+			return "", err
+		}
+		provider = dir.EncryptedPath
+	}
+	return provider, nil
+}
+
+// createDirectory создает каталог с открытым путем plain в каталоге облака
+// providerParent. Каталоги, созданные до шифрования путей, остаются под
+// открытыми именами - их только запоминаем, чтобы не проверять облако
+// повторно. Новый каталог создается под именем, которое возвращает encryptName.
+func (uc *storageUseCase) createDirectory(ctx context.Context, user *entity.User, plain, providerParent string, encryptName func() (string, error)) (*entity.Directory, error) {
+	name := plain[strings.LastIndex(plain, "/")+1:]
+	dir := &entity.Directory{UserID: user.ID, Path: plain, Name: name}
+
+	disk, err := uc.userStorage(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	legacyPath := dirPrefix(providerParent) + name
+	_, err = disk.Stat(ctx, legacyPath)
+	switch {
+	case err == nil:
+		dir.EncryptedPath, dir.EncryptedName = legacyPath, name
+	case errors.Is(err, storage.ErrNotFound):
+		encryptedName, err := encryptName()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt directory name: %w", err)
+		}
+
+		dir.EncryptedPath, dir.EncryptedName = dirPrefix(providerParent)+encryptedName, encryptedName
+		if err := disk.Mkdir(ctx, dir.EncryptedPath); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("failed to check directory: %w", err)
+	}
+
+	if err := uc.dirRepo.CreateDirectory(ctx, dir); err != nil {
+		// Каталог мог создать параллельный запрос
+		existing, getErr := uc.dirRepo.GetDirectoryByPath(ctx, user.ID, plain)
+		if getErr != nil {
+			return nil, fmt.Errorf("failed to save directory: %w", err)
+		}
+		return existing, nil
+	}
+	return dir, nil
+}
+
+// directoryMetadata описывает каталог из облака открытыми именем и путем
+func (uc *storageUseCase) directoryMetadata(ctx context.Context, userID uint, parent string, item storage.Resource) *entity.FileMetadata {
+	metadata := &entity.FileMetadata{
+		UserID:        userID,
+		Filename:      item.Name,
+		EncryptedName: item.Name,
+		Path:          dirPrefix(parent) + item.Name,
+		MimeType:      "directory",
+		IsEncrypted:   false,
+		Type:          "dir",
+	}
+
+	if dir, err := uc.dirRepo.GetDirectoryByEncryptedPath(ctx, userID, strings.TrimPrefix(item.Path, "disk:")); err == nil {
+		metadata.Filename = dir.Name
+		metadata.Path = dir.Path
+		metadata.IsEncrypted = dir.EncryptedName != dir.Name
+	}
+
+	return metadata
+}
+
+// newFileUUID генерирует случайный UUID версии 4
+func newFileUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// userKeyDerivation возвращает параметры вывода ключа пользователя,
+// при первом обращении генерирует их и сохраняет в БД
+func (uc *storageUseCase) userKeyDerivation(ctx context.Context, user *entity.User) (*encryption.KeyDerivation, error) {
+	if len(user.KeySalt) > 0 {
+		return &encryption.KeyDerivation{
+			KDF:    user.KeyKDF,
+			Params: user.KeyKDFParams,
+			Salt:   user.KeySalt,
+		}, nil
+	}
+
+	keyDerivation, err := uc.encryption.NewKeyDerivation()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key parameters: %w", err)
+	}
+
+	user.KeyKDF = keyDerivation.KDF
+	user.KeyKDFParams = keyDerivation.Params
+	user.KeySalt = keyDerivation.Salt
+
+	if err := uc.userRepo.UpdateUser(ctx, user); err != nil {
+		return nil, fmt.Errorf("failed to save key parameters: %w", err)
+	}
+
+	return keyDerivation, nil
+}
+
+// userKEK открывает ключ пользователя слотом мастер-пароля (см. KeySlot).
+// Пользователь без слотов переводится на слоты при первом обращении; пока
+// перевод невозможен, ключ выводится из мастер-пароля напрямую.
+func (uc *storageUseCase) userKEK(ctx context.Context, user *entity.User, masterPassword string) ([]byte, *encryption.KeyDerivation, error) {
+	if !user.HasPassphrase() {
+		return nil, nil, ErrPassphraseNotSet
+	}
+
+	// Ключ уже открыт при разблокировке сессии
+	if kek, keyDerivation, ok := sessionKEK(ctx, user); ok {
+		return kek, keyDerivation, nil
+	}
+
+	if uc.slotRepo != nil {
+		var kek []byte
+		var err error
+		if len(user.MasterKeyID) > 0 {
+			kek, err = uc.unlockKeySlot(ctx, user, entity.KeySlotPassword, masterPassword)
+		} else {
+			kek, err = uc.setupKeySlots(ctx, user, masterPassword)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if kek != nil {
+			// Пара ключей для обмена файлами нужна до того, как файлом
+			// поделятся с пользователем
+			uc.ensureShareKeys(ctx, user, kek)
+			return kek, encryption.MasterKeyDerivation(kek), nil
+		}
+	}
+
+	keyDerivation, err := uc.userKeyDerivation(ctx, user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kek, err := uc.encryption.DeriveKEK(masterPassword, keyDerivation)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	if err := uc.checkKEK(ctx, user, kek, masterPassword); err != nil {
+		return nil, nil, err
+	}
+
+	return kek, keyDerivation, nil
+}
+
+// nameKeys возвращает ключи для расшифровки имен файлов пользователя.
+// Без пароля ключ имен старых форматов берется из разблокированной сессии.
+func (uc *storageUseCase) nameKeys(ctx context.Context, user *entity.User, kek []byte, masterPassword string) *encryption.NameKeys {
+	return &encryption.NameKeys{KEK: kek, Legacy: sessionNameKey(ctx, user), Password: masterPassword}
+}
+
+// checkKEK сверяет выведенный из пароля ключ с проверочным значением
+// пользователя. Если значения еще нет, оно сохраняется, когда пароль
+// подтвержден хэшем пароля входа (аккаунты с общим паролем).
+func (uc *storageUseCase) checkKEK(ctx context.Context, user *entity.User, kek []byte, masterPassword string) error {
+	if !passphraseConfirmed(user, kek, masterPassword) {
+		return ErrInvalidMasterPassword
+	}
+	if len(user.KeyCheck) > 0 {
+		return nil
+	}
+
+	user.KeyCheck = encryption.NewKeyCheck(kek)
+	if err := uc.userRepo.UpdateUser(ctx, user); err != nil {
+		slog.Warn("failed to save key check", "user", user.ID, "error", err)
+	}
+	return nil
+}
+
+// VerifyMasterPassword проверяет мастер-пароль, не обращаясь к облаку
+func (uc *storageUseCase) VerifyMasterPassword(ctx context.Context, userID uint, masterPassword string) error {
+	user, err := uc.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return errors.New("user not found")
+	}
+
+	_, _, err = uc.userKEK(ctx, user, masterPassword)
+	return err
+}
+
+func (uc *storageUseCase) DownloadFile(ctx context.Context, userID uint, fileID uint, masterPassword string) (io.ReadCloser, string, error) {
 	// Получаем метаданные файла
 	fileMetadata, err := uc.fileRepo.GetFileMetadataByID(ctx, fileID)
 	if err != nil {
@@ -281,26 +788,116 @@ func (uc *storageUseCase) DownloadFile(ctx context.Context, userID uint, fileID
 		return nil, "", errors.New("user not found")
 	}
 
-	// Скачиваем зашифрованный файл из Яндекс.Диска
-	reader, err := uc.yandexDisk.DownloadFile(ctx, user.YandexDiskToken, fileMetadata.Path)
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to download file: %w", err)
+	// Ключ пользователя открываем до скачивания: неверный пароль отклоняется
+	// по слоту или проверочному значению без обращения к Яндекс.Диску
+	var kek, fileKey []byte
+	if len(user.KeySalt) > 0 || len(user.MasterKeyID) > 0 || !user.HasPassphrase() {
+		kek, _, err = uc.userKEK(ctx, user, masterPassword)
+		if err != nil {
+			return nil, "", err
+		}
 	}
-	defer reader.Close()
 
-	// Читаем зашифрованное содержимое
-	encryptedContent, err := io.ReadAll(reader)
+	if len(fileMetadata.WrappedKey) > 0 && kek != nil {
+		fileKey, err = encryption.UnwrapKey(kek, fileMetadata.WrappedKey)
+		if err != nil {
+			// Во время смены ключей ключ файла обернут еще старым ключом
+			// пользователя, который новым паролем не открыть
+			if uc.keyRotationRunning(ctx, userID) {
+				return nil, "", ErrFileRotationPending
+			}
+			return nil, "", fmt.Errorf("decryption failed: %w", err)
+		}
+	}
+	if fileKey == nil && masterPassword == "" {
+		return nil, "", ErrMasterPasswordRequired
+	}
+
+	disk, err := uc.userStorage(ctx, user)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to read file content: %w", err)
+		return nil, "", err
 	}
 
-	// Дешифруем файл
-	decryptedContent, err := uc.encryption.DecryptFile(encryptedContent, masterPassword)
+	// Скачиваем зашифрованный файл и дешифруем его потоком. Файл в облаке
+	// должен быть привязан к этой записи: чужой или подмененный файл не
+	// расшифруется даже с верным паролем - тогда читаем другую копию
+	reader, decrypted, err := uc.openFile(ctx, disk, fileMetadata, func(body io.Reader) (io.Reader, error) {
+		if fileKey != nil {
+			return uc.encryption.NewDecryptReaderWithKey(body, fileKey, fileContext(fileMetadata))
+		}
+		return uc.encryption.NewDecryptReader(body, masterPassword, fileContext(fileMetadata))
+	})
 	if err != nil {
-		return nil, "", fmt.Errorf("decryption failed: %w", err)
+		if errors.Is(err, encryption.ErrTampered) || errors.Is(err, encryption.ErrContextRequired) {
+			slog.Warn("integrity check failed", "file", fileMetadata.ID, "user", userID, "error", err)
+			return nil, "", encryption.ErrTampered
+		}
+		return nil, "", err
+	}
+
+	if fileMetadata.Chunked {
+		decrypted, err = uc.openChunked(ctx, disk, decrypted)
+		if err != nil {
+			reader.Close()
+			if errors.Is(err, encryption.ErrTampered) {
+				return nil, "", encryption.ErrTampered
+			}
+			return nil, "", fmt.Errorf("failed to read chunk manifest: %w", err)
+		}
+	}
+
+	// Пароль подошел - файлы с устаревшей функцией вывода ключа
+	// перешифровываем в фоне. Из разблокированной сессии пароля нет,
+	// перешифрование дождется запроса с паролем.
+	if masterPassword != "" && uc.needsKeyUpgrade(user, fileMetadata) {
+		go func() {
+			if err := uc.keyRotation.UpgradeKeys(context.Background(), userID, masterPassword, fileMetadata.ID); err != nil {
+				slog.Warn("key upgrade failed", "file", fileMetadata.ID, "error", err)
+			}
+		}()
+	}
+
+	// Открытое имя файла, зашифрованного клиентом, сервер не хранит
+	filename := fileMetadata.Filename
+	if fileMetadata.ClientEncrypted {
+		if name, err := uc.encryption.DecryptFilename(fileMetadata.EncryptedName, uc.nameKeys(ctx, user, kek, masterPassword), fileContext(fileMetadata)); err == nil {
+			filename = name
+		}
+	}
+
+	return &readCloser{Reader: decrypted, Closer: reader}, filename, nil
+}
+
+// needsKeyUpgrade проверяет, выведен ли ключ пользователя или файла
+// устаревшей функцией вывода ключа
+func (uc *storageUseCase) needsKeyUpgrade(user *entity.User, file *entity.FileMetadata) bool {
+	if uc.keyRotation == nil {
+		return false
+	}
+
+	// Параметры слота пароля обновляются при его открытии, перешифровать
+	// нужно только файлы старых форматов без ключа файла
+	if len(user.MasterKeyID) > 0 {
+		return len(file.WrappedKey) == 0
+	}
+
+	keyDerivation := &encryption.KeyDerivation{
+		KDF:    user.KeyKDF,
+		Params: user.KeyKDFParams,
+		Salt:   user.KeySalt,
 	}
 
-	return decryptedContent, fileMetadata.Filename, nil
+	return !uc.encryption.IsCurrentKDF(keyDerivation) || file.KDF != user.KeyKDF
+}
+
+// keyRotationRunning проверяет, идет ли у пользователя смена ключей
+func (uc *storageUseCase) keyRotationRunning(ctx context.Context, userID uint) bool {
+	if uc.keyRotation == nil {
+		return false
+	}
+
+	rotation, err := uc.keyRotation.GetKeyRotation(ctx, userID)
+	return err == nil && rotation.Status == entity.KeyRotationRunning
 }
 
 func (uc *storageUseCase) GetFileInfo(ctx context.Context, userID uint, fileID uint) (*entity.FileMetadata, error) {
@@ -313,6 +910,7 @@ func (uc *storageUseCase) GetFileInfo(ctx context.Context, userID uint, fileID u
 		return nil, errors.New("access denied")
 	}
 
+	file.Replicas = uc.fileReplicas(ctx, file.ID)
 	return file, nil
 }
 
@@ -331,14 +929,32 @@ func (uc *storageUseCase) DeleteFile(ctx context.Context, userID uint, fileID ui
 		return errors.New("user not found")
 	}
 
-	// Удаляем файл из Яндекс.Диска
-	err = uc.yandexDisk.DeleteFile(ctx, user.YandexDiskToken, file.Path)
+	disk, err := uc.userStorage(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	// Удаляем файл из хранилища
+	err = disk.Delete(ctx, file.Path)
 	if err != nil {
 		return err
 	}
 
 	// Удаляем запись из БД
-	return uc.fileRepo.DeleteFileMetadata(ctx, fileID)
+	if err := uc.fileRepo.DeleteFileMetadata(ctx, fileID); err != nil {
+		return err
+	}
+	if uc.replicaRepo != nil {
+		if err := uc.replicaRepo.SetFileReplicas(ctx, fileID, nil); err != nil {
+			slog.Warn("failed to delete file replicas", "file", fileID, "error", err)
+		}
+	}
+
+	// Фрагменты удаляются, когда на них не ссылается ни один файл
+	if file.Chunked && uc.chunkRepo != nil {
+		return uc.releaseFileChunks(ctx, user, fileID)
+	}
+	return nil
 }
 
 func (uc *storageUseCase) GetDecryptedFilename(ctx context.Context, userID uint, fileID uint, masterPassword string) (string, error) {
@@ -351,11 +967,39 @@ func (uc *storageUseCase) GetDecryptedFilename(ctx context.Context, userID uint,
 		return "", errors.New("access denied")
 	}
 
+	user, err := uc.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return "", errors.New("user not found")
+	}
+
+	kek, _, err := uc.userKEK(ctx, user, masterPassword)
+	if err != nil {
+		return "", err
+	}
+
 	// Дешифруем имя файла
-	decryptedName, err := uc.encryption.DecryptFilename(file.EncryptedName, masterPassword)
+	decryptedName, err := uc.encryption.DecryptFilename(file.EncryptedName, uc.nameKeys(ctx, user, kek, masterPassword), fileContext(file))
 	if err != nil {
 		return file.Filename, nil // Возвращаем сохраненное имя если не удалось расшифровать
 	}
 
 	return decryptedName, nil
-}
\ No newline at end of file
+}
+
+// countingWriter считает количество записанных байт
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// readCloser объединяет расшифровывающий reader с исходным телом ответа
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -6,6 +6,7 @@ import (
 
 	"server/internal/entity"
 	"server/internal/repository"
+	"server/pkg/encryption"
 )
 
 type userUseCase struct {
@@ -42,4 +43,47 @@ func (uc *userUseCase) UpdateUser(ctx context.Context, user *entity.User) error
 	// Яндекс токены обновляются через storage use case
 	
 	return uc.userRepo.UpdateUser(ctx, existingUser)
-}
\ No newline at end of file
+}
+
+// EncryptionSettings - настройки шифрования новых файлов пользователя;
+// nil оставляет настройку без изменений
+type EncryptionSettings struct {
+	CipherSuite        *string // Пустая строка - набор шифров по умолчанию для сервера
+	DeterministicNames *bool
+	Padding            *string // none, padme или pow2
+}
+
+// UpdateEncryptionSettings меняет настройки шифрования новых файлов
+// пользователя. Уже загруженные файлы не перешифровываются: их параметры
+// записаны в заголовке.
+func (uc *userUseCase) UpdateEncryptionSettings(ctx context.Context, userID uint, settings EncryptionSettings) error {
+	user, err := uc.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return errors.New("user not found")
+	}
+
+	if settings.CipherSuite != nil {
+		user.CipherSuite = 0
+		if *settings.CipherSuite != "" {
+			suite, err := encryption.ParseCipherSuite(*settings.CipherSuite)
+			if err != nil {
+				return err
+			}
+			user.CipherSuite = uint8(suite)
+		}
+	}
+
+	if settings.DeterministicNames != nil {
+		user.DeterministicNames = *settings.DeterministicNames
+	}
+
+	if settings.Padding != nil {
+		padding, err := encryption.ParsePaddingScheme(*settings.Padding)
+		if err != nil {
+			return err
+		}
+		user.Padding = uint8(padding)
+	}
+
+	return uc.userRepo.UpdateUser(ctx, user)
+}
@@ -0,0 +1,155 @@
+// Package chunker делит поток на фрагменты по содержимому (FastCDC).
+//
+// Границы фрагментов определяются скользящим хешем Gear по последним
+// байтам данных, поэтому вставка или удаление в начале файла сдвигает
+// только соседние границы: остальные фрагменты новой версии файла
+// совпадают с фрагментами старой. Таблица Gear и маски фиксированы -
+// их изменение сделает бесполезными все уже сохраненные фрагменты.
+package chunker
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Params - ограничения размера фрагментов в байтах
+type Params struct {
+	Min int // Граница не ставится раньше Min байт
+	Avg int // Ожидаемый размер, степень двойки
+	Max int // Фрагмент принудительно обрезается на Max байтах
+}
+
+// DefaultParams - размеры фрагментов по умолчанию
+var DefaultParams = Params{Min: 256 << 10, Avg: 1 << 20, Max: 4 << 20}
+
+var ErrInvalidParams = errors.New("invalid chunker parameters")
+
+var gear = newGearTable()
+
+// newGearTable строит таблицу Gear детерминированно из SHA-256
+func newGearTable() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		sum := sha256.Sum256([]byte{'g', 'e', 'a', 'r', byte(i)})
+		table[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return table
+}
+
+// Validate проверяет ограничения размера
+func (p Params) Validate() error {
+	if p.Min < 64 || p.Avg <= p.Min || p.Max <= p.Avg || p.Max > 64<<20 {
+		return fmt.Errorf("%w: sizes must satisfy 64 <= min < avg < max <= 64 MiB", ErrInvalidParams)
+	}
+	if p.Avg&(p.Avg-1) != 0 {
+		return fmt.Errorf("%w: avg must be a power of two", ErrInvalidParams)
+	}
+	return nil
+}
+
+// Chunker читает фрагменты из потока
+type Chunker struct {
+	r      io.Reader
+	params Params
+
+	// Нормализованное разбиение: до Avg байт граница ставится по более
+	// строгой маске, после - по менее строгой. Размеры фрагментов
+	// концентрируются около Avg.
+	maskS uint64
+	maskL uint64
+
+	buf        []byte
+	start, end int
+	eof        bool
+}
+
+// New создает разбиение потока r с ограничениями p
+func New(r io.Reader, p Params) (*Chunker, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Маски берут старшие биты хеша: они зависят от последних 64 байт
+	avgBits := bits.TrailingZeros(uint(p.Avg))
+	return &Chunker{
+		r:      r,
+		params: p,
+		maskS:  ^uint64(0) << (64 - (avgBits + 2)),
+		maskL:  ^uint64(0) << (64 - (avgBits - 2)),
+		buf:    make([]byte, p.Max),
+	}, nil
+}
+
+// Next возвращает следующий фрагмент или io.EOF после последнего.
+// Фрагмент действителен до следующего вызова Next. Пустой поток не
+// содержит фрагментов.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.end-c.start < c.params.Max && !c.eof {
+		if err := c.fill(); err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// fill сдвигает непрочитанные данные в начало буфера и дочитывает поток
+func (c *Chunker) fill() error {
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	for c.end < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cut возвращает длину первого фрагмента data
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.params.Min {
+		return n
+	}
+	if n > c.params.Max {
+		n = c.params.Max
+	}
+	normal := c.params.Avg
+	if normal > n {
+		normal = n
+	}
+
+	var hash uint64
+	i := c.params.Min
+	for ; i < normal; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
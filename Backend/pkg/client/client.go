@@ -0,0 +1,442 @@
+// Package client - эталонный клиент шифрования на стороне клиента.
+//
+// Клиент открывает ключ пользователя слотом пароля из копии слотов сервера,
+// шифрует содержимое и имена файлов в формате pkg/encryption (см.
+// pkg/encryption/FORMAT.md) и передает серверу только шифротексты. Мастер-
+// пароль и открытые данные не покидают клиент.
+//
+//	enc, _ := encryption.NewEncryptionService(encryption.Config{Argon2: encryption.DefaultArgon2Params})
+//	c := client.New("https://cloud.example.com/api/v1", token, enc)
+//	if err := c.Unlock(ctx, passphrase); err != nil { ... }
+//	id, err := c.Upload(ctx, "/docs", "report.pdf", f)
+//	name, err := c.Download(ctx, id, out)
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"server/pkg/encryption"
+)
+
+var ErrLocked = errors.New("client is locked, call Unlock first")
+
+// Client работает с API шифрования на клиенте
+type Client struct {
+	// Options - параметры шифрования новых файлов. Context задается
+	// при загрузке каждого файла.
+	Options encryption.WriteOptions
+
+	baseURL    string
+	token      string
+	httpClient *http.Client
+	enc        *encryption.EncryptionService
+
+	userID     uint64
+	masterKey  []byte
+	passphrase string // Нужен только для имен старых форматов
+}
+
+// File - метаданные файла на сервере
+type File struct {
+	ID              uint   `json:"id"`
+	UUID            string `json:"uuid"`
+	UserID          uint   `json:"user_id"`
+	EncryptedName   string `json:"encrypted_name"`
+	Path            string `json:"path"`
+	Dir             string `json:"dir"`
+	Size            int64  `json:"size"`
+	Type            string `json:"type"`
+	ClientEncrypted bool   `json:"client_encrypted"`
+}
+
+// New создает клиент API baseURL (например https://host/api/v1) с токеном
+// входа token. Параметры Argon2id новых слотов берутся из enc.
+func New(baseURL, token string, enc *encryption.EncryptionService) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+		enc:        enc,
+	}
+}
+
+// SetupPassphrase создает ключ пользователя и слот пароля passphrase.
+// Только для пользователей, которые еще не задали парольную фразу.
+func (c *Client) SetupPassphrase(ctx context.Context, passphrase string) error {
+	masterKey, err := encryption.NewMasterKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	keyDerivation, err := c.enc.NewKeyDerivation()
+	if err != nil {
+		return fmt.Errorf("failed to generate key parameters: %w", err)
+	}
+
+	slotKEK, err := c.enc.DeriveKEK(passphrase, keyDerivation)
+	if err != nil {
+		return fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	suite, err := c.enc.ResolveSuite(c.Options.Suite)
+	if err != nil {
+		return err
+	}
+
+	wrappedKey, err := encryption.WrapKey(suite, slotKEK, masterKey)
+	if err != nil {
+		return fmt.Errorf("failed to wrap key: %w", err)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"master_key_id": encryption.MasterKeyID(masterKey),
+		"slot": encryption.KeyringSlot{
+			Type:       encryption.SlotPassword,
+			KDF:        keyDerivation.KDF,
+			KDFParams:  keyDerivation.Params,
+			Salt:       keyDerivation.Salt,
+			WrappedKey: wrappedKey,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Keyring *encryption.Keyring `json:"keyring"`
+	}
+	if err := c.doJSON(ctx, http.MethodPost, "/storage/client/keyring", bytes.NewReader(body), &resp); err != nil {
+		return err
+	}
+	if resp.Keyring == nil {
+		return errors.New("server returned no keyring")
+	}
+
+	c.userID, c.masterKey, c.passphrase = resp.Keyring.UserID, masterKey, passphrase
+	return nil
+}
+
+// Unlock открывает ключ пользователя паролем passphrase
+func (c *Client) Unlock(ctx context.Context, passphrase string) error {
+	var resp struct {
+		Keyring *encryption.Keyring `json:"keyring"`
+	}
+	if err := c.doJSON(ctx, http.MethodGet, "/storage/client/keyring", nil, &resp); err != nil {
+		return err
+	}
+	if resp.Keyring == nil {
+		return errors.New("server returned no keyring")
+	}
+
+	masterKey, err := c.enc.Unlock(resp.Keyring, encryption.SlotPassword, []byte(passphrase))
+	if err != nil {
+		return err
+	}
+
+	c.userID, c.masterKey, c.passphrase = resp.Keyring.UserID, masterKey, passphrase
+	return nil
+}
+
+// Lock забывает ключ пользователя и пароль
+func (c *Client) Lock() {
+	clear(c.masterKey)
+	c.masterKey, c.passphrase = nil, ""
+}
+
+// UserID возвращает владельца открытого ключа
+func (c *Client) UserID() uint64 {
+	return c.userID
+}
+
+// Seal шифрует src в dst и возвращает зашифрованное имя файла name.
+// Шифротекст привязан к контексту fc (FileID - NewFileID, Dir - каталог
+// файла со слэшем на конце).
+func (c *Client) Seal(dst io.Writer, src io.Reader, name string, fc *encryption.FileContext) (string, error) {
+	encryptedName, err := c.EncryptName(name, fc)
+	if err != nil {
+		return "", err
+	}
+	if err := c.sealContent(dst, src, fc); err != nil {
+		return "", err
+	}
+	return encryptedName, nil
+}
+
+// EncryptName шифрует имя файла с параметрами Options
+func (c *Client) EncryptName(name string, fc *encryption.FileContext) (string, error) {
+	if c.masterKey == nil {
+		return "", ErrLocked
+	}
+
+	opts := c.Options
+	opts.Context = fc
+	return c.enc.EncryptFilename(name, c.masterKey, opts)
+}
+
+// Open расшифровывает содержимое src и имя файла encryptedName
+func (c *Client) Open(src io.Reader, encryptedName string, fc *encryption.FileContext) (io.Reader, string, error) {
+	if c.masterKey == nil {
+		return nil, "", ErrLocked
+	}
+
+	name, err := c.enc.DecryptFilename(encryptedName, &encryption.NameKeys{KEK: c.masterKey, Password: c.passphrase}, fc)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decrypt filename: %w", err)
+	}
+
+	plaintext, err := c.enc.NewDecryptReaderWithMasterKey(src, c.masterKey, fc)
+	if err != nil {
+		return nil, "", err
+	}
+	return plaintext, name, nil
+}
+
+// Mkdir создает каталог dir со всеми родителями. Имена каталогов шифруются
+// так же, как на сервере: детерминированно с привязкой к родителю.
+func (c *Client) Mkdir(ctx context.Context, dir string) error {
+	if c.masterKey == nil {
+		return ErrLocked
+	}
+
+	parent := "/"
+	for _, name := range strings.Split(dir, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if name == ".." {
+			return errors.New("invalid path")
+		}
+
+		encryptedName, err := c.enc.EncryptFilename(name, c.masterKey, encryption.WriteOptions{
+			Context:           &encryption.FileContext{UserID: c.userID, Dir: parent},
+			DeterministicName: true,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encrypt directory name: %w", err)
+		}
+
+		body, err := json.Marshal(map[string]string{"path": parent + name, "encrypted_name": encryptedName})
+		if err != nil {
+			return err
+		}
+		if err := c.doJSON(ctx, http.MethodPost, "/storage/client/directories", bytes.NewReader(body), nil); err != nil {
+			return err
+		}
+		parent += name + "/"
+	}
+	return nil
+}
+
+// Upload шифрует src и загружает его в каталог dir под именем name.
+// Недостающие каталоги создаются. Возвращает ID файла на сервере.
+func (c *Client) Upload(ctx context.Context, dir, name string, src io.Reader) (uint, error) {
+	if c.masterKey == nil {
+		return 0, ErrLocked
+	}
+
+	dir = cleanDir(dir)
+	if err := c.Mkdir(ctx, dir); err != nil {
+		return 0, err
+	}
+
+	fileID, err := NewFileID()
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate file id: %w", err)
+	}
+
+	fc := &encryption.FileContext{UserID: c.userID, FileID: fileID, Dir: dir}
+	encryptedName, err := c.EncryptName(name, fc)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encrypt filename: %w", err)
+	}
+
+	// Файл шифруется потоком прямо в тело запроса
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(c.writeUploadForm(form, fileID, encryptedName, src, fc))
+	}()
+
+	var resp struct {
+		FileID uint `json:"file_id"`
+	}
+	err = c.do(ctx, http.MethodPost, "/storage/client/upload?path="+url.QueryEscape(dir), pr, form.FormDataContentType(), &resp)
+	pr.Close()
+	if err != nil {
+		return 0, err
+	}
+	return resp.FileID, nil
+}
+
+// writeUploadForm пишет форму загрузки: поля идут раньше файла
+func (c *Client) writeUploadForm(form *multipart.Writer, fileID, encryptedName string, src io.Reader, fc *encryption.FileContext) error {
+	if err := form.WriteField("file_id", fileID); err != nil {
+		return err
+	}
+	if err := form.WriteField("encrypted_name", encryptedName); err != nil {
+		return err
+	}
+
+	part, err := form.CreateFormFile("file", encryptedName)
+	if err != nil {
+		return err
+	}
+	if err := c.sealContent(part, src, fc); err != nil {
+		return err
+	}
+	return form.Close()
+}
+
+// Download скачивает файл id, расшифровывает его в dst и возвращает
+// открытое имя файла
+func (c *Client) Download(ctx context.Context, id uint, dst io.Writer) (string, error) {
+	if c.masterKey == nil {
+		return "", ErrLocked
+	}
+
+	var info struct {
+		File *File `json:"file"`
+	}
+	if err := c.doJSON(ctx, http.MethodGet, fmt.Sprintf("/storage/files/%d", id), nil, &info); err != nil {
+		return "", err
+	}
+	if info.File == nil {
+		return "", errors.New("server returned no file")
+	}
+
+	resp, err := c.send(ctx, http.MethodGet, fmt.Sprintf("/storage/client/files/%d", id), nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	plaintext, name, err := c.Open(resp.Body, info.File.EncryptedName, fileContext(info.File))
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, plaintext); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// sealContent шифрует src случайным ключом файла, обернутым ключом пользователя
+func (c *Client) sealContent(dst io.Writer, src io.Reader, fc *encryption.FileContext) error {
+	if c.masterKey == nil {
+		return ErrLocked
+	}
+
+	opts := c.Options
+	opts.Context = fc
+	w, _, err := c.enc.NewEnvelopeWriter(dst, c.masterKey, encryption.MasterKeyDerivation(c.masterKey), opts)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// doJSON отправляет JSON-запрос и разбирает JSON-ответ в out (nil - не разбирать)
+func (c *Client) doJSON(ctx context.Context, method, path string, body io.Reader, out any) error {
+	contentType := ""
+	if body != nil {
+		contentType = "application/json"
+	}
+	return c.do(ctx, method, path, body, contentType, out)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, contentType string, out any) error {
+	resp, err := c.send(ctx, method, path, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// send выполняет запрос и возвращает ответ с кодом 2xx. Ошибку сервера
+// (поле error ответа) возвращает как ошибку.
+func (c *Client) send(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&apiErr); err != nil || apiErr.Error == "" {
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	return nil, fmt.Errorf("server returned %s: %s", resp.Status, apiErr.Error)
+}
+
+// NewFileID генерирует постоянный идентификатор файла (UUID версии 4)
+func NewFileID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// fileContext возвращает контекст привязки файла так же, как сервер
+func fileContext(file *File) *encryption.FileContext {
+	if file.UUID == "" {
+		return nil
+	}
+	dir := file.Dir
+	if dir == "" {
+		dir = file.Path[:strings.LastIndex(file.Path, "/")+1]
+	}
+	return &encryption.FileContext{UserID: uint64(file.UserID), FileID: file.UUID, Dir: dir}
+}
+
+// cleanDir приводит путь каталога к виду /a/b/ (корень - /), как сервер
+func cleanDir(dir string) string {
+	var parts []string
+	for _, part := range strings.Split(dir, "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return "/"
+	}
+	return "/" + strings.Join(parts, "/") + "/"
+}
@@ -25,10 +25,27 @@ func NewPostgresDB(host, port, user, password, dbname string) (*gorm.DB, error)
 	err = db.AutoMigrate(
 		&entity.User{},
 		&entity.FileMetadata{},
+		&entity.Directory{},
+		&entity.KeySlot{},
+		&entity.KeyRotation{},
+		&entity.KeyRotationItem{},
+		&entity.FileShare{},
+		&entity.Chunk{},
+		&entity.FileChunk{},
+		&entity.StorageBackend{},
+		&entity.FileReplica{},
+		&entity.ChunkReplica{},
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to auto-migrate: %w", err)
 	}
+
+	// Хэш старого мастер-пароля больше не хранится (см. KeyRotation.OldKeyCheck)
+	if db.Migrator().HasColumn(&entity.KeyRotation{}, "old_password_hash") {
+		if err := db.Migrator().DropColumn(&entity.KeyRotation{}, "old_password_hash"); err != nil {
+			return nil, fmt.Errorf("failed to auto-migrate: %w", err)
+		}
+	}
 	
 	log.Println("Database connection established and models migrated")
 	return db, nil
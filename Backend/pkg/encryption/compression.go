@@ -0,0 +1,191 @@
+package encryption
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+// Сжатие перед шифрованием.
+//
+// Содержимое сжимается до шифрования (после шифрования данные не сжимаются),
+// а кодек записывается в заголовок и аутентифицируется вместе с ним.
+// Сжатие раскрывает степень сжимаемости данных через размер файла; при
+// включенном выравнивании (см. padding.go) выравнивается уже сжатый размер.
+
+// Compression - кодек сжатия содержимого
+type Compression uint8
+
+const (
+	CompressionNone Compression = 0
+	CompressionGzip Compression = 1
+)
+
+var ErrUnsupportedCompression = errors.New("unsupported compression")
+
+// ParseCompression возвращает кодек по имени
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "", "none":
+		return CompressionNone, nil
+	case "gzip":
+		return CompressionGzip, nil
+	default:
+		return 0, fmt.Errorf("%w: %s", ErrUnsupportedCompression, name)
+	}
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(c))
+	}
+}
+
+// Valid проверяет, что кодек поддерживается
+func (c Compression) Valid() bool {
+	return c <= CompressionGzip
+}
+
+// Форматы, которые уже сжаты: повторное сжатие только тратит процессор
+var compressedMIMETypes = map[string]bool{
+	"application/zip":              true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/vnd.rar":          true,
+	"application/zstd":             true,
+	"application/java-archive":     true,
+	"application/epub+zip":         true,
+	"application/pdf":              true,
+}
+
+// Несжатые форматы, которые хорошо сжимаются
+var compressibleMIMETypes = map[string]bool{
+	"application/json":              true,
+	"application/x-ndjson":          true,
+	"application/xml":               true,
+	"application/javascript":        true,
+	"application/sql":               true,
+	"application/x-yaml":            true,
+	"application/yaml":              true,
+	"application/rtf":               true,
+	"application/msword":            true,
+	"application/vnd.ms-excel":      true,
+	"application/vnd.ms-powerpoint": true,
+	"application/x-sh":              true,
+	"application/x-tar":             true,
+	"image/svg+xml":                 true,
+	"image/bmp":                     true,
+	"image/tiff":                    true,
+}
+
+// mediaType возвращает MIME-тип без параметров в нижнем регистре
+func mediaType(contentType string) string {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mt
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// IsCompressedMIME проверяет, что формат уже сжат
+func IsCompressedMIME(contentType string) bool {
+	mt := mediaType(contentType)
+	switch {
+	case compressedMIMETypes[mt]:
+		return true
+	// Изображения, видео и аудио (кроме перечисленных несжатых) хранятся сжатыми
+	case strings.HasPrefix(mt, "image/") && !compressibleMIMETypes[mt],
+		strings.HasPrefix(mt, "video/"),
+		strings.HasPrefix(mt, "audio/") && mt != "audio/wav" && mt != "audio/x-wav":
+		return true
+	// Документы Office Open XML и OpenDocument - это ZIP-архивы
+	case strings.HasPrefix(mt, "application/vnd.openxmlformats-officedocument."),
+		strings.HasPrefix(mt, "application/vnd.oasis.opendocument."):
+		return true
+	}
+	return false
+}
+
+// IsCompressibleMIME проверяет, что формат стоит сжимать по умолчанию
+func IsCompressibleMIME(contentType string) bool {
+	if IsCompressedMIME(contentType) {
+		return false
+	}
+	mt := mediaType(contentType)
+	return strings.HasPrefix(mt, "text/") || compressibleMIMETypes[mt] ||
+		strings.HasSuffix(mt, "+json") || strings.HasSuffix(mt, "+xml")
+}
+
+// ChooseCompression выбирает кодек для файла типа contentType. requested -
+// кодек, запрошенный клиентом; пустая строка выбирает кодек по MIME-типу.
+// Уже сжатые форматы не сжимаются даже по запросу.
+func ChooseCompression(requested, contentType string) (Compression, error) {
+	if requested == "" {
+		if IsCompressibleMIME(contentType) {
+			return CompressionGzip, nil
+		}
+		return CompressionNone, nil
+	}
+
+	c, err := ParseCompression(requested)
+	if err != nil {
+		return 0, err
+	}
+	if IsCompressedMIME(contentType) {
+		return CompressionNone, nil
+	}
+	return c, nil
+}
+
+// compressWriter сжимает данные и пишет их в шифрующий writer
+type compressWriter struct {
+	*gzip.Writer
+	dst io.WriteCloser
+}
+
+// newCompressWriter оборачивает dst сжатием кодеком c
+func newCompressWriter(dst io.WriteCloser, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case CompressionNone:
+		return dst, nil
+	case CompressionGzip:
+		return &compressWriter{Writer: gzip.NewWriter(dst), dst: dst}, nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedCompression, uint8(c))
+	}
+}
+
+// Close дописывает сжатый поток и закрывает шифрующий writer
+func (w *compressWriter) Close() error {
+	if err := w.Writer.Close(); err != nil {
+		return err
+	}
+	return w.dst.Close()
+}
+
+// newDecompressReader оборачивает расшифрованный поток распаковкой
+func newDecompressReader(src io.Reader, c Compression) (io.Reader, error) {
+	switch c {
+	case CompressionNone:
+		return src, nil
+	case CompressionGzip:
+		zr, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptedStream, err)
+		}
+		return zr, nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedCompression, uint8(c))
+	}
+}
@@ -0,0 +1,88 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Привязка шифротекста к файлу.
+//
+// Идентификатор пользователя, постоянный идентификатор файла и версия
+// формата передаются в AEAD как дополнительные данные. Сами они в облако
+// не записываются, в заголовке остается только флаг привязки. Если
+// файл в облаке подменить файлом другого пользователя или другим файлом
+// того же пользователя, проверка подлинности не пройдет даже при верном
+// мастер-пароле.
+//
+// Начиная с версии 7 контекст дублируется в заголовке: без БД его можно
+// прочитать из самого файла (ReadFileContext) и расшифровать файл и его имя.
+//
+// Детерминированные имена (см. EncryptFilename) привязываются не к файлу,
+// а к пользователю и каталогу: иначе одинаковые имена в одном каталоге
+// не совпадали бы между загрузками.
+
+var contextAD = []byte("secure-cloud/file-context")
+
+var (
+	ErrTampered        = errors.New("file integrity check failed - encrypted file was modified or substituted")
+	ErrContextRequired = errors.New("encrypted file is bound to a file context that was not provided")
+)
+
+// FileContext - данные, к которым привязан шифротекст
+type FileContext struct {
+	UserID uint64 // Владелец файла
+	FileID string // Постоянный идентификатор файла (UUID)
+	Dir    string // Каталог файла (только для детерминированных имен)
+}
+
+// associatedData кодирует контекст для формата версии version
+func (fc *FileContext) associatedData(version uint8) []byte {
+	ad := make([]byte, 0, len(contextAD)+1+8+len(fc.FileID))
+	ad = append(ad, contextAD...)
+	ad = append(ad, version)
+	ad = binary.BigEndian.AppendUint64(ad, fc.UserID)
+	return append(ad, fc.FileID...)
+}
+
+// bindAD дополняет дополнительные данные ad контекстом fc (если он задан)
+func bindAD(ad []byte, fc *FileContext, version uint8) []byte {
+	if fc == nil {
+		return ad
+	}
+	bound := make([]byte, 0, len(ad)+len(contextAD)+9+len(fc.FileID))
+	bound = append(bound, ad...)
+	return append(bound, fc.associatedData(version)...)
+}
+
+// checkBinding сверяет флаг привязки из заголовка с переданным контекстом.
+// Непривязанный файл там, где ожидается привязанный, считается подменой.
+func checkBinding(bound bool, fc *FileContext) error {
+	switch {
+	case bound && fc == nil:
+		return ErrContextRequired
+	case !bound && fc != nil:
+		return ErrTampered
+	}
+	return nil
+}
+
+// ReadFileContext читает контекст привязки из заголовка файла r. Нужен
+// для восстановления без БД: сервер контекст из файла не берет, а передает
+// ожидаемый. Возвращает nil для непривязанных файлов и файлов до версии 7,
+// а также reader, который отдает содержимое r с начала.
+func ReadFileContext(r io.Reader) (*FileContext, io.Reader, error) {
+	src, h, headerBytes, err := openStream(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	replay := io.MultiReader(bytes.NewReader(headerBytes), src)
+	if h == nil || h.Context == nil {
+		return nil, replay, nil
+	}
+
+	fc := *h.Context
+	return &fc, replay, nil
+}
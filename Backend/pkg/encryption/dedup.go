@@ -0,0 +1,194 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Хранение фрагментами с дедупликацией.
+//
+// Файл делится на фрагменты по содержимому (pkg/chunker). Каждый фрагмент
+// шифруется ключом, выведенным из ключа дедупликации пользователя и самого
+// фрагмента, и хранится в облаке один раз под идентификатором, выведенным
+// так же. Одинаковые фрагменты одного пользователя дают одинаковые
+// идентификаторы, поэтому повторная загрузка передает только новые
+// фрагменты. Ключ дедупликации выводится из ключа пользователя: у разных
+// пользователей идентификаторы одинаковых фрагментов не совпадают, и по
+// облаку нельзя проверить, хранит ли пользователь известный файл.
+//
+// Список фрагментов файла (манифест) с их ключами шифруется как обычный
+// файл и лежит в облаке на месте файла.
+
+const (
+	ChunkIDSize = 16
+
+	chunkFormatVersion1 = 1
+	manifestVersion1    = 1
+	manifestEntrySize   = ChunkIDSize + 4 + keySize
+	maxManifestChunks   = 1 << 24
+)
+
+var (
+	dedupKeyInfo = []byte("secure-cloud/dedup")
+	chunkIDInfo  = []byte("secure-cloud/chunk-id")
+	chunkKeyInfo = []byte("secure-cloud/chunk-key")
+	chunkAD      = []byte("secure-cloud/chunk")
+
+	manifestMagic = []byte("SCM\x00")
+)
+
+var ErrInvalidManifest = errors.New("invalid chunk manifest")
+
+// ChunkRef - ссылка на зашифрованный фрагмент
+type ChunkRef struct {
+	ID   []byte // Идентификатор фрагмента в облаке
+	Key  []byte // Ключ фрагмента
+	Size uint32 // Размер открытого фрагмента
+}
+
+// Manifest - фрагменты файла по порядку
+type Manifest struct {
+	Chunks []ChunkRef
+}
+
+// DedupKey выводит ключ дедупликации из ключа пользователя из слотов.
+// Ключ пользователя не меняется при смене пароля, поэтому фрагменты
+// остаются общими для всех версий файлов.
+func DedupKey(masterKey []byte) []byte {
+	key := make([]byte, keySize)
+	io.ReadFull(hkdf.New(sha256.New, masterKey, nil, dedupKeyInfo), key)
+	return key
+}
+
+// NewChunkRef вычисляет идентификатор и ключ фрагмента chunk
+func NewChunkRef(dedupKey, chunk []byte) ChunkRef {
+	mac := hmac.New(sha256.New, dedupKey)
+	mac.Write(chunk)
+	prk := mac.Sum(nil)
+
+	ref := ChunkRef{
+		ID:   make([]byte, ChunkIDSize),
+		Key:  make([]byte, keySize),
+		Size: uint32(len(chunk)),
+	}
+	io.ReadFull(hkdf.Expand(sha256.New, prk, chunkIDInfo), ref.ID)
+	io.ReadFull(hkdf.Expand(sha256.New, prk, chunkKeyInfo), ref.Key)
+	return ref
+}
+
+// SealChunk шифрует фрагмент: version u8 || suite u8 || nonce || AEAD.
+// Идентификатор фрагмента входит в дополнительные данные.
+func SealChunk(suite CipherSuite, ref ChunkRef, chunk []byte) ([]byte, error) {
+	aead, err := suite.newAEAD(ref.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := make([]byte, 2+aead.NonceSize(), 2+aead.NonceSize()+len(chunk)+aead.Overhead())
+	blob[0], blob[1] = chunkFormatVersion1, byte(suite)
+	nonce := blob[2:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(blob, nonce, chunk, chunkAssociatedData(ref.ID)), nil
+}
+
+// OpenChunk расшифровывает фрагмент. Подмененный фрагмент или фрагмент
+// с другим идентификатором не проходит проверку подлинности.
+func OpenChunk(ref ChunkRef, blob []byte) ([]byte, error) {
+	if len(blob) < 2 || blob[0] != chunkFormatVersion1 {
+		return nil, fmt.Errorf("%w: chunk %x", ErrTampered, ref.ID)
+	}
+	suite := CipherSuite(blob[1])
+	if !suite.Valid() {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedSuite, blob[1])
+	}
+
+	aead, err := suite.newAEAD(ref.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < 2+aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("%w: chunk %x", ErrTampered, ref.ID)
+	}
+
+	nonce, ciphertext := blob[2:2+aead.NonceSize()], blob[2+aead.NonceSize():]
+	chunk, err := aead.Open(nil, nonce, ciphertext, chunkAssociatedData(ref.ID))
+	if err != nil || uint32(len(chunk)) != ref.Size {
+		return nil, fmt.Errorf("%w: chunk %x", ErrTampered, ref.ID)
+	}
+	return chunk, nil
+}
+
+func chunkAssociatedData(id []byte) []byte {
+	ad := make([]byte, 0, len(chunkAD)+1+len(id))
+	ad = append(ad, chunkAD...)
+	ad = append(ad, chunkFormatVersion1)
+	return append(ad, id...)
+}
+
+// Marshal сериализует манифест:
+// magic "SCM\x00" || version u8 || count u32 || (id [16] || size u32 || key [32]) * count
+func (m *Manifest) Marshal() []byte {
+	buf := make([]byte, 0, len(manifestMagic)+5+len(m.Chunks)*manifestEntrySize)
+	buf = append(buf, manifestMagic...)
+	buf = append(buf, manifestVersion1)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(m.Chunks)))
+	for _, ref := range m.Chunks {
+		buf = append(buf, ref.ID...)
+		buf = binary.BigEndian.AppendUint32(buf, ref.Size)
+		buf = append(buf, ref.Key...)
+	}
+	return buf
+}
+
+// Size возвращает размер открытого файла
+func (m *Manifest) Size() int64 {
+	var size int64
+	for _, ref := range m.Chunks {
+		size += int64(ref.Size)
+	}
+	return size
+}
+
+// IsManifest проверяет, является ли расшифрованный файл манифестом
+func IsManifest(data []byte) bool {
+	return bytes.HasPrefix(data, manifestMagic)
+}
+
+// ParseManifest разбирает манифест
+func ParseManifest(data []byte) (*Manifest, error) {
+	if !IsManifest(data) || len(data) < len(manifestMagic)+5 {
+		return nil, ErrInvalidManifest
+	}
+	data = data[len(manifestMagic):]
+	if data[0] != manifestVersion1 {
+		return nil, fmt.Errorf("%w: manifest version %d", ErrUnsupportedVersion, data[0])
+	}
+
+	count := binary.BigEndian.Uint32(data[1:5])
+	data = data[5:]
+	if count > maxManifestChunks || len(data) != int(count)*manifestEntrySize {
+		return nil, ErrInvalidManifest
+	}
+
+	m := &Manifest{Chunks: make([]ChunkRef, count)}
+	for i := range m.Chunks {
+		entry := data[i*manifestEntrySize : (i+1)*manifestEntrySize]
+		m.Chunks[i] = ChunkRef{
+			ID:   entry[:ChunkIDSize],
+			Size: binary.BigEndian.Uint32(entry[ChunkIDSize : ChunkIDSize+4]),
+			Key:  entry[ChunkIDSize+4:],
+		}
+	}
+	return m, nil
+}
@@ -1,128 +1,426 @@
 package encryption
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"strings"
 
+	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/pbkdf2"
 )
 
+const (
+	nameFormatVersion1 = 1
+	nameFormatVersion2 = 2 // Имя привязано к файлу (см. context.go)
+	nameFormatVersion3 = 3 // Детерминированное имя AES-SIV, привязано к каталогу
+
+	// Версии 4-6 повторяют 1-3, но ключ имен выводится из ключа
+	// пользователя, а не из мастер-пароля с фиксированной солью
+	nameFormatVersion4 = 4
+	nameFormatVersion5 = 5
+	nameFormatVersion6 = 6
+
+	sivKeySize = 64
+)
+
+var (
+	nameKeyInfo    = []byte("secure-cloud/filename")
+	sivNameKeyInfo = []byte("secure-cloud/filename-siv")
+	sivNameAD      = []byte("secure-cloud/filename-siv")
+)
+
+// ErrLegacyNameKeyRequired - имя старого формата нельзя расшифровать без мастер-пароля
+var ErrLegacyNameKeyRequired = errors.New("filename is encrypted in the old format, the master password is required")
+
+// Config - настройки шифрования новых файлов
+type Config struct {
+	Argon2 Argon2Params // Параметры вывода ключей из мастер-пароля
+	Suite  CipherSuite  // Набор шифров по умолчанию
+
+	// Argon2Limit - наибольшие параметры Argon2id, с которыми выводится ключ
+	// по заголовку файла или слоту (нулевое значение - вдвое больше Argon2,
+	// но не меньше удвоенных DefaultArgon2Params)
+	Argon2Limit Argon2Params
+
+	// EscrowPublicKey - открытый ключ X25519 администратора для слотов
+	// депонирования (nil - депонирование недоступно)
+	EscrowPublicKey []byte
+}
+
 type EncryptionService struct {
-	salt []byte
+	salt         []byte
+	argon2Params Argon2Params
+	argon2Limit  Argon2Params
+	suite        CipherSuite
+	escrowKey    []byte
 }
 
-func NewEncryptionService() *EncryptionService {
-	// Фиксированная соль для упрощения (в проде должен быть уникальным на файл)
+// NewEncryptionService создает сервис шифрования с настройками cfg
+func NewEncryptionService(cfg Config) (*EncryptionService, error) {
+	if err := cfg.Argon2.validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Argon2Limit == (Argon2Params{}) {
+		cfg.Argon2Limit = defaultArgon2Limit(cfg.Argon2)
+	}
+
+	if cfg.Suite == 0 {
+		cfg.Suite = DefaultCipherSuite
+	}
+	if !cfg.Suite.Valid() {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedSuite, uint8(cfg.Suite))
+	}
+
+	if cfg.EscrowPublicKey != nil && len(cfg.EscrowPublicKey) != x25519KeySize {
+		return nil, ErrInvalidEscrowKey
+	}
+
+	// Фиксированная соль старого формата: нужна для имен файлов и для
+	// расшифровки файлов, загруженных до появления заголовка
 	salt := []byte("secure-cloud-salt-2024")
-	return &EncryptionService{salt: salt}
+	return &EncryptionService{salt: salt, argon2Params: cfg.Argon2, argon2Limit: cfg.Argon2Limit, suite: cfg.Suite, escrowKey: cfg.EscrowPublicKey}, nil
+}
+
+// EscrowPublicKey возвращает открытый ключ депонирования или nil
+func (s *EncryptionService) EscrowPublicKey() []byte {
+	return s.escrowKey
+}
+
+// ResolveSuite возвращает набор шифров по умолчанию, если suite не задан,
+// и проверяет, что заданный набор поддерживается
+func (s *EncryptionService) ResolveSuite(suite CipherSuite) (CipherSuite, error) {
+	if suite == 0 {
+		return s.suite, nil
+	}
+	if !suite.Valid() {
+		return 0, fmt.Errorf("%w: %d", ErrUnsupportedSuite, uint8(suite))
+	}
+	return suite, nil
 }
 
 // deriveKey создает ключ из мастер-пароля
 func (s *EncryptionService) deriveKey(masterPassword string) []byte {
-	return pbkdf2.Key([]byte(masterPassword), s.salt, 100000, 32, sha256.New)
+	return pbkdf2.Key([]byte(masterPassword), s.salt, pbkdf2Iterations, 32, sha256.New)
 }
 
-// EncryptFile шифрует файл
-func (s *EncryptionService) EncryptFile(data []byte, masterPassword string) ([]byte, error) {
-	key := s.deriveKey(masterPassword)
-	
-	block, err := aes.NewCipher(key)
+// deriveKeyFromHeader создает ключ по параметрам KDF из заголовка
+func (s *EncryptionService) deriveKeyFromHeader(h *Header, masterPassword string) ([]byte, error) {
+	return s.DeriveKEK(masterPassword, &KeyDerivation{
+		KDF:    h.KDF,
+		Params: h.KDFParams,
+		Salt:   h.Salt,
+	})
+}
+
+// EncryptFile шифрует файл целиком в памяти (см. NewEncryptWriter)
+func (s *EncryptionService) EncryptFile(data []byte, masterPassword string, opts WriteOptions) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := s.NewEncryptWriter(&buf, masterPassword, opts)
 	if err != nil {
 		return nil, err
 	}
-	
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
+	if _, err := w.Write(data); err != nil {
 		return nil, err
 	}
-	
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	if err := w.Close(); err != nil {
 		return nil, err
 	}
-	
-	encrypted := gcm.Seal(nonce, nonce, data, nil)
-	return encrypted, nil
+
+	return buf.Bytes(), nil
 }
 
-// DecryptFile дешифрует файл
-func (s *EncryptionService) DecryptFile(encryptedData []byte, masterPassword string) ([]byte, error) {
-	key := s.deriveKey(masterPassword)
-	
-	block, err := aes.NewCipher(key)
+// DecryptFile дешифрует файл любого поддерживаемого формата.
+// fc - контекст, к которому должен быть привязан файл (nil для непривязанных файлов).
+func (s *EncryptionService) DecryptFile(encryptedData []byte, masterPassword string, fc *FileContext) ([]byte, error) {
+	if !hasMagic(encryptedData) {
+		if err := checkBinding(false, fc); err != nil {
+			return nil, err
+		}
+		return s.decryptLegacyFile(encryptedData, masterPassword)
+	}
+
+	h, headerLen, err := ParseHeader(encryptedData)
 	if err != nil {
 		return nil, err
 	}
-	
-	gcm, err := cipher.NewGCM(block)
+
+	if h.Version != FormatVersion1 {
+		r, err := s.NewDecryptReader(bytes.NewReader(encryptedData), masterPassword, fc)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	}
+
+	if err := checkBinding(false, fc); err != nil {
+		return nil, err
+	}
+
+	key, err := s.deriveKeyFromHeader(h, masterPassword)
 	if err != nil {
 		return nil, err
 	}
-	
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(h.Nonce) != gcm.NonceSize() {
+		return nil, ErrInvalidHeader
+	}
+
+	headerBytes, ciphertext := encryptedData[:headerLen], encryptedData[headerLen:]
+
+	decrypted, err := gcm.Open(nil, h.Nonce, ciphertext, headerBytes)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+
+	return decrypted, nil
+}
+
+// decryptLegacyFile дешифрует файл старого формата без заголовка
+func (s *EncryptionService) decryptLegacyFile(encryptedData []byte, masterPassword string) ([]byte, error) {
+	key := s.deriveKey(masterPassword)
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
 	nonceSize := gcm.NonceSize()
 	if len(encryptedData) < nonceSize {
 		return nil, errors.New("ciphertext too short")
 	}
-	
+
 	nonce, ciphertext := encryptedData[:nonceSize], encryptedData[nonceSize:]
-	
+
 	decrypted, err := gcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
-		return nil, errors.New("decryption failed - check master password")
+		return nil, ErrDecryptionFailed
 	}
-	
+
 	return decrypted, nil
 }
 
-// EncryptFilename шифрует имя файла
-func (s *EncryptionService) EncryptFilename(filename, masterPassword string) (string, error) {
-	key := s.deriveKey(masterPassword)
-	
-	block, err := aes.NewCipher(key[:16]) // Используем 16 байт для AES-128 для имен
-	if err != nil {
-		return "", err
+// NameKeys - ключи для расшифровки имен файлов. Имена версий 4-6
+// шифруются ключом, выведенным из ключа пользователя KEK. Имена версий 1-3
+// шифровались ключом из мастер-пароля с фиксированной солью
+// (LegacyNameKey): если Legacy не задан, он выводится из Password при
+// первом таком имени и запоминается.
+type NameKeys struct {
+	KEK      []byte
+	Legacy   []byte
+	Password string
+}
+
+// LegacyNameKey выводит из мастер-пароля ключ имен версий 1-3. Нужен
+// только для чтения: новые имена шифруются ключом пользователя.
+func (s *EncryptionService) LegacyNameKey(masterPassword string) []byte {
+	return s.deriveKey(masterPassword)
+}
+
+// legacyKey возвращает ключ имен версий 1-3
+func (s *EncryptionService) legacyKey(keys *NameKeys) ([]byte, error) {
+	if keys.Legacy == nil {
+		if keys.Password == "" {
+			return nil, ErrLegacyNameKeyRequired
+		}
+		keys.Legacy = s.LegacyNameKey(keys.Password)
 	}
-	
-	gcm, err := cipher.NewGCM(block)
+	return keys.Legacy, nil
+}
+
+// EncryptFilename шифрует имя файла ключом пользователя kek набором шифров
+// opts.Suite. Если задан opts.Context, имя привязывается к файлу. С
+// opts.DeterministicName имя шифруется AES-SIV и одинаково для одинаковых
+// имен в одном каталоге.
+func (s *EncryptionService) EncryptFilename(filename string, kek []byte, opts WriteOptions) (string, error) {
+	if len(kek) != keySize {
+		return "", errors.New("invalid key size")
+	}
+
+	if opts.DeterministicName {
+		return encryptFilenameSIV(filename, sivNameKey(kek), nameFormatVersion6, opts.Context)
+	}
+
+	suite, err := s.ResolveSuite(opts.Suite)
 	if err != nil {
 		return "", err
 	}
-	
-	nonce := make([]byte, gcm.NonceSize())
+
+	nonce := make([]byte, suite.nonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", err
 	}
-	
-	encrypted := gcm.Seal(nonce, nonce, []byte(filename), nil)
-	
+
+	version := byte(nameFormatVersion4)
+	if opts.Context != nil {
+		version = nameFormatVersion5
+	}
+	return sealFilename(filename, nameKey(kek), version, suite, nonce, opts.Context)
+}
+
+// sealFilename шифрует имя файла с заданным nonce
+func sealFilename(filename string, key []byte, version byte, suite CipherSuite, nonce []byte, fc *FileContext) (string, error) {
+	aead, err := suite.newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	// Версия и набор шифров идут первыми и аутентифицируются вместе с именем
+	prefix := []byte{version, byte(suite)}
+	encrypted := append(prefix, nonce...)
+	encrypted = aead.Seal(encrypted, nonce, []byte(filename), bindAD(prefix, fc, version))
+
 	// Конвертируем в base64 для использования в имени файла
 	encoded := base64.URLEncoding.EncodeToString(encrypted)
 	return encoded + ".encrypted", nil
 }
 
-// DecryptFilename дешифрует имя файла
-func (s *EncryptionService) DecryptFilename(encryptedFilename, masterPassword string) (string, error) {
+// DecryptFilename дешифрует имя файла. Если задан fc, имя должно быть
+// привязано к этому файлу.
+func (s *EncryptionService) DecryptFilename(encryptedFilename string, keys *NameKeys, fc *FileContext) (string, error) {
 	if !strings.HasSuffix(encryptedFilename, ".encrypted") {
 		return encryptedFilename, nil
 	}
-	
+
 	// Убираем расширение
 	base64Str := strings.TrimSuffix(encryptedFilename, ".encrypted")
-	
+
 	// Декодируем base64
 	encryptedData, err := base64.URLEncoding.DecodeString(base64Str)
 	if err != nil {
 		return "", err
 	}
-	
-	key := s.deriveKey(masterPassword)
+	if len(encryptedData) == 0 {
+		return "", errors.New("invalid encrypted filename")
+	}
+
+	version := encryptedData[0]
+	hasPrefix := len(encryptedData) > 2 && CipherSuite(encryptedData[1]).Valid()
+
+	// Привязанное имя принимаем только в форматах версий 2, 3, 5 и 6: имя
+	// без привязки на месте привязанного - подмена
+	if fc != nil {
+		switch {
+		case version == nameFormatVersion6:
+			return decryptFilenameSIV(encryptedData, sivNameKey(keys.KEK), fc)
+		case hasPrefix && version == nameFormatVersion5:
+			return decryptPrefixedFilename(encryptedData, nameKey(keys.KEK), fc)
+		case version != nameFormatVersion3 && !(hasPrefix && version == nameFormatVersion2):
+			return "", ErrTampered
+		}
+
+		legacy, err := s.legacyKey(keys)
+		if err != nil {
+			return "", err
+		}
+		if version == nameFormatVersion3 {
+			return decryptFilenameSIV(encryptedData, sivNameKey(legacy), fc)
+		}
+		return decryptPrefixedFilename(encryptedData, nameKey(legacy), fc)
+	}
+
+	// Старые имена начинаются прямо со случайного nonce, поэтому первый байт
+	// может случайно совпасть с версией - тогда пробуем оба формата
+	if hasPrefix && version == nameFormatVersion4 {
+		if name, err := decryptPrefixedFilename(encryptedData, nameKey(keys.KEK), nil); err == nil {
+			return name, nil
+		}
+	}
+
+	legacy, err := s.legacyKey(keys)
+	if err != nil {
+		return "", err
+	}
+	if hasPrefix && version == nameFormatVersion1 {
+		if name, err := decryptPrefixedFilename(encryptedData, nameKey(legacy), nil); err == nil {
+			return name, nil
+		}
+	}
+
+	return s.decryptLegacyFilename(encryptedData, legacy)
+}
+
+// decryptPrefixedFilename дешифрует имя с версией и набором шифров
+func decryptPrefixedFilename(encryptedData, key []byte, fc *FileContext) (string, error) {
+	prefix, rest := encryptedData[:2], encryptedData[2:]
+
+	aead, err := CipherSuite(prefix[1]).newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	if len(rest) < aead.NonceSize() {
+		return "", errors.New("invalid encrypted filename")
+	}
+
+	nonce, ciphertext := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+
+	decrypted, err := aead.Open(nil, nonce, ciphertext, bindAD(prefix, fc, prefix[0]))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt filename: %w", err)
+	}
+
+	return string(decrypted), nil
+}
+
+// encryptFilenameSIV шифрует имя детерминированно, привязывая его к
+// пользователю и каталогу из fc
+func encryptFilenameSIV(filename string, key []byte, version byte, fc *FileContext) (string, error) {
+	if fc == nil {
+		return "", ErrContextRequired
+	}
+
+	siv, err := newSIV(key)
+	if err != nil {
+		return "", err
+	}
+
+	prefix := []byte{version}
+	encrypted := append(prefix, siv.Seal([]byte(filename), sivNameAssociatedData(prefix, fc)...)...)
+
+	return base64.URLEncoding.EncodeToString(encrypted) + ".encrypted", nil
+}
+
+// decryptFilenameSIV дешифрует детерминированное имя
+func decryptFilenameSIV(encryptedData, key []byte, fc *FileContext) (string, error) {
+	siv, err := newSIV(key)
+	if err != nil {
+		return "", err
+	}
+
+	prefix := encryptedData[:1]
+	decrypted, err := siv.Open(encryptedData[1:], sivNameAssociatedData(prefix, fc)...)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt filename: %w", err)
+	}
+
+	return string(decrypted), nil
+}
+
+// sivNameAssociatedData возвращает дополнительные данные детерминированного имени
+func sivNameAssociatedData(prefix []byte, fc *FileContext) [][]byte {
+	user := make([]byte, 8)
+	binary.BigEndian.PutUint64(user, fc.UserID)
+	return [][]byte{sivNameAD, prefix, user, []byte(fc.Dir)}
+}
+
+// decryptLegacyFilename дешифрует имя старого формата (AES-128-GCM на усеченном ключе)
+func (s *EncryptionService) decryptLegacyFilename(encryptedData, legacyKey []byte) (string, error) {
+	key := legacyKey
 	
 	block, err := aes.NewCipher(key[:16])
 	if err != nil {
@@ -147,4 +445,22 @@ func (s *EncryptionService) DecryptFilename(encryptedFilename, masterPassword st
 	}
 	
 	return string(decrypted), nil
-}
\ No newline at end of file
+}
+
+// nameKey выводит из ключа key отдельный полноразмерный ключ для имен файлов
+func nameKey(key []byte) []byte {
+	return expandNameKey(key, nameKeyInfo, keySize)
+}
+
+// sivNameKey выводит ключ AES-SIV для детерминированных имен, независимый от nameKey
+func sivNameKey(key []byte) []byte {
+	return expandNameKey(key, sivNameKeyInfo, sivKeySize)
+}
+
+// expandNameKey выводит ключ размера size из key через HKDF
+func expandNameKey(key, info []byte, size int) []byte {
+	out := make([]byte, size)
+	kdf := hkdf.New(sha256.New, key, nil, info)
+	io.ReadFull(kdf, out)
+	return out
+}
@@ -0,0 +1,168 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Конвертное шифрование (форматы версий 3-7).
+//
+// Содержимое файла шифруется случайным ключом файла (DEK). Ключ файла
+// обертывается ключом пользователя (KEK), который выводится из мастер-пароля
+// по параметрам KeyDerivation. Обернутый ключ хранится в заголовке файла и
+// в метаданных файла в БД: при смене пароля достаточно переобернуть ключи
+// в БД, не перешифровывая сами файлы в облаке.
+
+const (
+	keySize = 32
+
+	// Размер обернутого ключа без префикса набора шифров: nonce | ключ | тег GCM
+	legacyWrappedKeySize = 12 + keySize + 16
+)
+
+var keyWrapAD = []byte("secure-cloud/key-wrap")
+
+var ErrInvalidWrappedKey = errors.New("invalid wrapped key")
+
+// WrapKey шифрует ключ файла ключом пользователя набором шифров suite.
+// Результат: suite uint8 | nonce | шифротекст.
+func WrapKey(suite CipherSuite, kek, key []byte) ([]byte, error) {
+	nonce := make([]byte, suite.nonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return wrapKey(suite, kek, key, nonce)
+}
+
+// wrapKey шифрует ключ файла с заданным nonce
+func wrapKey(suite CipherSuite, kek, key, nonce []byte) ([]byte, error) {
+	aead, err := suite.newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := append([]byte{byte(suite)}, nonce...)
+	return aead.Seal(wrapped, nonce, key, keyWrapAD), nil
+}
+
+// UnwrapKey расшифровывает ключ файла ключом пользователя.
+// Ошибка здесь почти всегда означает неверный мастер-пароль.
+func UnwrapKey(kek, wrapped []byte) ([]byte, error) {
+	// Ключи, обернутые до появления наборов шифров, не имеют префикса
+	// и всегда зашифрованы AES-256-GCM
+	suite := SuiteAES256GCM
+	if len(wrapped) != legacyWrappedKeySize {
+		if len(wrapped) == 0 {
+			return nil, ErrInvalidWrappedKey
+		}
+		suite, wrapped = CipherSuite(wrapped[0]), wrapped[1:]
+		if !suite.Valid() {
+			return nil, ErrInvalidWrappedKey
+		}
+	}
+
+	aead, err := suite.newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) != aead.NonceSize()+keySize+aead.Overhead() {
+		return nil, ErrInvalidWrappedKey
+	}
+
+	nonce, ciphertext := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+
+	key, err := aead.Open(nil, nonce, ciphertext, keyWrapAD)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+
+	return key, nil
+}
+
+// WriteOptions - параметры шифрования нового файла
+type WriteOptions struct {
+	Suite   CipherSuite  // Набор шифров (0 - набор по умолчанию)
+	Context *FileContext // Контекст, к которому привязывается файл (nil - без привязки)
+
+	// DeterministicName включает AES-SIV для имени: одинаковые имена в одном
+	// каталоге дают одинаковое зашифрованное имя. Требует Context.
+	DeterministicName bool
+
+	// Padding выравнивает размер открытого текста, скрывая точную длину файла
+	Padding PaddingScheme
+
+	// Compression сжимает содержимое перед шифрованием (см. ChooseCompression)
+	Compression Compression
+}
+
+// NewEnvelopeWriter шифрует данные случайным ключом файла, обернутым kek.
+// kd должны быть параметрами, по которым был выведен kek: они записываются
+// в заголовок, чтобы файл можно было расшифровать одним мастер-паролем.
+// Вторым значением возвращается обернутый ключ файла для хранения в БД.
+func (s *EncryptionService) NewEnvelopeWriter(w io.Writer, kek []byte, kd *KeyDerivation, opts WriteOptions) (io.WriteCloser, []byte, error) {
+	suite, err := s.ResolveSuite(opts.Suite)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dek := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, err := WrapKey(suite, kek, dek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prefix := make([]byte, suite.streamNoncePrefixSize())
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, nil, err
+	}
+
+	h := &Header{
+		Version:    CurrentFormatVersion,
+		KDF:        kd.KDF,
+		KDFParams:  kd.Params,
+		Salt:       kd.Salt,
+		Nonce:      prefix,
+		ChunkSize:  defaultChunkSize,
+		WrappedKey: wrapped,
+		Suite:      suite,
+		Codec:      opts.Compression,
+	}
+
+	if !opts.Compression.Valid() {
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnsupportedCompression, uint8(opts.Compression))
+	}
+
+	sw, err := newStreamWriter(w, dek, h, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cw, err := newCompressWriter(sw, opts.Compression)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cw, wrapped, nil
+}
+
+// NewDecryptReaderWithKey расшифровывает файл конвертного формата уже
+// известным ключом файла, не обращаясь к обернутому ключу из заголовка.
+// Файл без ключа в заголовке на месте конвертного считается подменой.
+func (s *EncryptionService) NewDecryptReaderWithKey(r io.Reader, dek []byte, fc *FileContext) (io.Reader, error) {
+	src, h, headerBytes, err := openStream(r)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil || h.Version < FormatVersion3 {
+		return nil, fmt.Errorf("%w: file has no envelope key", ErrTampered)
+	}
+
+	return newStreamReader(src, dek, h, headerBytes, fc)
+}
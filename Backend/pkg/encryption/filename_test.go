@@ -0,0 +1,101 @@
+package encryption
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFilenameRoundTrip(t *testing.T) {
+	s := newTestService(t)
+	kek := randomBytes(t, keySize)
+	keys := &NameKeys{KEK: kek}
+
+	bound := &FileContext{UserID: 7, FileID: "6f1c2a9e-3b4d-4c5e-8f70-1a2b3c4d5e6f"}
+	dir := &FileContext{UserID: 7, Dir: "/Документы/"}
+
+	tests := []struct {
+		name string
+		opts WriteOptions
+		fc   *FileContext
+	}{
+		{"unbound", WriteOptions{}, nil},
+		{"unbound xchacha", WriteOptions{Suite: SuiteXChaCha20Poly1305}, nil},
+		{"bound", WriteOptions{Context: bound}, bound},
+		{"deterministic", WriteOptions{Context: dir, DeterministicName: true}, dir},
+	}
+	for _, tt := range tests {
+		encrypted, err := s.EncryptFilename("Отчет 2024.pdf", kek, tt.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		name, err := s.DecryptFilename(encrypted, keys, tt.fc)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if name != "Отчет 2024.pdf" {
+			t.Fatalf("%s: got %q", tt.name, name)
+		}
+
+		// Другой ключ пользователя имя не открывает
+		if _, err := s.DecryptFilename(encrypted, &NameKeys{KEK: randomBytes(t, keySize)}, tt.fc); err == nil {
+			t.Errorf("%s: name decrypted with another user key", tt.name)
+		}
+	}
+
+	// Детерминированное имя одинаково в одном каталоге и различается в разных
+	a, _ := s.EncryptFilename("a.txt", kek, WriteOptions{Context: dir, DeterministicName: true})
+	b, _ := s.EncryptFilename("a.txt", kek, WriteOptions{Context: dir, DeterministicName: true})
+	c, _ := s.EncryptFilename("a.txt", kek, WriteOptions{Context: &FileContext{UserID: 7, Dir: "/"}, DeterministicName: true})
+	if a != b || a == c {
+		t.Error("deterministic names do not depend on the directory only")
+	}
+}
+
+func TestFilenameRejectsUnboundInBoundContext(t *testing.T) {
+	s := newTestService(t)
+	kek := randomBytes(t, keySize)
+
+	encrypted, err := s.EncryptFilename("a.txt", kek, WriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := &FileContext{UserID: 7, FileID: "6f1c2a9e-3b4d-4c5e-8f70-1a2b3c4d5e6f"}
+	if _, err := s.DecryptFilename(encrypted, &NameKeys{KEK: kek}, fc); !errors.Is(err, ErrTampered) {
+		t.Fatalf("got %v, want ErrTampered", err)
+	}
+
+	other := &FileContext{UserID: 7, FileID: "00000000-0000-4000-8000-000000000000"}
+	bound, err := s.EncryptFilename("a.txt", kek, WriteOptions{Context: fc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DecryptFilename(bound, &NameKeys{KEK: kek}, other); err == nil {
+		t.Fatal("name bound to another file decrypted")
+	}
+}
+
+func TestLegacyFilenameNeedsPassword(t *testing.T) {
+	s := newTestService(t)
+	fc := &FileContext{UserID: 7, FileID: "6f1c2a9e-3b4d-4c5e-8f70-1a2b3c4d5e6f"}
+
+	legacy := nameKey(s.LegacyNameKey("password"))
+	encrypted, err := sealFilename("a.txt", legacy, nameFormatVersion2, SuiteAES256GCM, randomBytes(t, SuiteAES256GCM.nonceSize()), fc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := &NameKeys{KEK: randomBytes(t, keySize)}
+	if _, err := s.DecryptFilename(encrypted, keys, fc); !errors.Is(err, ErrLegacyNameKeyRequired) {
+		t.Fatalf("got %v, want ErrLegacyNameKeyRequired", err)
+	}
+
+	keys.Password = "password"
+	name, err := s.DecryptFilename(encrypted, keys, fc)
+	if err != nil || name != "a.txt" {
+		t.Fatalf("got %q, %v", name, err)
+	}
+	if keys.Legacy == nil {
+		t.Error("legacy key is not cached")
+	}
+}
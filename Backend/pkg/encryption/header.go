@@ -0,0 +1,286 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Формат зашифрованного файла (полное описание и тестовые векторы - FORMAT.md):
+//
+//	magic     [4]byte  "SCF\x00"
+//	version   uint8    версия формата
+//	kdf       uint8    идентификатор функции вывода ключа (см. kdf.go)
+//	paramLen  uint8    длина параметров KDF
+//	params    []byte   параметры KDF (зависят от kdf)
+//	saltLen   uint8    длина соли
+//	salt      []byte   случайная соль KDF
+//	nonceLen  uint8    длина nonce (в версии 2 - префикс nonce)
+//	nonce     []byte   nonce AEAD
+//	chunkSize uint32   размер фрагмента открытого текста (с версии 2)
+//	keyLen    uint8    длина обернутого ключа файла (с версии 3)
+//	key       []byte   ключ файла, обернутый ключом пользователя
+//	suite     uint8    набор шифров содержимого (с версии 4, см. suite.go)
+//	flags     uint8    флаги (с версии 5)
+//	codec     uint8    кодек сжатия содержимого (с версии 6, см. compression.go)
+//	userID    uint64   владелец файла (с версии 7, только с флагом FlagBound)
+//	fileIDLen uint8    длина идентификатора файла (с версии 7, только с FlagBound)
+//	fileID    []byte   постоянный идентификатор файла
+//
+// Версия 1: за заголовком идет шифротекст AES-256-GCM целиком.
+// Версия 2: за заголовком идут фрагменты по chunkSize байт, каждый
+// зашифрован отдельно (см. stream.go).
+// Версия 3: как версия 2, но фрагменты шифруются случайным ключом файла,
+// а соль и параметры KDF относятся к ключу пользователя (см. envelope.go).
+// Версия 4: как версия 3, но набор шифров указан явно. В версиях 1-3
+// всегда используется AES-256-GCM.
+// Версия 5: как версия 4, плюс флаги. Флаг FlagBound означает, что файл
+// привязан к пользователю и файлу (см. context.go), FlagPadded - что длина
+// открытого текста выровнена (см. padding.go).
+// Версия 6: как версия 5, но открытый текст может быть сжат до шифрования.
+// Версия 7: как версия 6, но контекст привязки хранится в заголовке, чтобы
+// файл можно было расшифровать без БД (см. ReadFileContext). Сервер по-прежнему
+// передает ожидаемый контекст сам, поэтому подмена обнаруживается как раньше.
+//
+// Заголовок целиком передается в AEAD как дополнительные данные,
+// поэтому подмена параметров обнаруживается при расшифровке.
+//
+// Старые файлы (до появления заголовка) начинаются прямо с nonce и
+// шифруются ключом, выведенным из фиксированной соли.
+
+const (
+	FormatVersion1 = 1
+	FormatVersion2 = 2
+	FormatVersion3 = 3
+	FormatVersion4 = 4
+	FormatVersion5 = 5
+	FormatVersion6 = 6
+	FormatVersion7 = 7
+
+	// CurrentFormatVersion - версия, в которой пишутся новые файлы
+	CurrentFormatVersion = FormatVersion7
+
+	saltSize = 16
+)
+
+// Флаги заголовка
+const (
+	FlagBound  uint8 = 1 << 0
+	FlagPadded uint8 = 1 << 1
+
+	knownFlags = FlagBound | FlagPadded
+)
+
+var fileMagic = []byte{'S', 'C', 'F', 0}
+
+var (
+	ErrInvalidHeader      = errors.New("invalid encryption header")
+	ErrUnsupportedVersion = errors.New("unsupported encryption format version")
+	ErrUnsupportedKDF     = errors.New("unsupported key derivation function")
+)
+
+// Header описывает заголовок зашифрованного файла. Поля, которых нет в
+// версии Version, при сериализации не записываются.
+type Header struct {
+	Version    uint8
+	KDF        uint8  // Функция вывода ключа (см. kdf.go и KDFMasterKey)
+	KDFParams  []byte // Параметры KDF или идентификатор ключа пользователя
+	Salt       []byte
+	Nonce      []byte // Nonce (версия 1) или префикс nonce фрагментов
+	ChunkSize  uint32
+	WrappedKey []byte
+	Suite      CipherSuite
+	Flags      uint8
+	Codec      Compression
+	Context    *FileContext // Контекст привязки (с версии 7, только UserID и FileID)
+}
+
+// hasMagic проверяет, начинаются ли данные с заголовка нового формата
+func hasMagic(data []byte) bool {
+	return bytes.HasPrefix(data, fileMagic)
+}
+
+// Marshal сериализует заголовок в байты
+func (h *Header) Marshal() ([]byte, error) {
+	if len(h.KDFParams) > 255 || len(h.Salt) > 255 || len(h.Nonce) > 255 || len(h.WrappedKey) > 255 {
+		return nil, ErrInvalidHeader
+	}
+
+	buf := make([]byte, 0, len(fileMagic)+14+len(h.KDFParams)+len(h.Salt)+len(h.Nonce)+len(h.WrappedKey))
+	buf = append(buf, fileMagic...)
+	buf = append(buf, h.Version, h.KDF)
+	buf = append(buf, byte(len(h.KDFParams)))
+	buf = append(buf, h.KDFParams...)
+	buf = append(buf, byte(len(h.Salt)))
+	buf = append(buf, h.Salt...)
+	buf = append(buf, byte(len(h.Nonce)))
+	buf = append(buf, h.Nonce...)
+	if h.Version >= FormatVersion2 {
+		buf = binary.BigEndian.AppendUint32(buf, h.ChunkSize)
+	}
+	if h.Version >= FormatVersion3 {
+		buf = append(buf, byte(len(h.WrappedKey)))
+		buf = append(buf, h.WrappedKey...)
+	}
+	if h.Version >= FormatVersion4 {
+		buf = append(buf, byte(h.Suite))
+	}
+	if h.Version >= FormatVersion5 {
+		buf = append(buf, h.Flags)
+	}
+	if h.Version >= FormatVersion6 {
+		buf = append(buf, byte(h.Codec))
+	}
+	if h.Version >= FormatVersion7 && h.Flags&FlagBound != 0 {
+		if h.Context == nil || len(h.Context.FileID) > 255 {
+			return nil, ErrInvalidHeader
+		}
+		buf = binary.BigEndian.AppendUint64(buf, h.Context.UserID)
+		buf = append(buf, byte(len(h.Context.FileID)))
+		buf = append(buf, h.Context.FileID...)
+	}
+	return buf, nil
+}
+
+// ParseHeader разбирает заголовок в начале data и возвращает его вместе
+// с длиной заголовка в байтах
+func ParseHeader(data []byte) (*Header, int, error) {
+	h, raw, err := readHeader(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, 0, err
+	}
+	return h, len(raw), nil
+}
+
+// ReadHeader читает заголовок из r и возвращает его вместе с исходными
+// байтами (они передаются в AEAD как дополнительные данные). Из r
+// читается ровно заголовок, шифротекст остается непрочитанным.
+func ReadHeader(r io.Reader) (*Header, []byte, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(&byteReader{r}, 16)
+	}
+	return readHeader(br)
+}
+
+// byteReader отдает данные по одному байту, чтобы bufio.Reader не читал
+// из источника дальше заголовка
+type byteReader struct {
+	r io.Reader
+}
+
+func (b *byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return b.r.Read(p)
+}
+
+// readHeader читает заголовок из потока и возвращает его вместе с исходными байтами
+func readHeader(r *bufio.Reader) (*Header, []byte, error) {
+	var raw []byte
+
+	readN := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, ErrInvalidHeader
+		}
+		raw = append(raw, b...)
+		return b, nil
+	}
+
+	prefix, err := readN(len(fileMagic) + 2)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !hasMagic(prefix) {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	h := &Header{Version: prefix[len(fileMagic)], KDF: prefix[len(fileMagic)+1], Suite: SuiteAES256GCM}
+	if h.Version < FormatVersion1 || h.Version > FormatVersion7 {
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.Version)
+	}
+
+	fields := []*[]byte{&h.KDFParams, &h.Salt, &h.Nonce}
+	for _, field := range fields {
+		n, err := readN(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		if *field, err = readN(int(n[0])); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if h.Version >= FormatVersion2 {
+		b, err := readN(4)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.ChunkSize = binary.BigEndian.Uint32(b)
+		if h.ChunkSize < minChunkSize || h.ChunkSize > maxChunkSize {
+			return nil, nil, ErrInvalidHeader
+		}
+	}
+
+	if h.Version >= FormatVersion3 {
+		n, err := readN(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		if h.WrappedKey, err = readN(int(n[0])); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if h.Version >= FormatVersion4 {
+		b, err := readN(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.Suite = CipherSuite(b[0])
+		if !h.Suite.Valid() {
+			return nil, nil, fmt.Errorf("%w: %d", ErrUnsupportedSuite, b[0])
+		}
+	}
+
+	if h.Version >= FormatVersion5 {
+		b, err := readN(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.Flags = b[0]
+		if h.Flags&^knownFlags != 0 {
+			return nil, nil, ErrInvalidHeader
+		}
+	}
+
+	if h.Version >= FormatVersion6 {
+		b, err := readN(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.Codec = Compression(b[0])
+		if !h.Codec.Valid() {
+			return nil, nil, fmt.Errorf("%w: %d", ErrUnsupportedCompression, b[0])
+		}
+	}
+
+	if h.Version >= FormatVersion7 && h.Flags&FlagBound != 0 {
+		b, err := readN(9)
+		if err != nil {
+			return nil, nil, err
+		}
+		fileID, err := readN(int(b[8]))
+		if err != nil {
+			return nil, nil, err
+		}
+		h.Context = &FileContext{UserID: binary.BigEndian.Uint64(b[:8]), FileID: string(fileID)}
+	}
+
+	return h, raw, nil
+}
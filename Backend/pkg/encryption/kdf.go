@@ -0,0 +1,236 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Функции вывода ключа из мастер-пароля.
+//
+// Новые ключи выводятся Argon2id с параметрами из конфигурации, PBKDF2
+// остается только для расшифровки старых файлов. Параметры KDF хранятся
+// в заголовке каждого файла:
+//
+//	PBKDF2-SHA256: iterations uint32
+//	Argon2id:      time uint32 | memory uint32 (КиБ) | threads uint8
+//
+// Файлы, ключ которых обернут ключом пользователя из слотов, вместо
+// параметров KDF хранят идентификатор этого ключа (см. keyslot.go).
+
+const (
+	KDFPBKDF2SHA256 uint8 = 1
+	KDFArgon2id     uint8 = 2
+
+	pbkdf2Iterations    = 100000
+	maxPBKDF2Iterations = 10000000
+
+	maxArgon2Time   = 64
+	maxArgon2Memory = 4 * 1024 * 1024 // 4 ГиБ
+
+	keyCheckSize = 16
+)
+
+var keyCheckInfo = []byte("secure-cloud/key-check")
+
+// Argon2Params - параметры Argon2id
+type Argon2Params struct {
+	Time    uint32 // Количество проходов
+	Memory  uint32 // Объем памяти в КиБ
+	Threads uint8  // Степень параллелизма
+}
+
+// DefaultArgon2Params - параметры Argon2id по умолчанию (рекомендации RFC 9106)
+var DefaultArgon2Params = Argon2Params{
+	Time:    3,
+	Memory:  64 * 1024,
+	Threads: 4,
+}
+
+// MaxArgon2Params - наибольшие параметры, которые можно записать в заголовок
+var MaxArgon2Params = Argon2Params{Time: maxArgon2Time, Memory: maxArgon2Memory, Threads: 255}
+
+var (
+	ErrInvalidKDFParams   = errors.New("invalid key derivation parameters")
+	ErrKDFParamsTooCostly = errors.New("key derivation parameters exceed the server limit")
+)
+
+// validate проверяет, что параметры можно записать в заголовок и прочитать обратно
+func (p Argon2Params) validate() error {
+	if p.Time == 0 || p.Time > maxArgon2Time {
+		return fmt.Errorf("%w: argon2 time must be between 1 and %d", ErrInvalidKDFParams, maxArgon2Time)
+	}
+	if p.Threads == 0 {
+		return fmt.Errorf("%w: argon2 threads must be positive", ErrInvalidKDFParams)
+	}
+	if p.Memory < 8*uint32(p.Threads) || p.Memory > maxArgon2Memory {
+		return fmt.Errorf("%w: argon2 memory must be between %d and %d KiB", ErrInvalidKDFParams, 8*uint32(p.Threads), maxArgon2Memory)
+	}
+	return nil
+}
+
+// within сообщает, что параметры не дороже limit
+func (p Argon2Params) within(limit Argon2Params) bool {
+	return p.Time <= limit.Time && p.Memory <= limit.Memory && p.Threads <= limit.Threads
+}
+
+// defaultArgon2Limit - предел параметров из заголовков: вдвое больше
+// настроенных, но не меньше удвоенных параметров по умолчанию, чтобы
+// файлы оставались читаемыми после уменьшения настроек
+func defaultArgon2Limit(p Argon2Params) Argon2Params {
+	return Argon2Params{
+		Time:    min(2*max(p.Time, DefaultArgon2Params.Time), maxArgon2Time),
+		Memory:  min(2*max(p.Memory, DefaultArgon2Params.Memory), maxArgon2Memory),
+		Threads: uint8(min(2*max(uint32(p.Threads), uint32(DefaultArgon2Params.Threads)), 255)),
+	}
+}
+
+// encode кодирует параметры Argon2id для заголовка
+func (p Argon2Params) encode() []byte {
+	params := make([]byte, 0, 9)
+	params = binary.BigEndian.AppendUint32(params, p.Time)
+	params = binary.BigEndian.AppendUint32(params, p.Memory)
+	return append(params, p.Threads)
+}
+
+// parseArgon2Params извлекает параметры Argon2id из заголовка
+func parseArgon2Params(params []byte) (Argon2Params, error) {
+	if len(params) != 9 {
+		return Argon2Params{}, ErrInvalidHeader
+	}
+
+	p := Argon2Params{
+		Time:    binary.BigEndian.Uint32(params[0:4]),
+		Memory:  binary.BigEndian.Uint32(params[4:8]),
+		Threads: params[8],
+	}
+	if p.validate() != nil {
+		return Argon2Params{}, ErrInvalidHeader
+	}
+	return p, nil
+}
+
+// pbkdf2Params кодирует количество итераций PBKDF2
+func pbkdf2Params(iterations uint32) []byte {
+	params := make([]byte, 4)
+	binary.BigEndian.PutUint32(params, iterations)
+	return params
+}
+
+// parsePBKDF2Params извлекает количество итераций PBKDF2
+func parsePBKDF2Params(params []byte) (int, error) {
+	if len(params) != 4 {
+		return 0, ErrInvalidHeader
+	}
+	iterations := binary.BigEndian.Uint32(params)
+	if iterations == 0 || iterations > maxPBKDF2Iterations {
+		return 0, ErrInvalidHeader
+	}
+	return int(iterations), nil
+}
+
+// KeyDerivation описывает вывод ключа пользователя из мастер-пароля
+type KeyDerivation struct {
+	KDF    uint8
+	Params []byte
+	Salt   []byte
+}
+
+// NewKeyDerivation создает параметры вывода ключа по умолчанию со случайной солью
+func (s *EncryptionService) NewKeyDerivation() (*KeyDerivation, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	return &KeyDerivation{
+		KDF:    KDFArgon2id,
+		Params: s.argon2Params.encode(),
+		Salt:   salt,
+	}, nil
+}
+
+// IsCurrentKDF проверяет, совпадают ли параметры с текущими настройками.
+// Ключи с устаревшими параметрами стоит перевыпустить.
+func (s *EncryptionService) IsCurrentKDF(kd *KeyDerivation) bool {
+	return kd.KDF == KDFArgon2id && bytes.Equal(kd.Params, s.argon2Params.encode())
+}
+
+// DeriveKEK выводит ключ пользователя из мастер-пароля
+func (s *EncryptionService) DeriveKEK(masterPassword string, kd *KeyDerivation) ([]byte, error) {
+	// Ключ пользователя из слотов из пароля напрямую не выводится
+	if kd.KDF == KDFMasterKey {
+		return nil, ErrMasterKeyRequired
+	}
+	if len(kd.Salt) == 0 {
+		return nil, ErrInvalidHeader
+	}
+
+	switch kd.KDF {
+	case KDFPBKDF2SHA256:
+		iterations, err := parsePBKDF2Params(kd.Params)
+		if err != nil {
+			return nil, err
+		}
+		return pbkdf2.Key([]byte(masterPassword), kd.Salt, iterations, keySize, sha256.New), nil
+	case KDFArgon2id:
+		p, err := parseArgon2Params(kd.Params)
+		if err != nil {
+			return nil, err
+		}
+		// Заголовок приходит из облака: подмененный файл не должен заставить
+		// сервер выделить гигабайты памяти на один запрос
+		if !p.within(s.argon2Limit) {
+			return nil, ErrKDFParamsTooCostly
+		}
+		return argon2.IDKey([]byte(masterPassword), kd.Salt, p.Time, p.Memory, p.Threads, keySize), nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedKDF, kd.KDF)
+	}
+}
+
+// ValidateKeyDerivation проверяет параметры вывода ключа из пароля, не
+// выводя ключ. Нужна для слотов, которые создает клиент.
+func ValidateKeyDerivation(kd *KeyDerivation) error {
+	if len(kd.Salt) == 0 || len(kd.Salt) > 255 {
+		return ErrInvalidKDFParams
+	}
+
+	var err error
+	switch kd.KDF {
+	case KDFPBKDF2SHA256:
+		_, err = parsePBKDF2Params(kd.Params)
+	case KDFArgon2id:
+		_, err = parseArgon2Params(kd.Params)
+	default:
+		return fmt.Errorf("%w: %d", ErrUnsupportedKDF, kd.KDF)
+	}
+	if err != nil {
+		return ErrInvalidKDFParams
+	}
+	return nil
+}
+
+// NewKeyCheck возвращает проверочное значение ключа пользователя. По нему
+// неверный мастер-пароль обнаруживается сразу после вывода ключа, до
+// обращения к облаку. Значение вычисляется из уже выведенного ключа, поэтому
+// перебор паролей по нему стоит столько же, сколько перебор по заголовку
+// любого файла: одно вычисление KDF на пароль.
+func NewKeyCheck(kek []byte) []byte {
+	mac := hmac.New(sha256.New, kek)
+	mac.Write(keyCheckInfo)
+	return mac.Sum(nil)[:keyCheckSize]
+}
+
+// VerifyKeyCheck сверяет ключ пользователя с проверочным значением
+func VerifyKeyCheck(kek, check []byte) bool {
+	return hmac.Equal(NewKeyCheck(kek), check)
+}
@@ -0,0 +1,91 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestArgon2Limit(t *testing.T) {
+	limit := defaultArgon2Limit(Argon2Params{Time: 4, Memory: 256 * 1024, Threads: 2})
+	want := Argon2Params{Time: 8, Memory: 512 * 1024, Threads: 8}
+	if limit != want {
+		t.Errorf("got %+v, want %+v", limit, want)
+	}
+
+	// Пределы не меньше удвоенных параметров по умолчанию и не больше допустимых в заголовке
+	if limit := defaultArgon2Limit(testArgon2Params); limit != (Argon2Params{Time: 6, Memory: 128 * 1024, Threads: 8}) {
+		t.Errorf("cheap params: got %+v", limit)
+	}
+	if limit := defaultArgon2Limit(MaxArgon2Params); limit != MaxArgon2Params {
+		t.Errorf("max params: got %+v", limit)
+	}
+}
+
+func TestDecryptRejectsCostlyHeader(t *testing.T) {
+	s := newTestService(t)
+
+	var buf bytes.Buffer
+	w, err := s.NewEncryptWriter(&buf, "password", WriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("data"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		params Argon2Params
+	}{
+		{"memory", Argon2Params{Time: 1, Memory: MaxArgon2Params.Memory, Threads: 1}},
+		{"time", Argon2Params{Time: MaxArgon2Params.Time, Memory: 64, Threads: 1}},
+		{"threads", Argon2Params{Time: 1, Memory: 8 * 255, Threads: 255}},
+	}
+	for _, tt := range tests {
+		// Подмененные параметры в заголовке из облака
+		blob := bytes.Replace(buf.Bytes(), testArgon2Params.encode(), tt.params.encode(), 1)
+		if bytes.Equal(blob, buf.Bytes()) {
+			t.Fatal("params are not found in the header")
+		}
+
+		r, err := s.NewDecryptReader(bytes.NewReader(blob), "password", nil)
+		if err == nil {
+			_, err = io.ReadAll(r)
+		}
+		if !errors.Is(err, ErrKDFParamsTooCostly) {
+			t.Errorf("%s: got %v, want ErrKDFParamsTooCostly", tt.name, err)
+		}
+	}
+
+	// Без подмены файл открывается
+	r, err := s.NewDecryptReader(bytes.NewReader(buf.Bytes()), "password", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(r); err != nil || string(data) != "data" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
+
+func TestValidatePasswordSlotRejectsCostlyParams(t *testing.T) {
+	s := newTestService(t)
+	masterKeyID := MasterKeyID(make([]byte, keySize))
+	slot := &KeyringSlot{
+		Type:       SlotPassword,
+		KDF:        KDFArgon2id,
+		KDFParams:  DefaultArgon2Params.encode(),
+		Salt:       make([]byte, saltSize),
+		WrappedKey: make([]byte, 60),
+	}
+	if err := s.ValidatePasswordSlot(masterKeyID, slot); err != nil {
+		t.Fatal(err)
+	}
+
+	slot.KDFParams = Argon2Params{Time: 3, Memory: 1024 * 1024, Threads: 4}.encode()
+	if err := s.ValidatePasswordSlot(masterKeyID, slot); !errors.Is(err, ErrKDFParamsTooCostly) {
+		t.Fatalf("got %v, want ErrKDFParamsTooCostly", err)
+	}
+}
@@ -0,0 +1,135 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Копия слотов ключей в облаке.
+//
+// Сервер хранит рядом с файлами пользователя файл KeyringFileName со всеми
+// слотами (JSON). Как и заголовок LUKS, он не содержит секретов: ключ
+// пользователя в нем только в обернутом виде. Без БД по нему можно открыть
+// ключ пользователя паролем, ключом восстановления или ключом администратора
+// и расшифровать файлы формата KDFMasterKey.
+
+const (
+	KeyringFileName = ".secure-cloud-keyring.json"
+
+	keyringVersion = 1
+)
+
+// Типы слотов
+const (
+	SlotPassword = "password"
+	SlotRecovery = "recovery"
+	SlotEscrow   = "escrow"
+)
+
+var ErrKeyringLocked = errors.New("no key slot matches the provided secret")
+
+// Keyring - слоты ключей пользователя
+type Keyring struct {
+	Version     int           `json:"version"`
+	UserID      uint64        `json:"user_id"`
+	MasterKeyID []byte        `json:"master_key_id"`
+	Slots       []KeyringSlot `json:"slots"`
+}
+
+// KeyringSlot - ключ пользователя, обернутый ключом слота
+type KeyringSlot struct {
+	Type         string `json:"type"`
+	KDF          uint8  `json:"kdf,omitempty"`
+	KDFParams    []byte `json:"kdf_params,omitempty"`
+	Salt         []byte `json:"salt,omitempty"`
+	EphemeralKey []byte `json:"ephemeral_key,omitempty"`
+	WrappedKey   []byte `json:"wrapped_key"`
+}
+
+// MarshalKeyring сериализует слоты для записи в облако
+func MarshalKeyring(k *Keyring) ([]byte, error) {
+	k.Version = keyringVersion
+	return json.MarshalIndent(k, "", "  ")
+}
+
+// ParseKeyring разбирает файл со слотами
+func ParseKeyring(data []byte) (*Keyring, error) {
+	var k Keyring
+	if err := json.Unmarshal(data, &k); err != nil {
+		return nil, fmt.Errorf("invalid keyring: %w", err)
+	}
+	if k.Version != keyringVersion {
+		return nil, fmt.Errorf("%w: keyring version %d", ErrUnsupportedVersion, k.Version)
+	}
+	return &k, nil
+}
+
+// OpenKeySlot разворачивает ключ пользователя слотом пароля или ключа
+// восстановления. Ключ восстановления передается нормализованным
+// (см. NormalizeRecoveryKey).
+func (s *EncryptionService) OpenKeySlot(slot *KeyringSlot, secret string) ([]byte, error) {
+	slotKEK, err := s.DeriveKEK(secret, &KeyDerivation{KDF: slot.KDF, Params: slot.KDFParams, Salt: slot.Salt})
+	if err != nil {
+		return nil, err
+	}
+	return UnwrapKey(slotKEK, slot.WrappedKey)
+}
+
+// Unlock открывает ключ пользователя первым подходящим слотом типа slotType.
+// Для слота депонирования secret - закрытый ключ администратора.
+func (s *EncryptionService) Unlock(k *Keyring, slotType string, secret []byte) ([]byte, error) {
+	if slotType == SlotRecovery {
+		normalized, err := NormalizeRecoveryKey(string(secret))
+		if err != nil {
+			return nil, err
+		}
+		secret = []byte(normalized)
+	}
+
+	for i := range k.Slots {
+		slot := &k.Slots[i]
+		if slot.Type != slotType {
+			continue
+		}
+
+		var key []byte
+		var err error
+		if slotType == SlotEscrow {
+			key, err = OpenEscrow(secret, slot.EphemeralKey, slot.WrappedKey)
+		} else {
+			key, err = s.OpenKeySlot(slot, string(secret))
+		}
+		if err == nil && bytes.Equal(MasterKeyID(key), k.MasterKeyID) {
+			return key, nil
+		}
+	}
+
+	return nil, ErrKeyringLocked
+}
+
+// ValidatePasswordSlot проверяет слот пароля, созданный клиентом. Пароля
+// сервер не знает и открыть слот не может, поэтому проверяются только формат
+// и стоимость вывода ключа: слот, который сервер не откроет, не принимается.
+func (s *EncryptionService) ValidatePasswordSlot(masterKeyID []byte, slot *KeyringSlot) error {
+	if len(masterKeyID) != masterKeyIDSize {
+		return errors.New("invalid master key id")
+	}
+	if slot.Type != SlotPassword {
+		return fmt.Errorf("invalid key slot type %q", slot.Type)
+	}
+	if len(slot.WrappedKey) == 0 || len(slot.WrappedKey) > 255 {
+		return errors.New("invalid wrapped key")
+	}
+	kd := &KeyDerivation{KDF: slot.KDF, Params: slot.KDFParams, Salt: slot.Salt}
+	if err := ValidateKeyDerivation(kd); err != nil {
+		return err
+	}
+	if kd.KDF == KDFArgon2id {
+		if p, _ := parseArgon2Params(kd.Params); !p.within(s.argon2Limit) {
+			return ErrKDFParamsTooCostly
+		}
+	}
+	return nil
+}
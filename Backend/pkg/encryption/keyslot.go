@@ -0,0 +1,230 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Слоты ключей (по образцу LUKS).
+//
+// Ключ пользователя (KEK), которым обернуты ключи файлов, - случайный ключ,
+// который хранится только в обернутом виде в слотах. Каждый слот открывает
+// один и тот же ключ пользователя своим секретом:
+//
+//	пароль        - ключ слота выводится из мастер-пароля (см. kdf.go)
+//	ключ восстановления - ключ слота выводится из случайного ключа,
+//	                который пользователь распечатывает и хранит отдельно
+//	депонирование - ключ слота согласуется по X25519 с открытым ключом
+//	                администратора; закрытый ключ хранится вне сервера
+//
+// Смена пароля переобертывает только слот пароля. Ключ пользователя
+// задается в заголовке файла функцией KDFMasterKey: вместо соли и
+// параметров в заголовке хранится идентификатор ключа пользователя.
+
+const (
+	// KDFMasterKey - ключ файла обернут ключом пользователя из слотов
+	KDFMasterKey uint8 = 3
+
+	masterKeyIDSize = 8
+	recoveryKeySize = 20 // 160 бит, 32 символа base32
+	x25519KeySize   = 32
+)
+
+var (
+	masterKeyIDInfo = []byte("secure-cloud/master-key-id")
+	escrowInfo      = []byte("secure-cloud/escrow")
+
+	recoveryKeyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+var (
+	ErrMasterKeyRequired  = errors.New("file key is wrapped by the user master key, key slots are required")
+	ErrInvalidRecoveryKey = errors.New("invalid recovery key")
+	ErrInvalidEscrowKey   = errors.New("invalid escrow key")
+)
+
+// NewMasterKey создает случайный ключ пользователя
+func NewMasterKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// MasterKeyID возвращает идентификатор ключа пользователя. По нему можно
+// проверить, тем ли ключом обернут ключ файла, не раскрывая сам ключ.
+func MasterKeyID(masterKey []byte) []byte {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write(masterKeyIDInfo)
+	return mac.Sum(nil)[:masterKeyIDSize]
+}
+
+// MasterKeyDerivation возвращает параметры для заголовка файла, ключ
+// которого обернут ключом пользователя masterKey
+func MasterKeyDerivation(masterKey []byte) *KeyDerivation {
+	return &KeyDerivation{
+		KDF:    KDFMasterKey,
+		Params: MasterKeyID(masterKey),
+	}
+}
+
+// GenerateRecoveryKey создает ключ восстановления в печатном виде:
+// 32 символа base32 группами по 4 через дефис
+func GenerateRecoveryKey() (string, error) {
+	raw := make([]byte, recoveryKeySize)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return "", err
+	}
+
+	encoded := recoveryKeyEncoding.EncodeToString(raw)
+	groups := make([]string, 0, len(encoded)/4)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// NormalizeRecoveryKey приводит введенный ключ восстановления к виду, из
+// которого выводится ключ слота: регистр, пробелы и дефисы не важны
+func NormalizeRecoveryKey(recoveryKey string) (string, error) {
+	normalized := strings.Map(func(r rune) rune {
+		switch {
+		case r == '-' || r == ' ' || r == '\t':
+			return -1
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return r
+	}, recoveryKey)
+
+	raw, err := recoveryKeyEncoding.DecodeString(normalized)
+	if err != nil || len(raw) != recoveryKeySize {
+		return "", ErrInvalidRecoveryKey
+	}
+	return normalized, nil
+}
+
+// GenerateEscrowKeyPair создает пару ключей X25519 администратора
+func GenerateEscrowKeyPair() (publicKey, privateKey []byte, err error) {
+	return generateX25519KeyPair()
+}
+
+// SealEscrow оборачивает ключ пользователя для открытого ключа администратора.
+// Возвращает эфемерный открытый ключ и обернутый ключ; оба хранятся в слоте.
+func SealEscrow(publicKey, masterKey []byte) (ephemeralKey, wrapped []byte, err error) {
+	return sealX25519(publicKey, masterKey, escrowInfo, ErrInvalidEscrowKey)
+}
+
+// OpenEscrow разворачивает ключ пользователя закрытым ключом администратора
+func OpenEscrow(privateKey, ephemeralKey, wrapped []byte) ([]byte, error) {
+	return openX25519(privateKey, ephemeralKey, wrapped, escrowInfo, ErrInvalidEscrowKey)
+}
+
+// generateX25519KeyPair создает случайную пару ключей X25519
+func generateX25519KeyPair() (publicKey, privateKey []byte, err error) {
+	privateKey = make([]byte, x25519KeySize)
+	if _, err := io.ReadFull(rand.Reader, privateKey); err != nil {
+		return nil, nil, err
+	}
+
+	publicKey, err = curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return publicKey, privateKey, nil
+}
+
+// sealX25519 оборачивает key для открытого ключа publicKey ключом,
+// согласованным с эфемерной парой. info разделяет назначения ключей.
+func sealX25519(publicKey, key, info []byte, errInvalid error) (ephemeralKey, wrapped []byte, err error) {
+	if len(publicKey) != x25519KeySize {
+		return nil, nil, errInvalid
+	}
+
+	ephemeralKey, ephemeralPrivate, err := generateX25519KeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kek, err := x25519KEK(ephemeralPrivate, publicKey, ephemeralKey, publicKey, info, errInvalid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, err = WrapKey(SuiteAES256GCM, kek, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ephemeralKey, wrapped, nil
+}
+
+// openX25519 разворачивает ключ, обернутый sealX25519, закрытым ключом
+func openX25519(privateKey, ephemeralKey, wrapped, info []byte, errInvalid error) ([]byte, error) {
+	if len(privateKey) != x25519KeySize || len(ephemeralKey) != x25519KeySize {
+		return nil, errInvalid
+	}
+
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, errInvalid
+	}
+
+	kek, err := x25519KEK(privateKey, ephemeralKey, ephemeralKey, publicKey, info, errInvalid)
+	if err != nil {
+		return nil, err
+	}
+	return UnwrapKey(kek, wrapped)
+}
+
+// x25519KEK выводит ключ обертывания из общего секрета X25519.
+// Оба открытых ключа входят в соль, чтобы ключ был привязан к паре.
+func x25519KEK(private, peer, ephemeralKey, publicKey, info []byte, errInvalid error) ([]byte, error) {
+	shared, err := curve25519.X25519(private, peer)
+	if err != nil {
+		return nil, errInvalid
+	}
+
+	salt := make([]byte, 0, 2*x25519KeySize)
+	salt = append(salt, ephemeralKey...)
+	salt = append(salt, publicKey...)
+
+	kek := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, info), kek); err != nil {
+		return nil, err
+	}
+	return kek, nil
+}
+
+// NewDecryptReaderWithMasterKey расшифровывает файл, ключ которого обернут
+// ключом пользователя из слотов (или выведенным из пароля ключом
+// пользователя, если файл записан до появления слотов)
+func (s *EncryptionService) NewDecryptReaderWithMasterKey(r io.Reader, masterKey []byte, fc *FileContext) (io.Reader, error) {
+	src, h, headerBytes, err := openStream(r)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil || h.Version < FormatVersion3 {
+		return nil, fmt.Errorf("%w: file has no envelope key", ErrInvalidHeader)
+	}
+	if h.KDF == KDFMasterKey && !bytes.Equal(h.KDFParams, MasterKeyID(masterKey)) {
+		return nil, ErrDecryptionFailed
+	}
+
+	key, err := UnwrapKey(masterKey, h.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return newStreamReader(src, key, h, headerBytes, fc)
+}
@@ -0,0 +1,90 @@
+package encryption
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Выравнивание длины.
+//
+// Без выравнивания размер зашифрованного файла раскрывает точную длину
+// открытого текста. С выравниванием открытый текст дополняется до размера
+// из фиксированного набора, а истинная длина хранится внутри шифротекста:
+// в padded-потоке каждый фрагмент начинается с длины полезных данных
+//
+//	dataLen uint32 | data | нули
+//
+// и после данных могут идти фрагменты, состоящие только из заполнения.
+
+// PaddingScheme - схема выравнивания длины
+type PaddingScheme uint8
+
+const (
+	PaddingNone  PaddingScheme = 0
+	PaddingPadme PaddingScheme = 1 // Padmé: не более ~12% накладных расходов, O(log log L) бит утечки
+	PaddingPow2  PaddingScheme = 2 // Степени двойки: до 100% накладных расходов, O(log log L) бит утечки
+
+	paddedLenSize = 4
+)
+
+var ErrUnsupportedPadding = errors.New("unsupported padding scheme")
+
+// ParsePaddingScheme возвращает схему выравнивания по имени
+func ParsePaddingScheme(name string) (PaddingScheme, error) {
+	switch name {
+	case "", "none":
+		return PaddingNone, nil
+	case "padme":
+		return PaddingPadme, nil
+	case "pow2":
+		return PaddingPow2, nil
+	default:
+		return 0, fmt.Errorf("%w: %s", ErrUnsupportedPadding, name)
+	}
+}
+
+func (p PaddingScheme) String() string {
+	switch p {
+	case PaddingNone:
+		return "none"
+	case PaddingPadme:
+		return "padme"
+	case PaddingPow2:
+		return "pow2"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(p))
+	}
+}
+
+// Valid проверяет, что схема поддерживается
+func (p PaddingScheme) Valid() bool {
+	return p <= PaddingPow2
+}
+
+// paddedSize возвращает размер, до которого дополняется длина n
+func (p PaddingScheme) paddedSize(n uint64) uint64 {
+	switch p {
+	case PaddingPadme:
+		return padme(n)
+	case PaddingPow2:
+		if n <= 1 {
+			return n
+		}
+		return 1 << bits.Len64(n-1)
+	default:
+		return n
+	}
+}
+
+// padme реализует схему Padmé (Nikitin et al., "Reducing Metadata Leakage
+// from Encrypted Files and Communication with PURBs", 2019)
+func padme(n uint64) uint64 {
+	if n < 2 {
+		return n
+	}
+	e := uint64(bits.Len64(n) - 1) // floor(log2(n))
+	s := uint64(bits.Len64(e))     // floor(log2(e)) + 1
+	mask := uint64(1)<<(e-s) - 1
+	return (n + mask) &^ mask
+}
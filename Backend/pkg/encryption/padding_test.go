@@ -0,0 +1,174 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestPaddedSize(t *testing.T) {
+	tests := []struct {
+		scheme PaddingScheme
+		n      uint64
+		want   uint64
+	}{
+		{PaddingNone, 1000, 1000},
+		{PaddingPow2, 0, 0},
+		{PaddingPow2, 1, 1},
+		{PaddingPow2, 2, 2},
+		{PaddingPow2, 3, 4},
+		{PaddingPow2, 1024, 1024},
+		{PaddingPow2, 1025, 2048},
+		{PaddingPadme, 0, 0},
+		{PaddingPadme, 1, 1},
+		{PaddingPadme, 9, 10},
+		{PaddingPadme, 100, 104},
+		{PaddingPadme, 1000, 1024},
+		{PaddingPadme, 2053, 2176},
+		{PaddingPadme, 1 << 20, 1 << 20},
+		{PaddingPadme, 1<<20 + 1, 1<<20 + 1<<15},
+	}
+	for _, tt := range tests {
+		if got := tt.scheme.paddedSize(tt.n); got != tt.want {
+			t.Errorf("%s(%d) = %d, want %d", tt.scheme, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPadmeProperties(t *testing.T) {
+	for n := uint64(0); n < 1<<16; n++ {
+		p := padme(n)
+		if p < n {
+			t.Fatalf("padme(%d) = %d is smaller than the input", n, p)
+		}
+		if padme(p) != p {
+			t.Fatalf("padme(%d) = %d is not a fixed point", n, p)
+		}
+		if n > 0 && p < padme(n-1) {
+			t.Fatalf("padme is not monotonic at %d", n)
+		}
+		// Накладные расходы Padmé не превышают 12%
+		if n >= 256 && float64(p-n)/float64(n) > 0.12 {
+			t.Fatalf("padme(%d) = %d: overhead above 12%%", n, p)
+		}
+	}
+}
+
+func TestParsePaddingScheme(t *testing.T) {
+	for _, scheme := range []PaddingScheme{PaddingNone, PaddingPadme, PaddingPow2} {
+		parsed, err := ParsePaddingScheme(scheme.String())
+		if err != nil || parsed != scheme {
+			t.Errorf("%s: got %v, %v", scheme, parsed, err)
+		}
+	}
+	if _, err := ParsePaddingScheme("zero"); !errors.Is(err, ErrUnsupportedPadding) {
+		t.Errorf("unknown scheme: got %v", err)
+	}
+	if PaddingScheme(3).Valid() {
+		t.Error("scheme 3 is valid")
+	}
+}
+
+// sealPadded шифрует plaintext ключом файла dek фрагментами chunkSize
+func sealPadded(t *testing.T, dek []byte, chunkSize uint32, padding PaddingScheme, plaintext []byte) []byte {
+	t.Helper()
+	h := &Header{
+		Version:    FormatVersion7,
+		KDF:        KDFMasterKey,
+		KDFParams:  MasterKeyID(dek),
+		Nonce:      make([]byte, SuiteAES256GCM.streamNoncePrefixSize()),
+		ChunkSize:  chunkSize,
+		Suite:      SuiteAES256GCM,
+		WrappedKey: make([]byte, 1+SuiteAES256GCM.nonceSize()+keySize+16),
+	}
+
+	var buf bytes.Buffer
+	w, err := newStreamWriter(&buf, dek, h, WriteOptions{Padding: padding})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPaddedStreamRoundTrip(t *testing.T) {
+	s := newTestService(t)
+	dek := randomBytes(t, keySize)
+	data := randomBytes(t, 5*minChunkSize)
+
+	// Все длины до пяти фрагментов, включая случаи, когда в последний
+	// фрагмент не помещается длина данных
+	for _, padding := range []PaddingScheme{PaddingPadme, PaddingPow2} {
+		for size := 0; size <= len(data); size++ {
+			ciphertext := sealPadded(t, dek, minChunkSize, padding, data[:size])
+
+			r, err := s.NewDecryptReaderWithKey(bytes.NewReader(ciphertext), dek, nil)
+			if err != nil {
+				t.Fatalf("%s, %d bytes: %v", padding, size, err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%s, %d bytes: %v", padding, size, err)
+			}
+			if !bytes.Equal(got, data[:size]) {
+				t.Fatalf("%s, %d bytes: plaintext mismatch", padding, size)
+			}
+		}
+	}
+}
+
+func TestPaddingHidesLength(t *testing.T) {
+	dek := randomBytes(t, keySize)
+	data := randomBytes(t, 4*minChunkSize)
+
+	// С длиной данных в каждом фрагменте открытый текст длиной from..to
+	// дополняется до одного размера
+	tests := []struct {
+		padding  PaddingScheme
+		from, to int
+	}{
+		{PaddingPow2, minChunkSize - paddedLenSize + 1, 2 * (minChunkSize - paddedLenSize)},
+		{PaddingPadme, 2041, 2164},
+	}
+	for _, tt := range tests {
+		want := len(sealPadded(t, dek, minChunkSize, tt.padding, data[:tt.from]))
+		for size := tt.from + 1; size <= tt.to; size++ {
+			if got := len(sealPadded(t, dek, minChunkSize, tt.padding, data[:size])); got != want {
+				t.Fatalf("%s: %d bytes give %d bytes of ciphertext, %d bytes give %d", tt.padding, tt.from, want, size, got)
+			}
+		}
+		if got := len(sealPadded(t, dek, minChunkSize, tt.padding, data[:tt.to+1])); got == want {
+			t.Errorf("%s: %d bytes are padded to the same size", tt.padding, tt.to+1)
+		}
+	}
+}
+
+func TestPaddedStreamEnvelope(t *testing.T) {
+	s := newTestService(t)
+	masterKey := randomBytes(t, keySize)
+	plaintext := randomBytes(t, defaultChunkSize+10)
+
+	padded := sealTestStream(t, s, masterKey, plaintext, WriteOptions{Padding: PaddingPow2})
+	plain := sealTestStream(t, s, masterKey, plaintext, WriteOptions{})
+	if len(padded) <= len(plain) {
+		t.Fatalf("padded stream is %d bytes, unpadded %d", len(padded), len(plain))
+	}
+
+	got, err := openTestStream(s, masterKey, padded, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatal("plaintext mismatch")
+	}
+
+	if _, _, err := s.NewEnvelopeWriter(io.Discard, masterKey, MasterKeyDerivation(masterKey), WriteOptions{Padding: 9}); !errors.Is(err, ErrUnsupportedPadding) {
+		t.Fatalf("invalid padding: got %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package encryption
+
+import (
+	"errors"
+)
+
+// Обмен файлами между пользователями.
+//
+// У каждого пользователя есть пара ключей X25519. Закрытый ключ хранится
+// обернутым ключом пользователя (KEK), открытый - в открытом виде. Владелец
+// файла оборачивает ключ файла (DEK) для открытого ключа получателя так же,
+// как ключ пользователя для администратора в слоте депонирования, но с
+// другой меткой вывода ключа. Получатель открывает ключ файла своим
+// закрытым ключом, то есть своим мастер-паролем; мастер-пароль владельца
+// ему не нужен.
+
+var shareInfo = []byte("secure-cloud/share")
+
+var ErrInvalidShareKey = errors.New("invalid share key")
+
+// GenerateShareKeyPair создает пару ключей X25519 пользователя
+func GenerateShareKeyPair() (publicKey, privateKey []byte, err error) {
+	return generateX25519KeyPair()
+}
+
+// SealShare оборачивает ключ файла для открытого ключа получателя.
+// Возвращает эфемерный открытый ключ и обернутый ключ файла.
+func SealShare(publicKey, fileKey []byte) (ephemeralKey, wrapped []byte, err error) {
+	return sealX25519(publicKey, fileKey, shareInfo, ErrInvalidShareKey)
+}
+
+// OpenShare разворачивает ключ файла закрытым ключом получателя
+func OpenShare(privateKey, ephemeralKey, wrapped []byte) ([]byte, error) {
+	return openX25519(privateKey, ephemeralKey, wrapped, shareInfo, ErrInvalidShareKey)
+}
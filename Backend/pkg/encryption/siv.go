@@ -0,0 +1,157 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+// AES-SIV (RFC 5297) - детерминированное шифрование с аутентификацией.
+//
+// Синтетический вектор инициализации вычисляется из открытого текста и
+// дополнительных данных (S2V на AES-CMAC), поэтому одинаковые данные
+// всегда дают одинаковый шифротекст. Повторное использование ключа при
+// этом раскрывает только факт равенства сообщений. Используется для имен
+// файлов, по которым нужен поиск на сервере.
+
+const sivBlockSize = aes.BlockSize
+
+var ErrSIVAuth = errors.New("aes-siv: authentication failed")
+
+// sivCipher реализует AES-SIV с ключом 32, 48 или 64 байта
+type sivCipher struct {
+	mac cipher.Block // Ключ S2V (первая половина)
+	ctr cipher.Block // Ключ CTR (вторая половина)
+}
+
+// newSIV создает AES-SIV. Ключ делится пополам на ключи CMAC и CTR.
+func newSIV(key []byte) (*sivCipher, error) {
+	if len(key) != 32 && len(key) != 48 && len(key) != 64 {
+		return nil, errors.New("aes-siv: invalid key size")
+	}
+
+	mac, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	ctr, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &sivCipher{mac: mac, ctr: ctr}, nil
+}
+
+// Seal шифрует plaintext и возвращает V | C
+func (c *sivCipher) Seal(plaintext []byte, ad ...[]byte) []byte {
+	v := c.s2v(plaintext, ad)
+
+	out := make([]byte, sivBlockSize+len(plaintext))
+	copy(out, v)
+	c.xorCTR(out[sivBlockSize:], plaintext, v)
+	return out
+}
+
+// Open проверяет и расшифровывает V | C
+func (c *sivCipher) Open(ciphertext []byte, ad ...[]byte) ([]byte, error) {
+	if len(ciphertext) < sivBlockSize {
+		return nil, ErrSIVAuth
+	}
+
+	v, ct := ciphertext[:sivBlockSize], ciphertext[sivBlockSize:]
+
+	plaintext := make([]byte, len(ct))
+	c.xorCTR(plaintext, ct, v)
+
+	if subtle.ConstantTimeCompare(c.s2v(plaintext, ad), v) != 1 {
+		return nil, ErrSIVAuth
+	}
+	return plaintext, nil
+}
+
+// xorCTR шифрует src в режиме CTR со счетчиком из V (биты 31 и 63 сброшены)
+func (c *sivCipher) xorCTR(dst, src, v []byte) {
+	iv := make([]byte, sivBlockSize)
+	copy(iv, v)
+	iv[8] &= 0x7f
+	iv[12] &= 0x7f
+	cipher.NewCTR(c.ctr, iv).XORKeyStream(dst, src)
+}
+
+// s2v вычисляет синтетический вектор по дополнительным данным и открытому тексту
+func (c *sivCipher) s2v(plaintext []byte, ad [][]byte) []byte {
+	d := c.cmac(make([]byte, sivBlockSize))
+	for _, s := range ad {
+		d = dbl(d)
+		xorBytes(d, c.cmac(s))
+	}
+
+	var t []byte
+	if len(plaintext) >= sivBlockSize {
+		t = make([]byte, len(plaintext))
+		copy(t, plaintext)
+		xorBytes(t[len(t)-sivBlockSize:], d)
+	} else {
+		t = dbl(d)
+		padded := make([]byte, sivBlockSize)
+		copy(padded, plaintext)
+		padded[len(plaintext)] = 0x80
+		xorBytes(t, padded)
+	}
+
+	return c.cmac(t)
+}
+
+// cmac вычисляет AES-CMAC (RFC 4493) ключом S2V
+func (c *sivCipher) cmac(msg []byte) []byte {
+	l := make([]byte, sivBlockSize)
+	c.mac.Encrypt(l, l)
+	k1 := dbl(l)
+	k2 := dbl(k1)
+
+	// Последний блок: полный - XOR с k1, неполный - дополняется и XOR с k2
+	n := (len(msg) + sivBlockSize - 1) / sivBlockSize
+	if n == 0 {
+		n = 1
+	}
+	last := make([]byte, sivBlockSize)
+	rest := msg[(n-1)*sivBlockSize:]
+	if len(rest) == sivBlockSize {
+		copy(last, rest)
+		xorBytes(last, k1)
+	} else {
+		copy(last, rest)
+		last[len(rest)] = 0x80
+		xorBytes(last, k2)
+	}
+
+	x := make([]byte, sivBlockSize)
+	for i := 0; i < n-1; i++ {
+		xorBytes(x, msg[i*sivBlockSize:(i+1)*sivBlockSize])
+		c.mac.Encrypt(x, x)
+	}
+	xorBytes(x, last)
+	c.mac.Encrypt(x, x)
+	return x
+}
+
+// dbl умножает блок на x в GF(2^128)
+func dbl(b []byte) []byte {
+	out := make([]byte, sivBlockSize)
+	var carry byte
+	for i := sivBlockSize - 1; i >= 0; i-- {
+		out[i] = b[i]<<1 | carry
+		carry = b[i] >> 7
+	}
+	// Без ветвления: 0x87 при переносе старшего бита
+	out[sivBlockSize-1] ^= 0x87 & (0 - carry)
+	return out
+}
+
+// xorBytes выполняет dst ^= src
+func xorBytes(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
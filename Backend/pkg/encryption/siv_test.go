@@ -0,0 +1,124 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Векторы RFC 5297, приложение A
+func TestSIVVectors(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		ad        []string
+		plaintext string
+		output    string
+	}{
+		{
+			name:      "A.1 deterministic",
+			key:       "fffefdfc fbfaf9f8 f7f6f5f4 f3f2f1f0 f0f1f2f3 f4f5f6f7 f8f9fafb fcfdfeff",
+			ad:        []string{"10111213 14151617 18191a1b 1c1d1e1f 20212223 24252627"},
+			plaintext: "11223344 55667788 99aabbcc ddee",
+			output:    "85632d07 c6e8f37f 950acd32 0a2ecc93 40c02b96 90c4dc04 daef7f6a fe5c",
+		},
+		{
+			// Nonce передается последним элементом дополнительных данных
+			name: "A.2 nonce-based",
+			key:  "7f7e7d7c 7b7a7978 77767574 73727170 40414243 44454647 48494a4b 4c4d4e4f",
+			ad: []string{
+				"00112233 44556677 8899aabb ccddeeff deaddada deaddada ffeeddcc bbaa9988 77665544 33221100",
+				"10203040 50607080 90a0",
+				"09f91102 9d74e35b d84156c5 635688c0",
+			},
+			plaintext: "74686973 20697320 736f6d65 20706c61 696e7465 78742074 6f20656e 63727970 74207573 696e6720 5349562d 414553",
+			output:    "7bdb6e3b 432667eb 06f4d14b ff2fbd0f cb900f2f ddbe4043 26601965 c889bf17 dba77ceb 094fa663 b7a3f748 ba8af829 ea64ad54 4a272e9c 485b62a3 fd5c0d",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			siv, err := newSIV(unhex(t, tt.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ad [][]byte
+			for _, s := range tt.ad {
+				ad = append(ad, unhex(t, s))
+			}
+			plaintext, output := unhex(t, tt.plaintext), unhex(t, tt.output)
+
+			if got := siv.Seal(plaintext, ad...); !bytes.Equal(got, output) {
+				t.Fatalf("Seal = %x, want %x", got, output)
+			}
+
+			got, err := siv.Open(output, ad...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("Open = %x, want %x", got, plaintext)
+			}
+
+			// Измененные шифротекст, вектор или дополнительные данные не проходят проверку
+			for _, i := range []int{0, sivBlockSize, len(output) - 1} {
+				modified := bytes.Clone(output)
+				modified[i] ^= 1
+				if _, err := siv.Open(modified, ad...); !errors.Is(err, ErrSIVAuth) {
+					t.Errorf("byte %d modified: got %v, want ErrSIVAuth", i, err)
+				}
+			}
+			if _, err := siv.Open(output, ad[:len(ad)-1]...); !errors.Is(err, ErrSIVAuth) {
+				t.Errorf("associated data dropped: got %v, want ErrSIVAuth", err)
+			}
+			if _, err := siv.Open(output[:sivBlockSize-1], ad...); !errors.Is(err, ErrSIVAuth) {
+				t.Errorf("short ciphertext: got %v, want ErrSIVAuth", err)
+			}
+		})
+	}
+}
+
+// Векторы AES-CMAC из RFC 4493, раздел 4
+func TestCMACVectors(t *testing.T) {
+	block, err := aes.NewCipher(unhex(t, "2b7e1516 28aed2a6 abf71588 09cf4f3c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &sivCipher{mac: block}
+
+	message := unhex(t, "6bc1bee2 2e409f96 e93d7e11 7393172a ae2d8a57 1e03ac9c 9eb76fac 45af8e51 30c81c46 a35ce411 e5fbc119 1a0a52ef f69f2445 df4f9b17 ad2b417b e66c3710")
+	tests := []struct {
+		length int
+		mac    string
+	}{
+		{0, "bb1d6929 e9593728 7fa37d12 9b756746"},
+		{16, "070a16b4 6b4d4144 f79bdd9d d04a287c"},
+		{40, "dfa66747 de9ae630 30ca3261 1497c827"},
+		{64, "51f0bebf 7e3b9d92 fc497417 79363cfe"},
+	}
+	for _, tt := range tests {
+		if got := c.cmac(message[:tt.length]); !bytes.Equal(got, unhex(t, tt.mac)) {
+			t.Errorf("%d bytes: cmac = %x, want %s", tt.length, got, tt.mac)
+		}
+	}
+}
+
+func TestSIVInvalidKeySize(t *testing.T) {
+	for _, size := range []int{0, 16, 33, 65} {
+		if _, err := newSIV(make([]byte, size)); err == nil {
+			t.Errorf("%d byte key accepted", size)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Потоковое шифрование (форматы версий 2-7).
+//
+// Открытый текст делится на фрагменты по chunkSize байт, каждый фрагмент
+// шифруется AEAD набора шифров отдельно. Nonce фрагмента собирается из
+// случайного префикса из заголовка, номера фрагмента и флага последнего
+// фрагмента:
+//
+//	prefix [7]byte | counter uint32 | last uint8   (AES-256-GCM)
+//	prefix [19]byte | counter uint32 | last uint8  (XChaCha20-Poly1305)
+//
+// Номер фрагмента не дает переставлять фрагменты, а флаг последнего
+// фрагмента - незаметно обрезать файл. Последний фрагмент может быть
+// неполным или пустым, все остальные - строго chunkSize байт.
+//
+// Дополнительные данные каждого фрагмента - заголовок целиком и, для
+// привязанных файлов, контекст файла.
+
+const (
+	defaultChunkSize = 64 * 1024
+	minChunkSize     = 1024
+	maxChunkSize     = 16 * 1024 * 1024
+
+	// Счетчик фрагмента и флаг последнего фрагмента в конце nonce
+	streamNonceSuffixSize = 5
+)
+
+var (
+	ErrDecryptionFailed = errors.New("decryption failed - check master password")
+	ErrCorruptedStream  = errors.New("encrypted stream is corrupted or truncated")
+	ErrWriterClosed     = errors.New("encrypt writer is closed")
+)
+
+// streamNonce собирает nonce для фрагмента
+func streamNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, len(prefix)+streamNonceSuffixSize)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+type encryptWriter struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	ad      []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	out     []byte
+	closed  bool
+	err     error
+
+	padding PaddingScheme
+	dataOff int    // Место под длину данных в начале фрагмента (padded-поток)
+	written uint64 // Открытый текст, уже записанный во фрагменты
+}
+
+// NewEncryptWriter возвращает writer, который шифрует записанные данные
+// и пишет результат в w. Ключ файла оборачивается ключом, выведенным из
+// мастер-пароля со случайной солью. Close дописывает последний фрагмент
+// и обязателен, но сам w не закрывает.
+func (s *EncryptionService) NewEncryptWriter(w io.Writer, masterPassword string, opts WriteOptions) (io.WriteCloser, error) {
+	kd, err := s.NewKeyDerivation()
+	if err != nil {
+		return nil, err
+	}
+
+	kek, err := s.DeriveKEK(masterPassword, kd)
+	if err != nil {
+		return nil, err
+	}
+
+	ew, _, err := s.NewEnvelopeWriter(w, kek, kd, opts)
+	return ew, err
+}
+
+// newStreamWriter пишет заголовок h и возвращает writer, шифрующий фрагменты
+// ключом key. Контекст и выравнивание из opts отмечаются флагами заголовка.
+func newStreamWriter(w io.Writer, key []byte, h *Header, opts WriteOptions) (*encryptWriter, error) {
+	aead, err := h.Suite.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.Padding.Valid() {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedPadding, uint8(opts.Padding))
+	}
+
+	fc := opts.Context
+	if fc != nil {
+		h.Flags |= FlagBound
+		if h.Version >= FormatVersion7 {
+			h.Context = &FileContext{UserID: fc.UserID, FileID: fc.FileID}
+		}
+	}
+
+	dataOff := 0
+	if opts.Padding != PaddingNone {
+		h.Flags |= FlagPadded
+		dataOff = paddedLenSize
+	}
+
+	headerBytes, err := h.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(headerBytes); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		dst:     w,
+		aead:    aead,
+		ad:      bindAD(headerBytes, fc, h.Version),
+		prefix:  h.Nonce,
+		buf:     make([]byte, dataOff, h.ChunkSize),
+		out:     make([]byte, 0, int(h.ChunkSize)+aead.Overhead()),
+		padding: opts.Padding,
+		dataOff: dataOff,
+	}, nil
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// Полный фрагмент сбрасываем только когда пришли новые данные,
+		// иначе он может оказаться последним
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (w *encryptWriter) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.err != nil {
+		return w.err
+	}
+	if w.padding != PaddingNone {
+		return w.closePadded()
+	}
+	return w.flush(true)
+}
+
+// flush шифрует накопленный фрагмент и пишет его в dst
+func (w *encryptWriter) flush(last bool) error {
+	if w.dataOff > 0 {
+		binary.BigEndian.PutUint32(w.buf, uint32(len(w.buf)-w.dataOff))
+	}
+
+	if err := w.seal(w.buf, last); err != nil {
+		return err
+	}
+
+	w.buf = w.buf[:w.dataOff]
+	return nil
+}
+
+// closePadded дописывает остаток данных и заполнение так, чтобы общий
+// размер открытого текста совпал с размером из схемы выравнивания
+func (w *encryptWriter) closePadded() error {
+	chunkSize := uint64(cap(w.buf))
+	total := w.padding.paddedSize(w.written + uint64(len(w.buf)))
+
+	// Последний фрагмент должен вместить хотя бы длину данных
+	if rem := (total - w.written) % chunkSize; rem > 0 && rem < paddedLenSize {
+		total += paddedLenSize - rem
+	}
+
+	remaining := total - w.written
+	dataLen := len(w.buf) - w.dataOff
+	for {
+		size := int(min(remaining, chunkSize))
+		last := uint64(size) == remaining
+
+		binary.BigEndian.PutUint32(w.buf, uint32(dataLen))
+		n := len(w.buf)
+		w.buf = w.buf[:size]
+		clear(w.buf[n:])
+
+		if err := w.seal(w.buf, last); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+
+		remaining -= uint64(size)
+		w.buf = w.buf[:w.dataOff]
+		dataLen = 0
+	}
+}
+
+// seal шифрует фрагмент plain и пишет его в dst
+func (w *encryptWriter) seal(plain []byte, last bool) error {
+	if !last && w.counter == ^uint32(0) {
+		w.err = errors.New("encrypted stream is too long")
+		return w.err
+	}
+
+	nonce := streamNonce(w.prefix, w.counter, last)
+	w.out = w.aead.Seal(w.out[:0], nonce, plain, w.ad)
+	if _, err := w.dst.Write(w.out); err != nil {
+		w.err = err
+		return err
+	}
+
+	w.written += uint64(len(plain))
+	w.counter++
+	return nil
+}
+
+type decryptReader struct {
+	src       *bufio.Reader
+	aead      cipher.AEAD
+	ad        []byte
+	prefix    []byte
+	counter   uint32
+	chunkSize int
+	buf       []byte
+	plain     []byte
+	padded    bool
+	done      bool
+	err       error
+}
+
+// NewDecryptReader возвращает reader с расшифрованным содержимым r.
+// Первый фрагмент расшифровывается сразу, поэтому неверный мастер-пароль
+// или подмененный файл обнаруживаются до того, как вызывающий начнет
+// отдавать данные. Файлы старых форматов читаются в память целиком.
+// fc - контекст, к которому должен быть привязан файл (nil для непривязанных файлов).
+func (s *EncryptionService) NewDecryptReader(r io.Reader, masterPassword string, fc *FileContext) (io.Reader, error) {
+	src, h, headerBytes, err := openStream(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if h == nil {
+		return s.decryptBuffered(src, masterPassword, fc)
+	}
+	if h.Version == FormatVersion1 {
+		return s.decryptBuffered(io.MultiReader(bytes.NewReader(headerBytes), src), masterPassword, fc)
+	}
+
+	key, err := s.deriveKeyFromHeader(h, masterPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	// Начиная с версии 3 из пароля выводится только ключ пользователя,
+	// ключ файла лежит в заголовке в обернутом виде
+	if h.Version >= FormatVersion3 {
+		if key, err = UnwrapKey(key, h.WrappedKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return newStreamReader(src, key, h, headerBytes, fc)
+}
+
+// openStream читает заголовок из r. Для файлов старого формата без
+// заголовка возвращает nil вместо заголовка.
+func openStream(r io.Reader) (*bufio.Reader, *Header, []byte, error) {
+	src := bufio.NewReader(r)
+
+	magic, err := src.Peek(len(fileMagic))
+	if err != nil || !hasMagic(magic) {
+		return src, nil, nil, nil
+	}
+
+	h, headerBytes, err := readHeader(src)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return src, h, headerBytes, nil
+}
+
+// newStreamReader расшифровывает фрагменты из src ключом key
+func newStreamReader(src *bufio.Reader, key []byte, h *Header, headerBytes []byte, fc *FileContext) (io.Reader, error) {
+	if err := checkBinding(h.Flags&FlagBound != 0, fc); err != nil {
+		return nil, err
+	}
+
+	aead, err := h.Suite.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(h.Nonce) != h.Suite.streamNoncePrefixSize() {
+		return nil, ErrInvalidHeader
+	}
+
+	dr := &decryptReader{
+		src:       src,
+		aead:      aead,
+		ad:        bindAD(headerBytes, fc, h.Version),
+		prefix:    h.Nonce,
+		chunkSize: int(h.ChunkSize),
+		buf:       make([]byte, int(h.ChunkSize)+aead.Overhead()),
+		padded:    h.Flags&FlagPadded != 0,
+	}
+
+	if err := dr.readChunk(); err != nil {
+		if !errors.Is(err, ErrCorruptedStream) {
+			return nil, err
+		}
+		// Начиная с версии 3 ключ файла уже проверен при разворачивании,
+		// поэтому ошибка первого фрагмента означает подмену, а не неверный пароль
+		if h.Version >= FormatVersion3 {
+			return nil, ErrTampered
+		}
+		return nil, ErrDecryptionFailed
+	}
+
+	return newDecompressReader(dr, h.Codec)
+}
+
+// decryptBuffered читает файл целиком и расшифровывает его в памяти
+func (s *EncryptionService) decryptBuffered(r io.Reader, masterPassword string, fc *FileContext) (io.Reader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err := s.DecryptFile(data, masterPassword, fc)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(decrypted), nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// readChunk читает и расшифровывает очередной фрагмент
+func (r *decryptReader) readChunk() error {
+	n, err := io.ReadFull(r.src, r.buf)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		// Полный фрагмент последний, только если за ним ничего нет
+		if _, err := r.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if n < r.aead.Overhead() {
+		return ErrCorruptedStream
+	}
+	if !last && r.counter == ^uint32(0) {
+		return ErrCorruptedStream
+	}
+
+	nonce := streamNonce(r.prefix, r.counter, last)
+	plain, err := r.aead.Open(r.buf[:0], nonce, r.buf[:n], r.ad)
+	if err != nil {
+		return ErrCorruptedStream
+	}
+
+	// В padded-потоке отдаем только полезные данные фрагмента
+	if r.padded {
+		if len(plain) < paddedLenSize {
+			return ErrCorruptedStream
+		}
+		dataLen := binary.BigEndian.Uint32(plain)
+		if uint64(dataLen) > uint64(len(plain)-paddedLenSize) {
+			return ErrCorruptedStream
+		}
+		plain = plain[paddedLenSize : paddedLenSize+int(dataLen)]
+	}
+
+	r.plain = plain
+	r.counter++
+	r.done = last
+	return nil
+}
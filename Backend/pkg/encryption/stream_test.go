@@ -0,0 +1,195 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+// testArgon2Params - дешевые параметры Argon2id для тестов
+var testArgon2Params = Argon2Params{Time: 1, Memory: 64, Threads: 1}
+
+func newTestService(t *testing.T) *EncryptionService {
+	t.Helper()
+	s, err := NewEncryptionService(Config{Argon2: testArgon2Params})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// sealTestStream шифрует plaintext ключом пользователя из слотов
+func sealTestStream(t *testing.T, s *EncryptionService, masterKey, plaintext []byte, opts WriteOptions) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, _, err := s.NewEnvelopeWriter(&buf, masterKey, MasterKeyDerivation(masterKey), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// openTestStream расшифровывает поток целиком
+func openTestStream(s *EncryptionService, masterKey, ciphertext []byte, fc *FileContext) ([]byte, error) {
+	r, err := s.NewDecryptReaderWithMasterKey(bytes.NewReader(ciphertext), masterKey, fc)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// splitStream делит шифротекст на заголовок и фрагменты
+func splitStream(t *testing.T, ciphertext []byte, suite CipherSuite) ([]byte, [][]byte) {
+	t.Helper()
+	h, headerLen, err := ParseHeader(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := suite.newAEAD(make([]byte, keySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := int(h.ChunkSize) + aead.Overhead()
+	var chunks [][]byte
+	for rest := ciphertext[headerLen:]; len(rest) > 0; {
+		n := min(size, len(rest))
+		chunks = append(chunks, rest[:n])
+		rest = rest[n:]
+	}
+	return ciphertext[:headerLen], chunks
+}
+
+func joinStream(header []byte, chunks ...[]byte) []byte {
+	return bytes.Join(append([][]byte{header}, chunks...), nil)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	s := newTestService(t)
+	masterKey := randomBytes(t, keySize)
+	fc := &FileContext{UserID: 7, FileID: "6f1c2a9e-3b4d-4c5e-8f70-1a2b3c4d5e6f"}
+
+	for _, suite := range []CipherSuite{SuiteAES256GCM, SuiteXChaCha20Poly1305} {
+		for _, size := range []int{0, 1, defaultChunkSize - 1, defaultChunkSize, defaultChunkSize + 1, 3*defaultChunkSize + 5} {
+			plaintext := randomBytes(t, size)
+			ciphertext := sealTestStream(t, s, masterKey, plaintext, WriteOptions{Suite: suite, Context: fc})
+
+			got, err := openTestStream(s, masterKey, ciphertext, fc)
+			if err != nil {
+				t.Fatalf("%s, %d bytes: %v", suite, size, err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("%s, %d bytes: plaintext mismatch", suite, size)
+			}
+		}
+	}
+}
+
+func TestStreamRejectsTruncation(t *testing.T) {
+	s := newTestService(t)
+	masterKey := randomBytes(t, keySize)
+
+	for _, size := range []int{2 * defaultChunkSize, 3*defaultChunkSize + 5} {
+		ciphertext := sealTestStream(t, s, masterKey, randomBytes(t, size), WriteOptions{Suite: SuiteAES256GCM})
+		header, chunks := splitStream(t, ciphertext, SuiteAES256GCM)
+
+		cases := map[string][]byte{
+			"last chunk dropped":   joinStream(header, chunks[:len(chunks)-1]...),
+			"cut inside a chunk":   ciphertext[:len(ciphertext)-10],
+			"only the first chunk": joinStream(header, chunks[0]),
+			"header only":          header,
+		}
+		for name, truncated := range cases {
+			if _, err := openTestStream(s, masterKey, truncated, nil); err == nil {
+				t.Errorf("%d bytes, %s: truncated stream decrypted", size, name)
+			}
+		}
+	}
+}
+
+func TestStreamRejectsReordering(t *testing.T) {
+	s := newTestService(t)
+	masterKey := randomBytes(t, keySize)
+
+	ciphertext := sealTestStream(t, s, masterKey, randomBytes(t, 4*defaultChunkSize+1), WriteOptions{Suite: SuiteXChaCha20Poly1305})
+	header, chunks := splitStream(t, ciphertext, SuiteXChaCha20Poly1305)
+	if len(chunks) != 5 {
+		t.Fatalf("got %d chunks, want 5", len(chunks))
+	}
+
+	cases := map[string][]byte{
+		"first two swapped": joinStream(header, chunks[1], chunks[0], chunks[2], chunks[3], chunks[4]),
+		"middle swapped":    joinStream(header, chunks[0], chunks[2], chunks[1], chunks[3], chunks[4]),
+		"chunk duplicated":  joinStream(header, chunks[0], chunks[1], chunks[1], chunks[3], chunks[4]),
+		"last chunk moved":  joinStream(header, chunks[0], chunks[1], chunks[2], chunks[4], chunks[3]),
+		"trailing data":     append(bytes.Clone(ciphertext), chunks[4]...),
+		"middle chunk gone": joinStream(header, chunks[0], chunks[1], chunks[3], chunks[4]),
+	}
+	for name, reordered := range cases {
+		_, err := openTestStream(s, masterKey, reordered, nil)
+		if err == nil {
+			t.Errorf("%s: reordered stream decrypted", name)
+			continue
+		}
+		if !errors.Is(err, ErrCorruptedStream) && !errors.Is(err, ErrTampered) {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+}
+
+func TestStreamRejectsModification(t *testing.T) {
+	s := newTestService(t)
+	masterKey := randomBytes(t, keySize)
+	fc := &FileContext{UserID: 7, FileID: "6f1c2a9e-3b4d-4c5e-8f70-1a2b3c4d5e6f"}
+
+	ciphertext := sealTestStream(t, s, masterKey, randomBytes(t, 2*defaultChunkSize), WriteOptions{Context: fc})
+	_, headerLen, err := ParseHeader(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Изменение любого байта заголовка или шифротекста обнаруживается
+	for _, i := range []int{headerLen - 1, headerLen, headerLen + defaultChunkSize + 20, len(ciphertext) - 1} {
+		modified := bytes.Clone(ciphertext)
+		modified[i] ^= 1
+		if _, err := openTestStream(s, masterKey, modified, fc); err == nil {
+			t.Errorf("byte %d modified: stream decrypted", i)
+		}
+	}
+
+	// Файл, привязанный к другому файлу или без контекста, не открывается
+	other := &FileContext{UserID: 7, FileID: "00000000-0000-4000-8000-000000000000"}
+	if _, err := openTestStream(s, masterKey, ciphertext, other); !errors.Is(err, ErrTampered) {
+		t.Errorf("other file context: got %v, want ErrTampered", err)
+	}
+	if _, err := openTestStream(s, masterKey, ciphertext, nil); !errors.Is(err, ErrContextRequired) {
+		t.Errorf("no file context: got %v, want ErrContextRequired", err)
+	}
+}
+
+func TestStreamWrongKey(t *testing.T) {
+	s := newTestService(t)
+	masterKey := randomBytes(t, keySize)
+
+	ciphertext := sealTestStream(t, s, masterKey, []byte("secret"), WriteOptions{})
+	if _, err := openTestStream(s, randomBytes(t, keySize), ciphertext, nil); err == nil {
+		t.Fatal("stream decrypted with a wrong key")
+	}
+}
@@ -0,0 +1,92 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Наборы шифров.
+//
+// Набор шифров определяет AEAD для содержимого, ключей и имен файлов и
+// записывается в заголовок, поэтому файлы разных наборов расшифровываются
+// одинаково. XChaCha20-Poly1305 использует 192-битные nonce, поэтому
+// случайные nonce безопасны для практически неограниченного числа сообщений
+// одним ключом (у AES-GCM с 96-битными nonce этот предел около 2^32).
+
+// CipherSuite - идентификатор набора шифров
+type CipherSuite uint8
+
+const (
+	SuiteAES256GCM         CipherSuite = 1
+	SuiteXChaCha20Poly1305 CipherSuite = 2
+
+	DefaultCipherSuite = SuiteAES256GCM
+)
+
+var ErrUnsupportedSuite = errors.New("unsupported cipher suite")
+
+// ParseCipherSuite возвращает набор шифров по его имени
+func ParseCipherSuite(name string) (CipherSuite, error) {
+	switch name {
+	case "aes-256-gcm":
+		return SuiteAES256GCM, nil
+	case "xchacha20-poly1305":
+		return SuiteXChaCha20Poly1305, nil
+	default:
+		return 0, fmt.Errorf("%w: %s", ErrUnsupportedSuite, name)
+	}
+}
+
+func (c CipherSuite) String() string {
+	switch c {
+	case SuiteAES256GCM:
+		return "aes-256-gcm"
+	case SuiteXChaCha20Poly1305:
+		return "xchacha20-poly1305"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(c))
+	}
+}
+
+// Valid проверяет, что набор шифров поддерживается
+func (c CipherSuite) Valid() bool {
+	return c == SuiteAES256GCM || c == SuiteXChaCha20Poly1305
+}
+
+// newAEAD создает AEAD набора для 256-битного ключа
+func (c CipherSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	switch c {
+	case SuiteAES256GCM:
+		return newGCM(key)
+	case SuiteXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedSuite, uint8(c))
+	}
+}
+
+// nonceSize возвращает размер nonce набора
+func (c CipherSuite) nonceSize() int {
+	if c == SuiteXChaCha20Poly1305 {
+		return chacha20poly1305.NonceSizeX
+	}
+	return 12
+}
+
+// streamNoncePrefixSize возвращает размер случайного префикса nonce фрагментов
+func (c CipherSuite) streamNoncePrefixSize() int {
+	return c.nonceSize() - streamNonceSuffixSize
+}
+
+// newGCM создает AES-GCM для заданного ключа
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,564 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Тестовые векторы формата (см. FORMAT.md). Перегенерировать
+// testdata/vectors.json после изменения формата:
+//
+//	go test ./pkg/encryption -run TestVectors -update
+//
+// Векторы генерируются детерминированно: соли, nonce и ключи файлов
+// выводятся из идентификатора вектора, поэтому повторная генерация дает
+// тот же файл testdata/vectors.json. Проверка расшифровывает каждый вектор
+// и заново шифрует его из входных данных, сравнивая результат побайтно.
+// Сжатый gzip открытый текст зависит от реализации gzip, поэтому векторы
+// со сжатием проверяются только расшифровкой.
+
+const vectorsFile = "testdata/vectors.json"
+
+var updateVectors = flag.Bool("update", false, "regenerate "+vectorsFile)
+
+const testVectorsPassword = "correct horse battery staple"
+
+var testVectorsInfo = []byte("secure-cloud/test-vectors")
+
+// Параметры KDF векторов уменьшены, чтобы проверка шла быстро
+var (
+	vectorArgon2Params = Argon2Params{Time: 1, Memory: 64, Threads: 1}
+	vectorPBKDF2Iters  = uint32(1000)
+)
+
+// hexBytes - байты, которые в JSON записываются шестнадцатеричной строкой
+type hexBytes []byte
+
+func (b hexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(b))
+}
+
+func (b *hexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// vectorContext - контекст привязки вектора
+type vectorContext struct {
+	UserID uint64 `json:"user_id"`
+	FileID string `json:"file_id,omitempty"`
+	Dir    string `json:"dir,omitempty"`
+}
+
+func (c *vectorContext) fileContext() *FileContext {
+	if c == nil {
+		return nil
+	}
+	return &FileContext{UserID: c.UserID, FileID: c.FileID, Dir: c.Dir}
+}
+
+// testVectors - набор тестовых векторов
+type testVectors struct {
+	Description string       `json:"description"`
+	Files       []fileVector `json:"files"`
+	Names       []nameVector `json:"names"`
+}
+
+// fileVector - зашифрованный файл вместе со всеми входными данными.
+// Version 0 - файл старого формата без заголовка.
+type fileVector struct {
+	ID          string         `json:"id"`
+	Description string         `json:"description"`
+	Version     uint8          `json:"version"`
+	KDF         uint8          `json:"kdf,omitempty"`
+	KDFParams   hexBytes       `json:"kdf_params,omitempty"`
+	Salt        hexBytes       `json:"salt,omitempty"`
+	Password    string         `json:"password,omitempty"`
+	MasterKey   hexBytes       `json:"master_key,omitempty"` // Ключ пользователя из слотов (KDFMasterKey)
+	KEK         hexBytes       `json:"kek"`                  // Ключ, выведенный из пароля (промежуточное значение)
+	FileKey     hexBytes       `json:"file_key,omitempty"`   // Ключ файла (с версии 3)
+	WrapNonce   hexBytes       `json:"wrap_nonce,omitempty"` // Nonce обертывания ключа файла
+	Nonce       hexBytes       `json:"nonce"`
+	ChunkSize   uint32         `json:"chunk_size,omitempty"`
+	Suite       CipherSuite    `json:"suite,omitempty"`
+	Padding     PaddingScheme  `json:"padding,omitempty"`
+	Compression Compression    `json:"compression,omitempty"`
+	Context     *vectorContext `json:"context,omitempty"`
+	Plaintext   hexBytes       `json:"plaintext"`
+	Header      hexBytes       `json:"header,omitempty"`
+	Ciphertext  hexBytes       `json:"ciphertext"` // Файл целиком, вместе с заголовком
+}
+
+// nameVector - зашифрованное имя файла. Format 0 - имя старого формата.
+type nameVector struct {
+	ID          string         `json:"id"`
+	Description string         `json:"description"`
+	Format      uint8          `json:"format"`
+	Suite       CipherSuite    `json:"suite,omitempty"`
+	Password    string         `json:"password,omitempty"` // Форматы 0-3
+	KEK         hexBytes       `json:"kek,omitempty"`      // Ключ пользователя (форматы 4-6)
+	Nonce       hexBytes       `json:"nonce,omitempty"`
+	Context     *vectorContext `json:"context,omitempty"`
+	Name        string         `json:"name"`
+	Encrypted   string         `json:"encrypted"`
+}
+
+// fileVectorSpec описывает вектор файла до генерации
+type fileVectorSpec struct {
+	id, description string
+	version         uint8
+	kdf             uint8
+	suite           CipherSuite
+	chunkSize       uint32
+	padding         PaddingScheme
+	compression     Compression
+	bound           bool
+	size            int
+}
+
+var fileVectorSpecs = []fileVectorSpec{
+	{id: "legacy-gcm", description: "old format without header, PBKDF2 with the fixed salt", size: 64},
+	{id: "v1-pbkdf2-gcm", description: "format 1, whole file in one AES-256-GCM message", version: FormatVersion1, kdf: KDFPBKDF2SHA256, size: 64},
+	{id: "v1-argon2id-gcm", description: "format 1 with Argon2id", version: FormatVersion1, kdf: KDFArgon2id, size: 64},
+	{id: "v2-pbkdf2-gcm-chunks", description: "format 2, three chunks encrypted with the password key", version: FormatVersion2, kdf: KDFPBKDF2SHA256, chunkSize: minChunkSize, size: 2600},
+	{id: "v3-argon2id-gcm", description: "format 3, file key wrapped without cipher suite prefix", version: FormatVersion3, kdf: KDFArgon2id, size: 100},
+	{id: "v4-argon2id-xchacha", description: "format 4 with explicit cipher suite", version: FormatVersion4, kdf: KDFArgon2id, suite: SuiteXChaCha20Poly1305, size: 100},
+	{id: "v5-argon2id-gcm-bound", description: "format 5, bound to a file context that is not stored in the header", version: FormatVersion5, kdf: KDFArgon2id, bound: true, size: 100},
+	{id: "v6-pbkdf2-gcm-gzip", description: "format 6, gzip compressed before encryption", version: FormatVersion6, kdf: KDFPBKDF2SHA256, compression: CompressionGzip, size: 300},
+	{id: "v7-pbkdf2-gcm", description: "format 7, PBKDF2, AES-256-GCM", version: FormatVersion7, kdf: KDFPBKDF2SHA256, suite: SuiteAES256GCM, size: 100},
+	{id: "v7-pbkdf2-xchacha", description: "format 7, PBKDF2, XChaCha20-Poly1305", version: FormatVersion7, kdf: KDFPBKDF2SHA256, suite: SuiteXChaCha20Poly1305, size: 100},
+	{id: "v7-argon2id-gcm", description: "format 7, Argon2id, AES-256-GCM", version: FormatVersion7, kdf: KDFArgon2id, suite: SuiteAES256GCM, size: 100},
+	{id: "v7-argon2id-xchacha", description: "format 7, Argon2id, XChaCha20-Poly1305", version: FormatVersion7, kdf: KDFArgon2id, suite: SuiteXChaCha20Poly1305, size: 100},
+	{id: "v7-masterkey-gcm", description: "format 7, file key wrapped by the key slot master key, AES-256-GCM", version: FormatVersion7, kdf: KDFMasterKey, suite: SuiteAES256GCM, size: 100},
+	{id: "v7-masterkey-xchacha", description: "format 7, file key wrapped by the key slot master key, XChaCha20-Poly1305", version: FormatVersion7, kdf: KDFMasterKey, suite: SuiteXChaCha20Poly1305, size: 100},
+	{id: "v7-argon2id-gcm-empty", description: "format 7, empty file is a single empty last chunk", version: FormatVersion7, kdf: KDFArgon2id, suite: SuiteAES256GCM},
+	{id: "v7-argon2id-gcm-chunks", description: "format 7, three chunks with a short last chunk", version: FormatVersion7, kdf: KDFArgon2id, suite: SuiteAES256GCM, chunkSize: minChunkSize, size: 2600},
+	{id: "v7-argon2id-xchacha-full-last-chunk", description: "format 7, plaintext is an exact multiple of the chunk size", version: FormatVersion7, kdf: KDFArgon2id, suite: SuiteXChaCha20Poly1305, chunkSize: minChunkSize, size: 2 * minChunkSize},
+	{id: "v7-argon2id-gcm-bound-pow2", description: "format 7, bound and padded to a power of two", version: FormatVersion7, kdf: KDFArgon2id, suite: SuiteAES256GCM, padding: PaddingPow2, bound: true, chunkSize: minChunkSize, size: 1500},
+	{id: "v7-masterkey-xchacha-bound-padme-gzip", description: "format 7, bound, Padmé padding and gzip", version: FormatVersion7, kdf: KDFMasterKey, suite: SuiteXChaCha20Poly1305, padding: PaddingPadme, compression: CompressionGzip, bound: true, size: 300},
+}
+
+// nameVectorSpec описывает вектор имени до генерации
+type nameVectorSpec struct {
+	id, description string
+	format          uint8
+	suite           CipherSuite
+	context         *vectorContext
+	name            string
+}
+
+var nameVectorSpecs = []nameVectorSpec{
+	{id: "name-legacy", description: "old name format, AES-128-GCM on the truncated PBKDF2 key", name: "report.pdf"},
+	{id: "name-v1-gcm", description: "name format 1, AES-256-GCM", format: nameFormatVersion1, suite: SuiteAES256GCM, name: "report.pdf"},
+	{id: "name-v1-xchacha", description: "name format 1, XChaCha20-Poly1305", format: nameFormatVersion1, suite: SuiteXChaCha20Poly1305, name: "Отчет 2024.docx"},
+	{id: "name-v2-gcm", description: "name format 2, bound to the file", format: nameFormatVersion2, suite: SuiteAES256GCM, context: &vectorContext{UserID: 42, FileID: "6f1c2a9e-3b4d-4c5e-8f70-1a2b3c4d5e6f"}, name: "report.pdf"},
+	{id: "name-v3-siv", description: "name format 3, deterministic AES-SIV bound to the directory", format: nameFormatVersion3, context: &vectorContext{UserID: 42, Dir: "/Документы"}, name: "report.pdf"},
+	{id: "name-v4-gcm", description: "name format 4, AES-256-GCM with the key derived from the user key", format: nameFormatVersion4, suite: SuiteAES256GCM, name: "report.pdf"},
+	{id: "name-v4-xchacha", description: "name format 4, XChaCha20-Poly1305 with the key derived from the user key", format: nameFormatVersion4, suite: SuiteXChaCha20Poly1305, name: "Отчет 2024.docx"},
+	{id: "name-v5-gcm", description: "name format 5, bound to the file, key derived from the user key", format: nameFormatVersion5, suite: SuiteAES256GCM, context: &vectorContext{UserID: 42, FileID: "6f1c2a9e-3b4d-4c5e-8f70-1a2b3c4d5e6f"}, name: "report.pdf"},
+	{id: "name-v6-siv", description: "name format 6, deterministic AES-SIV bound to the directory, key derived from the user key", format: nameFormatVersion6, context: &vectorContext{UserID: 42, Dir: "/Документы"}, name: "report.pdf"},
+}
+
+// vectorBytes детерминированно выводит n байт для поля label вектора id
+func vectorBytes(id, label string, n int) []byte {
+	b := make([]byte, n)
+	io.ReadFull(hkdf.New(sha256.New, []byte(id), testVectorsInfo, []byte(label)), b)
+	return b
+}
+
+// vectorPlaintext возвращает открытый текст вектора: сжимаемый текст,
+// чтобы векторы со сжатием действительно сжимались
+func vectorPlaintext(id string, size int) []byte {
+	line := []byte("secure-cloud test vector " + id + "\n")
+	return bytes.Repeat(line, size/len(line)+1)[:size]
+}
+
+// generateTestVectors создает набор тестовых векторов всех поддерживаемых
+// версий формата, KDF и наборов шифров
+func generateTestVectors() (*testVectors, error) {
+	s, err := NewEncryptionService(Config{Argon2: vectorArgon2Params})
+	if err != nil {
+		return nil, err
+	}
+
+	tv := &testVectors{Description: "secure-cloud ciphertext format test vectors, see pkg/encryption/FORMAT.md"}
+
+	for _, spec := range fileVectorSpecs {
+		v, err := s.newFileVector(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", spec.id, err)
+		}
+		tv.Files = append(tv.Files, *v)
+	}
+
+	for _, spec := range nameVectorSpecs {
+		v := nameVector{
+			ID:          spec.id,
+			Description: spec.description,
+			Format:      spec.format,
+			Suite:       spec.suite,
+			Context:     spec.context,
+			Name:        spec.name,
+		}
+		if spec.format < nameFormatVersion4 {
+			v.Password = testVectorsPassword
+		} else {
+			v.KEK = vectorBytes(spec.id, "kek", keySize)
+		}
+		switch spec.format {
+		case 0:
+			v.Nonce = vectorBytes(spec.id, "nonce", 12)
+		case nameFormatVersion1, nameFormatVersion2, nameFormatVersion4, nameFormatVersion5:
+			v.Nonce = vectorBytes(spec.id, "nonce", spec.suite.nonceSize())
+		}
+
+		if v.Encrypted, err = s.sealNameVector(&v); err != nil {
+			return nil, fmt.Errorf("%s: %w", spec.id, err)
+		}
+		tv.Names = append(tv.Names, v)
+	}
+
+	return tv, nil
+}
+
+// newFileVector заполняет входные данные вектора и шифрует его
+func (s *EncryptionService) newFileVector(spec fileVectorSpec) (*fileVector, error) {
+	v := &fileVector{
+		ID:          spec.id,
+		Description: spec.description,
+		Version:     spec.version,
+		KDF:         spec.kdf,
+		Suite:       spec.suite,
+		ChunkSize:   spec.chunkSize,
+		Padding:     spec.padding,
+		Compression: spec.compression,
+		Plaintext:   vectorPlaintext(spec.id, spec.size),
+	}
+
+	if v.Suite == 0 {
+		v.Suite = SuiteAES256GCM
+	}
+	if v.Version >= FormatVersion2 && v.ChunkSize == 0 {
+		v.ChunkSize = defaultChunkSize
+	}
+	if spec.bound {
+		v.Context = &vectorContext{UserID: 42, FileID: "6f1c2a9e-3b4d-4c5e-8f70-1a2b3c4d5e6f"}
+	}
+
+	switch v.KDF {
+	case KDFPBKDF2SHA256:
+		v.KDFParams = pbkdf2Params(vectorPBKDF2Iters)
+	case KDFArgon2id:
+		v.KDFParams = vectorArgon2Params.encode()
+	case KDFMasterKey:
+		v.MasterKey = vectorBytes(spec.id, "master-key", keySize)
+		v.KDFParams = MasterKeyID(v.MasterKey)
+	}
+	if v.Version > 0 && v.KDF != KDFMasterKey {
+		v.Salt = vectorBytes(spec.id, "salt", saltSize)
+	}
+	if v.KDF != KDFMasterKey {
+		v.Password = testVectorsPassword
+	}
+
+	switch {
+	case v.Version <= FormatVersion1:
+		v.Nonce = vectorBytes(spec.id, "nonce", 12)
+	default:
+		v.Nonce = vectorBytes(spec.id, "nonce", v.Suite.streamNoncePrefixSize())
+	}
+	if v.Version >= FormatVersion3 {
+		v.FileKey = vectorBytes(spec.id, "file-key", keySize)
+		v.WrapNonce = vectorBytes(spec.id, "wrap-nonce", v.Suite.nonceSize())
+	}
+
+	kek, err := s.vectorKEK(v)
+	if err != nil {
+		return nil, err
+	}
+	v.KEK = kek
+
+	if v.Ciphertext, err = s.sealFileVector(v); err != nil {
+		return nil, err
+	}
+	if v.Version > 0 {
+		_, headerLen, err := ParseHeader(v.Ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		v.Header = v.Ciphertext[:headerLen]
+	}
+
+	return v, nil
+}
+
+// vectorKEK выводит ключ, которым шифруется содержимое (до версии 3) или
+// обертывается ключ файла (с версии 3)
+func (s *EncryptionService) vectorKEK(v *fileVector) ([]byte, error) {
+	switch {
+	case v.Version == 0:
+		return s.deriveKey(v.Password), nil
+	case v.KDF == KDFMasterKey:
+		return v.MasterKey, nil
+	default:
+		return s.DeriveKEK(v.Password, &KeyDerivation{KDF: v.KDF, Params: v.KDFParams, Salt: v.Salt})
+	}
+}
+
+// sealFileVector шифрует открытый текст вектора его входными данными
+func (s *EncryptionService) sealFileVector(v *fileVector) ([]byte, error) {
+	kek, err := s.vectorKEK(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.Version <= FormatVersion1 {
+		gcm, err := newGCM(kek)
+		if err != nil {
+			return nil, err
+		}
+		if v.Version == 0 {
+			return gcm.Seal(bytes.Clone(v.Nonce), v.Nonce, v.Plaintext, nil), nil
+		}
+
+		h := &Header{Version: v.Version, KDF: v.KDF, KDFParams: v.KDFParams, Salt: v.Salt, Nonce: v.Nonce}
+		headerBytes, err := h.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		return gcm.Seal(bytes.Clone(headerBytes), v.Nonce, v.Plaintext, headerBytes), nil
+	}
+
+	h := &Header{
+		Version:   v.Version,
+		KDF:       v.KDF,
+		KDFParams: v.KDFParams,
+		Salt:      v.Salt,
+		Nonce:     v.Nonce,
+		ChunkSize: v.ChunkSize,
+		Suite:     v.Suite,
+		Codec:     v.Compression,
+	}
+
+	key := kek
+	if v.Version >= FormatVersion3 {
+		key = v.FileKey
+		if h.WrappedKey, err = wrapKey(v.Suite, kek, v.FileKey, v.WrapNonce); err != nil {
+			return nil, err
+		}
+		// В версии 3 ключ обертывался без префикса набора шифров
+		if v.Version == FormatVersion3 {
+			h.WrappedKey = h.WrappedKey[1:]
+		}
+	}
+
+	var buf bytes.Buffer
+	sw, err := newStreamWriter(&buf, key, h, WriteOptions{Context: v.Context.fileContext(), Padding: v.Padding})
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := newCompressWriter(sw, v.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(v.Plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// sealNameVector шифрует имя вектора его входными данными
+func (s *EncryptionService) sealNameVector(v *nameVector) (string, error) {
+	switch v.Format {
+	case 0:
+		block, err := aes.NewCipher(s.deriveKey(v.Password)[:16])
+		if err != nil {
+			return "", err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return "", err
+		}
+		encrypted := gcm.Seal(bytes.Clone(v.Nonce), v.Nonce, []byte(v.Name), nil)
+		return base64.URLEncoding.EncodeToString(encrypted) + ".encrypted", nil
+	case nameFormatVersion1, nameFormatVersion2:
+		return sealFilename(v.Name, nameKey(s.deriveKey(v.Password)), v.Format, v.Suite, v.Nonce, v.Context.fileContext())
+	case nameFormatVersion3:
+		return encryptFilenameSIV(v.Name, sivNameKey(s.deriveKey(v.Password)), v.Format, v.Context.fileContext())
+	case nameFormatVersion4, nameFormatVersion5:
+		return sealFilename(v.Name, nameKey(v.KEK), v.Format, v.Suite, v.Nonce, v.Context.fileContext())
+	case nameFormatVersion6:
+		return encryptFilenameSIV(v.Name, sivNameKey(v.KEK), v.Format, v.Context.fileContext())
+	default:
+		return "", fmt.Errorf("unknown name format %d", v.Format)
+	}
+}
+
+// verifyTestVectors проверяет, что каждый вектор расшифровывается и что
+// шифрование тех же входных данных дает тот же шифротекст
+func verifyTestVectors(tv *testVectors) error {
+	s, err := NewEncryptionService(Config{Argon2: vectorArgon2Params})
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i := range tv.Files {
+		if err := s.verifyFileVector(&tv.Files[i]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", tv.Files[i].ID, err))
+		}
+	}
+	for i := range tv.Names {
+		if err := s.verifyNameVector(&tv.Names[i]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", tv.Names[i].ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *EncryptionService) verifyFileVector(v *fileVector) error {
+	kek, err := s.vectorKEK(v)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(kek, v.KEK) {
+		return errors.New("derived key mismatch")
+	}
+
+	if v.Version > 0 {
+		h, headerLen, err := ParseHeader(v.Ciphertext)
+		if err != nil {
+			return err
+		}
+		headerBytes, err := h.Marshal()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(headerBytes, v.Ciphertext[:headerLen]) || !bytes.Equal(headerBytes, v.Header) {
+			return errors.New("header does not round-trip")
+		}
+		if h.Version != v.Version {
+			return fmt.Errorf("header version %d, want %d", h.Version, v.Version)
+		}
+	}
+
+	fc := v.Context.fileContext()
+
+	var plain []byte
+	if v.KDF == KDFMasterKey {
+		r, err := s.NewDecryptReaderWithMasterKey(bytes.NewReader(v.Ciphertext), v.MasterKey, fc)
+		if err != nil {
+			return err
+		}
+		if plain, err = io.ReadAll(r); err != nil {
+			return err
+		}
+	} else if plain, err = s.DecryptFile(v.Ciphertext, v.Password, fc); err != nil {
+		return err
+	}
+	if !bytes.Equal(plain, v.Plaintext) {
+		return errors.New("decrypted plaintext mismatch")
+	}
+
+	if v.Compression != CompressionNone {
+		return nil
+	}
+
+	ciphertext, err := s.sealFileVector(v)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(ciphertext, v.Ciphertext) {
+		return errors.New("ciphertext mismatch")
+	}
+	return nil
+}
+
+func (s *EncryptionService) verifyNameVector(v *nameVector) error {
+	name, err := s.DecryptFilename(v.Encrypted, &NameKeys{KEK: v.KEK, Password: v.Password}, v.Context.fileContext())
+	if err != nil {
+		return err
+	}
+	if name != v.Name {
+		return errors.New("decrypted name mismatch")
+	}
+
+	encrypted, err := s.sealNameVector(v)
+	if err != nil {
+		return err
+	}
+	if encrypted != v.Encrypted {
+		return errors.New("encrypted name mismatch")
+	}
+	return nil
+}
+
+func TestVectors(t *testing.T) {
+	if *updateVectors {
+		tv, err := generateTestVectors()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.MarshalIndent(tv, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(vectorsFile, append(data, '\n'), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(vectorsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tv testVectors
+	if err := json.Unmarshal(data, &tv); err != nil {
+		t.Fatalf("invalid test vectors file: %v", err)
+	}
+	if len(tv.Files) == 0 || len(tv.Names) == 0 {
+		t.Fatal("test vectors file is empty")
+	}
+	if err := verifyTestVectors(&tv); err != nil {
+		t.Fatal(err)
+	}
+
+	// Генерация детерминирована: файл в репозитории соответствует коду
+	generated, err := generateTestVectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := json.MarshalIndent(generated, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(data), want) {
+		t.Errorf("%s is out of date, run go test ./pkg/encryption -run TestVectors -update", vectorsFile)
+	}
+}
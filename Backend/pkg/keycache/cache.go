@@ -0,0 +1,159 @@
+// Package keycache хранит ключи разблокированных сессий в памяти сервера.
+//
+// Ключи сессии шифруются случайным секретом, который отдается клиенту и
+// на сервере не хранится: без секрета из запроса записи в памяти (и в
+// дампе памяти процесса) бесполезны. Запись удаляется после простоя
+// дольше заданного времени или явной блокировкой сессии.
+package keycache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const SecretSize = 32
+
+var ErrLocked = errors.New("session is locked")
+
+// Cache - зашифрованные ключи сессий
+type Cache struct {
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	userID   uint
+	sealed   []byte
+	lastUsed time.Time
+}
+
+// New создает кэш, в котором запись живет idleTimeout с последнего
+// обращения. Просроченные записи стираются в фоне.
+func New(idleTimeout time.Duration) *Cache {
+	c := &Cache{idleTimeout: idleTimeout, entries: make(map[string]*entry)}
+	go c.expireLoop()
+	return c
+}
+
+// IdleTimeout возвращает время простоя, после которого сессия блокируется
+func (c *Cache) IdleTimeout() time.Duration {
+	return c.idleTimeout
+}
+
+// Put шифрует data новым секретом и сохраняет под sessionID, заменяя
+// прежнюю запись. Возвращает секрет, который нужно передать клиенту.
+func (c *Cache) Put(sessionID string, userID uint, data []byte) ([]byte, error) {
+	secret := make([]byte, SecretSize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, sealed); err != nil {
+		return nil, err
+	}
+	sealed = aead.Seal(sealed, sealed, data, associatedData(sessionID, userID))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(sessionID)
+	c.entries[sessionID] = &entry{userID: userID, sealed: sealed, lastUsed: time.Now()}
+	return secret, nil
+}
+
+// Get расшифровывает запись сессии секретом клиента и продлевает ее.
+// Для отсутствующей, просроченной или чужой записи и неверного секрета
+// возвращает ErrLocked.
+func (c *Cache) Get(sessionID string, userID uint, secret []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[sessionID]
+	if !ok || e.userID != userID {
+		return nil, ErrLocked
+	}
+	if time.Since(e.lastUsed) > c.idleTimeout {
+		c.remove(sessionID)
+		return nil, ErrLocked
+	}
+
+	aead, err := newAEAD(secret)
+	if err != nil || len(e.sealed) < aead.NonceSize() {
+		return nil, ErrLocked
+	}
+	data, err := aead.Open(nil, e.sealed[:aead.NonceSize()], e.sealed[aead.NonceSize():], associatedData(sessionID, userID))
+	if err != nil {
+		return nil, ErrLocked
+	}
+
+	e.lastUsed = time.Now()
+	return data, nil
+}
+
+// Delete стирает запись сессии
+func (c *Cache) Delete(sessionID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(sessionID)
+}
+
+// remove стирает запись; вызывается под c.mu
+func (c *Cache) remove(sessionID string) {
+	if e, ok := c.entries[sessionID]; ok {
+		Wipe(e.sealed)
+		delete(c.entries, sessionID)
+	}
+}
+
+func (c *Cache) expireLoop() {
+	interval := c.idleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	for range time.Tick(interval) {
+		c.mu.Lock()
+		for sessionID, e := range c.entries {
+			if time.Since(e.lastUsed) > c.idleTimeout {
+				c.remove(sessionID)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func newAEAD(secret []byte) (cipher.AEAD, error) {
+	if len(secret) != SecretSize {
+		return nil, ErrLocked
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// associatedData привязывает запись к сессии и пользователю
+func associatedData(sessionID string, userID uint) []byte {
+	ad := binary.BigEndian.AppendUint64(nil, uint64(userID))
+	return append(ad, sessionID...)
+}
+
+// Wipe затирает секретные данные
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,108 @@
+package keycache
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCachePutGet(t *testing.T) {
+	c := New(time.Minute)
+	secret, err := c.Put("session", 7, []byte("keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := c.Get("session", 7, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("keys")) {
+		t.Fatalf("got %q", data)
+	}
+
+	wrong := bytes.Clone(secret)
+	wrong[0] ^= 1
+	tests := []struct {
+		name      string
+		sessionID string
+		userID    uint
+		secret    []byte
+	}{
+		{"wrong secret", "session", 7, wrong},
+		{"short secret", "session", 7, secret[:16]},
+		{"another user", "session", 8, secret},
+		{"another session", "other", 7, secret},
+	}
+	for _, tt := range tests {
+		if _, err := c.Get(tt.sessionID, tt.userID, tt.secret); !errors.Is(err, ErrLocked) {
+			t.Errorf("%s: got %v, want ErrLocked", tt.name, err)
+		}
+	}
+
+	c.Delete("session")
+	if _, err := c.Get("session", 7, secret); !errors.Is(err, ErrLocked) {
+		t.Fatalf("deleted session: got %v, want ErrLocked", err)
+	}
+}
+
+func TestCacheReplacesEntry(t *testing.T) {
+	c := New(time.Minute)
+	old, _ := c.Put("session", 7, []byte("old"))
+	secret, _ := c.Put("session", 7, []byte("new"))
+
+	if _, err := c.Get("session", 7, old); !errors.Is(err, ErrLocked) {
+		t.Fatalf("old secret: got %v, want ErrLocked", err)
+	}
+	if data, err := c.Get("session", 7, secret); err != nil || string(data) != "new" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
+
+func TestCacheIdleExpiry(t *testing.T) {
+	c := New(100 * time.Millisecond)
+	secret, err := c.Put("session", 7, []byte("keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Обращения продлевают запись
+	for i := 0; i < 4; i++ {
+		time.Sleep(60 * time.Millisecond)
+		if _, err := c.Get("session", 7, secret); err != nil {
+			t.Fatalf("after %d accesses: %v", i, err)
+		}
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, err := c.Get("session", 7, secret); !errors.Is(err, ErrLocked) {
+		t.Fatalf("idle session: got %v, want ErrLocked", err)
+	}
+	c.mu.Lock()
+	n := len(c.entries)
+	c.mu.Unlock()
+	if n != 0 {
+		t.Fatal("expired entry is kept")
+	}
+}
+
+func TestCacheExpiresInBackground(t *testing.T) {
+	c := New(10 * time.Millisecond)
+	if _, err := c.Put("session", 7, []byte("keys")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Просроченные записи стираются и без обращений к ним
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		n := len(c.entries)
+		c.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("idle entry is not removed in background")
+}
@@ -0,0 +1,353 @@
+// Package local_disk хранит зашифрованные файлы в каталоге на сервере
+// (установки без облака, тестовые окружения).
+//
+// Каждому пользователю при подключении выделяется подкаталог корня, его имя
+// служит учетными данными пользователя. Пути запросов не выходят за пределы
+// подкаталога: ".." отбрасывается, символические ссылки не допускаются.
+package local_disk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"server/pkg/storage"
+)
+
+// ProviderName - имя локального хранилища в реестре хранилищ
+const ProviderName = "local"
+
+// tempPrefix - префикс временных файлов незавершенной записи
+const tempPrefix = ".upload-"
+
+var ErrInvalidPath = errors.New("invalid storage path")
+
+var (
+	_ storage.StorageProvider = (*Client)(nil)
+	_ storage.Connector       = (*Client)(nil)
+)
+
+type Client struct {
+	root string
+}
+
+// NewClient создает хранилище в каталоге root, создавая его при необходимости
+func NewClient(root string) (*Client, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create storage root: %w", err)
+	}
+
+	// Корень может быть символической ссылкой - дальше сравниваем с настоящим путем
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{root: root}, nil
+}
+
+// Connect выделяет пользователю подкаталог; переданные учетные данные
+// не используются
+func (c *Client) Connect(ctx context.Context, userID uint, credentials string) (string, error) {
+	name := fmt.Sprintf("user-%d", userID)
+	if err := os.Mkdir(filepath.Join(c.root, name), 0o700); err != nil && !errors.Is(err, fs.ErrExist) {
+		return "", fmt.Errorf("failed to create user directory: %w", err)
+	}
+	return name, nil
+}
+
+// List возвращает содержимое каталога
+func (c *Client) List(ctx context.Context, credentials, path string) ([]storage.Resource, error) {
+	dir, err := c.resolve(credentials, path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	resources := make([]storage.Resource, 0, len(entries))
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), tempPrefix) || entry.Type()&fs.ModeSymlink != 0 {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		resources = append(resources, c.resource(credentials, filepath.Join(dir, entry.Name()), info))
+	}
+	return resources, nil
+}
+
+// Upload записывает файл атомарно: во временный файл рядом и переименованием
+func (c *Client) Upload(ctx context.Context, credentials, path string, content io.Reader) error {
+	target, err := c.resolve(credentials, path)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(target, content)
+}
+
+func (c *Client) Download(ctx context.Context, credentials, path string) (io.ReadCloser, error) {
+	target, err := c.resolve(credentials, path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(target)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	if info, err := file.Stat(); err != nil || info.IsDir() {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a file", path)
+	}
+	return file, nil
+}
+
+func (c *Client) Delete(ctx context.Context, credentials, path string) error {
+	target, err := c.resolve(credentials, path)
+	if err != nil {
+		return err
+	}
+	if target == c.userRoot(credentials) {
+		return ErrInvalidPath
+	}
+
+	if _, err := os.Lstat(target); err != nil {
+		return notFound(err)
+	}
+	return os.RemoveAll(target)
+}
+
+// Mkdir создает каталог; родительский каталог должен существовать
+func (c *Client) Mkdir(ctx context.Context, credentials, path string) error {
+	target, err := c.resolve(credentials, path)
+	if err != nil {
+		return err
+	}
+
+	err = os.Mkdir(target, 0o700)
+	if errors.Is(err, fs.ErrExist) {
+		if info, statErr := os.Stat(target); statErr == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+// Move перемещает файл или каталог, не перезаписывая существующий
+func (c *Client) Move(ctx context.Context, credentials, from, to string) error {
+	source, target, err := c.transferPaths(credentials, from, to)
+	if err != nil {
+		return err
+	}
+	return os.Rename(source, target)
+}
+
+// Copy копирует файл или каталог, не перезаписывая существующий
+func (c *Client) Copy(ctx context.Context, credentials, from, to string) error {
+	source, target, err := c.transferPaths(credentials, from, to)
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(target, rel)
+
+		switch {
+		case entry.IsDir():
+			return os.Mkdir(dest, 0o700)
+		case entry.Type().IsRegular():
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			return writeAtomic(dest, file)
+		}
+		// Символические ссылки и специальные файлы не копируем
+		return nil
+	})
+}
+
+func (c *Client) Stat(ctx context.Context, credentials, path string) (*storage.Resource, error) {
+	target, err := c.resolve(credentials, path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	resource := c.resource(credentials, target, info)
+	return &resource, nil
+}
+
+// Quota возвращает место, занятое файлами пользователя; объем не ограничен
+func (c *Client) Quota(ctx context.Context, credentials string) (*storage.Quota, error) {
+	userRoot, err := c.resolve(credentials, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	quota := &storage.Quota{}
+	err = filepath.WalkDir(userRoot, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			quota.Used += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return quota, nil
+}
+
+// resolve переводит путь хранилища в путь на диске внутри подкаталога
+// пользователя
+func (c *Client) resolve(credentials, path string) (string, error) {
+	if credentials == "" || credentials != filepath.Base(credentials) || credentials == "." || credentials == ".." {
+		return "", ErrInvalidPath
+	}
+	if strings.ContainsRune(path, 0) {
+		return "", ErrInvalidPath
+	}
+
+	// Clean от корня отбрасывает все ".." в начале пути
+	userRoot := c.userRoot(credentials)
+	clean := filepath.Clean("/" + strings.TrimPrefix(path, "disk:"))
+	target := filepath.Join(userRoot, filepath.FromSlash(clean))
+
+	rel, err := filepath.Rel(userRoot, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrInvalidPath
+	}
+
+	// Символическая ссылка внутри подкаталога могла бы вести за его пределы
+	current := userRoot
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." {
+			break
+		}
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err != nil {
+			break
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", ErrInvalidPath
+		}
+	}
+
+	return target, nil
+}
+
+func (c *Client) userRoot(credentials string) string {
+	return filepath.Join(c.root, credentials)
+}
+
+// transferPaths проверяет источник и цель перемещения или копирования
+func (c *Client) transferPaths(credentials, from, to string) (string, string, error) {
+	source, err := c.resolve(credentials, from)
+	if err != nil {
+		return "", "", err
+	}
+	target, err := c.resolve(credentials, to)
+	if err != nil {
+		return "", "", err
+	}
+
+	if _, err := os.Lstat(source); err != nil {
+		return "", "", notFound(err)
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return "", "", fmt.Errorf("%s already exists", to)
+	}
+	if strings.HasPrefix(target+string(filepath.Separator), source+string(filepath.Separator)) {
+		return "", "", ErrInvalidPath
+	}
+	return source, target, nil
+}
+
+// resource описывает файл на диске путем хранилища
+func (c *Client) resource(credentials, path string, info fs.FileInfo) storage.Resource {
+	// Подкаталог пользователя - корень хранилища "/"
+	resourcePath := "/"
+	if rel, _ := filepath.Rel(c.userRoot(credentials), path); rel != "." {
+		resourcePath += filepath.ToSlash(rel)
+	}
+	resource := storage.Resource{
+		Path:     resourcePath,
+		Name:     info.Name(),
+		Type:     "file",
+		Size:     info.Size(),
+		Modified: info.ModTime(),
+		Created:  info.ModTime(),
+	}
+	if info.IsDir() {
+		resource.Type = "dir"
+		resource.Size = 0
+	} else {
+		resource.MimeType = mime.TypeByExtension(filepath.Ext(info.Name()))
+	}
+	return resource
+}
+
+// writeAtomic записывает файл через временный файл в том же каталоге:
+// прерванная запись не оставляет частичного файла
+func writeAtomic(target string, content io.Reader) error {
+	temp, err := os.CreateTemp(filepath.Dir(target), tempPrefix+"*")
+	if err != nil {
+		return notFound(err)
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := io.Copy(temp, content); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), target)
+}
+
+// notFound сводит отсутствие файла к storage.ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return storage.ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+package local_disk
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"server/pkg/storage"
+)
+
+func newTestClient(t *testing.T) (*Client, string) {
+	t.Helper()
+	c, err := NewClient(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := c.Connect(context.Background(), 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, credentials
+}
+
+func TestResolveStaysInUserRoot(t *testing.T) {
+	c, credentials := newTestClient(t)
+	userRoot := c.userRoot(credentials)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", userRoot},
+		{"", userRoot},
+		{"disk:/a.txt", filepath.Join(userRoot, "a.txt")},
+		{"/a/../b", filepath.Join(userRoot, "b")},
+		{"../../etc/passwd", filepath.Join(userRoot, "etc", "passwd")},
+		{"/../user-2/secret", filepath.Join(userRoot, "user-2", "secret")},
+		{"a/./../../..", userRoot},
+	}
+	for _, tt := range tests {
+		got, err := c.resolve(credentials, tt.path)
+		if err != nil {
+			t.Errorf("%q: %v", tt.path, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q resolved to %s, want %s", tt.path, got, tt.want)
+		}
+	}
+
+	if _, err := c.resolve(credentials, "/a\x00b"); !errors.Is(err, ErrInvalidPath) {
+		t.Errorf("NUL byte: got %v, want ErrInvalidPath", err)
+	}
+}
+
+func TestResolveRejectsForeignCredentials(t *testing.T) {
+	c, _ := newTestClient(t)
+	for _, credentials := range []string{"", ".", "..", "../user-1", "user-1/..", "/etc"} {
+		if _, err := c.resolve(credentials, "/a.txt"); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("credentials %q: got %v, want ErrInvalidPath", credentials, err)
+		}
+	}
+}
+
+func TestResolveRejectsSymlinks(t *testing.T) {
+	c, credentials := newTestClient(t)
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(c.userRoot(credentials), "link")); err != nil {
+		t.Skip("symlinks are not supported:", err)
+	}
+
+	ctx := context.Background()
+	for _, path := range []string{"/link", "/link/secret"} {
+		if _, err := c.Download(ctx, credentials, path); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("download %s: got %v, want ErrInvalidPath", path, err)
+		}
+	}
+	if err := c.Upload(ctx, credentials, "/link/new", strings.NewReader("x")); !errors.Is(err, ErrInvalidPath) {
+		t.Errorf("upload through symlink: got %v, want ErrInvalidPath", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new")); err == nil {
+		t.Error("file written outside the user directory")
+	}
+
+	items, err := c.List(ctx, credentials, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Errorf("symlink listed: %+v", items)
+	}
+}
+
+func TestClientFiles(t *testing.T) {
+	c, credentials := newTestClient(t)
+	ctx := context.Background()
+
+	if err := c.Mkdir(ctx, credentials, "/.hidden"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Upload(ctx, credentials, "/.hidden/.env", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Пути ресурсов начинаются от корня хранилища, точка в начале имени сохраняется
+	root, err := c.Stat(ctx, credentials, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Path != "/" || root.Type != "dir" {
+		t.Errorf("root: got %s (%s)", root.Path, root.Type)
+	}
+	items, err := c.List(ctx, credentials, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Path != "/.hidden" {
+		t.Fatalf("got %+v", items)
+	}
+	file, err := c.Stat(ctx, credentials, "/.hidden/.env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Path != "/.hidden/.env" || file.Size != 4 {
+		t.Errorf("got %s, %d bytes", file.Path, file.Size)
+	}
+
+	if err := c.Move(ctx, credentials, "/.hidden", "/.hidden/inner"); !errors.Is(err, ErrInvalidPath) {
+		t.Errorf("move into itself: got %v, want ErrInvalidPath", err)
+	}
+	if err := c.Delete(ctx, credentials, "/../"); !errors.Is(err, ErrInvalidPath) {
+		t.Errorf("delete of the user directory: got %v, want ErrInvalidPath", err)
+	}
+	if _, err := c.Download(ctx, credentials, "/missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("missing file: got %v, want ErrNotFound", err)
+	}
+
+	r, err := c.Download(ctx, credentials, "/../.hidden/.env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, _ := io.ReadAll(r); string(data) != "data" {
+		t.Errorf("got %q", data)
+	}
+}
@@ -0,0 +1,57 @@
+// Package ratelimit ограничивает число попыток по ключу (адресу клиента,
+// аккаунту) в скользящем окне. Состояние хранится в памяти процесса.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter разрешает не больше limit попыток по одному ключу за window
+type Limiter struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu       sync.Mutex
+	attempts map[string][]time.Time
+}
+
+func New(limit int, window time.Duration) *Limiter {
+	return &Limiter{limit: limit, window: window, now: time.Now, attempts: make(map[string][]time.Time)}
+}
+
+// Allow учитывает попытку по ключу key и сообщает, укладывается ли она в лимит.
+// Отклоненные попытки не учитываются.
+func (l *Limiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	recent := l.recent(key, now)
+	if len(recent) >= l.limit {
+		l.attempts[key] = recent
+		return false
+	}
+	l.attempts[key] = append(recent, now)
+
+	// Ключи без попыток в окне стираются, чтобы карта не росла
+	if len(l.attempts) > 1024 {
+		for k := range l.attempts {
+			if len(l.recent(k, now)) == 0 {
+				delete(l.attempts, k)
+			}
+		}
+	}
+	return true
+}
+
+// recent возвращает попытки по ключу за последнее окно; вызывается под l.mu
+func (l *Limiter) recent(key string, now time.Time) []time.Time {
+	attempts := l.attempts[key]
+	i := 0
+	for i < len(attempts) && now.Sub(attempts[i]) >= l.window {
+		i++
+	}
+	return attempts[i:]
+}
@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := New(3, time.Minute)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow("a") {
+			t.Fatalf("attempt %d rejected", i+1)
+		}
+	}
+	if l.Allow("a") {
+		t.Fatal("fourth attempt allowed")
+	}
+	if !l.Allow("b") {
+		t.Fatal("another key is limited")
+	}
+
+	// Отклоненная попытка не продлевает блокировку
+	now = now.Add(30 * time.Second)
+	if l.Allow("a") {
+		t.Fatal("attempt allowed inside the window")
+	}
+	now = now.Add(30 * time.Second)
+	for i := 0; i < 3; i++ {
+		if !l.Allow("a") {
+			t.Fatalf("attempt %d rejected after the window", i+1)
+		}
+	}
+	if l.Allow("a") {
+		t.Fatal("fourth attempt allowed in the new window")
+	}
+}
+
+func TestLimiterPrunesIdleKeys(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := New(1, time.Minute)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 1024; i++ {
+		l.Allow(string(rune('a' + i)))
+	}
+	now = now.Add(time.Minute)
+	l.Allow("last")
+	if len(l.attempts) != 1 {
+		t.Fatalf("%d keys kept, want 1", len(l.attempts))
+	}
+}
@@ -0,0 +1,676 @@
+// Package s3 хранит зашифрованные файлы в бакете S3-совместимого хранилища
+// (Amazon S3, MinIO и т.п.).
+//
+// Каталогов в S3 нет: каталог - это общий префикс ключей, пустой каталог
+// отмечается объектом нулевой длины с ключом "каталог/". Учетные данные
+// пользователя - JSON Credentials: у каждого пользователя свой бакет или
+// префикс в бакете.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/pkg/storage"
+)
+
+// ProviderName - имя S3-хранилища в реестре хранилищ
+const ProviderName = "s3"
+
+// PartSize - размер части при загрузке по частям. Файлы меньше одной части
+// загружаются одним запросом.
+const PartSize = 8 << 20
+
+var ErrInvalidCredentials = errors.New("invalid s3 credentials")
+
+var (
+	_ storage.StorageProvider = (*Client)(nil)
+	_ storage.Connector       = (*Client)(nil)
+)
+
+// Credentials - доступ пользователя к бакету
+type Credentials struct {
+	Endpoint        string `json:"endpoint"` // https://s3.amazonaws.com, http://localhost:9000
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	Prefix          string `json:"prefix,omitempty"`     // Каталог пользователя в бакете
+	PathStyle       bool   `json:"path_style,omitempty"` // Бакет в пути, а не в имени хоста (MinIO)
+}
+
+type Client struct {
+	httpClient *http.Client
+	endpoints  *storage.EndpointPolicy
+}
+
+// NewClient создает клиент, который обращается только к адресам,
+// разрешенным endpoints
+func NewClient(endpoints *storage.EndpointPolicy) *Client {
+	// Общего таймаута нет: большие файлы скачиваются потоком дольше 30 секунд
+	transport := endpoints.Transport()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	return &Client{
+		httpClient: &http.Client{Transport: transport, CheckRedirect: endpoints.CheckRedirect},
+		endpoints:  endpoints,
+	}
+}
+
+// Connect проверяет учетные данные запросом к бакету и возвращает их
+// в нормализованном виде
+func (c *Client) Connect(ctx context.Context, userID uint, credentials string) (string, error) {
+	b, err := c.open(credentials)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{"list-type": {"2"}, "max-keys": {"1"}, "prefix": {b.creds.Prefix}}
+	resp, err := b.do(ctx, http.MethodGet, "", query, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return "", fmt.Errorf("bucket is not accessible: %w", err)
+	}
+
+	normalized, err := json.Marshal(b.creds)
+	if err != nil {
+		return "", err
+	}
+	return string(normalized), nil
+}
+
+// List возвращает содержимое каталога
+func (c *Client) List(ctx context.Context, credentials, p string) ([]storage.Resource, error) {
+	b, err := c.open(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := b.dirKey(p)
+	var resources []storage.Resource
+	found := dir == b.creds.Prefix
+	err = b.list(ctx, dir, "/", func(page *listResult) bool {
+		for _, prefix := range page.CommonPrefixes {
+			found = true
+			resources = append(resources, b.dirResource(prefix.Prefix))
+		}
+		for _, object := range page.Contents {
+			found = true
+			if object.Key == dir {
+				continue // Отметка самого каталога
+			}
+			resources = append(resources, b.fileResource(object.Key, object.Size, object.LastModified, ""))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, storage.ErrNotFound
+	}
+	return resources, nil
+}
+
+// Upload записывает файл одним запросом или, если он больше PartSize,
+// по частям. Незавершенная загрузка по частям отменяется.
+func (c *Client) Upload(ctx context.Context, credentials, p string, content io.Reader) error {
+	b, err := c.open(credentials)
+	if err != nil {
+		return err
+	}
+	key := b.key(p)
+	if key == b.creds.Prefix {
+		return fmt.Errorf("%s is a directory", p)
+	}
+
+	part := make([]byte, PartSize)
+	n, err := io.ReadFull(content, part)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return b.putObject(ctx, key, part[:n])
+	}
+	if err != nil {
+		return err
+	}
+
+	uploadID, err := b.createMultipartUpload(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := b.uploadParts(ctx, key, uploadID, part, content); err != nil {
+		b.abortMultipartUpload(context.WithoutCancel(ctx), key, uploadID)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) Download(ctx context.Context, credentials, p string) (io.ReadCloser, error) {
+	b, err := c.open(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.do(ctx, http.MethodGet, b.key(p), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete удаляет файл или каталог со всем содержимым
+func (c *Client) Delete(ctx context.Context, credentials, p string) error {
+	b, err := c.open(credentials)
+	if err != nil {
+		return err
+	}
+
+	resource, err := b.stat(ctx, p)
+	if err != nil {
+		return err
+	}
+	if resource.Type == "file" {
+		return b.deleteObject(ctx, b.key(p))
+	}
+
+	dir := b.dirKey(p)
+	if dir == b.creds.Prefix {
+		return errors.New("cannot delete the storage root")
+	}
+	return b.eachObject(ctx, dir, func(object listObject) error {
+		return b.deleteObject(ctx, object.Key)
+	})
+}
+
+// Mkdir создает отметку каталога; родительский каталог должен существовать
+func (c *Client) Mkdir(ctx context.Context, credentials, p string) error {
+	b, err := c.open(credentials)
+	if err != nil {
+		return err
+	}
+
+	dir := b.dirKey(p)
+	if dir == b.creds.Prefix {
+		return nil
+	}
+
+	parent, err := b.stat(ctx, path.Dir(cleanPath(p)))
+	if err != nil {
+		return fmt.Errorf("parent directory: %w", err)
+	}
+	if parent.Type != "dir" {
+		return fmt.Errorf("%s is not a directory", path.Dir(cleanPath(p)))
+	}
+	return b.putObject(ctx, dir, nil)
+}
+
+// Move копирует ресурс и удаляет источник: переименования в S3 нет
+func (c *Client) Move(ctx context.Context, credentials, from, to string) error {
+	if err := c.Copy(ctx, credentials, from, to); err != nil {
+		return err
+	}
+	return c.Delete(ctx, credentials, from)
+}
+
+// Copy копирует файл или каталог, не перезаписывая существующий. Объекты
+// копируются на стороне хранилища (до 5 ГиБ на объект).
+func (c *Client) Copy(ctx context.Context, credentials, from, to string) error {
+	b, err := c.open(credentials)
+	if err != nil {
+		return err
+	}
+
+	source, err := b.stat(ctx, from)
+	if err != nil {
+		return err
+	}
+	if _, err := b.stat(ctx, to); err == nil {
+		return fmt.Errorf("%s already exists", to)
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+
+	if source.Type == "file" {
+		return b.copyObject(ctx, b.key(from), b.key(to))
+	}
+
+	sourceDir, targetDir := b.dirKey(from), b.dirKey(to)
+	if strings.HasPrefix(targetDir, sourceDir) {
+		return fmt.Errorf("cannot copy %s into itself", from)
+	}
+	return b.eachObject(ctx, sourceDir, func(object listObject) error {
+		return b.copyObject(ctx, object.Key, targetDir+strings.TrimPrefix(object.Key, sourceDir))
+	})
+}
+
+func (c *Client) Stat(ctx context.Context, credentials, p string) (*storage.Resource, error) {
+	b, err := c.open(credentials)
+	if err != nil {
+		return nil, err
+	}
+	return b.stat(ctx, p)
+}
+
+// Quota возвращает размер объектов пользователя; объем бакета S3 не сообщает
+func (c *Client) Quota(ctx context.Context, credentials string) (*storage.Quota, error) {
+	b, err := c.open(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	quota := &storage.Quota{}
+	err = b.eachObject(ctx, b.creds.Prefix, func(object listObject) error {
+		quota.Used += object.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return quota, nil
+}
+
+// bucket - бакет пользователя
+type bucket struct {
+	client   *Client
+	creds    Credentials
+	endpoint *url.URL
+}
+
+// open разбирает учетные данные пользователя
+func (c *Client) open(credentials string) (*bucket, error) {
+	var creds Credentials
+	if err := json.Unmarshal([]byte(credentials), &creds); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(creds.Endpoint, "/"))
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" || endpoint.Path != "" {
+		return nil, fmt.Errorf("%w: endpoint must be an http(s) URL without a path", ErrInvalidCredentials)
+	}
+	if err := c.endpoints.CheckURL(endpoint); err != nil {
+		return nil, err
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("%w: access_key_id and secret_access_key are required", ErrInvalidCredentials)
+	}
+	// Имя бакета без PathStyle становится частью имени хоста
+	if !validBucket(creds.Bucket) {
+		return nil, fmt.Errorf("%w: invalid bucket name", ErrInvalidCredentials)
+	}
+	if creds.Region == "" {
+		creds.Region = "us-east-1"
+	}
+
+	creds.Endpoint = endpoint.String()
+	creds.Prefix = strings.Trim(cleanPath(creds.Prefix), "/")
+	if creds.Prefix != "" {
+		creds.Prefix += "/"
+	}
+	return &bucket{client: c, creds: creds, endpoint: endpoint}, nil
+}
+
+// validBucket проверяет имя бакета: 3-63 символа из латинских букв, цифр,
+// точек, дефисов и подчеркиваний (последние и заглавные - у старых бакетов)
+func validBucket(name string) bool {
+	if len(name) < 3 || len(name) > 63 {
+		return false
+	}
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// cleanPath приводит путь хранилища к виду "/a/b" без ".."
+func cleanPath(p string) string {
+	return path.Clean("/" + strings.TrimPrefix(p, "disk:"))
+}
+
+// key - ключ объекта для пути хранилища
+func (b *bucket) key(p string) string {
+	return b.creds.Prefix + strings.TrimPrefix(cleanPath(p), "/")
+}
+
+// dirKey - префикс ключей содержимого каталога
+func (b *bucket) dirKey(p string) string {
+	key := b.key(p)
+	if key == b.creds.Prefix {
+		return key
+	}
+	return key + "/"
+}
+
+// storagePath - путь хранилища для ключа объекта
+func (b *bucket) storagePath(key string) string {
+	return "/" + strings.TrimSuffix(strings.TrimPrefix(key, b.creds.Prefix), "/")
+}
+
+func (b *bucket) fileResource(key string, size int64, modified time.Time, mimeType string) storage.Resource {
+	name := path.Base(b.storagePath(key))
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(path.Ext(name))
+	}
+	return storage.Resource{
+		Path:     b.storagePath(key),
+		Name:     name,
+		Type:     "file",
+		MimeType: mimeType,
+		Size:     size,
+		Modified: modified,
+		Created:  modified,
+	}
+}
+
+func (b *bucket) dirResource(key string) storage.Resource {
+	p := b.storagePath(key)
+	return storage.Resource{Path: p, Name: path.Base(p), Type: "dir"}
+}
+
+func (b *bucket) stat(ctx context.Context, p string) (*storage.Resource, error) {
+	key := b.key(p)
+	if key == b.creds.Prefix {
+		resource := b.dirResource(key)
+		return &resource, nil
+	}
+
+	resp, err := b.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	switch err := checkResponse(resp); {
+	case err == nil:
+		modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		resource := b.fileResource(key, resp.ContentLength, modified, resp.Header.Get("Content-Type"))
+		return &resource, nil
+	case !errors.Is(err, storage.ErrNotFound):
+		return nil, err
+	}
+
+	// Объекта нет - это каталог, если есть ключи с его префиксом
+	query := url.Values{"list-type": {"2"}, "max-keys": {"1"}, "prefix": {key + "/"}}
+	page, err := b.listPage(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if len(page.Contents) == 0 && len(page.CommonPrefixes) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	resource := b.dirResource(key)
+	return &resource, nil
+}
+
+func (b *bucket) putObject(ctx context.Context, key string, data []byte) error {
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err := b.do(ctx, http.MethodPut, key, nil, header, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+func (b *bucket) deleteObject(ctx context.Context, key string) error {
+	resp, err := b.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+func (b *bucket) copyObject(ctx context.Context, from, to string) error {
+	header := http.Header{"X-Amz-Copy-Source": {"/" + b.creds.Bucket + "/" + escape(from, false)}}
+	resp, err := b.do(ctx, http.MethodPut, to, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponseBody(resp)
+}
+
+func (b *bucket) createMultipartUpload(ctx context.Context, key string) (string, error) {
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err := b.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return "", fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode XML response: %w", err)
+	}
+	return result.UploadID, nil
+}
+
+// uploadParts загружает первую часть first, остаток content и завершает загрузку
+func (b *bucket) uploadParts(ctx context.Context, key, uploadID string, first []byte, content io.Reader) error {
+	type completedPart struct {
+		PartNumber int
+		ETag       string
+	}
+	var parts []completedPart
+
+	part := first
+	for number := 1; len(part) > 0; number++ {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := b.do(ctx, http.MethodPut, key, query, nil, part)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if err := checkResponse(resp); err != nil {
+			return fmt.Errorf("failed to upload part %d: %w", number, err)
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		n, err := io.ReadFull(content, first)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		part = first[:n]
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponseBody(resp); err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+	return nil
+}
+
+func (b *bucket) abortMultipartUpload(ctx context.Context, key, uploadID string) {
+	resp, err := b.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+type listObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+type listResult struct {
+	Contents       []listObject
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list перебирает страницы ListObjectsV2, пока fn возвращает true
+func (b *bucket) list(ctx context.Context, prefix, delimiter string, fn func(*listResult) bool) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+
+	for {
+		page, err := b.listPage(ctx, query)
+		if err != nil {
+			return err
+		}
+		if !fn(page) || !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// eachObject вызывает fn для каждого объекта с префиксом prefix
+func (b *bucket) eachObject(ctx context.Context, prefix string, fn func(listObject) error) error {
+	var objects []listObject
+	err := b.list(ctx, prefix, "", func(page *listResult) bool {
+		objects = append(objects, page.Contents...)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		if err := fn(object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *bucket) listPage(ctx context.Context, query url.Values) (*listResult, error) {
+	resp, err := b.do(ctx, http.MethodGet, "", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	var page listResult
+	if err := xml.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("failed to decode XML response: %w", err)
+	}
+	return &page, nil
+}
+
+// do выполняет подписанный запрос к объекту key (пустой key - к бакету)
+func (b *bucket) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *b.endpoint
+	objectPath := "/" + key
+	if b.creds.PathStyle {
+		objectPath = "/" + b.creds.Bucket + objectPath
+	} else {
+		u.Host = b.creds.Bucket + "." + u.Host
+	}
+	u.Path = objectPath
+	u.RawPath = escape(objectPath, false)
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		payloadHash = hashHex(body)
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	signRequest(req, b.creds.AccessKeyID, b.creds.SecretAccessKey, b.creds.Region, payloadHash, time.Now())
+
+	resp, err := b.client.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	return resp, nil
+}
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+// checkResponse переводит ответ с ошибкой в error; отсутствующий объект -
+// storage.ErrNotFound
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	var e errorResponse
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(body, &e)
+
+	if e.Code == "NoSuchKey" || (resp.StatusCode == http.StatusNotFound && e.Code == "") {
+		return storage.ErrNotFound
+	}
+	if e.Code != "" {
+		return fmt.Errorf("s3 request failed with status %d: %s: %s", resp.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Errorf("s3 request failed with status %d: %s", resp.StatusCode, string(body))
+}
+
+// checkResponseBody проверяет и ответ 200 с ошибкой в теле: так S3 отвечает
+// на копирование и завершение загрузки по частям
+func checkResponseBody(resp *http.Response) error {
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	var e errorResponse
+	if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+		return fmt.Errorf("s3 request failed: %s: %s", e.Code, e.Message)
+	}
+	return nil
+}
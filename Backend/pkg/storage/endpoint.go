@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var ErrEndpointNotAllowed = errors.New("storage endpoint is not allowed")
+
+// sharedAddressSpace - 100.64.0.0/10 (CGNAT), IsPrivate его не включает
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// EndpointPolicy ограничивает адреса хранилищ, которые пользователь задает
+// сам (S3, WebDAV): иначе сервер можно заставить обращаться к своей
+// внутренней сети. Без списка разрешены только https и публичные адреса.
+// Хосты и сети из списка (локальный MinIO, Nextcloud в той же сети)
+// разрешены и по http.
+type EndpointPolicy struct {
+	hosts    []string // Имена хостов; разрешены и их поддомены (бакет в имени хоста)
+	networks []netip.Prefix
+}
+
+// NewEndpointPolicy разбирает список разрешенных хостов, IP-адресов и сетей
+// в записи CIDR
+func NewEndpointPolicy(allowlist []string) (*EndpointPolicy, error) {
+	p := &EndpointPolicy{}
+	for _, entry := range allowlist {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			p.networks = append(p.networks, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			p.networks = append(p.networks, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		if strings.ContainsAny(entry, "/:") {
+			return nil, fmt.Errorf("invalid storage endpoint allowlist entry %q", entry)
+		}
+		p.hosts = append(p.hosts, strings.TrimSuffix(entry, "."))
+	}
+	return p, nil
+}
+
+// CheckURL проверяет адрес хранилища до запроса. Имена хостов, которые
+// указывают во внутреннюю сеть, отклоняются при соединении (см. Transport).
+func (p *EndpointPolicy) CheckURL(u *url.URL) error {
+	host := strings.ToLower(u.Hostname())
+	if p.allowedHost(host) {
+		return nil
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if p.inNetworks(addr) {
+			return nil
+		}
+		if !isPublic(addr) {
+			return fmt.Errorf("%w: %s is not a public address", ErrEndpointNotAllowed, host)
+		}
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("%w: only https is allowed for %s", ErrEndpointNotAllowed, u.Host)
+	}
+	return nil
+}
+
+// Transport возвращает транспорт, который соединяется только с разрешенными
+// адресами. Адрес проверяется после разрешения имени, поэтому имя, которое
+// указывает во внутреннюю сеть, не поможет. Прокси из окружения не
+// используется: соединение с ним обошло бы проверку.
+func (p *EndpointPolicy) Transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	guarded := &net.Dialer{Timeout: dialer.Timeout, KeepAlive: dialer.KeepAlive, Control: p.control}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err == nil && p.allowedHost(strings.ToLower(host)) {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return guarded.DialContext(ctx, network, address)
+	}
+	return transport
+}
+
+// CheckRedirect не дает перенаправлению увести запрос на запрещенный адрес
+func (p *EndpointPolicy) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return p.CheckURL(req.URL)
+}
+
+// control проверяет адрес, с которым устанавливается соединение
+func (p *EndpointPolicy) control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrEndpointNotAllowed, address)
+	}
+	if addr := addrPort.Addr().Unmap(); !isPublic(addr) && !p.inNetworks(addr) {
+		return fmt.Errorf("%w: %s is not a public address", ErrEndpointNotAllowed, addr)
+	}
+	return nil
+}
+
+func (p *EndpointPolicy) allowedHost(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	for _, allowed := range p.hosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *EndpointPolicy) inNetworks(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, network := range p.networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPublic сообщает, что адрес не относится к локальным, частным и
+// служебным диапазонам
+func isPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || !addr.IsGlobalUnicast() || addr.IsPrivate() || sharedAddressSpace.Contains(addr) {
+		return false
+	}
+	// 0.0.0.0/8 - "эта сеть"
+	return !addr.Is4() || addr.As4()[0] != 0
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestEndpointPolicyCheckURL(t *testing.T) {
+	strict, err := NewEndpointPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowlist, err := NewEndpointPolicy([]string{"minio.internal", "localhost", "10.1.0.0/16", "192.168.0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url             string
+		strict, allowed bool
+	}{
+		{"https://s3.amazonaws.com", true, true},
+		{"https://93.184.216.34", true, true},
+		{"http://s3.amazonaws.com", false, false},
+		{"http://localhost:9000", false, true},
+		{"https://localhost:9000", true, true}, // Имя проверяется при соединении
+		{"http://bucket.minio.internal:9000", false, true},
+		{"http://minio.internal.evil.com", false, false},
+		{"https://127.0.0.1", false, false},
+		{"https://[::1]:9000", false, false},
+		{"https://169.254.169.254", false, false},
+		{"https://[fe80::1]", false, false},
+		{"https://10.1.2.3", false, true},
+		{"http://10.1.2.3:9000", false, true},
+		{"https://10.2.0.1", false, false},
+		{"http://192.168.0.5", false, true},
+		{"https://192.168.0.6", false, false},
+		{"https://100.64.0.1", false, false},
+		{"https://0.1.2.3", false, false},
+		{"https://[::ffff:127.0.0.1]", false, false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := strict.CheckURL(u); (err == nil) != tt.strict {
+			t.Errorf("%s without allowlist: got %v", tt.url, err)
+		}
+		if err := allowlist.CheckURL(u); (err == nil) != tt.allowed {
+			t.Errorf("%s with allowlist: got %v", tt.url, err)
+		}
+	}
+}
+
+func TestEndpointPolicyInvalidEntry(t *testing.T) {
+	for _, entry := range []string{"localhost:9000", "http://minio", "10.0.0.0/33"} {
+		if _, err := NewEndpointPolicy([]string{entry}); err == nil {
+			t.Errorf("%q accepted", entry)
+		}
+	}
+}
+
+func TestEndpointPolicyTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	get := func(p *EndpointPolicy, target string) error {
+		client := &http.Client{Transport: p.Transport(), CheckRedirect: p.CheckRedirect}
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, target, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	// Имя, которое разрешается в адрес внутренней сети, отклоняется при соединении
+	strict, _ := NewEndpointPolicy(nil)
+	if err := get(strict, "http://localhost:"+u.Port()); !errors.Is(err, ErrEndpointNotAllowed) {
+		t.Errorf("loopback without allowlist: got %v", err)
+	}
+
+	for _, entry := range []string{"localhost", "127.0.0.0/8"} {
+		p, _ := NewEndpointPolicy([]string{entry})
+		if err := get(p, "http://localhost:"+u.Port()); err != nil {
+			t.Errorf("allowlisted %s: %v", entry, err)
+		}
+	}
+
+	// Перенаправление во внутреннюю сеть не выполняется
+	redirect := httptest.NewServer(http.RedirectHandler("http://169.254.169.254/latest/meta-data/", http.StatusFound))
+	defer redirect.Close()
+	p, _ := NewEndpointPolicy([]string{"127.0.0.1"})
+	if err := get(p, redirect.URL); !errors.Is(err, ErrEndpointNotAllowed) {
+		t.Errorf("redirect to metadata service: got %v", err)
+	}
+}
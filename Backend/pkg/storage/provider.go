@@ -0,0 +1,112 @@
+// Package storage описывает хранилища, в которых лежат зашифрованные файлы
+// пользователей (Яндекс.Диск и другие).
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound        = errors.New("resource not found")
+	ErrUnknownProvider = errors.New("unknown storage provider")
+	ErrNotConnected    = errors.New("storage is not connected")
+)
+
+// Resource - файл или каталог в хранилище
+type Resource struct {
+	Path       string    `json:"path"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"` // "dir" или "file"
+	MimeType   string    `json:"mime_type"`
+	Size       int64     `json:"size"`
+	Modified   time.Time `json:"modified"`
+	Created    time.Time `json:"created"`
+	ResourceID string    `json:"resource_id"`
+	MediaType  string    `json:"media_type"` // Дополнительное поле
+}
+
+// Quota - занятое и доступное место в байтах
+type Quota struct {
+	Total int64 `json:"total"` // 0 - без ограничения
+	Used  int64 `json:"used"`
+}
+
+// StorageProvider - хранилище файлов. Один провайдер обслуживает всех
+// пользователей: учетные данные пользователя (токен, ключи доступа)
+// передаются в каждый вызов. Пути абсолютные, с "/" в начале.
+type StorageProvider interface {
+	// List возвращает содержимое каталога
+	List(ctx context.Context, credentials, path string) ([]Resource, error)
+	// Upload записывает файл, заменяя существующий
+	Upload(ctx context.Context, credentials, path string, content io.Reader) error
+	Download(ctx context.Context, credentials, path string) (io.ReadCloser, error)
+	Delete(ctx context.Context, credentials, path string) error
+	// Mkdir создает каталог; родительский каталог должен существовать,
+	// уже существующий каталог ошибкой не считается
+	Mkdir(ctx context.Context, credentials, path string) error
+	// Move и Copy не перезаписывают существующий файл
+	Move(ctx context.Context, credentials, from, to string) error
+	Copy(ctx context.Context, credentials, from, to string) error
+	Stat(ctx context.Context, credentials, path string) (*Resource, error)
+	Quota(ctx context.Context, credentials string) (*Quota, error)
+}
+
+// Connector - провайдер, который подключается без OAuth: по учетным данным,
+// переданным пользователем. Connect проверяет их (или выделяет пользователю
+// место) и возвращает учетные данные для сохранения у пользователя.
+type Connector interface {
+	Connect(ctx context.Context, userID uint, credentials string) (string, error)
+}
+
+// Registry - провайдеры хранилищ по именам
+type Registry struct {
+	mu          sync.RWMutex
+	providers   map[string]StorageProvider
+	defaultName string
+}
+
+// NewRegistry создает реестр; defaultName используется для пользователей,
+// у которых провайдер не указан
+func NewRegistry(defaultName string) *Registry {
+	return &Registry{providers: make(map[string]StorageProvider), defaultName: defaultName}
+}
+
+func (r *Registry) Register(name string, provider StorageProvider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers[name] = provider
+}
+
+// Get возвращает провайдер по имени, для пустого имени - провайдер по умолчанию
+func (r *Registry) Get(name string) (StorageProvider, error) {
+	if name == "" {
+		name = r.defaultName
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	provider, ok := r.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProvider, name)
+	}
+	return provider, nil
+}
+
+// Names возвращает имена зарегистрированных провайдеров
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"io"
+)
+
+// Storage - хранилище одного пользователя: провайдер вместе с учетными
+// данными пользователя
+type Storage struct {
+	Provider    string
+	provider    StorageProvider
+	credentials string
+}
+
+// Bind связывает провайдер с учетными данными пользователя
+func Bind(name string, provider StorageProvider, credentials string) *Storage {
+	return &Storage{Provider: name, provider: provider, credentials: credentials}
+}
+
+// Open возвращает хранилище пользователя у провайдера name
+func (r *Registry) Open(name, credentials string) (*Storage, error) {
+	provider, err := r.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = r.defaultName
+	}
+	return Bind(name, provider, credentials), nil
+}
+
+func (s *Storage) List(ctx context.Context, path string) ([]Resource, error) {
+	return s.provider.List(ctx, s.credentials, path)
+}
+
+func (s *Storage) Upload(ctx context.Context, path string, content io.Reader) error {
+	return s.provider.Upload(ctx, s.credentials, path, content)
+}
+
+func (s *Storage) Download(ctx context.Context, path string) (io.ReadCloser, error) {
+	return s.provider.Download(ctx, s.credentials, path)
+}
+
+func (s *Storage) Delete(ctx context.Context, path string) error {
+	return s.provider.Delete(ctx, s.credentials, path)
+}
+
+func (s *Storage) Mkdir(ctx context.Context, path string) error {
+	return s.provider.Mkdir(ctx, s.credentials, path)
+}
+
+func (s *Storage) Move(ctx context.Context, from, to string) error {
+	return s.provider.Move(ctx, s.credentials, from, to)
+}
+
+func (s *Storage) Copy(ctx context.Context, from, to string) error {
+	return s.provider.Copy(ctx, s.credentials, from, to)
+}
+
+func (s *Storage) Stat(ctx context.Context, path string) (*Resource, error) {
+	return s.provider.Stat(ctx, s.credentials, path)
+}
+
+func (s *Storage) Quota(ctx context.Context) (*Quota, error) {
+	return s.provider.Quota(ctx, s.credentials)
+}
@@ -0,0 +1,476 @@
+// Package webdav хранит зашифрованные файлы на WebDAV-сервере (Nextcloud,
+// ownCloud и т.п.).
+//
+// Учетные данные пользователя - JSON Credentials: адрес каталога WebDAV,
+// имя пользователя и пароль приложения.
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/pkg/storage"
+)
+
+// ProviderName - имя WebDAV-хранилища в реестре хранилищ
+const ProviderName = "webdav"
+
+// maxPropfindSize - предел ответа PROPFIND: около 30 тысяч элементов каталога
+const maxPropfindSize = 32 << 20
+
+var ErrInvalidCredentials = errors.New("invalid webdav credentials")
+
+var (
+	_ storage.StorageProvider = (*Client)(nil)
+	_ storage.Connector       = (*Client)(nil)
+)
+
+// Credentials - доступ пользователя к WebDAV
+type Credentials struct {
+	URL      string `json:"url"` // https://cloud.example.com/remote.php/dav/files/alice/
+	Username string `json:"username"`
+	Password string `json:"password"` // Пароль приложения
+}
+
+type Client struct {
+	httpClient *http.Client
+	endpoints  *storage.EndpointPolicy
+}
+
+// NewClient создает клиент, который обращается только к адресам,
+// разрешенным endpoints
+func NewClient(endpoints *storage.EndpointPolicy) *Client {
+	// Общего таймаута нет: большие файлы скачиваются потоком дольше 30 секунд
+	transport := endpoints.Transport()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	return &Client{
+		httpClient: &http.Client{Transport: transport, CheckRedirect: endpoints.CheckRedirect},
+		endpoints:  endpoints,
+	}
+}
+
+// Connect проверяет адрес и пароль запросом к корню и возвращает учетные
+// данные в нормализованном виде
+func (c *Client) Connect(ctx context.Context, userID uint, credentials string) (string, error) {
+	s, err := c.open(credentials)
+	if err != nil {
+		return "", err
+	}
+
+	root, err := s.stat(ctx, "/")
+	if err != nil {
+		return "", fmt.Errorf("webdav server is not accessible: %w", err)
+	}
+	if root.Type != "dir" {
+		return "", fmt.Errorf("%w: url must point to a collection", ErrInvalidCredentials)
+	}
+
+	normalized, err := json.Marshal(s.creds)
+	if err != nil {
+		return "", err
+	}
+	return string(normalized), nil
+}
+
+// List возвращает содержимое каталога (PROPFIND с глубиной 1)
+func (c *Client) List(ctx context.Context, credentials, p string) ([]storage.Resource, error) {
+	s, err := c.open(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := cleanPath(p)
+	responses, err := s.propfind(ctx, dir, "1", resourceProps)
+	if err != nil {
+		return nil, err
+	}
+
+	resources := make([]storage.Resource, 0, len(responses))
+	for _, response := range responses {
+		resource, err := s.resource(response)
+		if err != nil {
+			return nil, err
+		}
+		if resource.Path == dir {
+			continue // Сам каталог
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+// Upload записывает файл, заменяя существующий
+func (c *Client) Upload(ctx context.Context, credentials, p string, content io.Reader) error {
+	s, err := c.open(credentials)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, cleanPath(p), content, http.Header{"Content-Type": {"application/octet-stream"}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp, "upload")
+}
+
+func (c *Client) Download(ctx context.Context, credentials, p string) (io.ReadCloser, error) {
+	s, err := c.open(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(ctx, http.MethodGet, cleanPath(p), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp, "download"); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *Client) Delete(ctx context.Context, credentials, p string) error {
+	s, err := c.open(credentials)
+	if err != nil {
+		return err
+	}
+
+	p = cleanPath(p)
+	if p == "/" {
+		return errors.New("cannot delete the storage root")
+	}
+
+	resp, err := s.do(ctx, http.MethodDelete, p, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp, "delete")
+}
+
+// Mkdir создает каталог (MKCOL); родительский каталог должен существовать
+func (c *Client) Mkdir(ctx context.Context, credentials, p string) error {
+	s, err := c.open(credentials)
+	if err != nil {
+		return err
+	}
+
+	p = cleanPath(p)
+	if p == "/" {
+		return nil
+	}
+
+	resp, err := s.do(ctx, "MKCOL", p+"/", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// 405 - ресурс уже существует; ошибка, если это файл
+	if resp.StatusCode == http.StatusMethodNotAllowed {
+		resource, err := s.stat(ctx, p)
+		if err == nil && resource.Type == "dir" {
+			return nil
+		}
+		return fmt.Errorf("%s already exists", p)
+	}
+	return checkResponse(resp, "create folder")
+}
+
+// Move перемещает файл или каталог, не перезаписывая существующий
+func (c *Client) Move(ctx context.Context, credentials, from, to string) error {
+	return c.transfer(ctx, credentials, "MOVE", from, to)
+}
+
+// Copy копирует файл или каталог, не перезаписывая существующий
+func (c *Client) Copy(ctx context.Context, credentials, from, to string) error {
+	return c.transfer(ctx, credentials, "COPY", from, to)
+}
+
+// transfer выполняет MOVE или COPY
+func (c *Client) transfer(ctx context.Context, credentials, method, from, to string) error {
+	s, err := c.open(credentials)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{
+		"Destination": {s.url(cleanPath(to)).String()},
+		"Overwrite":   {"F"},
+	}
+	resp, err := s.do(ctx, method, cleanPath(from), nil, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return fmt.Errorf("%s already exists", to)
+	}
+	return checkResponse(resp, strings.ToLower(method))
+}
+
+func (c *Client) Stat(ctx context.Context, credentials, p string) (*storage.Resource, error) {
+	s, err := c.open(credentials)
+	if err != nil {
+		return nil, err
+	}
+	return s.stat(ctx, p)
+}
+
+// Quota возвращает объем и занятое место по свойствам RFC 4331
+func (c *Client) Quota(ctx context.Context, credentials string) (*storage.Quota, error) {
+	s, err := c.open(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	responses, err := s.propfind(ctx, "/", "0", quotaProps)
+	if err != nil {
+		return nil, err
+	}
+	if len(responses) == 0 {
+		return nil, errors.New("empty quota response")
+	}
+
+	prop := responses[0].prop()
+	quota := &storage.Quota{}
+	quota.Used, _ = strconv.ParseInt(strings.TrimSpace(prop.QuotaUsed), 10, 64)
+	// Отрицательный остаток - объем не ограничен или неизвестен
+	if available, err := strconv.ParseInt(strings.TrimSpace(prop.QuotaAvailable), 10, 64); err == nil && available >= 0 {
+		quota.Total = quota.Used + available
+	}
+	return quota, nil
+}
+
+// session - WebDAV пользователя
+type session struct {
+	client *Client
+	creds  Credentials
+	base   *url.URL
+}
+
+// open разбирает учетные данные пользователя
+func (c *Client) open(credentials string) (*session, error) {
+	var creds Credentials
+	if err := json.Unmarshal([]byte(credentials), &creds); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	base, err := url.Parse(creds.URL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" || base.RawQuery != "" {
+		return nil, fmt.Errorf("%w: url must be an http(s) URL", ErrInvalidCredentials)
+	}
+	if err := c.endpoints.CheckURL(base); err != nil {
+		return nil, err
+	}
+	if creds.Username == "" || creds.Password == "" {
+		return nil, fmt.Errorf("%w: username and password are required", ErrInvalidCredentials)
+	}
+
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	base.RawPath = ""
+	base.Fragment = ""
+	creds.URL = base.String() + "/"
+	return &session{client: c, creds: creds, base: base}, nil
+}
+
+// cleanPath приводит путь хранилища к виду "/a/b" без ".."
+func cleanPath(p string) string {
+	return path.Clean("/" + strings.TrimPrefix(p, "disk:"))
+}
+
+// url - адрес ресурса; путь уже очищен cleanPath
+func (s *session) url(p string) *url.URL {
+	u := *s.base
+	u.Path = s.base.Path + p
+	return &u
+}
+
+func (s *session) do(ctx context.Context, method, p string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url(p).String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.SetBasicAuth(s.creds.Username, s.creds.Password)
+
+	resp, err := s.client.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	return resp, nil
+}
+
+func (s *session) stat(ctx context.Context, p string) (*storage.Resource, error) {
+	responses, err := s.propfind(ctx, cleanPath(p), "0", resourceProps)
+	if err != nil {
+		return nil, err
+	}
+	if len(responses) == 0 {
+		return nil, storage.ErrNotFound
+	}
+
+	resource, err := s.resource(responses[0])
+	if err != nil {
+		return nil, err
+	}
+	return &resource, nil
+}
+
+const resourceProps = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getcontentlength/>
+    <d:getcontenttype/>
+    <d:getlastmodified/>
+    <d:creationdate/>
+    <d:getetag/>
+    <oc:fileid/>
+  </d:prop>
+</d:propfind>`
+
+const quotaProps = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:quota-used-bytes/>
+    <d:quota-available-bytes/>
+  </d:prop>
+</d:propfind>`
+
+type multistatus struct {
+	Responses []propfindResponse `xml:"DAV: response"`
+}
+
+type propfindResponse struct {
+	Href      string `xml:"DAV: href"`
+	Propstats []struct {
+		Prop   davProp `xml:"DAV: prop"`
+		Status string  `xml:"DAV: status"`
+	} `xml:"DAV: propstat"`
+}
+
+type davProp struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	ContentLength  string `xml:"DAV: getcontentlength"`
+	ContentType    string `xml:"DAV: getcontenttype"`
+	LastModified   string `xml:"DAV: getlastmodified"`
+	CreationDate   string `xml:"DAV: creationdate"`
+	ETag           string `xml:"DAV: getetag"`
+	FileID         string `xml:"http://owncloud.org/ns fileid"`
+	QuotaUsed      string `xml:"DAV: quota-used-bytes"`
+	QuotaAvailable string `xml:"DAV: quota-available-bytes"`
+}
+
+// prop возвращает найденные свойства (propstat со статусом 200)
+func (r *propfindResponse) prop() davProp {
+	for _, propstat := range r.Propstats {
+		if strings.Contains(propstat.Status, " 200") {
+			return propstat.Prop
+		}
+	}
+	return davProp{}
+}
+
+func (s *session) propfind(ctx context.Context, p, depth, props string) ([]propfindResponse, error) {
+	header := http.Header{
+		"Depth":        {depth},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	}
+	resp, err := s.do(ctx, "PROPFIND", p, strings.NewReader(props), header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "propfind"); err != nil {
+		return nil, err
+	}
+
+	// Ответ присылает сервер, выбранный пользователем: читаем не больше предела
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPropfindSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if len(body) > maxPropfindSize {
+		return nil, fmt.Errorf("propfind response exceeds %d bytes", maxPropfindSize)
+	}
+	var result multistatus
+	if err := xml.NewDecoder(bytes.NewReader(body)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode XML response: %w", err)
+	}
+	return result.Responses, nil
+}
+
+// resource переводит ответ PROPFIND в ресурс хранилища
+func (s *session) resource(r propfindResponse) (storage.Resource, error) {
+	href, err := url.Parse(r.Href)
+	if err != nil {
+		return storage.Resource{}, fmt.Errorf("invalid href %q: %w", r.Href, err)
+	}
+	if !strings.HasPrefix(href.Path+"/", s.base.Path+"/") {
+		return storage.Resource{}, fmt.Errorf("href %q is outside of %s", r.Href, s.base.Path)
+	}
+
+	prop := r.prop()
+	resourcePath := cleanPath(strings.TrimPrefix(href.Path, s.base.Path))
+	resource := storage.Resource{
+		Path:       resourcePath,
+		Name:       path.Base(resourcePath),
+		Type:       "file",
+		ResourceID: prop.FileID,
+	}
+	if resource.ResourceID == "" {
+		resource.ResourceID = strings.Trim(prop.ETag, `"`)
+	}
+	if modified, err := http.ParseTime(prop.LastModified); err == nil {
+		resource.Modified = modified
+		resource.Created = modified
+	}
+	if created, err := time.Parse(time.RFC3339, prop.CreationDate); err == nil {
+		resource.Created = created
+	}
+
+	if prop.ResourceType.Collection != nil {
+		resource.Type = "dir"
+		return resource, nil
+	}
+
+	resource.Size, _ = strconv.ParseInt(strings.TrimSpace(prop.ContentLength), 10, 64)
+	resource.MimeType = prop.ContentType
+	if resource.MimeType == "" {
+		resource.MimeType = mime.TypeByExtension(path.Ext(resource.Name))
+	}
+	return resource, nil
+}
+
+// checkResponse переводит ответ с ошибкой в error; 404 - storage.ErrNotFound
+func checkResponse(resp *http.Response, operation string) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return storage.ErrNotFound
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	return fmt.Errorf("%s failed with status %d: %s", operation, resp.StatusCode, string(body))
+}
@@ -0,0 +1,253 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"server/pkg/storage"
+)
+
+func TestConnectChecksEndpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMultiStatus)
+	}))
+	defer server.Close()
+
+	strict, err := storage.NewEndpointPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := `{"url": "` + server.URL + `/dav/", "username": "alice", "password": "secret"}`
+	tests := []string{
+		credentials,
+		`{"url": "http://169.254.169.254/latest/", "username": "alice", "password": "secret"}`,
+		`{"url": "https://[::1]/dav/", "username": "alice", "password": "secret"}`,
+	}
+	for _, creds := range tests {
+		if _, err := NewClient(strict).Connect(context.Background(), 1, creds); !errors.Is(err, storage.ErrEndpointNotAllowed) {
+			t.Errorf("%s: got %v, want ErrEndpointNotAllowed", creds, err)
+		}
+	}
+
+	// Сервер из списка разрешенных доступен и по http; дальше ответ
+	// проверяется как обычно
+	allowed, err := storage.NewEndpointPolicy([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewClient(allowed).Connect(context.Background(), 1, credentials); errors.Is(err, storage.ErrEndpointNotAllowed) {
+		t.Fatalf("allowlisted server: %v", err)
+	}
+}
+
+// newTestServer запускает WebDAV-сервер с обработчиком handler и возвращает
+// клиент и учетные данные для него
+func newTestServer(t *testing.T, handler http.HandlerFunc) (*Client, string) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	endpoints, err := storage.NewEndpointPolicy([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewClient(endpoints), `{"url": "` + server.URL + `/dav/", "username": "alice", "password": "secret"}`
+}
+
+func TestPropfindLimitsResponse(t *testing.T) {
+	c, credentials := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write([]byte(`<d:multistatus xmlns:d="DAV:">`))
+		w.Write([]byte(strings.Repeat(" ", maxPropfindSize)))
+		w.Write([]byte(`</d:multistatus>`))
+	})
+
+	if _, err := c.List(context.Background(), credentials, "/"); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("got %v, want an error about the response size", err)
+	}
+}
+
+// docsMultistatus - ответ на PROPFIND: каталог /dav/docs/ и файл в нем
+const docsMultistatus = `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:response>
+    <d:href>/dav/docs/</d:href>
+    <d:propstat>
+      <d:prop>
+        <d:resourcetype><d:collection/></d:resourcetype>
+        <d:getlastmodified>Tue, 15 Oct 2024 10:00:00 GMT</d:getlastmodified>
+      </d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>
+  </d:response>
+  <d:response>
+    <d:href>/dav/docs/report%20v2.txt.encrypted</d:href>
+    <d:propstat>
+      <d:prop>
+        <d:resourcetype/>
+        <d:getcontentlength>1234</d:getcontentlength>
+        <d:getlastmodified>Tue, 15 Oct 2024 11:00:00 GMT</d:getlastmodified>
+        <d:getetag>"abc"</d:getetag>
+        <oc:fileid>42</oc:fileid>
+      </d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>
+    <d:propstat>
+      <d:prop><d:getcontenttype/></d:prop>
+      <d:status>HTTP/1.1 404 Not Found</d:status>
+    </d:propstat>
+  </d:response>
+</d:multistatus>`
+
+func TestListAndStatParseMultistatus(t *testing.T) {
+	c, credentials := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "alice" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "PROPFIND" || r.URL.Path != "/dav/docs" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		body := docsMultistatus
+		if r.Header.Get("Depth") == "0" {
+			body = body[:strings.Index(body, "  <d:response>\n    <d:href>/dav/docs/report")] + "</d:multistatus>"
+		}
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write([]byte(body))
+	})
+	ctx := context.Background()
+
+	items, err := c.List(ctx, credentials, "/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("got %+v", items)
+	}
+	file := items[0]
+	if file.Path != "/docs/report v2.txt.encrypted" || file.Name != "report v2.txt.encrypted" || file.Type != "file" {
+		t.Errorf("got path %s, name %s, type %s", file.Path, file.Name, file.Type)
+	}
+	if file.Size != 1234 || file.ResourceID != "42" || file.Modified.Hour() != 11 {
+		t.Errorf("got size %d, id %s, modified %s", file.Size, file.ResourceID, file.Modified)
+	}
+
+	dir, err := c.Stat(ctx, credentials, "disk:/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir.Path != "/docs" || dir.Type != "dir" {
+		t.Errorf("got %s (%s)", dir.Path, dir.Type)
+	}
+
+	if _, err := c.Stat(ctx, credentials, "/missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("missing resource: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestListRejectsForeignHref(t *testing.T) {
+	c, credentials := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write([]byte(strings.ReplaceAll(docsMultistatus, "/dav/docs/report", "/other/report")))
+	})
+
+	if _, err := c.List(context.Background(), credentials, "/docs"); err == nil {
+		t.Fatal("resource outside of the storage root is listed")
+	}
+}
+
+func TestMkdirExistingCollection(t *testing.T) {
+	existing := map[string]string{"/dav/docs": "dir", "/dav/notes": "file"}
+	c, credentials := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "MKCOL":
+			if _, ok := existing[strings.TrimSuffix(r.URL.Path, "/")]; ok {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		case "PROPFIND":
+			resourceType := "<d:resourcetype/>"
+			if existing[r.URL.Path] == "dir" {
+				resourceType = "<d:resourcetype><d:collection/></d:resourcetype>"
+			}
+			w.WriteHeader(http.StatusMultiStatus)
+			w.Write([]byte(`<d:multistatus xmlns:d="DAV:"><d:response><d:href>` + r.URL.Path + `</d:href>` +
+				`<d:propstat><d:prop>` + resourceType + `</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>` +
+				`</d:response></d:multistatus>`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	ctx := context.Background()
+
+	for _, dir := range []string{"/docs", "/new", "/"} {
+		if err := c.Mkdir(ctx, credentials, dir); err != nil {
+			t.Errorf("%s: %v", dir, err)
+		}
+	}
+	if err := c.Mkdir(ctx, credentials, "/notes"); err == nil {
+		t.Error("file is treated as an existing folder")
+	}
+}
+
+func TestTransferDoesNotOverwrite(t *testing.T) {
+	var requests []*http.Request
+	c, credentials := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if r.Header.Get("Overwrite") == "F" && strings.HasSuffix(r.Header.Get("Destination"), "/dav/existing") {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	ctx := context.Background()
+
+	if err := c.Move(ctx, credentials, "/a", "/existing"); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("move: got %v", err)
+	}
+	if err := c.Copy(ctx, credentials, "/a", "/existing"); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("copy: got %v", err)
+	}
+	if err := c.Move(ctx, credentials, "/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 3 || requests[0].Method != "MOVE" || requests[1].Method != "COPY" {
+		t.Fatalf("got %d requests", len(requests))
+	}
+	if dest := requests[2].Header.Get("Destination"); !strings.HasSuffix(dest, "/dav/b") || requests[2].URL.Path != "/dav/a" {
+		t.Errorf("moved %s to %s", requests[2].URL.Path, dest)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	c, credentials := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/dav/a.encrypted" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("data"))
+	})
+	ctx := context.Background()
+
+	if _, err := c.Download(ctx, credentials, "/missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("missing file: got %v, want ErrNotFound", err)
+	}
+
+	body, err := c.Download(ctx, credentials, "/../a.encrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if data, _ := io.ReadAll(body); string(data) != "data" {
+		t.Errorf("got %q", data)
+	}
+}
@@ -9,8 +9,17 @@ import (
 	"net/url"
 	"strings"
 	"time"
+	
+	"server/pkg/storage"
 )
 
+// ProviderName - имя провайдера Яндекс.Диска в реестре хранилищ
+const ProviderName = "yandex_disk"
+
+var ErrResourceNotFound = storage.ErrNotFound
+
+var _ storage.StorageProvider = (*Client)(nil)
+
 type Client struct {
 	clientID     string
 	clientSecret string
@@ -26,17 +35,8 @@ type TokenResponse struct {
 	Scope        string `json:"scope"`
 }
 
-type DiskResource struct {
-	Path       string    `json:"path"`
-	Name       string    `json:"name"`
-	Type       string    `json:"type"` // "dir" или "file"
-	MimeType   string    `json:"mime_type"`
-	Size       int64     `json:"size"`
-	Modified   time.Time `json:"modified"`
-	Created    time.Time `json:"created"`
-	ResourceID string    `json:"resource_id"`
-	MediaType  string    `json:"media_type"` // Дополнительное поле
-}
+// DiskResource - ресурс Яндекс.Диска, общая модель ресурсов хранилищ
+type DiskResource = storage.Resource
 
 type DiskResponse struct {
 	Embedded struct {
@@ -90,6 +90,15 @@ func (c *Client) ExchangeCodeForToken(ctx context.Context, code string) (*TokenR
 	return &tokenResp, nil
 }
 
+// List возвращает содержимое каталога
+func (c *Client) List(ctx context.Context, accessToken, path string) ([]storage.Resource, error) {
+	diskResp, err := c.GetFilesList(ctx, accessToken, path)
+	if err != nil {
+		return nil, err
+	}
+	return diskResp.Embedded.Items, nil
+}
+
 func (c *Client) GetFilesList(ctx context.Context, accessToken, path string) (*DiskResponse, error) {
 	req, err := http.NewRequestWithContext(
 		ctx,
@@ -137,6 +146,10 @@ func (c *Client) GetFilesList(ctx context.Context, accessToken, path string) (*D
 		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
 	
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrResourceNotFound
+	}
+	
 	if resp.StatusCode != http.StatusOK {
 		fmt.Printf("DEBUG: Yandex.Disk API error (%d): %s\n", resp.StatusCode, string(bodyBytes))
 		return nil, fmt.Errorf("yandex disk API returned status %d: %s", resp.StatusCode, string(bodyBytes))
@@ -159,8 +172,8 @@ func (c *Client) GetFilesList(ctx context.Context, accessToken, path string) (*D
 	
 	return &diskResp, nil
 }
-// UploadFile - загружает файл в Яндекс.Диск
-func (c *Client) UploadFile(ctx context.Context, accessToken, path string, content io.Reader) error {
+// Upload - загружает файл в Яндекс.Диск
+func (c *Client) Upload(ctx context.Context, accessToken, path string, content io.Reader) error {
 	// 1. Получаем URL для загрузки
 	uploadURL, err := c.getUploadURL(ctx, accessToken, path)
 	if err != nil {
@@ -190,8 +203,8 @@ func (c *Client) UploadFile(ctx context.Context, accessToken, path string, conte
 	return nil
 }
 
-// DownloadFile - скачивает файл из Яндекс.Диска
-func (c *Client) DownloadFile(ctx context.Context, accessToken, path string) (io.ReadCloser, error) {
+// Download - скачивает файл из Яндекс.Диска
+func (c *Client) Download(ctx context.Context, accessToken, path string) (io.ReadCloser, error) {
 	// 1. Получаем URL для скачивания
 	downloadURL, err := c.getDownloadURL(ctx, accessToken, path)
 	if err != nil {
@@ -221,8 +234,8 @@ func (c *Client) DownloadFile(ctx context.Context, accessToken, path string) (io
 	return resp.Body, nil
 }
 
-// DeleteFile - удаляет файл из Яндекс.Диска
-func (c *Client) DeleteFile(ctx context.Context, accessToken, path string) error {
+// Delete - удаляет файл из Яндекс.Диска
+func (c *Client) Delete(ctx context.Context, accessToken, path string) error {
 	req, err := http.NewRequestWithContext(
 		ctx,
 		"DELETE",
@@ -246,6 +259,10 @@ func (c *Client) DeleteFile(ctx context.Context, accessToken, path string) error
 	}
 	defer resp.Body.Close()
 	
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrResourceNotFound
+	}
+	
 	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("delete failed with status %d: %s", resp.StatusCode, string(body))
@@ -254,6 +271,162 @@ func (c *Client) DeleteFile(ctx context.Context, accessToken, path string) error
 	return nil
 }
 
+// Move - перемещает (переименовывает) файл на Яндекс.Диске
+func (c *Client) Move(ctx context.Context, accessToken, from, to string) error {
+	return c.transfer(ctx, accessToken, "move", from, to)
+}
+
+// Copy - копирует файл на Яндекс.Диске
+func (c *Client) Copy(ctx context.Context, accessToken, from, to string) error {
+	return c.transfer(ctx, accessToken, "copy", from, to)
+}
+
+// transfer - перемещает или копирует ресурс (operation: "move" или "copy")
+func (c *Client) transfer(ctx context.Context, accessToken, operation, from, to string) error {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"POST",
+		"https://cloud-api.yandex.net/v1/disk/resources/"+operation,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	
+	req.Header.Set("Authorization", "OAuth "+accessToken)
+	
+	params := req.URL.Query()
+	params.Add("from", from)
+	params.Add("path", to)
+	params.Add("overwrite", "false")
+	req.URL.RawQuery = params.Encode()
+	
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrResourceNotFound
+	}
+	
+	// 201 - перемещено сразу, 202 - операция выполняется асинхронно
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s failed with status %d: %s", operation, resp.StatusCode, string(body))
+	}
+	
+	return nil
+}
+
+// Mkdir - создает папку на Яндекс.Диске. Родительская папка должна существовать,
+// уже существующая папка ошибкой не считается
+func (c *Client) Mkdir(ctx context.Context, accessToken, path string) error {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"PUT",
+		"https://cloud-api.yandex.net/v1/disk/resources",
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	
+	req.Header.Set("Authorization", "OAuth "+accessToken)
+	
+	params := req.URL.Query()
+	params.Add("path", path)
+	req.URL.RawQuery = params.Encode()
+	
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	
+	// 409 - папка уже существует
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusConflict {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("create folder failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	
+	return nil
+}
+
+// Stat - возвращает сведения о файле или папке
+func (c *Client) Stat(ctx context.Context, accessToken, path string) (*storage.Resource, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"GET",
+		"https://cloud-api.yandex.net/v1/disk/resources",
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	
+	req.Header.Set("Authorization", "OAuth "+accessToken)
+	
+	params := req.URL.Query()
+	params.Add("path", path)
+	params.Add("limit", "0") // Содержимое папки не нужно
+	req.URL.RawQuery = params.Encode()
+	
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrResourceNotFound
+	}
+	
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("stat failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	
+	var resource storage.Resource
+	if err := json.NewDecoder(resp.Body).Decode(&resource); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON response: %w", err)
+	}
+	
+	return &resource, nil
+}
+
+// Quota - возвращает объем Диска и занятое место
+func (c *Client) Quota(ctx context.Context, accessToken string) (*storage.Quota, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://cloud-api.yandex.net/v1/disk/", nil)
+	if err != nil {
+		return nil, err
+	}
+	
+	req.Header.Set("Authorization", "OAuth "+accessToken)
+	
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("quota request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	
+	var result struct {
+		TotalSpace int64 `json:"total_space"`
+		UsedSpace  int64 `json:"used_space"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON response: %w", err)
+	}
+	
+	return &storage.Quota{Total: result.TotalSpace, Used: result.UsedSpace}, nil
+}
+
 // getUploadURL - получает URL для загрузки файла
 func (c *Client) getUploadURL(ctx context.Context, accessToken, path string) (string, error) {
 	req, err := http.NewRequestWithContext(
@@ -318,6 +491,10 @@ func (c *Client) getDownloadURL(ctx context.Context, accessToken, path string) (
 	}
 	defer resp.Body.Close()
 	
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrResourceNotFound
+	}
+	
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		return "", fmt.Errorf("failed to get download URL: status %d: %s", resp.StatusCode, string(body))
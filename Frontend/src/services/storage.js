@@ -16,8 +16,9 @@ export const storageService = {
   // Загрузка файла
   uploadFile: (file, masterPassword, path = '/') => {
     const formData = new FormData();
-    formData.append('file', file);
+    // Сервер читает форму потоком: пароль должен идти раньше файла
     formData.append('master_password', masterPassword);
+    formData.append('file', file);
     
     return api.post(`/storage/upload?path=${encodeURIComponent(path)}`, formData, {
       headers: {